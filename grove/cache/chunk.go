@@ -0,0 +1,383 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/remap"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/rfc"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// ChunkKeySeparator separates an object's cache key from the chunk number, in the cache keys of the chunks of objects cached in ranges. See remapdata.RemapRuleBase.RangeChunkBytes.
+const ChunkKeySeparator = remapdata.CacheKeySeparator + "chunk:"
+
+// chunkKey returns the cache key of the given chunk of the object with the given cache key.
+func chunkKey(key string, chunk int64) string {
+	return key + ChunkKeySeparator + strconv.FormatInt(chunk, 10)
+}
+
+// conditionalHdrs are the request headers which are removed from chunk requests to parents, because the client's validators apply to the client's response, not to each chunk.
+var conditionalHdrs = []string{"If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// byteRange is a single range from a Range header. A negative start is a suffix range of the last -start bytes, and a negative end is an open range to the end of the object.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// parseSingleRange parses a Range header with a single byte range, per RFC7233§2.1. Returns false if the header isn't a valid single byte range.
+func parseSingleRange(hdr string) (byteRange, bool) {
+	if !strings.HasPrefix(hdr, "bytes=") {
+		return byteRange{}, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(hdr, "bytes="))
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return byteRange{}, false
+	}
+	startStr, endStr := spec[:dash], spec[dash+1:]
+	if startStr == "" {
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{start: -suffix, end: -1}, true
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	if endStr == "" {
+		return byteRange{start: start, end: -1}, true
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return byteRange{}, false
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// resolve returns the first and last byte of the range, in an object of the given total length, and whether the range is satisfiable.
+func (r byteRange) resolve(total int64) (int64, int64, bool) {
+	start, end := r.start, r.end
+	if start < 0 {
+		start = total + start
+		if start < 0 {
+			start = 0
+		}
+		end = total - 1
+	}
+	if end < 0 || end >= total {
+		end = total - 1
+	}
+	if start >= total {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// parseContentRange parses a Content-Range header of the form `bytes first-last/total`. Returns false if the header is missing or malformed, or the total is unknown.
+func parseContentRange(hdr string) (int64, int64, int64, bool) {
+	if !strings.HasPrefix(hdr, "bytes ") {
+		return 0, 0, 0, false
+	}
+	spec := strings.TrimPrefix(hdr, "bytes ")
+	slash := strings.Index(spec, "/")
+	dash := strings.Index(spec, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, false
+	}
+	first, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	last, err := strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	total, err := strconv.ParseInt(spec[slash+1:], 10, 64)
+	if err != nil || first > last || last >= total {
+		return 0, 0, 0, false
+	}
+	return first, last, total, true
+}
+
+func contentRange(first int64, last int64, total int64) string {
+	return "bytes " + strconv.FormatInt(first, 10) + "-" + strconv.FormatInt(last, 10) + "/" + strconv.FormatInt(total, 10)
+}
+
+// chunk is the body of a single chunk of an object, and the data needed to assemble it with other chunks of the same object.
+type chunk struct {
+	index int64
+	start int64
+	body  []byte
+	total int64
+	// validator is the ETag, or if there isn't one the Last-Modified, of the object the chunk is from. Chunks with different validators are from different versions of the object, and can't be assembled together.
+	validator string
+}
+
+// chunkGetter gets the chunks of an object for a single client request, from the cache, or from the parent with a range request for only the missing chunk.
+type chunkGetter struct {
+	h               *Handler
+	r               *http.Request
+	producer        *remap.RemappingProducer
+	pluginContext   map[string]*interface{}
+	reqTime         time.Time
+	reqCacheControl web.CacheControl
+	cache           icache.Cache
+	cacheKey        string
+	chunkBytes      int64
+	reqID           uint64
+}
+
+// get returns the object for the given chunk, and how it was reused from the cache. If the chunk isn't in the cache, or can't be reused, it's requested from the parent and cached. The returned object may not be a chunk, e.g. if the parent returned an error; see parse.
+func (g *chunkGetter) get(index int64) (*cacheobj.CacheObj, remapdata.Reuse, error) {
+	key := chunkKey(g.cacheKey, index)
+	reuse := remapdata.ReuseCannot
+	cached, ok := GetVariant(g.cache, key, g.r.Header)
+	if ok {
+		reuse = rfc.CanReuseStored(g.r.Header, cached.RespHeaders, g.reqCacheControl, cached.RespCacheControl, cached.ReqHeaders, cached.ReqRespTime, cached.RespRespTime, g.h.strictRFC)
+		if reuse == remapdata.ReuseCan {
+			log.Debugf("chunkGetter.get '%v' cache hit (reqid %v)\n", key, g.reqID)
+			return cached, reuse, nil
+		}
+	}
+
+	revalidateObj := (*cacheobj.CacheObj)(nil)
+	if reuse == remapdata.ReuseMustRevalidate || reuse == remapdata.ReuseMustRevalidateCanStale {
+		revalidateObj = cached
+	}
+	log.Debugf("chunkGetter.get '%v' requesting from parent, revalidating %v (reqid %v)\n", key, revalidateObj != nil, g.reqID)
+	req := g.request(index)
+	obj, _, err := NewRetrier(g.h, req.Header, g.reqTime, g.reqCacheControl, g.producer.WithCacheKey(key), g.reqID).Get(req, revalidateObj)
+	if revalidateObj != nil && ((err != nil && reuse == remapdata.ReuseMustRevalidateCanStale) || canStaleIfError(revalidateObj, obj, err, g.producer)) {
+		log.Errorf("revalidating chunk '%v' failed - serving stale: %v (reqid %v)\n", key, err, g.reqID)
+		return revalidateObj, reuse, nil
+	}
+	if err != nil {
+		return nil, reuse, err
+	}
+	if stream := obj.Stream(); stream != nil {
+		body, err := stream.Wait()
+		if err != nil {
+			return nil, reuse, errors.New("receiving chunk: " + err.Error())
+		}
+		obj = obj.Complete(body)
+	}
+	return obj, reuse, nil
+}
+
+// request returns the parent request for the given chunk. The BeforeParentRequest plugins are run on it before the chunk's Range is set, so plugins can't change which bytes are requested.
+func (g *chunkGetter) request(index int64) *http.Request {
+	req := new(http.Request)
+	*req = *g.r
+	req.Header = web.CopyHeader(g.r.Header)
+	for _, name := range conditionalHdrs {
+		req.Header.Del(name)
+	}
+	g.h.plugins.OnBeforeParentRequest(g.producer.PluginCfg(), g.pluginContext, plugin.BeforeParentRequestData{Req: req, RemapRule: g.producer.Name()})
+	start := index * g.chunkBytes
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(start+g.chunkBytes-1, 10))
+	return req
+}
+
+// parse returns the chunk of the given object, which must have been returned by get for the given index. Returns false if the object isn't a chunk, e.g. an error, or a partial response for the wrong range.
+// If the parent ignored the range request and returned the whole object, the object is split into chunks, and all of them are cached.
+func (g *chunkGetter) parse(obj *cacheobj.CacheObj, index int64) (*chunk, bool) {
+	validator := obj.RespHeaders.Get("ETag")
+	if validator == "" {
+		validator = obj.RespHeaders.Get("Last-Modified")
+	}
+	switch obj.Code {
+	case http.StatusPartialContent:
+		first, last, total, ok := parseContentRange(obj.RespHeaders.Get("Content-Range"))
+		if !ok || first != index*g.chunkBytes || last-first+1 != int64(len(obj.Body)) {
+			return nil, false
+		}
+		return &chunk{index: index, start: first, body: obj.Body, total: total, validator: validator}, true
+	case http.StatusOK:
+		total := int64(len(obj.Body))
+		if rfc.CanCache(http.MethodGet, obj.ReqHeaders, obj.Code, obj.RespHeaders, g.h.strictRFC) {
+			for i := int64(0); i*g.chunkBytes < total; i++ {
+				AddVariant(g.cache, chunkKey(g.cacheKey, i), splitChunk(obj, i, g.chunkBytes))
+			}
+		}
+		start := index * g.chunkBytes
+		if start >= total {
+			return &chunk{index: index, start: start, total: total, validator: validator}, true
+		}
+		return &chunk{index: index, start: start, body: splitChunk(obj, index, g.chunkBytes).Body, total: total, validator: validator}, true
+	}
+	return nil, false
+}
+
+// splitChunk returns the given chunk of a complete object, as a partial response for the chunk.
+func splitChunk(obj *cacheobj.CacheObj, index int64, chunkBytes int64) *cacheobj.CacheObj {
+	total := int64(len(obj.Body))
+	start := index * chunkBytes
+	end := start + chunkBytes
+	if end > total {
+		end = total
+	}
+	hdr := web.CopyHeader(obj.RespHeaders)
+	hdr.Set("Content-Range", contentRange(start, end-1, total))
+	hdr.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	chunkObj := *obj
+	chunkObj.RespHeaders = hdr
+	chunkObj.Code = http.StatusPartialContent
+	chunkObj.Body = append([]byte(nil), obj.Body[start:end]...)
+	chunkObj.Size = chunkObj.ComputeSize()
+	return &chunkObj
+}
+
+// removeAll removes every chunk of the object from the cache. This is used when chunks from different versions of the object are found, so they can be refetched consistently.
+func (g *chunkGetter) removeAll(total int64) {
+	for i := int64(0); i*g.chunkBytes < total; i++ {
+		RemoveVariant(g.cache, chunkKey(g.cacheKey, i))
+	}
+}
+
+// chunkReader reads a range of an object from its chunks, getting each chunk as it's needed, so large ranges are never entirely in memory.
+type chunkReader struct {
+	g   *chunkGetter
+	cur *chunk
+	pos int64
+	end int64
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.pos > cr.end {
+		return 0, io.EOF
+	}
+	if index := cr.pos / cr.g.chunkBytes; cr.cur.index != index {
+		obj, _, err := cr.g.get(index)
+		if err != nil {
+			return 0, errors.New("getting chunk " + strconv.FormatInt(index, 10) + ": " + err.Error())
+		}
+		next, ok := cr.g.parse(obj, index)
+		if !ok {
+			return 0, errors.New("getting chunk " + strconv.FormatInt(index, 10) + ": parent returned " + strconv.Itoa(obj.Code) + " " + obj.RespHeaders.Get("Content-Range"))
+		}
+		if next.validator != cr.cur.validator || next.total != cr.cur.total {
+			cr.g.removeAll(cr.cur.total)
+			return 0, errors.New("getting chunk " + strconv.FormatInt(index, 10) + ": chunk is from a different version of the object, removed all chunks")
+		}
+		cr.cur = next
+	}
+	last := cr.end - cr.cur.start + 1
+	if last > int64(len(cr.cur.body)) {
+		last = int64(len(cr.cur.body))
+	}
+	off := cr.pos - cr.cur.start
+	if off >= last {
+		return 0, errors.New("chunk " + strconv.FormatInt(cr.cur.index, 10) + " is shorter than its range")
+	}
+	n := copy(p, cr.cur.body[off:last])
+	cr.pos += int64(n)
+	return n, nil
+}
+
+// serveChunked serves a request for a single byte range from the chunks of the object, requesting only the chunks which aren't cached from the parent. Returns false without responding if the request can't be served from chunks, e.g. because it has multiple ranges or an If-Range, in which case it should be served normally.
+func (h *Handler) serveChunked(r *http.Request, responder *Responder, remappingProducer *remap.RemappingProducer, pluginContext map[string]*interface{}, reqTime time.Time, reqCacheControl web.CacheControl, cacheKey string, connectionClose bool, reqID uint64) bool {
+	rng, ok := parseSingleRange(r.Header.Get("Range"))
+	if !ok || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	g := &chunkGetter{
+		h:               h,
+		r:               r,
+		producer:        remappingProducer,
+		pluginContext:   pluginContext,
+		reqTime:         reqTime,
+		reqCacheControl: reqCacheControl,
+		cache:           remappingProducer.Cache(),
+		cacheKey:        cacheKey,
+		chunkBytes:      remappingProducer.RangeChunkBytes(),
+		reqID:           reqID,
+	}
+
+	index := int64(0) // suffix ranges need the total length first, which every chunk has
+	if rng.start > 0 {
+		index = rng.start / g.chunkBytes
+	}
+	obj, reuse, err := g.get(index)
+	if err != nil {
+		log.Errorf("getting chunk %v of '%v': %v (reqid %v)\n", index, cacheKey, err, reqID)
+		responder.OriginConnectFailed = true
+		responder.Do()
+		return true
+	}
+	responder.OriginReqSuccess = true
+	responder.Reuse = reuse
+	responder.OriginCode = obj.OriginCode
+	responder.ProxyStr = obj.ProxyURL
+
+	code, hdrs, body := obj.Code, obj.RespHeaders, obj.Body
+	reader := io.Reader(nil)
+	if first, ok := g.parse(obj, index); !ok {
+		if obj.Code == http.StatusOK || obj.Code == http.StatusPartialContent {
+			log.Errorf("chunk %v of '%v' returned %v with unexpected range '%v' (reqid %v)\n", index, cacheKey, obj.Code, obj.RespHeaders.Get("Content-Range"), reqID)
+			code, hdrs, body = http.StatusBadGateway, http.Header{}, []byte(http.StatusText(http.StatusBadGateway))
+		}
+		// otherwise, e.g. a 404, serve the parent's response as-is.
+	} else if start, end, ok := rng.resolve(first.total); !ok {
+		code, body = http.StatusRequestedRangeNotSatisfiable, nil
+		hdrs = http.Header{"Content-Range": {"bytes */" + strconv.FormatInt(first.total, 10)}}
+	} else {
+		log.Debugf("serving '%v' range %v-%v/%v from %v byte chunks (reqid %v)\n", cacheKey, start, end, first.total, g.chunkBytes, reqID)
+		code, body = http.StatusPartialContent, nil
+		hdrs = web.CopyHeader(obj.RespHeaders)
+		hdrs.Set("Content-Range", contentRange(start, end, first.total))
+		hdrs.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		hdrs.Set("Accept-Ranges", "bytes")
+		reader = &chunkReader{g: g, cur: first, pos: start, end: end}
+	}
+
+	responder.SetReaderResponse(&code, &hdrs, &body, reader, connectionClose)
+	beforeRespData := plugin.BeforeRespondData{Req: r, CacheObj: obj, Code: &code, Hdr: &hdrs, Body: &body, BodyReader: &responder.BodyReader, RemapRule: remappingProducer.Name()}
+	h.plugins.OnBeforeRespond(remappingProducer.PluginCfg(), pluginContext, beforeRespData)
+	responder.Do()
+	return true
+}
+
+// RemoveChunks removes all chunks of the object with the given key from the cache. Returns whether any chunks existed.
+// This requires iterating over all cache keys, and is therefore expensive for large caches.
+func RemoveChunks(cache icache.Cache, key string) bool {
+	prefix := key + ChunkKeySeparator
+	removed := false
+	for _, k := range cache.Keys() {
+		if strings.HasPrefix(k, prefix) {
+			log.Debugf("RemoveChunks '%v' removing chunk '%v'\n", key, k)
+			removed = cache.Remove(k) || removed
+		}
+	}
+	return removed
+}
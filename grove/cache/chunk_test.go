@@ -0,0 +1,214 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/icache"
+)
+
+func TestParseSingleRange(t *testing.T) {
+	tests := []struct {
+		hdr   string
+		total int64
+		ok    bool
+		start int64
+		end   int64
+	}{
+		{"bytes=0-99", 1000, true, 0, 99},
+		{"bytes=900-", 1000, true, 900, 999},
+		{"bytes=900-2000", 1000, true, 900, 999},
+		{"bytes=-100", 1000, true, 900, 999},
+		{"bytes=-2000", 1000, true, 0, 999},
+		{"bytes=1000-", 1000, false, 0, 0},
+		{"bytes=0-9,20-29", 1000, false, 0, 0},
+		{"bytes=9-0", 1000, false, 0, 0},
+		{"items=0-9", 1000, false, 0, 0},
+	}
+	for _, test := range tests {
+		rng, ok := parseSingleRange(test.hdr)
+		start, end := int64(0), int64(0)
+		if ok {
+			start, end, ok = rng.resolve(test.total)
+		}
+		if ok != test.ok || start != test.start || end != test.end {
+			t.Errorf("parseSingleRange('%v') total %v expected %v %v-%v, actual %v %v-%v", test.hdr, test.total, test.ok, test.start, test.end, ok, start, end)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	if first, last, total, ok := parseContentRange("bytes 100-199/1000"); !ok || first != 100 || last != 199 || total != 1000 {
+		t.Errorf("parseContentRange expected 100-199/1000, actual %v %v-%v/%v", ok, first, last, total)
+	}
+	for _, hdr := range []string{"", "bytes */1000", "bytes 100-199/*", "bytes 200-100/1000", "bytes 0-1000/1000"} {
+		if _, _, _, ok := parseContentRange(hdr); ok {
+			t.Errorf("parseContentRange('%v') expected invalid, actual valid", hdr)
+		}
+	}
+}
+
+// rangeOrigin is an origin which serves its content with http.ServeContent, honoring Range requests unless ignoreRange, and records the Range of each request.
+type rangeOrigin struct {
+	*testOrigin
+	m           sync.Mutex
+	content     []byte
+	etag        string
+	ignoreRange bool
+	ranges      []string
+}
+
+func newRangeOrigin(content []byte) *rangeOrigin {
+	o := &rangeOrigin{content: content, etag: `"v1"`}
+	o.testOrigin = newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		o.m.Lock()
+		content, etag, ignoreRange := o.content, o.etag, o.ignoreRange
+		o.ranges = append(o.ranges, r.Header.Get("Range"))
+		o.m.Unlock()
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", etag)
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	return o
+}
+
+// takeRanges returns the Range headers requested since it was last called.
+func (o *rangeOrigin) takeRanges() []string {
+	o.m.Lock()
+	defer o.m.Unlock()
+	ranges := o.ranges
+	o.ranges = nil
+	return ranges
+}
+
+func (o *rangeOrigin) set(content []byte, etag string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.content, o.etag = content, etag
+}
+
+// testContent returns n bytes, each different from its neighbors, so misassembled ranges are detected.
+func testContent(n int, first byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i%26)
+	}
+	return b
+}
+
+// chunkKeys returns the cache keys of chunks in the cache.
+func chunkKeys(cache icache.Cache) []string {
+	keys := []string{}
+	for _, key := range cache.Keys() {
+		if strings.Contains(key, ChunkKeySeparator) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestServeChunked(t *testing.T) {
+	content := testContent(100, 'a')
+	origin := newRangeOrigin(content)
+	defer origin.Close()
+	h, _ := newTestHandler(t, origin.URL, `"range_chunk_bytes": 10,`, false)
+
+	tests := []struct {
+		rng          string
+		first        int
+		last         int
+		parentRanges []string
+	}{
+		{"bytes=15-34", 15, 34, []string{"bytes=10-19", "bytes=20-29", "bytes=30-39"}}, // across chunk boundaries
+		{"bytes=25-44", 25, 44, []string{"bytes=40-49"}},                               // only the missing chunk
+		{"bytes=-5", 95, 99, []string{"bytes=0-9", "bytes=90-99"}},                     // suffix ranges need the total from the first chunk
+		{"bytes=92-", 92, 99, nil},                                                     // open range
+		{"bytes=0-1000", 0, 99, []string{"bytes=50-59", "bytes=60-69", "bytes=70-79", "bytes=80-89"}},
+	}
+	for _, test := range tests {
+		w := serve(h, http.MethodGet, "/obj", http.Header{"Range": {test.rng}})
+		if w.Code != http.StatusPartialContent || w.Body.String() != string(content[test.first:test.last+1]) {
+			t.Errorf("GET %v expected 206 '%s', actual %v '%v'", test.rng, content[test.first:test.last+1], w.Code, w.Body.String())
+		}
+		if expected := contentRange(int64(test.first), int64(test.last), 100); w.Header().Get("Content-Range") != expected {
+			t.Errorf("GET %v expected Content-Range '%v', actual '%v'", test.rng, expected, w.Header().Get("Content-Range"))
+		}
+		if actual := origin.takeRanges(); !reflect.DeepEqual(actual, test.parentRanges) {
+			t.Errorf("GET %v expected parent requests for %v, actual %v", test.rng, test.parentRanges, actual)
+		}
+	}
+
+	w := serve(h, http.MethodGet, "/obj", http.Header{"Range": {"bytes=100-"}})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */100" {
+		t.Errorf("GET past the end expected 416 'bytes */100', actual %v '%v'", w.Code, w.Header().Get("Content-Range"))
+	}
+}
+
+func TestServeChunkedParentIgnoresRange(t *testing.T) {
+	content := testContent(100, 'a')
+	origin := newRangeOrigin(content)
+	origin.ignoreRange = true
+	defer origin.Close()
+	h, cache := newTestHandler(t, origin.URL, `"range_chunk_bytes": 10,`, false)
+
+	w := serve(h, http.MethodGet, "/obj", http.Header{"Range": {"bytes=15-34"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(content[15:35]) || w.Header().Get("Content-Range") != "bytes 15-34/100" {
+		t.Fatalf("GET expected 206 'bytes 15-34/100' '%s', actual %v '%v' '%v'", content[15:35], w.Code, w.Header().Get("Content-Range"), w.Body.String())
+	}
+	if origin.Reqs() != 1 {
+		t.Errorf("expected the parent's 200 to be split into chunks, actual %v parent requests", origin.Reqs())
+	}
+	if keys := chunkKeys(cache); len(keys) != 10 {
+		t.Errorf("expected all 10 chunks of the parent's 200 cached, actual %v", keys)
+	}
+}
+
+func TestServeChunkedVersionMismatch(t *testing.T) {
+	origin := newRangeOrigin(testContent(100, 'a'))
+	defer origin.Close()
+	h, cache := newTestHandler(t, origin.URL, `"range_chunk_bytes": 10,`, false)
+
+	serve(h, http.MethodGet, "/obj", http.Header{"Range": {"bytes=0-9"}})
+	content := testContent(100, 'A')
+	origin.set(content, `"v2"`)
+
+	// chunk 0 is cached from v1, and chunk 1 is from v2, so they can't be assembled
+	w := serve(h, http.MethodGet, "/obj", http.Header{"Range": {"bytes=5-14"}})
+	if w.Body.Len() >= 10 {
+		t.Errorf("GET across versions expected the response cut short, actual '%v'", w.Body.String())
+	}
+	if keys := chunkKeys(cache); len(keys) != 0 {
+		t.Errorf("GET across versions expected all chunks removed, actual %v", keys)
+	}
+
+	origin.takeRanges()
+	w = serve(h, http.MethodGet, "/obj", http.Header{"Range": {"bytes=5-14"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(content[5:15]) {
+		t.Errorf("GET after removing chunks expected 206 '%s', actual %v '%v'", content[5:15], w.Code, w.Body.String())
+	}
+	if actual, expected := origin.takeRanges(), []string{"bytes=0-9", "bytes=10-19"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("GET after removing chunks expected parent requests for %v, actual %v", expected, actual)
+	}
+}
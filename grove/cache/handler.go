@@ -15,6 +15,8 @@ package cache
 */
 
 import (
+	"context"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
@@ -23,13 +25,17 @@ import (
 	"unsafe"
 
 	"github.com/apache/trafficcontrol/grove/cachedata"
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/plugin"
 
 	"github.com/apache/trafficcontrol/grove/remap"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/rfc"
+	"github.com/apache/trafficcontrol/grove/sibling"
 	"github.com/apache/trafficcontrol/grove/stat"
 	"github.com/apache/trafficcontrol/grove/thread"
+	"github.com/apache/trafficcontrol/grove/trace"
 	"github.com/apache/trafficcontrol/grove/web"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
@@ -70,7 +76,10 @@ type Handler struct {
 	httpConns       *web.ConnMap
 	httpsConns      *web.ConnMap
 	interfaceName   string
-	requestID       uint64 // Atomic - DO NOT access or modify without atomic operations
+	reload          func() error
+	siblings        *sibling.Siblings // nil if sibling lookup is disabled
+	tracer          *trace.Tracer     // nil if tracing is disabled
+	requestID       uint64            // Atomic - DO NOT access or modify without atomic operations
 	// keyThrottlers     Throttlers
 	// nocacheThrottlers Throttlers
 }
@@ -113,6 +122,9 @@ func NewHandler(
 	httpConns *web.ConnMap,
 	httpsConns *web.ConnMap,
 	interfaceName string,
+	reload func() error,
+	siblings *sibling.Siblings,
+	tracer *trace.Tracer,
 ) *Handler {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -135,6 +147,9 @@ func NewHandler(
 		httpConns:       httpConns,
 		httpsConns:      httpsConns,
 		interfaceName:   interfaceName,
+		reload:          reload,
+		siblings:        siblings,
+		tracer:          tracer,
 		// keyThrottlers:     NewThrottlers(keyLimit),
 		// nocacheThrottlers: NewThrottlers(nocacheLimit),
 	}
@@ -167,12 +182,21 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reqID := atomic.AddUint64(&h.requestID, 1)
 	pluginContext := copyPluginContext(h.pluginContext) // must give each request a copy, because they can modify in parallel
 	srvrData := cachedata.SrvrData{h.hostname, h.port, h.scheme}
-	onReqData := plugin.OnRequestData{W: w, R: r, Stats: h.stats, StatRules: h.remapper.StatRules(), HTTPConns: h.httpConns, HTTPSConns: h.httpsConns, InterfaceName: h.interfaceName, SrvrData: srvrData, RequestID: reqID}
+	onReqData := plugin.OnRequestData{W: w, R: r, Stats: h.stats, StatRules: h.remapper.StatRules(), HTTPConns: h.httpConns, HTTPSConns: h.httpsConns, InterfaceName: h.interfaceName, SrvrData: srvrData, RequestID: reqID, Reload: h.reload}
 	stop := h.plugins.OnRequest(h.remapper.PluginCfg(), pluginContext, onReqData)
 	if stop {
 		return
 	}
 
+	ctx, span := h.tracer.StartRequest(r, "grove request")
+	defer span.End()
+	r = r.WithContext(ctx)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.address", r.Host)
+	span.SetAttribute("client.address", r.RemoteAddr)
+	span.SetAttribute("grove.request_id", reqID)
+
 	conn := (*web.InterceptConn)(nil)
 	if realConn, ok := h.conns.Get(r.RemoteAddr); !ok {
 		log.Infof("RemoteAddr '%v' not in Conns (reqid %v)\n", r.RemoteAddr, reqID)
@@ -224,16 +248,52 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	connectionClose := h.connectionClose || remappingProducer.ConnectionClose()
 
-	beforeCacheLookUpData := plugin.BeforeCacheLookUpData{Req: r, DefaultCacheKey: remappingProducer.CacheKey(), CacheKeyOverrideFunc: remappingProducer.OverrideCacheKey}
+	if h.rateLimit(r, remappingProducer, responder, connectionClose, reqID) {
+		return
+	}
+
+	rejectCode := 0
+	rejectHdr := http.Header(nil)
+	reject := func(code int, hdr http.Header) {
+		if rejectCode == 0 {
+			rejectCode, rejectHdr = code, hdr
+		}
+	}
+	beforeCacheLookUpData := plugin.BeforeCacheLookUpData{Req: r, DefaultCacheKey: remappingProducer.CacheKey(), CacheKeyOverrideFunc: remappingProducer.OverrideCacheKey, CacheKey: remappingProducer.CacheKey, Cache: remappingProducer.Cache(), Reject: reject}
 	h.plugins.OnBeforeCacheLookup(remappingProducer.PluginCfg(), pluginContext, beforeCacheLookUpData)
+	if rejectCode != 0 {
+		log.Debugf("request rejected by plugin with code %v (reqid %v)\n", rejectCode, reqID)
+		if rejectHdr == nil {
+			rejectHdr = http.Header{}
+		}
+		rejectBody := []byte(http.StatusText(rejectCode))
+		responder.SetResponse(&rejectCode, &rejectHdr, &rejectBody, connectionClose)
+		responder.Do()
+		return
+	}
 
 	cacheKey := remappingProducer.CacheKey()
 	retrier := NewRetrier(h, reqHeader, reqTime, reqCacheControl, remappingProducer, reqID)
 
 	cache := remappingProducer.Cache()
 
+	if r.Method == remapdata.MethodPurge {
+		h.purge(r, responder, cache, cacheKey, remappingProducer.RangeChunkBytes() > 0, remappingProducer.PluginCfg(), pluginContext, reqID)
+		return
+	}
+
+	if remappingProducer.RangeChunkBytes() > 0 && r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		if h.serveChunked(r, responder, remappingProducer, pluginContext, reqTime, reqCacheControl, cacheKey, connectionClose, reqID) {
+			return
+		}
+	}
+
 	var reqHost *string
-	cacheObj, ok := cache.Get(cacheKey)
+	_, lookupSpan := trace.Start(r.Context(), "cache lookup", trace.SpanKindInternal)
+	cacheObj, ok := GetVariant(cache, cacheKey, reqHeader)
+	lookupSpan.SetAttribute("grove.cache.key", cacheKey)
+	lookupSpan.SetAttribute("grove.cache.found", ok)
+	lookupSpan.End()
 	if !ok {
 		log.Debugf("cache.Handler.ServeHTTP: '%v' not in cache (reqid %v)\n", cacheKey, reqID)
 		beforeParentRequestData := plugin.BeforeParentRequestData{Req: r, RemapRule: remappingProducer.Name()}
@@ -253,13 +313,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		responder.OriginCode = cacheObj.OriginCode
 		// create new pointers, so plugins don't modify the cacheObj
 		codePtr, hdrsPtr, bodyPtr := cacheObj.Code, cacheObj.RespHeaders, cacheObj.Body
-		responder.SetResponse(&codePtr, &hdrsPtr, &bodyPtr, connectionClose)
+		responder.SetStreamResponse(&codePtr, &hdrsPtr, &bodyPtr, cacheObj.Stream(), connectionClose)
 		responder.OriginReqSuccess = true
 		responder.ProxyStr = cacheObj.ProxyURL
 		if reqHost != nil {
 			responder.ToFQDN = *reqHost
 		}
-		beforeRespData := plugin.BeforeRespondData{Req: r, CacheObj: cacheObj, Code: &codePtr, Hdr: &hdrsPtr, Body: &bodyPtr, RemapRule: remappingProducer.Name()}
+		beforeRespData := plugin.BeforeRespondData{Req: r, CacheObj: cacheObj, Code: &codePtr, Hdr: &hdrsPtr, Body: &bodyPtr, BodyReader: &responder.BodyReader, RemapRule: remappingProducer.Name()}
 		h.plugins.OnBeforeRespond(remappingProducer.PluginCfg(), pluginContext, beforeRespData)
 		responder.Do()
 		return
@@ -273,6 +333,14 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.plugins.OnBeforeParentRequest(remappingProducer.PluginCfg(), pluginContext, beforeParentRequestData)
 	}
 
+	if (canReuseStored == remapdata.ReuseMustRevalidate || canReuseStored == remapdata.ReuseMustRevalidateCanStale) && rfc.StaleWhileRevalidate(cacheObj.RespHeaders, cacheObj.RespCacheControl, cacheObj.ReqRespTime, cacheObj.RespRespTime, remappingProducer.StaleWhileRevalidate()) {
+		log.Debugf("cache.Handler.ServeHTTP: '%v' serving stale while revalidating (reqid %v)\n", cacheKey, reqID)
+		// the revalidation outlives this request, so it gets its own copy of the request and its own producer, which the getter mutates
+		revalidateRetrier := NewRetrier(h, reqHeader, reqTime, reqCacheControl, remappingProducer.WithCacheKey(cacheKey), reqID)
+		go revalidateStale(revalidateRetrier, r.Clone(context.Background()), cacheObj, cacheKey, reqID)
+		canReuseStored = remapdata.ReuseCan
+	}
+
 	switch canReuseStored {
 	case remapdata.ReuseCan:
 		log.Debugf("cache.Handler.ServeHTTP: '%v' cache hit! (reqid %v)\n", cacheKey, reqID)
@@ -286,7 +354,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	case remapdata.ReuseMustRevalidate:
 		log.Debugf("cache.Handler.ServeHTTP: '%v' must revalidate (reqid %v)\n", cacheKey, reqID)
+		oldCacheObj := cacheObj
 		cacheObj, reqHost, err = retrier.Get(r, cacheObj)
+		if canStaleIfError(oldCacheObj, cacheObj, err, remappingProducer) {
+			log.Errorf("revalidating '%v' failed - serving stale per stale-if-error: %v (reqid %v)\n", cacheKey, err, reqID)
+			cacheObj, err = oldCacheObj, nil
+		}
 		if err != nil {
 			log.Errorf("retrying get error: %v (reqid %v)\n", err, reqID)
 			responder.Do()
@@ -299,13 +372,16 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Errorf("retrying get error - serving stale as allowed: %v (reqid %v)\n", err, reqID)
 			cacheObj = oldCacheObj
+		} else if canStaleIfError(oldCacheObj, cacheObj, err, remappingProducer) {
+			log.Errorf("revalidating '%v' returned %v - serving stale per stale-if-error (reqid %v)\n", cacheKey, cacheObj.Code, reqID)
+			cacheObj = oldCacheObj
 		}
 	}
 	log.Debugf("cache.Handler.ServeHTTP: '%v' responding with %v (reqid %v)\n", cacheKey, cacheObj.Code, reqID)
 
 	// create new pointers, so plugins don't modify the cacheObj
 	codePtr, hdrsPtr, bodyPtr := cacheObj.Code, cacheObj.RespHeaders, cacheObj.Body
-	responder.SetResponse(&codePtr, &hdrsPtr, &bodyPtr, connectionClose)
+	responder.SetStreamResponse(&codePtr, &hdrsPtr, &bodyPtr, cacheObj.Stream(), connectionClose)
 	responder.OriginReqSuccess = true
 	responder.Reuse = canReuseStored
 	responder.OriginCode = cacheObj.OriginCode
@@ -314,7 +390,90 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if reqHost != nil {
 		responder.ToFQDN = *reqHost
 	}
-	beforeRespData := plugin.BeforeRespondData{Req: r, CacheObj: cacheObj, Code: &codePtr, Hdr: &hdrsPtr, Body: &bodyPtr, RemapRule: remappingProducer.Name()}
+	beforeRespData := plugin.BeforeRespondData{Req: r, CacheObj: cacheObj, Code: &codePtr, Hdr: &hdrsPtr, Body: &bodyPtr, BodyReader: &responder.BodyReader, RemapRule: remappingProducer.Name()}
 	h.plugins.OnBeforeRespond(remappingProducer.PluginCfg(), pluginContext, beforeRespData)
 	responder.Do()
 }
+
+// revalidateStale revalidates a stale object which was served to the client per stale-while-revalidate. The revalidated object is cached by the Retrier, and concurrent revalidations of the same key are collapsed by the Handler's Getter.
+func revalidateStale(retrier *Retrier, r *http.Request, cacheObj *cacheobj.CacheObj, cacheKey string, reqID uint64) {
+	if _, _, err := retrier.Get(r, cacheObj); err != nil {
+		log.Errorf("background revalidation of '%v' failed: %v (reqid %v)\n", cacheKey, err, reqID)
+	}
+}
+
+// canStaleIfError returns whether the stale object may be served in place of the result of revalidating it, because the revalidation failed or returned a retry code, and the stale object is within its stale-if-error window.
+func canStaleIfError(staleObj *cacheobj.CacheObj, newObj *cacheobj.CacheObj, err error, remappingProducer *remap.RemappingProducer) bool {
+	if err == nil && !isFailure(newObj, remappingProducer.RetryCodes()) {
+		return false
+	}
+	return rfc.StaleIfError(staleObj.RespHeaders, staleObj.RespCacheControl, staleObj.ReqRespTime, staleObj.RespRespTime, remappingProducer.StaleIfError())
+}
+
+// rateLimit checks the request against the rule's rate and connection limits. If it's over a limit, it responds with a 429 and a Retry-After header, counts it in the rule's stats, and returns true.
+func (h *Handler) rateLimit(r *http.Request, remappingProducer *remap.RemappingProducer, responder *Responder, connectionClose bool, reqID uint64) bool {
+	limiter := remappingProducer.RateLimiter()
+	if limiter == nil {
+		return false
+	}
+	ip, err := web.GetIP(r)
+	if err != nil {
+		log.Errorf("rate limiting: %v, limiting by rule only (reqid %v)\n", err, reqID)
+	}
+	conns := 0
+	if ip != nil {
+		for _, connMap := range []*web.ConnMap{h.httpConns, h.httpsConns} {
+			if connMap != nil {
+				conns += connMap.ClientLen(ip.String())
+			}
+		}
+	}
+	limit, retryAfter := limiter.Allow(ip, conns, time.Now())
+	if limit == remapdata.RateLimitNone {
+		return false
+	}
+	log.Debugf("request from %v over the %v limit of rule %v, retry after %v (reqid %v)\n", r.RemoteAddr, limit, remappingProducer.Name(), retryAfter, reqID)
+	if remapStats, ok := h.stats.Remap().Stats(r.Host); ok {
+		remapStats.AddRateLimited(limit)
+	}
+	code := http.StatusTooManyRequests
+	hdr := http.Header{}
+	hdr.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	body := []byte(http.StatusText(code))
+	// close connections over the connection limit, so the client's connections are reduced rather than reused
+	responder.SetResponse(&code, &hdr, &body, connectionClose || limit == remapdata.RateLimitConnections)
+	responder.Do()
+	return true
+}
+
+// purge handles a PURGE request, removing the object for the request's cache key, all its Vary variants, and any variants cached by plugins, from the cache. If chunked is true, all the object's range chunks are removed as well. Clients must be allowed by the stats ACL.
+func (h *Handler) purge(r *http.Request, responder *Responder, cache icache.Cache, cacheKey string, chunked bool, pluginCfg map[string]interface{}, pluginContext map[string]*interface{}, reqID uint64) {
+	ip, err := web.GetIP(r)
+	if err != nil {
+		log.Errorf("purge failed to get IP: %v (reqid %v)\n", err, reqID)
+		*responder.ResponseCode = http.StatusInternalServerError
+		responder.Do()
+		return
+	}
+	if !h.remapper.StatRules().Allowed(ip) {
+		log.Debugf("purge IP %v not allowed (reqid %v)\n", ip, reqID)
+		*responder.ResponseCode = http.StatusForbidden
+		responder.Do()
+		return
+	}
+	removed := RemoveVariant(cache, cacheKey)
+	for _, key := range h.plugins.OnPurge(pluginCfg, pluginContext, plugin.PurgeData{Req: r, CacheKey: cacheKey, Cache: cache}) {
+		removed = RemoveVariant(cache, key) || removed
+	}
+	if chunked {
+		removed = RemoveChunks(cache, cacheKey) || removed
+	}
+	if removed {
+		log.Infof("purged '%v' (reqid %v)\n", cacheKey, reqID)
+		*responder.ResponseCode = http.StatusOK
+	} else {
+		log.Debugf("purge '%v' not in cache (reqid %v)\n", cacheKey, reqID)
+		*responder.ResponseCode = http.StatusNotFound
+	}
+	responder.Do()
+}
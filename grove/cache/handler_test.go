@@ -0,0 +1,360 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/memcache"
+	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/remap"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/sibling"
+	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/web"
+)
+
+const testHost = "cache.test"
+
+// testOrigin is an origin which counts its requests, and responds with its handler.
+type testOrigin struct {
+	*httptest.Server
+	reqs uint64
+}
+
+func newTestOrigin(h http.HandlerFunc) *testOrigin {
+	o := &testOrigin{}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&o.reqs, 1)
+		h(w, r)
+	}))
+	return o
+}
+
+func (o *testOrigin) Reqs() uint64 { return atomic.LoadUint64(&o.reqs) }
+
+// newTestHandler returns a Handler with a single remap rule from testHost to the given origin, and its memory cache. The ruleJSON is added to the rule's JSON object, e.g. `"stale_while_revalidate_ms": 1000,`. The given plugins are enabled.
+func newTestHandler(t *testing.T, origin string, ruleJSON string, strictRFC bool, enabledPlugins ...string) (*Handler, icache.Cache) {
+	dir, err := ioutil.TempDir("", "grove-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remapFile := filepath.Join(dir, "remap.json")
+	remapJSON := `{"parent_selection": "consistent-hash", "retry_num": 1, "timeout_ms": 5000, "retry_codes": [], "rules": [{` + ruleJSON + `
+		"name": "test",
+		"from": "http://` + testHost + `",
+		"query-string": {"remap": true, "cache": true},
+		"to": [{"url": "` + origin + `", "weight": 1}]
+	}]}`
+	if err := ioutil.WriteFile(remapFile, []byte(remapJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	caches := map[string]icache.Cache{"": memcache.New(1024 * 1024)}
+	plugins := plugin.Get(enabledPlugins)
+	remapper, err := remap.LoadRemapper(remapFile, plugins.LoadFuncs(), caches, remap.NewRemappingTransport(5*time.Second, 5*time.Second, 10, 5*time.Second))
+	if err != nil {
+		t.Fatalf("loading remap rules: %v", err)
+	}
+	conns := web.NewConnMap()
+	stats := stat.New(remapper.Rules(), caches, 1024*1024, conns, nil, stat.NewParentConns(), "test")
+	pluginContext := map[string]*interface{}{}
+	plugins.OnStartup(remapper.PluginCfg(), pluginContext, plugin.StartupData{Shared: remapper.PluginSharedCfg()})
+	h := NewHandler(remapper, 0, stats, "http", "80", conns, strictRFC, false, plugins, pluginContext, conns, nil, "", nil, nil, nil)
+	return h, caches[""]
+}
+
+// serve serves a request with the given method, path and headers, and returns the response.
+func serve(h http.Handler, method string, path string, hdr http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Host = testHost
+	for name, vals := range hdr {
+		r.Header[name] = vals
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPurge(t *testing.T) {
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("body " + r.Header.Get("Accept-Language")))
+	})
+	defer origin.Close()
+	h, cache := newTestHandler(t, origin.URL, "", false)
+
+	for _, lang := range []string{"en", "fr", "en"} {
+		if w := serve(h, http.MethodGet, "/obj", http.Header{"Accept-Language": {lang}}); w.Code != http.StatusOK || w.Body.String() != "body "+lang {
+			t.Fatalf("GET expected 200 'body %v', actual %v '%v'", lang, w.Code, w.Body.String())
+		}
+	}
+	if origin.Reqs() != 2 {
+		t.Fatalf("expected 2 origin requests for 2 variants, actual %v", origin.Reqs())
+	}
+
+	if w := serve(h, remapdata.MethodPurge, "/obj", nil); w.Code != http.StatusOK {
+		t.Fatalf("PURGE expected 200, actual %v", w.Code)
+	}
+	for _, key := range cache.Keys() {
+		if strings.Contains(key, "/obj") {
+			t.Errorf("PURGE expected the object and all its variants removed, actual key '%v' still cached", key)
+		}
+	}
+	if w := serve(h, remapdata.MethodPurge, "/obj", nil); w.Code != http.StatusNotFound {
+		t.Errorf("PURGE of an uncached object expected 404, actual %v", w.Code)
+	}
+
+	serve(h, http.MethodGet, "/obj", http.Header{"Accept-Language": {"en"}})
+	if origin.Reqs() != 3 {
+		t.Errorf("GET after PURGE expected a cache miss, actual %v origin requests", origin.Reqs())
+	}
+}
+
+func TestStream(t *testing.T) {
+	sendHeaders, sendRest := make(chan struct{}), make(chan struct{})
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		<-sendHeaders
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		<-sendRest
+		w.Write([]byte("second"))
+	})
+	defer origin.Close()
+	h, cache := newTestHandler(t, origin.URL, `"stream": true,`, false)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	cached := func() bool {
+		for _, key := range cache.Keys() {
+			if strings.Contains(key, "/obj") {
+				return true
+			}
+		}
+		return false
+	}
+	get := func() <-chan *http.Response {
+		respChan := make(chan *http.Response, 1)
+		go func() {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/obj", nil)
+			if err != nil {
+				t.Error(err)
+			}
+			req.Host = testHost
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("GET error: %v", err)
+			}
+			respChan <- resp
+		}()
+		return respChan
+	}
+
+	// the second request is collapsed onto the first's parent request, whether it arrives before or after the parent headers
+	first := get()
+	for i := 0; i < 100 && origin.Reqs() < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := get()
+	time.Sleep(50 * time.Millisecond)
+	close(sendHeaders)
+
+	resps := []*http.Response{<-first, <-second}
+	for i, resp := range resps {
+		if resp == nil {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		p := make([]byte, len("first "))
+		if _, err := io.ReadFull(resp.Body, p); err != nil || string(p) != "first " {
+			t.Fatalf("GET %v expected the bytes received so far 'first ' before the origin finished, actual '%s' %v", i, p, err)
+		}
+	}
+	if origin.Reqs() != 1 {
+		t.Errorf("expected the second GET collapsed onto the first's parent request, actual %v origin requests", origin.Reqs())
+	}
+	if cached() {
+		t.Errorf("expected the object not cached before the fill completes, actual keys %v", cache.Keys())
+	}
+
+	close(sendRest)
+	for i, resp := range resps {
+		if rest, err := ioutil.ReadAll(resp.Body); err != nil || string(rest) != "second" {
+			t.Errorf("GET %v expected the rest of the body 'second', actual '%s' %v", i, rest, err)
+		}
+	}
+	for i := 0; i < 100 && !cached(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cached() {
+		t.Fatalf("expected the object cached after the fill completes, actual keys %v", cache.Keys())
+	}
+	if w := serve(h, http.MethodGet, "/obj", nil); w.Code != http.StatusOK || w.Body.String() != "first second" || origin.Reqs() != 1 {
+		t.Errorf("GET after the fill expected a cache hit 200 'first second', actual %v '%v' %v origin requests", w.Code, w.Body.String(), origin.Reqs())
+	}
+}
+
+func TestStreamUncacheable(t *testing.T) {
+	body := strings.Repeat("uncacheable ", 10000)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(body))
+	})
+	defer origin.Close()
+	h, cache := newTestHandler(t, origin.URL, `"stream": true,`, false)
+
+	for i := 0; i < 2; i++ {
+		if w := serve(h, http.MethodGet, "/obj", nil); w.Code != http.StatusOK || w.Body.String() != body {
+			t.Fatalf("GET expected 200 with the origin body, actual %v len %v", w.Code, w.Body.Len())
+		}
+	}
+	if origin.Reqs() != 2 || len(cache.Keys()) != 0 {
+		t.Errorf("GET of an uncacheable object expected 2 origin requests and nothing cached, actual %v %v", origin.Reqs(), cache.Keys())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("compressible ", 1000)
+	ifNoneMatch := atomic.Value{}
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch.Store(r.Header.Get("If-None-Match"))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(body + r.Header.Get("Accept-Language")))
+	})
+	defer origin.Close()
+	h, cache := newTestHandler(t, origin.URL, `"stream": true, "plugins": {"compress": {}},`, false, "compress")
+
+	get := func(lang string) {
+		t.Helper()
+		w := serve(h, http.MethodGet, "/obj", http.Header{"Accept-Encoding": {"gzip"}, "Accept-Language": {lang}})
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != `"v1-gzip"` {
+			t.Fatalf("GET expected gzipped 200, actual %v %+v", w.Code, w.Header())
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("GET response gzip error: %v", err)
+		}
+		if decompressed, err := ioutil.ReadAll(zr); err != nil || string(decompressed) != body+lang {
+			t.Fatalf("GET expected the body to decompress to the origin's, actual err %v len %v", err, len(decompressed))
+		}
+	}
+	variantCached := func() bool {
+		for _, key := range cache.Keys() {
+			if strings.Contains(key, plugin.CompressCacheKeySeparator) {
+				return true
+			}
+		}
+		return false
+	}
+
+	get("en")
+	for i := 0; i < 100 && !variantCached(); i++ {
+		time.Sleep(10 * time.Millisecond) // streamed variants are cached after the response
+	}
+	if !variantCached() {
+		t.Fatalf("GET expected the compressed variant to be cached, actual keys %v", cache.Keys())
+	}
+	get("en")
+	get("fr")
+	if origin.Reqs() != 2 {
+		t.Fatalf("expected 2 origin requests for 2 variants, actual %v", origin.Reqs())
+	}
+
+	if w := serve(h, remapdata.MethodPurge, "/obj", nil); w.Code != http.StatusOK {
+		t.Fatalf("PURGE expected 200, actual %v", w.Code)
+	}
+	for _, key := range cache.Keys() {
+		if strings.Contains(key, "/obj") {
+			t.Errorf("PURGE expected the object and all its compressed variants removed, actual key '%v' still cached", key)
+		}
+	}
+
+	serve(h, http.MethodGet, "/obj", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {`"v1-gzip"`}})
+	if actual := ifNoneMatch.Load(); actual != `"v1"` {
+		t.Errorf("parent request If-None-Match expected the identity ETag '\"v1\"', actual '%v'", actual)
+	}
+}
+
+func TestSiblingHeader(t *testing.T) {
+	parentHdr := atomic.Value{}
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		parentHdr.Store(r.Header.Get(sibling.Header))
+		w.Header().Set("Cache-Control", "no-store")
+	})
+	defer origin.Close()
+
+	h, _ := newTestHandler(t, origin.URL, "", false)
+	serve(h, http.MethodGet, "/obj", http.Header{sibling.Header: {"1"}})
+	if actual := parentHdr.Load(); actual != "1" {
+		t.Errorf("parent request without siblings expected the client's %v header '1', actual '%v'", sibling.Header, actual)
+	}
+
+	siblings, err := sibling.New("self.test:80", []string{"self.test:80"}, nil, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.siblings = siblings
+	r := httptest.NewRequest(http.MethodGet, "/obj", nil)
+	r.Host = testHost
+	r.Header.Set(sibling.Header, "1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if actual := parentHdr.Load(); actual != "" {
+		t.Errorf("parent request with siblings expected no %v header, actual '%v'", sibling.Header, actual)
+	}
+	if actual := r.Header.Get(sibling.Header); actual != "1" {
+		t.Errorf("client request expected to keep its %v header '1', actual '%v'", sibling.Header, actual)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	body := int32(0)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=600") // stale on arrival
+		w.Write([]byte("body " + strconv.Itoa(int(atomic.AddInt32(&body, 1)))))
+	})
+	defer origin.Close()
+	h, _ := newTestHandler(t, origin.URL, `"stale_while_revalidate_ms": 600000,`, false)
+
+	if w := serve(h, http.MethodGet, "/obj", nil); w.Code != http.StatusOK || w.Body.String() != "body 1" {
+		t.Fatalf("GET expected 200 'body 1', actual %v '%v'", w.Code, w.Body.String())
+	}
+	if w := serve(h, http.MethodGet, "/obj", http.Header{"X-Test": {"stale"}}); w.Code != http.StatusOK || w.Body.String() != "body 1" {
+		t.Fatalf("GET of stale object expected the stale 200 'body 1', actual %v '%v'", w.Code, w.Body.String())
+	}
+	for i := 0; i < 100 && origin.Reqs() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if origin.Reqs() != 2 {
+		t.Fatalf("GET of stale object expected a background revalidation, actual %v origin requests", origin.Reqs())
+	}
+}
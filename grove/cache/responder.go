@@ -15,12 +15,15 @@ package cache
 */
 
 import (
+	"io"
 	"net/http"
 
 	"github.com/apache/trafficcontrol/grove/cachedata"
+	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/plugin"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/trace"
 	"github.com/apache/trafficcontrol/grove/web"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
@@ -36,6 +39,8 @@ type Responder struct {
 	Stats         stat.Stats
 	F             RespondFunc
 	ResponseCode  *int
+	// BodyReader is the reader the body is copied from, if the body is nil when Do() is called. It may be replaced after the response is set, e.g. by plugins which transform the body as it's sent.
+	BodyReader io.Reader
 	cachedata.ParentRespData
 	cachedata.SrvrData
 	cachedata.ReqData
@@ -79,10 +84,31 @@ func NewResponder(w http.ResponseWriter, pluginCfg map[string]interface{}, plugi
 
 // SetResponse is a helper which sets the RespondFunc of r to `web.Respond` with the given code, headers, body, and connectionClose. Note it takes a pointer to the headers and body, which may be modified after calling this but before the Do() sends the response.
 func (r *Responder) SetResponse(code *int, hdrs *http.Header, body *[]byte, connectionClose bool) {
+	r.SetStreamResponse(code, hdrs, body, nil, connectionClose)
+}
+
+// SetStreamResponse is like SetResponse, but if the body is nil when Do() is called, and the stream is not nil, the body is copied from the stream to the client as it's received from the parent.
+// The body takes precedence, so plugins which replace the body (for example, to serve a range) are respected.
+func (r *Responder) SetStreamResponse(code *int, hdrs *http.Header, body *[]byte, stream *cacheobj.Stream, connectionClose bool) {
+	reader := io.Reader(nil)
+	if stream != nil {
+		reader = stream.NewReader()
+	}
+	r.SetReaderResponse(code, hdrs, body, reader, connectionClose)
+}
+
+// SetReaderResponse is like SetStreamResponse, but the body is read from the given reader, if the body is nil when Do() is called.
+func (r *Responder) SetReaderResponse(code *int, hdrs *http.Header, body *[]byte, reader io.Reader, connectionClose bool) {
 	r.ResponseCode = code
+	r.BodyReader = reader
 	r.F = func() (uint64, error) {
+		reader := r.BodyReader
 		if r.Req.Method == http.MethodHead {
 			*body = nil
+			reader = nil
+		}
+		if *body == nil && reader != nil && web.BodyAllowed(*code) {
+			return web.RespondStream(r.W, *code, *hdrs, reader, connectionClose)
 		}
 		return web.Respond(r.W, *code, *hdrs, *body, connectionClose)
 	}
@@ -93,11 +119,16 @@ func (r *Responder) SetResponse(code *int, hdrs *http.Header, body *[]byte, conn
 // For parent connect failures, originCode should be 0.
 func (r *Responder) Do() {
 	// TODO move plugins.BeforeRespond here? How do we distinguish between success, and know to set headers? r.OriginReqSuccess?
+	_, span := trace.Start(r.Req.Context(), "client write", trace.SpanKindInternal)
 	bytesSent, err := r.F()
 	if err != nil {
 		log.Errorf("%s %s %s %v : responding: %v", r.Req.RemoteAddr, r.Req.Method, r.Req.RequestURI, r.ResponseCode, err.Error())
+		span.SetError(err.Error())
 	}
 	web.TryFlush(r.W) // TODO remove? Let plugins do it, if they need to?
+	span.SetAttribute("grove.bytes_sent", bytesSent)
+	span.End()
+	trace.FromContext(r.Req.Context()).SetAttribute("http.response.status_code", *r.ResponseCode)
 
 	respSuccess := err != nil
 	respData := cachedata.RespData{*r.ResponseCode, bytesSent, respSuccess, isCacheHit(r.Reuse, r.OriginCode)}
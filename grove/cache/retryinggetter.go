@@ -16,15 +16,20 @@ package cache
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/remap"
 	"github.com/apache/trafficcontrol/grove/rfc"
+	"github.com/apache/trafficcontrol/grove/sibling"
 	"github.com/apache/trafficcontrol/grove/thread"
+	"github.com/apache/trafficcontrol/grove/trace"
 	"github.com/apache/trafficcontrol/grove/web"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
@@ -54,15 +59,35 @@ func NewRetrier(h *Handler, reqHdr http.Header, reqTime time.Time, reqCacheContr
 // Get takes the HTTP request and the cached object if there is one, and makes a new request, retrying according to its RemappingProducer. If no cached object exists, pass a nil obj.
 // Along with the cacheobj.CacheObj, a string pointer to the request hostname used to fetch the cacheobj.CacheObj is returned.
 func (r *Retrier) Get(req *http.Request, obj *cacheobj.CacheObj) (*cacheobj.CacheObj, *string, error) {
+	if siblingObj, siblingHost, ok := r.getFromSibling(req, obj); ok {
+		return siblingObj, siblingHost, nil
+	}
+
 	retryGetFunc := func(remapping remap.Remapping, retryFailures bool, obj *cacheobj.CacheObj) *cacheobj.CacheObj {
 		// return true for Revalidate, and issue revalidate requests separately.
 		canReuse := func(cacheObj *cacheobj.CacheObj) bool {
 			return rfc.CanReuse(r.ReqHdr, r.ReqCacheControl, cacheObj, r.H.strictRFC, true)
 		}
+		// only the request which actually gets from the parent reports its health, not requests collapsed onto it by the getter.
 		getAndCache := func() *cacheobj.CacheObj {
-			return GetAndCache(remapping.Request, remapping.ProxyURL, remapping.CacheKey, remapping.Name, remapping.Request.Header, r.ReqTime, r.H.strictRFC, remapping.Cache, r.H.ruleThrottlers[remapping.Name], obj, remapping.Timeout, retryFailures, remapping.RetryNum, remapping.RetryCodes, remapping.Transport, r.ReqID)
+			start := time.Now()
+			if r.H.siblings != nil {
+				remapping.Request.Header.Del(sibling.Header) // the parent request's headers are copied from the client request, which may be from a sibling, and parents don't need to know
+			}
+			parentReq := r.H.stats.ParentConns().Trace(remapping.Request)
+			parentObj := (*cacheobj.CacheObj)(nil)
+			remapping.Streams.Throttle(func() {
+				parentObj = GetAndCache(parentReq, remapping.ProxyURL, remapping.CacheKey, remapping.Name, parentReq.Header, r.ReqTime, r.H.strictRFC, remapping.Cache, r.H.ruleThrottlers[remapping.Name], obj, remapping.Timeout, retryFailures, remapping.RetryNum, remapping.RetryCodes, remapping.Transport, remapping.Stream, r.ReqID)
+			})
+			failed := isFailure(parentObj, remapping.RetryCodes)
+			remapping.ParentHealth.Report(!failed, time.Since(start))
+			if remapStats, ok := r.H.stats.Remap().Stats(req.Host); failed && ok {
+				remapStats.AddParentFailure()
+			}
+			return parentObj
 		}
 		gotObj, getReqID := r.H.getter.Get(remapping.CacheKey, getAndCache, canReuse, r.ReqID)
+		trace.FromContext(remapping.Request.Context()).SetAttribute("grove.collapsed", getReqID != r.ReqID)
 
 		req := remapping.Request
 		log.Debugf("Retrier.Get Y URI %v %v %v remapping.CacheKey %v rule %v parent %v code %v headers %+v len(body) %v getterid %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), remapping.CacheKey, remapping.Name, remapping.ProxyURL, gotObj.Code, gotObj.RespHeaders, len(gotObj.Body), getReqID, r.ReqID)
@@ -73,12 +98,52 @@ func (r *Retrier) Get(req *http.Request, obj *cacheobj.CacheObj) (*cacheobj.Cach
 	return retryingGet(retryGetFunc, req, r.RemappingProducer, obj)
 }
 
+// getFromSibling requests the object from the sibling which owns it, if sibling lookup is enabled, and another sibling owns the object. Along with the object, the sibling address is returned.
+// Returns false if the object should be requested from the parent instead, because this Grove owns it, the request came from a sibling, or the sibling failed.
+// Only HTTP requests are sent to siblings, because the sibling request is HTTP, and would be remapped by a different rule than an HTTPS request.
+func (r *Retrier) getFromSibling(req *http.Request, obj *cacheobj.CacheObj) (*cacheobj.CacheObj, *string, bool) {
+	fromSibling := req.Header.Get(sibling.Header) != ""
+	if r.H.siblings == nil || fromSibling || r.H.scheme != "http" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil, nil, false
+	}
+
+	cacheKey := r.RemappingProducer.CacheKey()
+	owner, health, ok := r.H.siblings.Owner(cacheKey)
+	if !ok {
+		return nil, nil, false
+	}
+	siblingReq, err := sibling.Request(owner, req)
+	if err != nil {
+		log.Errorf("sibling request for '%v' to '%v': %v (reqid %v)\n", cacheKey, owner, err, r.ReqID)
+		return nil, nil, false
+	}
+
+	name := r.RemappingProducer.Name()
+	retryCodes := r.RemappingProducer.RetryCodes()
+	canReuse := func(cacheObj *cacheobj.CacheObj) bool {
+		return rfc.CanReuse(r.ReqHdr, r.ReqCacheControl, cacheObj, r.H.strictRFC, true)
+	}
+	getAndCache := func() *cacheobj.CacheObj {
+		start := time.Now()
+		siblingObj := GetAndCache(siblingReq, nil, cacheKey, name, siblingReq.Header, r.ReqTime, r.H.strictRFC, r.RemappingProducer.Cache(), r.H.ruleThrottlers[name], obj, 0, false, 0, retryCodes, r.H.siblings.Transport(), r.RemappingProducer.Stream(), r.ReqID)
+		health.Report(!isFailure(siblingObj, retryCodes), time.Since(start))
+		return siblingObj
+	}
+	siblingObj, _ := r.H.getter.Get(cacheKey, getAndCache, canReuse, r.ReqID)
+	if isFailure(siblingObj, retryCodes) {
+		log.Warnf("sibling '%v' failed for '%v' with code %v, requesting from parent (reqid %v)\n", owner, cacheKey, siblingObj.Code, r.ReqID)
+		return nil, nil, false
+	}
+	log.Debugf("Retrier.Get '%v' from sibling '%v' code %v (reqid %v)\n", cacheKey, owner, siblingObj.Code, r.ReqID)
+	return siblingObj, &owner, true
+}
+
 // retryingGet takes a function, and retries failures up to the RemappingProducer RetryNum limit. On failure, it creates a new remapping. The func f should use `remapping` to make its request. If it hits failures up to the limit, it returns the last received cacheobj.CacheObj
 // Along with the cacheobj.CacheObj, a string pointer to the request hostname used to fetch the cacheobj.CacheObj is returned.
 // TODO refactor to not close variables - it's awkward and confusing.
 func retryingGet(getCacheObj func(remapping remap.Remapping, retryFailures bool, obj *cacheobj.CacheObj) *cacheobj.CacheObj, request *http.Request, remappingProducer *remap.RemappingProducer, cachedObj *cacheobj.CacheObj) (*cacheobj.CacheObj, *string, error) {
 	obj := (*cacheobj.CacheObj)(nil)
-	for {
+	for attempt := 1; ; attempt++ {
 		remapping, retryAllowed, err := remappingProducer.GetNext(request)
 		if err == remap.ErrNoMoreRetries {
 			if obj == nil {
@@ -88,8 +153,23 @@ func retryingGet(getCacheObj func(remapping remap.Remapping, retryFailures bool,
 		} else if err != nil {
 			return nil, nil, err
 		}
+		// Each attempt is its own span, which the parent continues. The span isn't given the client request's context, because collapsed requests may share the parent request, which must not be canceled if this client disconnects.
+		if _, span := trace.Start(request.Context(), "parent request", trace.SpanKindClient); span != nil {
+			remapping.Request = remapping.Request.WithContext(trace.ContextWithSpan(remapping.Request.Context(), span))
+			trace.Inject(remapping.Request)
+			span.SetAttribute("url.full", remapping.Request.URL.String())
+			span.SetAttribute("grove.parent.attempt", attempt)
+		}
 		obj = getCacheObj(remapping, retryAllowed, cachedObj)
-		if !isFailure(obj, remapping.RetryCodes) {
+		failed := isFailure(obj, remapping.RetryCodes)
+		if span := trace.FromContext(remapping.Request.Context()); span != nil {
+			span.SetAttribute("http.response.status_code", obj.Code)
+			if failed {
+				span.SetError("parent failed with code " + strconv.Itoa(obj.Code))
+			}
+			span.End()
+		}
+		if !failed {
 			return obj, &remapping.Request.URL.Host, nil
 		}
 	}
@@ -104,6 +184,7 @@ const ModifiedSinceHdr = "If-Modified-Since"
 
 // GetAndCache makes a client request for the given `http.Request` and caches it if `CanCache`.
 // THe `ruleThrottler` may be nil, in which case the request will be unthrottled.
+// If stream is true, the returned object may be streaming, in which case it's returned as soon as the parent headers are received, and the body is read into its Stream in the background and cached once complete.
 func GetAndCache(
 	req *http.Request,
 	proxyURL *url.URL,
@@ -120,10 +201,12 @@ func GetAndCache(
 	retryNum int,
 	retryCodes map[int]struct{},
 	transport *http.Transport,
+	stream bool,
 	reqID uint64,
 ) *cacheobj.CacheObj {
 	// TODO this is awkward, with 'revalidateObj' indicating whether the request is a Revalidate. Should Getting and Caching be split up? How?
-	get := func() *cacheobj.CacheObj {
+	// get returns the object, and if the object is streaming, a func which must be called to fill the stream from the parent and cache the completed object.
+	get := func() (*cacheobj.CacheObj, func()) {
 		// TODO figure out why respReqTime isn't used by rules
 		log.Debugf("GetAndCache calling request %v %v %v %v %v (reqid %v)\n", req.Method, req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), req.Header, reqID)
 		// TODO Verify overriding the passed reqTime is the right thing to do
@@ -136,17 +219,31 @@ func GetAndCache(
 		} else {
 			req.Header.Del(ModifiedSinceHdr)
 		}
-		respCode, respHeader, respBody, reqTime, reqRespTime, err := web.Request(transport, req)
-		log.Debugf("GetAndCache web.Request URI %v %v %v cacheKey %v rule %v parent %v error %v reval %v code %v len(body) %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, err, revalidateObj != nil, respCode, len(respBody), reqID)
+		respCode, respHeader, respBodyReader, contentLength, reqTime, reqRespTime, err := web.RequestStream(transport, req)
+
+		_, isRetryCode := retryCodes[respCode]
+		isNotModified := revalidateObj != nil && respCode == http.StatusNotModified
+		streamBody := err == nil && stream && web.BodyAllowed(respCode) && !(isRetryCode && !cacheFailure) && !isNotModified
+
+		respBody := []byte(nil)
+		if err == nil && !streamBody {
+			respBody, err = ioutil.ReadAll(respBodyReader)
+			respBodyReader.Close()
+			if err != nil {
+				respCode, respHeader, respBody = 0, nil, nil
+				err = errors.New("reading response body: " + err.Error())
+			}
+		}
+		log.Debugf("GetAndCache web.Request URI %v %v %v cacheKey %v rule %v parent %v error %v reval %v code %v len(body) %v stream %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, err, revalidateObj != nil, respCode, len(respBody), streamBody, reqID)
 
 		if err != nil {
 			log.Errorf("Parent error for URI %v %v %v cacheKey %v rule %v parent %v error %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, err, reqID)
 			code := CodeConnectFailure
 			body := []byte(http.StatusText(code))
-			return cacheobj.New(reqHeader, body, code, code, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{})
+			return cacheobj.New(reqHeader, body, code, code, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{}), nil
 		}
-		if _, ok := retryCodes[respCode]; ok && !cacheFailure {
-			return cacheobj.New(reqHeader, respBody, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{})
+		if isRetryCode && !cacheFailure {
+			return cacheobj.New(reqHeader, respBody, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{}), nil
 		}
 
 		log.Debugf("GetAndCache request returned %v headers %+v (reqid %v)\n", respCode, respHeader, reqID)
@@ -161,14 +258,40 @@ func GetAndCache(
 			lastModified = respRespTime
 		}
 
+		if streamBody {
+			log.Debugf("GetAndCache streaming %v content-length %v (reqid %v)\n", cacheKey, contentLength, reqID)
+			canCache := rfc.CanCache(req.Method, reqHeader, respCode, respHeader, strictRFC)
+			bodyStream := (*cacheobj.Stream)(nil)
+			if canCache {
+				bodyStream = cacheobj.NewStream(contentLength)
+			} else {
+				bodyStream = cacheobj.NewDiscardingStream() // uncacheable bodies are only kept until they're sent to the client
+			}
+			obj := cacheobj.NewStreaming(reqHeader, bodyStream, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, respRespTime, lastModified)
+			fill := func() {
+				fillStream(bodyStream, respBodyReader)
+				body, err := bodyStream.Wait()
+				if err != nil {
+					log.Errorf("Parent error streaming URI %v %v %v cacheKey %v rule %v parent %v after %v bytes, not caching: %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, bodyStream.Len(), err, reqID)
+					return
+				}
+				if !canCache {
+					return
+				}
+				log.Debugf("GetAndCache stream complete, adding %v len(body) %v (reqid %v)\n", cacheKey, len(body), reqID)
+				AddVariant(cache, cacheKey, obj.Complete(body))
+			}
+			return obj, fill
+		}
+
 		obj := (*cacheobj.CacheObj)(nil)
 		log.Debugf("h.cache.Add %v (reqid %v)\n", cacheKey, reqID)
 		log.Debugf("GetAndCache respCode %v (reqid %v)\n", respCode, reqID)
-		if revalidateObj == nil || respCode != http.StatusNotModified {
+		if !isNotModified {
 			log.Debugf("GetAndCache new %v (reqid %v)\n", cacheKey, reqID)
 			obj = cacheobj.New(reqHeader, respBody, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, respRespTime, lastModified)
 			if !rfc.CanCache(req.Method, reqHeader, respCode, respHeader, strictRFC) {
-				return obj // return without caching
+				return obj, nil // return without caching
 			}
 		} else {
 			log.Debugf("GetAndCache revalidating %v len(revalidateObj.Body) %v (reqid %v)\n", cacheKey, len(revalidateObj.Body), reqID)
@@ -191,8 +314,8 @@ func GetAndCache(
 				HitCount:         revalidateObj.HitCount, // no need to +1 here, the cache Get did that
 			}
 		}
-		cache.Add(cacheKey, obj) // TODO store pointer?
-		return obj
+		AddVariant(cache, cacheKey, obj) // TODO store pointer?
+		return obj, nil
 	}
 
 	c := (*cacheobj.CacheObj)(nil)
@@ -200,6 +323,39 @@ func GetAndCache(
 		log.Errorf("rule %v not in ruleThrottlers map. Requesting with no origin limit! (reqid %v)\n", remapName, reqID)
 		ruleThrottler = thread.NewNoThrottler()
 	}
-	ruleThrottler.Throttle(func() { c = get() })
-	return c
+	if !stream {
+		ruleThrottler.Throttle(func() { c, _ = get() })
+		return c
+	}
+
+	// Streams hold the rule throttler until the fill is complete, so they count against the rule's concurrent parent requests for the whole transfer, but the object is returned as soon as the headers are received.
+	objChan := make(chan *cacheobj.CacheObj, 1)
+	go ruleThrottler.Throttle(func() {
+		obj, fill := get()
+		objChan <- obj
+		if fill != nil {
+			fill()
+		}
+	})
+	return <-objChan
+}
+
+// fillStream reads the parent response body into the stream until the body is exhausted, then closes both.
+func fillStream(s *cacheobj.Stream, body io.ReadCloser) {
+	defer body.Close()
+	buf := make([]byte, web.StreamBufferBytes)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			s.Write(buf[:n])
+		}
+		if err == io.EOF {
+			s.Close(nil)
+			return
+		}
+		if err != nil {
+			s.Close(errors.New("reading response body: " + err.Error()))
+			return
+		}
+	}
 }
@@ -0,0 +1,81 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/rfc"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// GetVariant gets the object for the given key from the cache. If the object stored under the key is a Vary index, the variant selected by the given request headers is returned instead, per RFC7234§4.1.
+// This updates the lru-ness and hitcount of both the index and the variant, as icache.Cache.Get does.
+func GetVariant(cache icache.Cache, key string, reqHdr http.Header) (*cacheobj.CacheObj, bool) {
+	obj, ok := cache.Get(key)
+	if !ok || !obj.IsVaryIndex() {
+		return obj, ok
+	}
+	variantKey := rfc.VaryKey(key, obj.VaryHeaders, reqHdr)
+	log.Debugf("GetVariant '%v' is a vary index, getting variant '%v'\n", key, variantKey)
+	return cache.Get(variantKey)
+}
+
+// AddVariant adds the given object to the cache. If the object's response has a Vary header, the object is stored under its secondary key, and a Vary index is stored under the given primary key, so multiple variants of the same URL may be cached at once. The index is fresh for as long as the freshest of its variants, so it isn't expired before them.
+// Responses with `Vary: *` are stored under the primary key, as they can never be reused without revalidation anyway.
+func AddVariant(cache icache.Cache, key string, obj *cacheobj.CacheObj) {
+	varyHdrs := rfc.VaryHeaders(obj.RespHeaders)
+	if len(varyHdrs) == 0 || rfc.VaryAny(obj.RespHeaders) {
+		cache.Add(key, obj)
+		return
+	}
+	variantKey := rfc.VaryKey(key, varyHdrs, obj.ReqHeaders)
+	log.Debugf("AddVariant '%v' varies on %+v, adding variant '%v'\n", key, varyHdrs, variantKey)
+	cache.Add(variantKey, obj)
+	index := cacheobj.NewVaryIndex(varyHdrs, obj)
+	if oldIndex, ok := cache.Peek(key); ok && oldIndex.IsVaryIndex() && freshFor(oldIndex) > freshFor(index) {
+		index = cacheobj.NewVaryIndex(varyHdrs, oldIndex)
+	}
+	cache.Add(key, index)
+}
+
+// freshFor returns how much longer the given object is fresh.
+func freshFor(obj *cacheobj.CacheObj) time.Duration {
+	return rfc.FreshFor(obj.RespHeaders, obj.RespCacheControl, obj.ReqRespTime, obj.RespRespTime)
+}
+
+// RemoveVariant removes the given key from the cache. If the object stored under the key is a Vary index, all its variants are removed as well, so they can't be resurrected by a later index for the same key. Returns whether the key existed.
+// Removing variants requires iterating over all cache keys, and is therefore expensive for large caches.
+func RemoveVariant(cache icache.Cache, key string) bool {
+	obj, ok := cache.Peek(key)
+	if !ok {
+		return false
+	}
+	if obj.IsVaryIndex() {
+		prefix := key + rfc.VaryKeySeparator
+		for _, k := range cache.Keys() {
+			if strings.HasPrefix(k, prefix) {
+				log.Debugf("RemoveVariant '%v' removing variant '%v'\n", key, k)
+				cache.Remove(k)
+			}
+		}
+	}
+	return cache.Remove(key)
+}
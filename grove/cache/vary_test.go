@@ -0,0 +1,80 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/memcache"
+)
+
+func TestRemoveVariant(t *testing.T) {
+	c := memcache.New(1024 * 1024)
+	now := time.Now()
+	newObj := func(lang string) *cacheobj.CacheObj {
+		reqHdr := http.Header{"Accept-Language": {lang}}
+		respHdr := http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept-Language"}}
+		return cacheobj.New(reqHdr, []byte(lang), http.StatusOK, http.StatusOK, "", respHdr, now, now, now, now)
+	}
+	AddVariant(c, "key", newObj("en"))
+	AddVariant(c, "key", newObj("fr"))
+	c.Add("keyother", newObj("en"))
+	if len(c.Keys()) != 4 {
+		t.Fatalf("expected an index, 2 variants, and another key, actual keys %v", c.Keys())
+	}
+
+	if !RemoveVariant(c, "key") {
+		t.Errorf("RemoveVariant of existing key expected true, actual false")
+	}
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != "keyother" {
+		t.Errorf("RemoveVariant expected to remove the index and all variants, but not other keys, actual keys %v", keys)
+	}
+	if RemoveVariant(c, "key") {
+		t.Errorf("RemoveVariant of removed key expected false, actual true")
+	}
+}
+
+func TestAddVariantIndexFreshness(t *testing.T) {
+	c := memcache.New(1024 * 1024)
+	now := time.Now()
+	newObj := func(lang string, maxAge string) *cacheobj.CacheObj {
+		reqHdr := http.Header{"Accept-Language": {lang}}
+		respHdr := http.Header{"Cache-Control": {"max-age=" + maxAge}, "Vary": {"Accept-Language"}}
+		return cacheobj.New(reqHdr, []byte(lang), http.StatusOK, http.StatusOK, "", respHdr, now, now, now, now)
+	}
+	indexFreshFor := func() time.Duration {
+		index, ok := c.Peek("key")
+		if !ok || !index.IsVaryIndex() {
+			t.Fatalf("expected a vary index, actual %+v", index)
+		}
+		return freshFor(index)
+	}
+
+	AddVariant(c, "key", newObj("en", "60"))
+	if fresh := indexFreshFor(); fresh <= 0 || fresh > time.Minute {
+		t.Errorf("index expected to be fresh for the variant's 60s, actual %v", fresh)
+	}
+	AddVariant(c, "key", newObj("fr", "3600"))
+	if fresh := indexFreshFor(); fresh <= time.Minute || fresh > time.Hour {
+		t.Errorf("index expected to be fresh for the fresher variant's 3600s, actual %v", fresh)
+	}
+	AddVariant(c, "key", newObj("de", "10"))
+	if fresh := indexFreshFor(); fresh <= time.Minute || fresh > time.Hour {
+		t.Errorf("index expected to keep the freshest variant's 3600s, actual %v", fresh)
+	}
+}
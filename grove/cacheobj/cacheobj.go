@@ -35,12 +35,39 @@ type CacheObj struct {
 	LastModified     time.Time // the origin LastModified if it exists, or Date if it doesn't
 	Size             uint64
 	HitCount         uint64 // the number of times this object was hit
+	// VaryHeaders is the list of request header names the origin response varies on, if this object is a Vary index rather than a response. The response variants are stored under secondary keys, see rfc.VaryKey.
+	VaryHeaders []string
+	// stream is the body being received from the parent, if the object is still being filled. Streaming objects have a nil Body, and are never stored in a cache; see Complete. This is unexported, so gob encoding by disk caches ignores it.
+	stream *Stream
+}
+
+// Stream returns the body being received from the parent, or nil if this object is not streaming, in which case the Body is complete.
+func (c CacheObj) Stream() *Stream {
+	return c.stream
+}
+
+// Complete returns a copy of this streaming object with the given complete body, suitable for storing in a cache.
+func (c CacheObj) Complete(body []byte) *CacheObj {
+	obj := c
+	obj.Body = body
+	obj.stream = nil
+	obj.Size = obj.ComputeSize()
+	return &obj
+}
+
+// IsVaryIndex returns whether this object is a Vary index, pointing to response variants stored under secondary keys, rather than a response itself.
+func (c CacheObj) IsVaryIndex() bool {
+	return len(c.VaryHeaders) > 0
 }
 
 // ComputeSize computes the size of the given CacheObj. This computation is expensive, as the headers must be iterated over. Thus, the size should be computed once and stored, not computed on-the-fly for every new request for the cached object.
 func (c CacheObj) ComputeSize() uint64 {
 	// TODO include headers size
-	return uint64(len(c.Body))
+	size := uint64(len(c.Body))
+	for _, name := range c.VaryHeaders {
+		size += uint64(len(name))
+	}
+	return size
 }
 
 func New(reqHeader http.Header, bytes []byte, code int, originCode int, proxyURL string, respHeader http.Header, reqTime time.Time, reqRespTime time.Time, respRespTime time.Time, lastModified time.Time) *CacheObj {
@@ -63,3 +90,39 @@ func New(reqHeader http.Header, bytes []byte, code int, originCode int, proxyURL
 	obj.Size = obj.ComputeSize()
 	return obj
 }
+
+// NewStreaming creates a new CacheObj whose body is still being received into the given stream. The Size is computed when the stream is complete; see Complete.
+func NewStreaming(reqHeader http.Header, stream *Stream, code int, originCode int, proxyURL string, respHeader http.Header, reqTime time.Time, reqRespTime time.Time, respRespTime time.Time, lastModified time.Time) *CacheObj {
+	obj := New(reqHeader, nil, code, originCode, proxyURL, respHeader, reqTime, reqRespTime, respRespTime, lastModified)
+	obj.stream = stream
+	return obj
+}
+
+// freshnessHeaders are the response headers which determine an object's freshness, per RFC7234§4.2.
+var freshnessHeaders = []string{"Cache-Control", "Expires", "Date", "Age", "Last-Modified"}
+
+// NewVaryIndex creates a Vary index object for the given variant. The index is stored under the primary cache key, and records the request headers the variant's response varies on, so the secondary key of the variant for any request can be computed.
+// The index has the variant's freshness, so caches which expire objects keep it as long as the variant. The variant may also be another index, to keep its freshness.
+func NewVaryIndex(varyHeaders []string, variant *CacheObj) *CacheObj {
+	respHeaders := http.Header{}
+	for _, name := range freshnessHeaders {
+		if vals, ok := variant.RespHeaders[name]; ok {
+			respHeaders[name] = append([]string(nil), vals...)
+		}
+	}
+	obj := &CacheObj{
+		RespHeaders:      respHeaders,
+		RespCacheControl: variant.RespCacheControl,
+		Code:             variant.Code,
+		OriginCode:       variant.OriginCode,
+		ProxyURL:         variant.ProxyURL,
+		ReqTime:          variant.ReqTime,
+		ReqRespTime:      variant.ReqRespTime,
+		RespRespTime:     variant.RespRespTime,
+		LastModified:     variant.LastModified,
+		HitCount:         1,
+		VaryHeaders:      varyHeaders,
+	}
+	obj.Size = obj.ComputeSize()
+	return obj
+}
@@ -0,0 +1,145 @@
+package cacheobj
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// MaxStreamSizeHint is the largest buffer preallocated for a Stream. Larger bodies grow the buffer as they're received, so a wrong or huge Content-Length can't allocate before any bytes arrive.
+const MaxStreamSizeHint = 4 * 1024 * 1024
+
+// ErrStreamDiscarded is returned by the reader of a discarding Stream, if the Stream already has a reader, whose reads discarded the bytes.
+var ErrStreamDiscarded = errors.New("stream already read")
+
+// Stream is a response body which is still being received from a parent. It is written by a single filler, and may be read by any number of readers concurrently, each of which reads from the beginning and blocks until more bytes arrive or the fill finishes.
+//
+// A discarding Stream, for bodies which won't be cached, may only be read by a single reader, and discards bytes once they're read, so the body isn't kept in memory.
+type Stream struct {
+	buf       []byte
+	discard   bool
+	discarded int  // the number of bytes read and discarded from the front of buf, if discard
+	read      bool // whether a reader was created, if discard
+	done      bool
+	err       error
+	m         sync.Mutex
+	cond      *sync.Cond
+}
+
+// NewStream creates a new Stream. The sizeHint is the expected body size, e.g. from the Content-Length, which is used to preallocate the buffer, up to MaxStreamSizeHint. It may be 0 if unknown.
+func NewStream(sizeHint int64) *Stream {
+	s := &Stream{}
+	if sizeHint > MaxStreamSizeHint {
+		sizeHint = MaxStreamSizeHint
+	}
+	if sizeHint > 0 {
+		s.buf = make([]byte, 0, sizeHint)
+	}
+	s.cond = sync.NewCond(&s.m)
+	return s
+}
+
+// NewDiscardingStream creates a new discarding Stream, which may only be read by a single reader, and discards bytes once they're read.
+func NewDiscardingStream() *Stream {
+	s := NewStream(0)
+	s.discard = true
+	return s
+}
+
+// Discarding returns whether the stream discards bytes once they're read, and thus may only have a single reader.
+func (s *Stream) Discarding() bool { return s.discard }
+
+// Write appends p to the stream, and wakes any readers waiting for more bytes. Write must not be called after Close.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.m.Lock()
+	s.buf = append(s.buf, p...)
+	s.m.Unlock()
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close finishes the stream. If err is not nil, the fill failed, and readers will get err after reading the bytes received so far.
+func (s *Stream) Close(err error) {
+	s.m.Lock()
+	s.done = true
+	s.err = err
+	s.m.Unlock()
+	s.cond.Broadcast()
+}
+
+// Wait blocks until the stream is finished, and returns the complete body, and any fill error. If the stream is discarding, only the bytes which haven't been read are returned.
+func (s *Stream) Wait() ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for !s.done {
+		s.cond.Wait()
+	}
+	return s.buf, s.err
+}
+
+// Len returns the number of bytes received so far, including any discarded.
+func (s *Stream) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.discarded + len(s.buf)
+}
+
+// NewReader returns a reader of the stream from the beginning. Reads block until bytes are available, and return io.EOF once the stream finishes successfully. If the stream is discarding and already has a reader, reads return ErrStreamDiscarded.
+func (s *Stream) NewReader() io.Reader {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.discard && s.read {
+		return &streamReader{s: s, err: ErrStreamDiscarded}
+	}
+	s.read = true
+	return &streamReader{s: s}
+}
+
+type streamReader struct {
+	s   *Stream
+	off int
+	err error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	r.s.m.Lock()
+	defer r.s.m.Unlock()
+	for r.off >= len(r.s.buf) && !r.s.done {
+		r.s.cond.Wait()
+	}
+	if r.off >= len(r.s.buf) {
+		if r.s.err != nil {
+			return 0, r.s.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, r.s.buf[r.off:])
+	r.off += n
+	if r.s.discard {
+		// the reader's offset is always the front of the buffer. The read bytes are released when the reader catches up, or once append reallocates.
+		r.s.discarded += r.off
+		r.s.buf = r.s.buf[r.off:]
+		if len(r.s.buf) == 0 {
+			r.s.buf = nil
+		}
+		r.off = 0
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package cacheobj
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	s := NewStream(0)
+
+	// readers started before, during, and after the fill must all get the whole body
+	numReaders := 10
+	results := make([][]byte, numReaders)
+	wg := sync.WaitGroup{}
+	startReader := func(i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := ioutil.ReadAll(s.NewReader())
+			if err != nil {
+				t.Errorf("reader %v expected nil error, actual %v", i, err)
+			}
+			results[i] = b
+		}()
+	}
+
+	for i := 0; i < numReaders/2; i++ {
+		startReader(i)
+	}
+	s.Write([]byte("foo"))
+	for i := numReaders / 2; i < numReaders-1; i++ {
+		startReader(i)
+	}
+	s.Write([]byte("bar"))
+	s.Close(nil)
+	startReader(numReaders - 1)
+	wg.Wait()
+
+	for i, b := range results {
+		if string(b) != "foobar" {
+			t.Errorf("reader %v expected 'foobar', actual '%s'", i, b)
+		}
+	}
+	if body, err := s.Wait(); err != nil || string(body) != "foobar" {
+		t.Errorf("Wait expected 'foobar' nil, actual '%s' %v", body, err)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	s := NewStream(3)
+	s.Write([]byte("foo"))
+	fillErr := errors.New("parent went away")
+	s.Close(fillErr)
+
+	b, err := ioutil.ReadAll(s.NewReader())
+	if err != fillErr {
+		t.Errorf("expected fill error, actual %v", err)
+	}
+	if string(b) != "foo" {
+		t.Errorf("expected bytes received before error 'foo', actual '%s'", b)
+	}
+}
+
+func TestStreamSizeHint(t *testing.T) {
+	s := NewStream(1 << 50) // a huge Content-Length must not be allocated up front
+	if actual := cap(s.buf); actual != MaxStreamSizeHint {
+		t.Errorf("expected the preallocated buffer capped at %v, actual %v", MaxStreamSizeHint, actual)
+	}
+}
+
+func TestDiscardingStream(t *testing.T) {
+	s := NewDiscardingStream()
+	r := s.NewReader()
+	s.Write([]byte("foo"))
+	p := make([]byte, 10)
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "foo" {
+		t.Fatalf("expected 'foo' nil, actual '%s' %v", p[:n], err)
+	}
+	if s.buf != nil {
+		t.Errorf("expected read bytes to be discarded, actual buffer '%s'", s.buf)
+	}
+
+	s.Write([]byte("bar"))
+	s.Close(nil)
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "bar" {
+		t.Errorf("expected the rest 'bar' nil, actual '%s' %v", b, err)
+	}
+	if actual := s.Len(); actual != 6 {
+		t.Errorf("expected Len to count discarded bytes 6, actual %v", actual)
+	}
+	if _, err := ioutil.ReadAll(s.NewReader()); err != ErrStreamDiscarded {
+		t.Errorf("expected a second reader to get ErrStreamDiscarded, actual %v", err)
+	}
+}
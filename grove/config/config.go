@@ -61,6 +61,33 @@ type Config struct {
 	CacheFiles           map[string][]CacheFile `json:"cache_files"`
 	// FileMemBytes is the amount of memory to use as an LRU in front of each name in CacheFiles, that is, each named group of files. E.g. if there are 10 files, the amount of memory used will be 10*FileMemBytes+CacheSizeBytes.
 	FileMemBytes int `json:"file_mem_bytes"`
+	// CacheFilesExpiredGCIntervalMS is how often to remove expired objects from the CacheFiles, regardless of their size. If 0, expired objects are only removed when the size of a file exceeds its maximum, in least-recently-used order.
+	CacheFilesExpiredGCIntervalMS int `json:"cache_files_expired_gc_interval_ms"`
+	// CacheFilesExpiredGCGraceMS is how long an object must have been expired before it's removed by the expired GC. Expired objects may still be revalidated, or served stale per stale-while-revalidate and stale-if-error, so this should generally be at least as long as any rule's stale windows.
+	CacheFilesExpiredGCGraceMS int `json:"cache_files_expired_gc_grace_ms"`
+	// Siblings is the list of Grove caches which share cache misses, of the form "host:port", including this one. Each cache key is owned by one sibling, and misses for keys owned by another sibling are requested from it, rather than the parent. All siblings must have the same list. If empty, misses are always requested from the parent.
+	Siblings []string `json:"siblings"`
+	// SiblingSelf is the address of this Grove in Siblings.
+	SiblingSelf string `json:"sibling_self"`
+	// SiblingTimeoutMS is the timeout to connect to a sibling and receive its response headers. This should be short, because the parent is requested after a sibling fails.
+	SiblingTimeoutMS int `json:"sibling_timeout_ms"`
+	// SiblingMaxFailures is the number of consecutive failed requests after which a sibling is marked down, and its keys are requested from the parent.
+	SiblingMaxFailures int `json:"sibling_max_failures"`
+	// SiblingCooldownMS is how long a sibling is marked down, before it's tried again.
+	SiblingCooldownMS int `json:"sibling_cooldown_ms"`
+
+	// TracingExporter is where to export W3C trace spans: "file", "http", or empty to neither generate nor forward trace context.
+	TracingExporter string `json:"tracing_exporter"`
+	// TracingFile is the file the "file" exporter appends OTLP JSON span batches to, one per line.
+	TracingFile string `json:"tracing_file"`
+	// TracingEndpoint is the OTLP/HTTP traces endpoint the "http" exporter posts to, e.g. http://localhost:4318/v1/traces.
+	TracingEndpoint string `json:"tracing_endpoint"`
+	// TracingSampleRatio is the fraction of requests without an incoming traceparent which are sampled. Requests with a traceparent follow its sampled flag.
+	TracingSampleRatio float64 `json:"tracing_sample_ratio"`
+	// TracingFlushIntervalMS is how often buffered spans are exported.
+	TracingFlushIntervalMS int `json:"tracing_flush_interval_ms"`
+	// TracingTimeoutMS is the timeout of the "http" exporter's requests.
+	TracingTimeoutMS int `json:"tracing_timeout_ms"`
 }
 
 type CacheFile struct {
@@ -109,6 +136,12 @@ var DefaultConfig = Config{
 	ServerWriteTimeoutMS:   3 * MSPerSec,
 	ServerReadTimeoutMS:    3 * MSPerSec,
 	FileMemBytes:           bytesPerMebibyte * 100,
+	SiblingTimeoutMS:       1 * MSPerSec,
+	SiblingMaxFailures:     3,
+	SiblingCooldownMS:      10 * MSPerSec,
+	TracingSampleRatio:     1.0,
+	TracingFlushIntervalMS: 5 * MSPerSec,
+	TracingTimeoutMS:       10 * MSPerSec,
 }
 
 // LoadConfig loads the given config file. If an empty string is passed, the default config is returned.
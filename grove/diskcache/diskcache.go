@@ -18,11 +18,14 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/lru"
+	"github.com/apache/trafficcontrol/grove/rfc"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
 
@@ -34,10 +37,26 @@ type DiskCache struct {
 	sizeBytes    uint64
 	maxSizeBytes uint64
 	lru          *lru.LRU
+	touchM       sync.Mutex
+	touches      map[string]touch // metadata updates of gotten objects, not yet written
+	closing      chan struct{}
+	closed       chan struct{}
 }
 
 const BucketName = "b"
 
+// TouchFlushInterval is how often the last access times and hit counts of gotten objects are written to their metadata. Gets are frequent, so their updates are written together in one transaction, rather than each in its own.
+const TouchFlushInterval = time.Second
+
+// RecoverBatchSize is the number of metadata writes in each transaction of ResetAfterRestart, so recovering a large cache doesn't hold the database's write lock, blocking adds, for the entire recovery.
+const RecoverBatchSize = 1000
+
+// touch is the pending metadata update of an object which has been gotten.
+type touch struct {
+	lastAccess time.Time
+	hits       uint64
+}
+
 func New(path string, cacheSizeBytes uint64) (*DiskCache, error) {
 	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
@@ -45,37 +64,150 @@ func New(path string, cacheSizeBytes uint64) (*DiskCache, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte(BucketName)); err != nil {
-			return errors.New("creating bucket: " + err.Error())
+		for _, name := range []string{BucketName, MetaBucketName} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return errors.New("creating bucket '" + name + "': " + err.Error())
+			}
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, errors.New("creating bucket for database '" + path + "': " + err.Error())
+		return nil, errors.New("creating buckets for database '" + path + "': " + err.Error())
 	}
 
-	return &DiskCache{db: db, maxSizeBytes: cacheSizeBytes, lru: lru.NewLRU(), sizeBytes: 0}, nil
+	c := &DiskCache{
+		db:           db,
+		maxSizeBytes: cacheSizeBytes,
+		lru:          lru.NewLRU(),
+		sizeBytes:    0,
+		touches:      map[string]touch{},
+		closing:      make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	go c.flushTouchesEvery(TouchFlushInterval)
+	return c, nil
 }
 
-// ResetAfterRestart rebuilds the LRU with an arbirtrary order and sets sizeBytes. This seems crazy, but it is better than doing nothing, sice gc is based on the LRU and sizeBytes. In the future, we may want to periodically sync the LRU to disk, but we'll still need to iterate over all keys in the disk DB to avoid orphaning objects.
+// ResetAfterRestart rebuilds the LRU and sets sizeBytes from the metadata bucket, restoring the LRU order from each object's last access time. Object bodies are not read. Objects stored without metadata, e.g. by an older version, are given metadata and treated as the least recently used. Metadata without an object is deleted.
+// The rebuild is done in a goroutine, and metadata is written in transactions of RecoverBatchSize, so objects may be added while it runs. Objects added or gotten while it runs are kept as the most recently used.
 // Note: this assumes the LRU is empty. Don't run twice
 func (c *DiskCache) ResetAfterRestart() {
-	go c.db.View(func(tx *bolt.Tx) error {
+	go func() {
 		log.Infof("Starting cache recovery from disk for: %s... ", c.db.Path())
-		size := 0
-		b := tx.Bucket([]byte(BucketName))
+		if err := c.recover(); err != nil {
+			log.Errorln("DiskCache recovering '" + c.db.Path() + "': " + err.Error())
+			return
+		}
+		log.Infof("Cache recovery from disk for %s done (%d bytes). ", c.db.Path(), c.Size())
+	}()
+}
 
-		cursor := b.Cursor()
+type keyMeta struct {
+	key  string
+	meta ObjMeta
+}
 
+func (c *DiskCache) recover() error {
+	metas := []keyMeta{}
+	orphans := []string{}
+	missing := []keyMeta{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketName))
+		mb := tx.Bucket([]byte(MetaBucketName))
+		if b == nil || mb == nil {
+			return errors.New("bucket does not exist")
+		}
+		err := mb.ForEach(func(k, v []byte) error {
+			meta, err := decodeObjMeta(v)
+			if err != nil || b.Get(k) == nil {
+				orphans = append(orphans, string(k))
+				return nil
+			}
+			metas = append(metas, keyMeta{key: string(k), meta: meta})
+			return nil
+		})
+		if err != nil {
+			return errors.New("reading metadata: " + err.Error())
+		}
+		cursor := b.Cursor()
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			c.lru.Add(string(k), uint64(len(v)))
-			size += len(v)
+			if mb.Get(k) != nil {
+				continue
+			}
+			missing = append(missing, keyMeta{key: string(k), meta: ObjMeta{Size: uint64(len(v))}})
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		atomic.AddUint64(&c.sizeBytes, uint64(size))
-		log.Infof("Cache recovery from disk for %s done (%d bytes). ", c.db.Path(), c.sizeBytes)
+	// Objects may be added or removed between reading and writing, so each write checks the object and metadata haven't changed since they were read.
+	err = c.updateBatches(len(orphans), func(b *bolt.Bucket, mb *bolt.Bucket, i int) error {
+		k := []byte(orphans[i])
+		if _, err := decodeObjMeta(mb.Get(k)); err == nil && b.Get(k) != nil {
+			return nil
+		}
+		if err := mb.Delete(k); err != nil {
+			return errors.New("deleting orphaned metadata '" + orphans[i] + "': " + err.Error())
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	err = c.updateBatches(len(missing), func(b *bolt.Bucket, mb *bolt.Bucket, i int) error {
+		k := []byte(missing[i].key)
+		if mb.Get(k) != nil || b.Get(k) == nil {
+			return nil
+		}
+		if err := mb.Put(k, missing[i].meta.encode()); err != nil {
+			return errors.New("creating metadata '" + missing[i].key + "': " + err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(metas, func(i, j int) bool { return metas[i].meta.LastAccess.After(metas[j].meta.LastAccess) })
+	metas = append(metas, missing...) // objects without metadata have no access time, so they're treated as the oldest.
+
+	size := uint64(0)
+	for _, km := range metas {
+		if c.lru.AddOldest(km.key, km.meta.Size) {
+			size += km.meta.Size
+		}
+	}
+	atomic.AddUint64(&c.sizeBytes, size)
+	return nil
+}
+
+// updateBatches calls f for each i in [0, n), in write transactions of RecoverBatchSize, with the object and metadata buckets.
+func (c *DiskCache) updateBatches(n int, f func(b *bolt.Bucket, mb *bolt.Bucket, i int) error) error {
+	for start := 0; start < n; start += RecoverBatchSize {
+		end := start + RecoverBatchSize
+		if end > n {
+			end = n
+		}
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(BucketName))
+			mb := tx.Bucket([]byte(MetaBucketName))
+			if b == nil || mb == nil {
+				return errors.New("bucket does not exist")
+			}
+			for i := start; i < end; i++ {
+				if err := f(b, mb, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Add takes a key and value to add. Returns whether an eviction occurred
@@ -94,21 +226,33 @@ func (c *DiskCache) Add(key string, val *cacheobj.CacheObj) bool {
 	}
 	valBytes := buf.Bytes()
 
+	now := time.Now()
+	meta := ObjMeta{
+		Size:       uint64(len(valBytes)),
+		LastAccess: now,
+		Expiry:     now.Add(rfc.FreshFor(val.RespHeaders, val.RespCacheControl, val.ReqTime, val.ReqRespTime)),
+		HitCount:   val.HitCount,
+	}
+
 	err := c.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BucketName))
-		if b == nil {
+		mb := tx.Bucket([]byte(MetaBucketName))
+		if b == nil || mb == nil {
 			return errors.New("bucket does not exist")
 		}
-		return b.Put([]byte(key), valBytes)
+		if err := b.Put([]byte(key), valBytes); err != nil {
+			return err
+		}
+		return mb.Put([]byte(key), meta.encode())
 	})
 	if err != nil {
 		log.Errorln("DiskCache.Add inserting '" + key + "' in database: " + err.Error())
 		return eviction
 	}
 
-	c.lru.Add(key, uint64(len(valBytes)))
+	oldSizeBytes := c.lru.Add(key, meta.Size)
 
-	newSizeBytes := atomic.AddUint64(&c.sizeBytes, uint64(len(valBytes)))
+	newSizeBytes := atomic.AddUint64(&c.sizeBytes, meta.Size-oldSizeBytes)
 	if newSizeBytes > c.maxSizeBytes {
 		go c.gc(newSizeBytes)
 	}
@@ -131,16 +275,7 @@ func (c *DiskCache) gc(cacheSizeBytes uint64) {
 		}
 
 		log.Debugf("DiskCache.gc deleting key '" + key + "'")
-		err := c.db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(BucketName))
-			if b == nil {
-				return errors.New("bucket does not exist")
-			}
-			b.Delete([]byte(key))
-
-			return b.Delete([]byte(key))
-		})
-		if err != nil {
+		if err := c.db.Update(func(tx *bolt.Tx) error { return deleteKey(tx, key) }); err != nil {
 			log.Errorln("removing '" + key + "' from cache: " + err.Error())
 		}
 
@@ -148,58 +283,209 @@ func (c *DiskCache) gc(cacheSizeBytes uint64) {
 	}
 }
 
+// GCExpired removes all objects which have been expired for longer than grace, regardless of the cache size. Only metadata is read. Returns the number of objects removed.
+func (c *DiskCache) GCExpired(grace time.Duration) int {
+	now := time.Now()
+	expired := []string{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte(MetaBucketName))
+		if mb == nil {
+			return errors.New("bucket does not exist")
+		}
+		return mb.ForEach(func(k, v []byte) error {
+			if meta, err := decodeObjMeta(v); err == nil && meta.Expired(now, grace) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Errorln("DiskCache.GCExpired reading metadata for '" + c.db.Path() + "': " + err.Error())
+		return 0
+	}
+
+	removed := 0
+	for _, key := range expired {
+		if c.Remove(key) {
+			removed++
+		}
+	}
+	return removed
+}
+
 // Get takes a key, and returns its value, and whether it was found, and updates the lru-ness and hitcount
 func (c *DiskCache) Get(key string) (*cacheobj.CacheObj, bool) {
-	val, found := c.Peek(key)
-	if found {
-		c.lru.Add(key, val.Size) // TODO directly call c.ll.MoveToFront
-		log.Debugln("DiskCache.Get getting '" + key + "' from cache and updating LRU")
-		atomic.AddUint64(&val.HitCount, 1)
-		return val, true
+	val, meta, found := c.get(key)
+	if !found {
+		return nil, false
+	}
+	c.lru.Add(key, meta.Size) // TODO directly call c.ll.MoveToFront
+	log.Debugln("DiskCache.Get getting '" + key + "' from cache and updating LRU")
+	val.HitCount++
+	c.touch(key, time.Now())
+	return val, true
+}
+
+// touch records that the key was gotten at the given time. The key's metadata is updated by the next flushTouches.
+func (c *DiskCache) touch(key string, now time.Time) {
+	c.touchM.Lock()
+	defer c.touchM.Unlock()
+	t := c.touches[key]
+	if now.After(t.lastAccess) {
+		t.lastAccess = now
+	}
+	t.hits++
+	c.touches[key] = t
+}
+
+// flushTouchesEvery writes the pending touches every interval, until the cache is closed, when it writes them one last time.
+func (c *DiskCache) flushTouchesEvery(interval time.Duration) {
+	defer close(c.closed)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flushTouches()
+		case <-c.closing:
+			c.flushTouches()
+			return
+		}
 	}
-	return nil, false
+}
 
+// flushTouches updates the last access time and hit count of the metadata of all keys touched since the last flush, in a single transaction. Keys which were removed in the meantime are skipped.
+func (c *DiskCache) flushTouches() {
+	c.touchM.Lock()
+	touches := c.touches
+	c.touches = map[string]touch{}
+	c.touchM.Unlock()
+	if len(touches) == 0 {
+		return
+	}
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte(MetaBucketName))
+		if mb == nil {
+			return errors.New("bucket does not exist")
+		}
+		for key, t := range touches {
+			metaBytes := mb.Get([]byte(key))
+			if metaBytes == nil {
+				continue
+			}
+			meta, err := decodeObjMeta(metaBytes)
+			if err != nil {
+				log.Errorln("DiskCache.flushTouches decoding metadata for '" + key + "': " + err.Error())
+				continue
+			}
+			if t.lastAccess.After(meta.LastAccess) {
+				meta.LastAccess = t.lastAccess
+			}
+			meta.HitCount += t.hits
+			if err := mb.Put([]byte(key), meta.encode()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorln("DiskCache.flushTouches updating metadata for '" + c.db.Path() + "': " + err.Error())
+	}
 }
 
 // Peek takes a key, and returns its value, and whether it was found, without changing the lru-ness or hitcount
 func (c *DiskCache) Peek(key string) (*cacheobj.CacheObj, bool) {
+	val, _, found := c.get(key)
+	return val, found
+}
+
+// get returns the object and metadata of the given key, and whether it was found. The object's HitCount is taken from the metadata, which is the only place it's updated after the object is added.
+func (c *DiskCache) get(key string) (*cacheobj.CacheObj, ObjMeta, bool) {
 	log.Debugln("DiskCache.Get key '" + key + "'")
 	valBytes := []byte(nil)
+	meta := ObjMeta{}
 
 	err := c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BucketName))
-		if b == nil {
+		mb := tx.Bucket([]byte(MetaBucketName))
+		if b == nil || mb == nil {
 			return errors.New("bucket does not exist")
 		}
 		valBytes = b.Get([]byte(key))
+		if valBytes == nil {
+			return nil
+		}
+		if metaBytes := mb.Get([]byte(key)); metaBytes != nil {
+			m, err := decodeObjMeta(metaBytes)
+			if err != nil {
+				return errors.New("decoding metadata: " + err.Error())
+			}
+			meta = m
+		}
 		return nil
 	})
 	if err != nil {
 		log.Errorln("DiskCache.Peek getting '" + key + "' from cache: " + err.Error())
-		return nil, false
+		return nil, ObjMeta{}, false
 	}
 
 	if valBytes == nil {
 		log.Debugln("DiskCache.Peek key '" + key + "' CACHE MISS")
-		return nil, false
+		return nil, ObjMeta{}, false
 	}
 
 	buf := bytes.NewBuffer(valBytes)
 	val := cacheobj.CacheObj{}
 	if err := gob.NewDecoder(buf).Decode(&val); err != nil {
 		log.Errorln("DiskCache.Peek decoding '" + key + "' from cache: " + err.Error())
-		return nil, false
+		return nil, ObjMeta{}, false
+	}
+	if meta.Size == 0 {
+		meta.Size = uint64(len(valBytes)) // the object was stored before its metadata was created by ResetAfterRestart
+	}
+	if meta.HitCount > val.HitCount {
+		val.HitCount = meta.HitCount
 	}
 
 	log.Debugln("DiskCache.Peek key '" + key + "' CACHE HIT")
-	return &val, true
+	return &val, meta, true
+}
+
+// Remove removes the key from the cache. Returns whether the key existed.
+func (c *DiskCache) Remove(key string) bool {
+	sizeBytes, exists := c.lru.Remove(key)
+	if err := c.db.Update(func(tx *bolt.Tx) error { return deleteKey(tx, key) }); err != nil {
+		log.Errorln("DiskCache.Remove removing '" + key + "' from cache: " + err.Error())
+	}
+	if !exists {
+		return false
+	}
+	atomic.AddUint64(&c.sizeBytes, ^uint64(sizeBytes-1)) // subtract sizeBytes
+	return true
+}
+
+// deleteKey deletes the given key's object and metadata.
+func deleteKey(tx *bolt.Tx, key string) error {
+	b := tx.Bucket([]byte(BucketName))
+	mb := tx.Bucket([]byte(MetaBucketName))
+	if b == nil || mb == nil {
+		return errors.New("bucket does not exist")
+	}
+	if err := b.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return mb.Delete([]byte(key))
 }
 
 func (c *DiskCache) Size() uint64 {
 	return atomic.LoadUint64(&c.sizeBytes)
 }
 
+// Close writes the pending touches, and closes the database.
 func (c *DiskCache) Close() {
+	close(c.closing)
+	<-c.closed
 	c.db.Close()
 }
 
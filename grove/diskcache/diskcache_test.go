@@ -0,0 +1,146 @@
+package diskcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+)
+
+func TestResetAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.db")
+
+	c, err := New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("creating cache: %v", err)
+	}
+	now := time.Now()
+	fresh := http.Header{"Cache-Control": {"max-age=3600"}}
+	for _, key := range []string{"a", "b", "c"} {
+		c.Add(key, cacheobj.New(nil, []byte(key), http.StatusOK, http.StatusOK, "", fresh, now, now, now, now))
+	}
+	c.Add("expired", cacheobj.New(nil, []byte("expired"), http.StatusOK, http.StatusOK, "", http.Header{"Cache-Control": {"max-age=0"}}, now, now, now, now))
+	c.touch("a", time.Now().Add(time.Second))
+	size := c.Size()
+	c.Close()
+
+	c, err = New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("reopening cache: %v", err)
+	}
+	defer c.Close()
+	if err := c.recover(); err != nil {
+		t.Fatalf("recovering cache: %v", err)
+	}
+	if c.Size() != size {
+		t.Errorf("recovered size expected %v, actual %v", size, c.Size())
+	}
+	if expected, actual := []string{"b", "c", "expired", "a"}, c.Keys(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("recovered LRU order expected %v, actual %v", expected, actual)
+	}
+	if obj, ok := c.Peek("a"); !ok || obj.HitCount != 2 {
+		t.Errorf("recovered hit count expected 2, actual %v", obj)
+	}
+
+	time.Sleep(time.Millisecond)
+	if removed := c.GCExpired(0); removed != 1 {
+		t.Errorf("GCExpired removed expected 1, actual %v", removed)
+	}
+	if _, ok := c.Peek("expired"); ok {
+		t.Errorf("GCExpired expected to remove 'expired', but it still exists")
+	}
+	if expected, actual := []string{"b", "c", "a"}, c.Keys(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("LRU after GCExpired expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := New(filepath.Join(dir, "cache.db"), 1024*1024)
+	if err != nil {
+		t.Fatalf("creating cache: %v", err)
+	}
+	defer c.Close()
+	now := time.Now()
+	fresh := http.Header{"Cache-Control": {"max-age=3600"}}
+	c.Add("a", cacheobj.New(nil, []byte("a"), http.StatusOK, http.StatusOK, "", fresh, now, now, now, now))
+	c.Add("b", cacheobj.New(nil, []byte("b"), http.StatusOK, http.StatusOK, "", fresh, now, now, now, now))
+	sizeB := c.Size() / 2
+
+	if !c.Remove("a") {
+		t.Errorf("Remove of existing key expected true, actual false")
+	}
+	if c.Remove("a") {
+		t.Errorf("Remove of removed key expected false, actual true")
+	}
+	if _, ok := c.Peek("a"); ok {
+		t.Errorf("Peek of removed key expected not found, actual found")
+	}
+	if c.Size() != sizeB {
+		t.Errorf("Size after Remove expected %v, actual %v", sizeB, c.Size())
+	}
+
+	// the removed key's metadata must be removed too, so it isn't restored after a restart
+	if err := c.recover(); err != nil {
+		t.Fatalf("recovering cache: %v", err)
+	}
+	if expected, actual := []string{"b"}, c.Keys(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("recovered keys after Remove expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestGetTouches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := New(filepath.Join(dir, "cache.db"), 1024*1024)
+	if err != nil {
+		t.Fatalf("creating cache: %v", err)
+	}
+	defer c.Close()
+	now := time.Now()
+	c.Add("a", cacheobj.New(nil, []byte("a"), http.StatusOK, http.StatusOK, "", http.Header{"Cache-Control": {"max-age=3600"}}, now, now, now, now))
+	for i := 0; i < 3; i++ {
+		if _, ok := c.Get("a"); !ok {
+			t.Fatalf("Get expected found, actual not found")
+		}
+	}
+
+	// concurrent gets are written in a single flush, with all their hits
+	c.flushTouches()
+	if obj, ok := c.Peek("a"); !ok || obj.HitCount != 4 {
+		t.Errorf("hit count after flushing 3 gets expected 4, actual %v", obj)
+	}
+}
@@ -0,0 +1,64 @@
+package diskcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// MetaBucketName is the name of the bucket holding each object's ObjMeta, under the same key as the object in BucketName. Metadata is kept separately, so it can be read and updated without reading or decoding object bodies.
+const MetaBucketName = "m"
+
+// ObjMeta is the metadata of a stored object.
+type ObjMeta struct {
+	// Size is the size in bytes of the encoded object, as stored on disk.
+	Size uint64
+	// LastAccess is the last time the object was added or gotten. This is used to restore the LRU order on restart.
+	LastAccess time.Time
+	// Expiry is the time the object stops being fresh, as computed when it was added.
+	Expiry   time.Time
+	HitCount uint64
+}
+
+const objMetaLen = 32
+
+// Expired returns whether the object has been stale for longer than grace, at the given time.
+func (m ObjMeta) Expired(now time.Time, grace time.Duration) bool {
+	return now.Sub(m.Expiry) > grace
+}
+
+// encode serializes the metadata into a fixed-size buffer. Metadata is written on every Get, so this avoids the cost of gob.
+func (m ObjMeta) encode() []byte {
+	b := make([]byte, objMetaLen)
+	binary.BigEndian.PutUint64(b[0:], m.Size)
+	binary.BigEndian.PutUint64(b[8:], uint64(m.LastAccess.UnixNano()))
+	binary.BigEndian.PutUint64(b[16:], uint64(m.Expiry.UnixNano()))
+	binary.BigEndian.PutUint64(b[24:], m.HitCount)
+	return b
+}
+
+func decodeObjMeta(b []byte) (ObjMeta, error) {
+	if len(b) != objMetaLen {
+		return ObjMeta{}, errors.New("malformed metadata: expected length 32")
+	}
+	return ObjMeta{
+		Size:       binary.BigEndian.Uint64(b[0:]),
+		LastAccess: time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))),
+		Expiry:     time.Unix(0, int64(binary.BigEndian.Uint64(b[16:]))),
+		HitCount:   binary.BigEndian.Uint64(b[24:]),
+	}, nil
+}
@@ -16,6 +16,7 @@ package diskcache
 
 import (
 	"errors"
+	"time"
 
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/config"
@@ -66,6 +67,30 @@ func (c *MultiDiskCache) Peek(key string) (*cacheobj.CacheObj, bool) {
 	return (*c)[i].Peek(key)
 }
 
+func (c *MultiDiskCache) Remove(key string) bool {
+	i := c.keyIdx(key)
+	log.Debugf("MultiDiskCache.Remove key '%+v' mapped to %+v\n", key, i)
+	return (*c)[i].Remove(key)
+}
+
+// GCExpired removes all objects which have been expired for longer than grace from all files. Returns the number of objects removed.
+func (c *MultiDiskCache) GCExpired(grace time.Duration) int {
+	removed := 0
+	for _, cache := range *c {
+		removed += cache.GCExpired(grace)
+	}
+	return removed
+}
+
+// GCExpiredEvery calls GCExpired with the given grace every interval. It never returns, and should be called in a goroutine.
+func (c *MultiDiskCache) GCExpiredEvery(interval time.Duration, grace time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		removed := c.GCExpired(grace)
+		log.Infof("MultiDiskCache.GCExpired removed %d expired objects in %v\n", removed, time.Since(start))
+	}
+}
+
 func (c *MultiDiskCache) Size() uint64 {
 	sum := uint64(0)
 	for _, cache := range *c {
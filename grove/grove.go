@@ -27,7 +27,6 @@ import (
 	"reflect"
 	"runtime"
 	"runtime/pprof"
-	"strconv"
 	"strings"
 	"time"
 
@@ -36,17 +35,15 @@ import (
 
 	"github.com/apache/trafficcontrol/lib/go-log"
 
-	"github.com/apache/trafficcontrol/grove/cache"
 	"github.com/apache/trafficcontrol/grove/config"
 	"github.com/apache/trafficcontrol/grove/diskcache"
 	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/memcache"
-	"github.com/apache/trafficcontrol/grove/plugin"
 	"github.com/apache/trafficcontrol/grove/remap"
 	"github.com/apache/trafficcontrol/grove/remapdata"
-	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/sibling"
 	"github.com/apache/trafficcontrol/grove/tiercache"
-	"github.com/apache/trafficcontrol/grove/web"
+	"github.com/apache/trafficcontrol/grove/trace"
 )
 
 const ShutdownTimeout = 60 * time.Second
@@ -81,219 +78,76 @@ func main() {
 	}
 	log.Init(eventW, errW, warnW, infoW, debugW)
 
-	caches, err := createCaches(cfg.CacheFiles, uint64(cfg.FileMemBytes), uint64(cfg.CacheSizeBytes))
+	s, err := newServer(*configFileName, cfg)
 	if err != nil {
-		log.Errorln("starting service: creating caches: " + err.Error())
+		log.Errorln("starting service: " + err.Error())
 		os.Exit(1)
 	}
 
-	reqTimeout := time.Duration(cfg.ReqTimeoutMS) * time.Millisecond
-	reqKeepAlive := time.Duration(cfg.ReqKeepAliveMS) * time.Millisecond
-	reqMaxIdleConns := cfg.ReqMaxIdleConns
-	reqIdleConnTimeout := time.Duration(cfg.ReqIdleConnTimeoutMS) * time.Millisecond
-	baseTransport := remap.NewRemappingTransport(reqTimeout, reqKeepAlive, reqMaxIdleConns, reqIdleConnTimeout)
-
-	plugins := plugin.Get(cfg.Plugins)
-	remapper, err := remap.LoadRemapper(cfg.RemapRulesFile, plugins.LoadFuncs(), caches, baseTransport)
-	if err != nil {
-		log.Errorf("starting service: loading remap rules: %v\n", err)
-		os.Exit(1)
-	}
-
-	certs, err := loadCerts(remapper.Rules())
-	if err != nil {
-		log.Errorf("starting service: loading certificates: %v\n", err)
-		os.Exit(1)
-	}
-	defaultCert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
-	if err != nil {
-		log.Errorf("starting service: loading default certificate: %v\n", err)
-		os.Exit(1)
-	}
-	certs = append(certs, defaultCert)
-
-	httpListener, httpConns, httpConnStateCallback, err := web.InterceptListen("tcp", fmt.Sprintf(":%d", cfg.Port))
-	if err != nil {
-		log.Errorf("creating HTTP listener %v: %v\n", cfg.Port, err)
-		os.Exit(1)
+	if *pprof {
+		profile()
 	}
+	signalReloader(unix.SIGHUP, func() { s.reload() })
+}
 
-	httpsConns := (*web.ConnMap)(nil)
-	httpsServer := (*http.Server)(nil)
-	httpsListener := net.Listener(nil)
-	httpsConnStateCallback := (func(net.Conn, http.ConnState))(nil)
-	tlsConfig := (*tls.Config)(nil)
-	if cfg.CertFile != "" && cfg.KeyFile != "" {
-		if httpsListener, httpsConns, httpsConnStateCallback, tlsConfig, err = web.InterceptListenTLS("tcp", fmt.Sprintf(":%d", cfg.HTTPSPort), certs, cfg.DisableHTTP2); err != nil {
-			log.Errorf("creating HTTPS listener %v: %v\n", cfg.HTTPSPort, err)
-			return
-		}
+// createSiblings creates the sibling group of the given config. Returns nil if no siblings are configured.
+func createSiblings(cfg config.Config) (*sibling.Siblings, error) {
+	if len(cfg.Siblings) == 0 {
+		return nil, nil
 	}
+	timeout := time.Duration(cfg.SiblingTimeoutMS) * time.Millisecond
+	transport := remap.NewRemappingTransport(timeout, time.Duration(cfg.ReqKeepAliveMS)*time.Millisecond, cfg.ReqMaxIdleConns, time.Duration(cfg.ReqIdleConnTimeoutMS)*time.Millisecond)
+	transport.ResponseHeaderTimeout = timeout
+	return sibling.New(cfg.SiblingSelf, cfg.Siblings, transport, cfg.SiblingMaxFailures, time.Duration(cfg.SiblingCooldownMS)*time.Millisecond)
+}
 
-	// TODO pass total size for all file groups?
-	stats := stat.New(remapper.Rules(), caches, uint64(cfg.CacheSizeBytes), httpConns, httpsConns, Version)
-
-	buildHandler := func(scheme string, port string, conns *web.ConnMap, stats stat.Stats, pluginContext map[string]*interface{}) *cache.HandlerPointer {
-		return cache.NewHandlerPointer(cache.NewHandler(
-			remapper,
-			uint64(cfg.ConcurrentRuleRequests),
-			stats,
-			scheme,
-			port,
-			conns,
-			cfg.RFCCompliant,
-			cfg.ConnectionClose,
-			plugins,
-			pluginContext,
-			httpConns,
-			httpsConns,
-			cfg.InterfaceName,
-		))
+// createTracer creates the W3C trace context tracer of the given config. Returns nil if tracing is disabled.
+func createTracer(cfg config.Config) (*trace.Tracer, error) {
+	if cfg.TracingExporter == "" {
+		return nil, nil
 	}
-
-	pluginContext := map[string]*interface{}{}
-
-	httpHandler := buildHandler("http", strconv.Itoa(cfg.Port), httpConns, stats, pluginContext)
-	httpsHandler := buildHandler("https", strconv.Itoa(cfg.HTTPSPort), httpsConns, stats, pluginContext)
-
-	idleTimeout := time.Duration(cfg.ServerIdleTimeoutMS) * time.Millisecond
-	readTimeout := time.Duration(cfg.ServerReadTimeoutMS) * time.Millisecond
-	writeTimeout := time.Duration(cfg.ServerWriteTimeoutMS) * time.Millisecond
-
-	plugins.OnStartup(remapper.PluginCfg(), pluginContext, plugin.StartupData{Config: cfg, Shared: remapper.PluginSharedCfg()})
-
-	// TODO add config to not serve HTTP (only HTTPS). If port is not set?
-	httpServer := startServer(httpHandler, httpListener, httpConnStateCallback, nil, cfg.Port, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "http")
-
-	if cfg.CertFile != "" && cfg.KeyFile != "" {
-		httpsServer = startServer(httpsHandler, httpsListener, httpsConnStateCallback, tlsConfig, cfg.HTTPSPort, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "https")
+	if cfg.TracingFlushIntervalMS <= 0 {
+		return nil, errors.New("tracing_flush_interval_ms must be positive")
 	}
-
-	reloadConfig := func() {
-		log.Infoln("reloading config")
-		err := error(nil)
-		oldCfg := cfg
-		cfg, err = config.LoadConfig(*configFileName)
-		if err != nil {
-			log.Errorln("reloading config: failed to load config file, keeping existing config: " + err.Error())
-			cfg = oldCfg
-			return
+	exporter := trace.Exporter(nil)
+	switch cfg.TracingExporter {
+	case "file":
+		if cfg.TracingFile == "" {
+			return nil, errors.New("tracing_exporter file requires a tracing_file")
 		}
-		eventW, errW, warnW, infoW, debugW, err := log.GetLogWriters(cfg)
+		fileExporter, err := trace.NewFileExporter(cfg.TracingFile)
 		if err != nil {
-			log.Errorln("reloading config: failed to get log writers from '" + *configFileName + "', keeping existing log locations: " + err.Error())
-		} else {
-			log.Init(eventW, errW, warnW, infoW, debugW)
-		}
-
-		// TODO add cache file reloading
-		// The problem is, the disk db needs file locks, so there's no way to close and create new files without making all requests cache miss in the meantime.
-		// Thus, the file paths must be kept, diffed, only removed paths' dbs closed, only new paths opened, and dbs for existing paths passed into the new caches object.
-		if cachesChanged(oldCfg, cfg) {
-			log.Warnln("reloading config: caches changed in new config! Dynamic cache reloading is not supported! Old cache files and sizes will be used, and new cache config will NOT be loaded! Restart service to apply cache changes!")
+			return nil, err
 		}
-
-		plugins = plugin.Get(cfg.Plugins)
-		oldRemapper := remapper
-		remapper, err = remap.LoadRemapper(cfg.RemapRulesFile, plugins.LoadFuncs(), caches, baseTransport)
-		if err != nil {
-			log.Errorln("reloading config: failed to load remap rules, keeping existing rules: " + err.Error())
-			remapper = oldRemapper
-			return
-		}
-
-		if cfg.Port != oldCfg.Port {
-			if httpListener, httpConns, httpConnStateCallback, err = web.InterceptListen("tcp", fmt.Sprintf(":%d", cfg.Port)); err != nil {
-				log.Errorf("reloading config: creating HTTP listener %v: %v\n", cfg.Port, err)
-				return
-			}
-		}
-
-		if (cfg.CertFile != oldCfg.CertFile || cfg.KeyFile != oldCfg.KeyFile) && cfg.HTTPSPort != oldCfg.HTTPSPort {
-			log.Warnln("config certificate changed, but port did not. Cannot recreate listener on same port without stopping the service. Restart the service to load the new certificate.")
-		}
-
-		if cfg.HTTPSPort != oldCfg.HTTPSPort {
-			if httpsListener, httpsConns, httpsConnStateCallback, tlsConfig, err = web.InterceptListenTLS("tcp", fmt.Sprintf(":%d", cfg.HTTPSPort), certs, cfg.DisableHTTP2); err != nil {
-				log.Errorf("creating HTTPS listener %v: %v\n", cfg.HTTPSPort, err)
-			}
-		}
-
-		stats = stat.New(remapper.Rules(), caches, uint64(cfg.CacheSizeBytes), httpConns, httpsConns, Version) // TODO copy stats from old stats object?
-
-		httpCacheHandler := cache.NewHandler(
-			remapper,
-			uint64(cfg.ConcurrentRuleRequests),
-			stats,
-			"http",
-			strconv.Itoa(cfg.Port),
-			httpConns,
-			cfg.RFCCompliant,
-			cfg.ConnectionClose,
-			plugins,
-			pluginContext,
-			httpConns,
-			httpsConns,
-			cfg.InterfaceName,
-		)
-		httpHandler.Set(httpCacheHandler)
-
-		httpsCacheHandler := cache.NewHandler(
-			remapper,
-			uint64(cfg.ConcurrentRuleRequests),
-			stats,
-			"https",
-			strconv.Itoa(cfg.HTTPSPort),
-			httpsConns,
-			cfg.RFCCompliant,
-			cfg.ConnectionClose,
-			plugins,
-			pluginContext,
-			httpConns,
-			httpsConns,
-			cfg.InterfaceName,
-		)
-		httpsHandler.Set(httpsCacheHandler)
-
-		plugins.OnStartup(remapper.PluginCfg(), pluginContext, plugin.StartupData{Config: cfg, Shared: remapper.PluginSharedCfg()})
-
-		if cfg.Port != oldCfg.Port {
-			ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
-			defer cancel()
-			if err := httpServer.Shutdown(ctx); err != nil {
-				if err == context.DeadlineExceeded {
-					log.Errorf("closing http server: connections didn't close gracefully in %v, forcefully closing.\n", ShutdownTimeout)
-					httpServer.Close()
-				} else {
-					log.Errorf("closing http server: %v\n", err)
-				}
-
-			}
-			httpServer = startServer(httpHandler, httpListener, httpConnStateCallback, nil, cfg.Port, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "http")
-		}
-
-		if (httpsServer == nil || cfg.HTTPSPort != oldCfg.HTTPSPort) && cfg.CertFile != "" && cfg.KeyFile != "" {
-			if httpsServer != nil {
-				ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
-				defer cancel()
-				if err := httpsServer.Shutdown(ctx); err != nil {
-					if err == context.DeadlineExceeded {
-						log.Errorf("closing https server: connections didn't close gracefully in %v, forcefully closing.\n", ShutdownTimeout)
-						httpServer.Close()
-					} else {
-						log.Errorf("closing https server: %v\n", err)
-					}
-				}
-			}
-
-			httpsServer = startServer(httpsHandler, httpsListener, httpsConnStateCallback, tlsConfig, cfg.HTTPSPort, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "https")
+		exporter = fileExporter
+	case "http":
+		if cfg.TracingEndpoint == "" {
+			return nil, errors.New("tracing_exporter http requires a tracing_endpoint")
 		}
+		exporter = trace.NewHTTPExporter(cfg.TracingEndpoint, time.Duration(cfg.TracingTimeoutMS)*time.Millisecond)
+	default:
+		return nil, errors.New("unknown tracing_exporter '" + cfg.TracingExporter + "', must be file or http")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorln("creating tracer: getting hostname: " + err.Error())
 	}
+	resource := []trace.Attribute{{Key: "service.name", Value: "grove"}, {Key: "service.version", Value: Version}, {Key: "host.name", Value: hostname}}
+	return trace.NewTracer(exporter, resource, cfg.TracingSampleRatio, time.Duration(cfg.TracingFlushIntervalMS)*time.Millisecond), nil
+}
 
-	if *pprof {
-		profile()
+// shutdownServer gracefully shuts down the given server, forcefully closing it if connections don't close within ShutdownTimeout.
+func shutdownServer(server *http.Server, protocol string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		if err == context.DeadlineExceeded {
+			log.Errorf("closing %s server: connections didn't close gracefully in %v, forcefully closing.\n", protocol, ShutdownTimeout)
+			server.Close()
+		} else {
+			log.Errorf("closing %s server: %v\n", protocol, err)
+		}
 	}
-	signalReloader(unix.SIGHUP, reloadConfig)
 }
 
 func profile() {
@@ -358,6 +212,19 @@ func startServer(handler http.Handler, listener net.Listener, connState func(net
 	return server
 }
 
+// loadAllCerts loads the certificates of the given remap rules, followed by the default certificate.
+func loadAllCerts(rules []remapdata.RemapRule, certFile string, keyFile string) ([]tls.Certificate, error) {
+	certs, err := loadCerts(rules)
+	if err != nil {
+		return nil, errors.New("loading certificates: " + err.Error())
+	}
+	defaultCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("loading default certificate: " + err.Error())
+	}
+	return append(certs, defaultCert), nil
+}
+
 func loadCerts(rules []remapdata.RemapRule) ([]tls.Certificate, error) {
 	certs := []tls.Certificate{}
 	for _, rule := range rules {
@@ -380,8 +247,8 @@ func loadCerts(rules []remapdata.RemapRule) ([]tls.Certificate, error) {
 	return certs, nil
 }
 
-// createCaches creates the caches specified in the config. The nameFiles is the map of names to groups of files, nameMemBytes is the amount of memory to use for each named group, and memCacheBytes is the amount of memory to use for the default memory cache.
-func createCaches(nameFiles map[string][]config.CacheFile, nameMemBytes uint64, memCacheBytes uint64) (map[string]icache.Cache, error) {
+// createCaches creates the caches specified in the config. The nameFiles is the map of names to groups of files, nameMemBytes is the amount of memory to use for each named group, memCacheBytes is the amount of memory to use for the default memory cache, and expiredGCInterval and expiredGCGrace are how often to remove expired objects from the files, and how long they must have been expired, if expiredGCInterval is nonzero.
+func createCaches(nameFiles map[string][]config.CacheFile, nameMemBytes uint64, memCacheBytes uint64, expiredGCInterval time.Duration, expiredGCGrace time.Duration) (map[string]icache.Cache, error) {
 	caches := map[string]icache.Cache{}
 	caches[""] = memcache.New(memCacheBytes) // default empty names to the mem cache
 
@@ -390,6 +257,9 @@ func createCaches(nameFiles map[string][]config.CacheFile, nameMemBytes uint64,
 		if err != nil {
 			return nil, errors.New("creating cache '" + name + "': " + err.Error())
 		}
+		if expiredGCInterval > 0 {
+			go multiDiskCache.GCExpiredEvery(expiredGCInterval, expiredGCGrace)
+		}
 		caches[name] = tiercache.New(memcache.New(nameMemBytes), multiDiskCache)
 	}
 
@@ -397,7 +267,7 @@ func createCaches(nameFiles map[string][]config.CacheFile, nameMemBytes uint64,
 }
 
 func cachesChanged(oldCfg, newCfg config.Config) bool {
-	return oldCfg.FileMemBytes == newCfg.FileMemBytes &&
-		oldCfg.CacheSizeBytes != newCfg.CacheSizeBytes &&
+	return oldCfg.FileMemBytes != newCfg.FileMemBytes ||
+		oldCfg.CacheSizeBytes != newCfg.CacheSizeBytes ||
 		!reflect.DeepEqual(oldCfg.CacheFiles, newCfg.CacheFiles)
 }
@@ -0,0 +1,207 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/config"
+)
+
+const testHost = "grove.test"
+
+func TestReload(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("body"))
+	}))
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "grove-reload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	remapFile := filepath.Join(dir, "remap.json")
+	remapJSON := `{"parent_selection": "consistent-hash", "retry_num": 1, "timeout_ms": 5000, "retry_codes": [], "rules": [{
+		"name": "test",
+		"from": "http://` + testHost + `",
+		"to": [{"url": "` + origin.URL + `", "weight": 1}]
+	}]}`
+	if err := ioutil.WriteFile(remapFile, []byte(remapJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(dir, "grove.cfg")
+	writeCfg := func(disableHTTP2 bool) {
+		cfgJSON := `{
+			"port": 0,
+			"https_port": 0,
+			"cert_file": "` + certFile + `",
+			"key_file": "` + keyFile + `",
+			"remap_rules_file": "` + remapFile + `",
+			"cache_size_bytes": 1048576,
+			"plugins": ["record_stats"],
+			"disable_http2": ` + strconv.FormatBool(disableHTTP2) + `,
+			"log_location_error": "null",
+			"log_location_warning": "null",
+			"log_location_info": "null",
+			"log_location_debug": "null",
+			"log_location_event": "null"
+		}`
+		if err := ioutil.WriteFile(cfgFile, []byte(cfgJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCfg(false)
+	cfg, err := config.LoadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(cfgFile, cfg)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	defer func() {
+		s.httpServer.Close()
+		s.httpsServer.Close()
+		s.httpListener.Close()
+		s.httpsListener.Close()
+	}()
+
+	httpAddr := s.httpListener.Addr().String()
+	httpsAddr := s.httpsListener.Addr().String()
+
+	get(t, httpAddr)
+	waitForStatus2xx(t, s, 1)
+	if proto := negotiatedProtocol(t, httpsAddr); proto != "h2" {
+		t.Errorf("HTTPS with HTTP/2 enabled expected to negotiate 'h2', actual '%v'", proto)
+	}
+
+	oldHTTPServer, oldHTTPSServer := s.httpServer, s.httpsServer
+	writeCfg(true)
+	if err := s.reload(); err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+
+	if s.httpServer == oldHTTPServer || s.httpsServer == oldHTTPSServer {
+		t.Errorf("reload with changed disable_http2 expected new servers, actual servers not replaced")
+	}
+	if addr := s.httpListener.Addr().String(); addr != httpAddr {
+		t.Errorf("reload with unchanged port expected the same HTTP listener %v, actual %v", httpAddr, addr)
+	}
+	if proto := negotiatedProtocol(t, httpsAddr); proto == "h2" {
+		t.Errorf("HTTPS after reload with HTTP/2 disabled expected not to negotiate 'h2', actual 'h2'")
+	}
+
+	if actual := s.stats.System().Version(); actual != Version {
+		t.Errorf("stats version after reload expected %v, actual %v", Version, actual)
+	}
+	waitForStatus2xx(t, s, 1) // stats from before the reload are kept
+	get(t, httpAddr)
+	waitForStatus2xx(t, s, 2)
+}
+
+// get requests the test object from the server at addr, failing the test if it isn't a 200.
+func get(t *testing.T, addr string) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = testHost
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET expected 200, actual %v", resp.StatusCode)
+	}
+}
+
+// waitForStatus2xx waits for the test rule's 2xx count to be expected, because stats are written after the response is sent.
+func waitForStatus2xx(t *testing.T, s *server, expected uint64) {
+	remapStats, ok := s.stats.Remap().Stats(testHost)
+	if !ok {
+		t.Fatalf("expected stats for %v, actual none", testHost)
+	}
+	actual := uint64(0)
+	for i := 0; i < 100; i++ {
+		if actual = remapStats.Status2xx(); actual == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("stats 2xx expected %v, actual %v", expected, actual)
+}
+
+// negotiatedProtocol makes a TLS connection to addr offering HTTP/2, and returns the protocol negotiated.
+func negotiatedProtocol(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().NegotiatedProtocol
+}
+
+// writeTestCert writes a self-signed certificate and key to dir, and returns their paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: testHost},
+		DNSNames:     []string{testHost},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
@@ -29,15 +29,17 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apache/trafficcontrol/lib/go-tc"
-	to "github.com/apache/trafficcontrol/traffic_ops/v2-client"
+	to "github.com/apache/trafficcontrol/traffic_ops/client"
 
 	"github.com/apache/trafficcontrol/grove/config"
+	"github.com/apache/trafficcontrol/grove/plugin"
 	"github.com/apache/trafficcontrol/grove/remap"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/web"
@@ -192,7 +194,6 @@ func main() {
 	pretty := flag.Bool("pretty", false, "Whether to pretty-print output")
 	ignoreUpdateFlag := flag.Bool("ignore-update-flag", false, "Whether to fetch and apply the config, without checking or updating the Traffic Ops Update Pending flag")
 	host := flag.String("host", "", "The hostname of the server whose config to generate")
-	// api := flag.String("api", "1.2", "API version. Determines whether to use /api/1.3/configs/ or older, less efficient 1.2 APIs")
 	toInsecure := flag.Bool("insecure", false, "Whether to allow invalid certificates with Traffic Ops")
 	certDir := flag.String("certdir", DefaultCertificateDir, "Directory to save certificates to")
 	noServiceReload := flag.Bool("no-service-reload", false, "Whether to avoid trying to reload the Grove service")
@@ -229,8 +230,6 @@ func main() {
 		}
 	}
 
-	// TODO remove this once converted to 1.3 API
-	// using the 1.2 API
 	var hostServer tc.Server
 	var hostProfile tc.Profile
 	var ok bool
@@ -262,7 +261,6 @@ func main() {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error: profile '" + hostServer.Profile + "' not in Profiles\n")
 		os.Exit(ExitError)
 	}
-	// end of API 1.2 stuff
 
 	if hostProfile.Type == GroveProfileType {
 		updateRequired, cfg, err := createGroveCfg(toc, hostServer)
@@ -290,12 +288,7 @@ func main() {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: the profile '" + hostServer.Profile + "' is not a '" + GroveProfileType + "', will not build a config from it.")
 	}
 
-	rules := remap.RemapRules{}
-	// if *api == "1.3" {
-	// 	rules, err = createRulesNewAPI(toc, *host, *certDir)
-	// } else {
-	rules, err = createRulesOldAPI(toc, *host, *certDir, servers) // TODO remove once 1.3 / traffic_ops_golang is deployed to production.
-	// }
+	rules, err := createRulesAPI(toc, *host, *certDir, servers)
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error creating rules: " + err.Error())
 		os.Exit(ExitError)
@@ -455,7 +448,7 @@ func setConfigParameter(cfg *config.Config, name string, value string) error {
 	return err
 }
 
-func createRulesOldAPI(toc *to.Session, host string, certDir string, servers map[string]tc.Server) (remap.RemapRules, error) {
+func createRulesAPI(toc *to.Session, host string, certDir string, servers map[string]tc.Server) (remap.RemapRules, error) {
 	cachegroupsArr, _, err := toc.GetCacheGroupsNullable()
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Cachegroups: " + err.Error())
@@ -469,12 +462,52 @@ func createRulesOldAPI(toc *to.Session, host string, certDir string, servers map
 		os.Exit(1)
 	}
 
-	deliveryservices, _, err := toc.GetDeliveryServicesByServer(hostServer.ID)
+	topologiesArr, _, err := toc.GetTopologies()
+	if err != nil {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Topologies: " + err.Error())
+		os.Exit(1)
+	}
+	topologies := makeTopologyNameMap(topologiesArr)
+
+	serverCapsArr, _, err := toc.GetServerServerCapabilities(nil, nil, nil)
+	if err != nil {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Server Capabilities: " + err.Error())
+		os.Exit(1)
+	}
+	serverCaps := makeServerCapabilitiesMap(serverCapsArr)
+
+	dsCapsArr, _, err := toc.GetDeliveryServicesRequiredCapabilities(nil, nil, nil)
+	if err != nil {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Deliveryservice Required Capabilities: " + err.Error())
+		os.Exit(1)
+	}
+	dsCaps := makeDSRequiredCapabilitiesMap(dsCapsArr)
+
+	assignedDSes, _, err := toc.GetDeliveryServicesByServer(hostServer.ID)
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Deliveryservices: " + err.Error())
 		os.Exit(1)
 	}
 
+	// delivery services with topologies aren't assigned to servers, so get all the CDN's delivery services to find them
+	cdnDSes, _, err := toc.GetDeliveryServicesByCDNID(hostServer.CDNID)
+	if err != nil {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops CDN Deliveryservices: " + err.Error())
+		os.Exit(1)
+	}
+
+	deliveryservices := getHostDeliveryServices(hostServer, assignedDSes, cdnDSes, topologies, serverCaps, dsCaps)
+
+	dsTiers := map[string]dsTier{}
+	for _, ds := range deliveryservices {
+		tier, err := getDSTier(hostServer, ds, servers, cachegroups, topologies, serverCaps, dsCaps)
+		if err != nil {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting '" + host + "' deliveryservice '" + *ds.XMLID + "' parents: " + err.Error())
+			os.Exit(1)
+		}
+		dsTiers[*ds.XMLID] = tier
+	}
+
 	deliveryserviceRegexArr, _, err := toc.GetDeliveryServiceRegexes()
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Deliveryservice Regexes: " + err.Error())
@@ -495,157 +528,46 @@ func createRulesOldAPI(toc *to.Session, host string, certDir string, servers map
 		os.Exit(1)
 	}
 
-	parents, err := getParents(host, servers, cachegroups)
+	cdnSSLKeys, _, err := toc.GetCDNSSLKeys(hostServer.CDNName)
 	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting '" + host + "' parents: " + err.Error())
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting '" + hostServer.CDNName + "' SSL keys: " + err.Error())
 		os.Exit(1)
 	}
+	dsCerts := makeDSCertMap(cdnSSLKeys)
 
-	sameCDN := func(s tc.Server) bool {
-		return s.CDNName == hostServer.CDNName
-	}
-
-	serverAvailable := func(s tc.Server) bool {
-		status := strings.ToLower(s.Status)
-		statuses := AvailableStatuses()
-		_, ok := statuses[status]
-		return ok
-	}
-
-	parents = filterParents(parents, sameCDN)
-	parents = filterParents(parents, serverAvailable)
-
-	cdnSSLKeys, _, err := toc.GetCDNSSLKeys(hostServer.CDNName)
+	dsSigningPlugins, err := getDSSigningPlugins(toc, deliveryservices)
 	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting '" + hostServer.CDNName + "' SSL keys: " + err.Error())
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Deliveryservice signing keys: " + err.Error())
 		os.Exit(1)
 	}
-	dsCerts := makeDSCertMap(cdnSSLKeys)
 
-	return createRulesOld(host, deliveryservices, parents, deliveryserviceRegexes, cdns, serverParameters, dsCerts, certDir)
+	return createRules(host, deliveryservices, dsTiers, deliveryserviceRegexes, cdns, serverParameters, dsCerts, certDir, dsSigningPlugins)
 }
 
-// func createRulesNewAPI(toc *to.Session, host string, certDir string) (remap.RemapRules, error) {
-// 	cacheCfg, err := toc.CacheConfig(host)
-// 	if err != nil {
-// 		fmt.Printf("Error getting Traffic Ops Cache Config: %v\n", err)
-// 		os.Exit(1)
-// 	}
-
-// 	rules := []remapdata.RemapRule{}
-
-// 	allowedIPs, err := makeAllowIP(cacheCfg.AllowIP)
-// 	if err != nil {
-// 		return remap.RemapRules{}, fmt.Errorf("creating allowed IPs: %v", err)
-// 	}
-
-// 	cdnSSLKeys, err := toc.CDNSSLKeys(cacheCfg.CDN)
-// 	if err != nil {
-// 		fmt.Printf("Error getting %v SSL keys: %v\n", cacheCfg.CDN, err)
-// 		os.Exit(1)
-// 	}
-// 	dsCerts := makeDSCertMap(cdnSSLKeys)
-
-// 	weight := DefaultRuleWeight
-// 	retryNum := DefaultRetryNum
-// 	timeout := DefaultTimeout
-// 	parentSelection := DefaultRuleParentSelection
-
-// 	for _, ds := range cacheCfg.DeliveryServices {
-// 		protocol := ds.Protocol
-// 		queryStringRule, err := getQueryStringRule(ds.QueryStringIgnore)
-// 		if err != nil {
-// 			return remap.RemapRules{}, fmt.Errorf("getting deliveryservice %v Query String Rule: %v", ds.XMLID, err)
-// 		}
-
-// 		protocolStrs := []ProtocolStr{}
-// 		switch protocol {
-// 		case ProtocolHTTP:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "http"})
-// 		case ProtocolHTTPS:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-// 		case ProtocolHTTPAndHTTPS:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "http"})
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-// 		case ProtocolHTTPToHTTPS:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "https"})
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-// 		}
-
-// 		cert, hasCert := dsCerts[ds.XMLID]
-// 		// DEBUG
-// 		// if protocol != ProtocolHTTP {
-// 		// 	if !hasCert {
-// 		// 		fmt.Fprint(os.Stderr, "HTTPS delivery service: "+ds.XMLID+" has no certificate!\n")
-// 		// 	} else if err := createCertificateFiles(cert, certDir); err != nil {
-// 		// 		fmt.Fprint(os.Stderr, "HTTPS delivery service "+ds.XMLID+" failed to create certificate: "+err.Error()+"\n")
-// 		// 	}
-// 		// }
-
-// 		dsType := strings.ToLower(ds.Type)
-// 		if !strings.HasPrefix(dsType, "http") && !strings.HasPrefix(dsType, "dns") {
-// 			fmt.Printf("createRules skipping deliveryservice %v - unknown type %v", ds.XMLID, ds.Type)
-// 			continue
-// 		}
-
-// 		for _, protocolStr := range protocolStrs {
-// 			for _, dsRegex := range ds.Regexes {
-// 				rule := remapdata.RemapRule{}
-// 				pattern, patternLiteralRegex := trimLiteralRegex(dsRegex)
-// 				rule.Name = fmt.Sprintf("%s.%s.%s.%s", ds.XMLID, protocolStr.From, protocolStr.To, pattern)
-// 				rule.From = buildFrom(protocolStr.From, pattern, patternLiteralRegex, host, dsType, cacheCfg.Domain)
-
-// 				if protocolStr.From == "https" && hasCert {
-// 					rule.CertificateFile = getCertFileName(cert, certDir)
-// 					rule.CertificateKeyFile = getCertKeyFileName(cert, certDir)
-// 					// fmt.Fprintf(os.Stderr, "HTTPS delivery service: "+ds.XMLID+" certificate %+v\n", cert)
-// 				}
-
-// 				for _, parent := range cacheCfg.Parents {
-// 					to, proxyURLStr := buildToNew(parent, protocolStr.To, ds.OriginFQDN, dsType)
-// 					proxyURL, err := url.Parse(proxyURLStr)
-// 					if err != nil {
-// 						return remap.RemapRules{}, fmt.Errorf("error parsing deliveryservice %v parent %v proxy_url: %v", ds.XMLID, parent.Host, proxyURLStr)
-// 					}
-
-// 					ruleTo := remapdata.RemapRuleTo{
-// 						RemapRuleToBase: remapdata.RemapRuleToBase{
-// 							URL:      to,
-// 							Weight:   &weight,
-// 							RetryNum: &retryNum,
-// 						},
-// 						ProxyURL:   proxyURL,
-// 						RetryCodes: DefaultRetryCodes(),
-// 						Timeout:    &timeout,
-// 					}
-// 					rule.To = append(rule.To, ruleTo)
-// 					// TODO get from TO?
-// 					rule.RetryNum = &retryNum
-// 					rule.Timeout = &timeout
-// 					rule.RetryCodes = DefaultRetryCodes()
-// 					rule.QueryString = queryStringRule
-// 					rule.DSCP = ds.DSCP
-// 					if err != nil {
-// 						return remap.RemapRules{}, err
-// 					}
-// 					rule.ConnectionClose = DefaultRuleConnectionClose
-// 					rule.ParentSelection = &parentSelection
-// 				}
-// 				rules = append(rules, rule)
-// 			}
-// 		}
-// 	}
-
-// 	remapRules := remap.RemapRules{
-// 		Rules:           rules,
-// 		RetryCodes:      DefaultRetryCodes(),
-// 		Timeout:         &timeout,
-// 		ParentSelection: &parentSelection,
-// 		Stats:           remap.RemapRulesStats{Allow: allowedIPs},
-// 	}
-
-// 	return remapRules, nil
-// }
+// getDSSigningPlugins returns the url_sig or uri_signing plugin config of each signed delivery service, keyed by the delivery service XMLID, and then by plugin name.
+func getDSSigningPlugins(toc *to.Session, dses []tc.DeliveryServiceNullable) (map[string]map[string]interface{}, error) {
+	dsPlugins := map[string]map[string]interface{}{}
+	for _, ds := range dses {
+		if ds.XMLID == nil || ds.SigningAlgorithm == nil {
+			continue
+		}
+		switch *ds.SigningAlgorithm {
+		case tc.SigningAlgorithmURLSig:
+			keys, _, err := toc.GetDeliveryServiceURLSigKeys(*ds.XMLID)
+			if err != nil {
+				return nil, errors.New("getting deliveryservice '" + *ds.XMLID + "' URL sig keys: " + err.Error())
+			}
+			dsPlugins[*ds.XMLID] = map[string]interface{}{"url_sig": plugin.URLSigConfig{Keys: keys, ErrorURL: DefaultURLSigErrorURL}}
+		case tc.SigningAlgorithmURISigning:
+			keys, _, err := toc.GetDeliveryServiceURISigningKeys(*ds.XMLID)
+			if err != nil {
+				return nil, errors.New("getting deliveryservice '" + *ds.XMLID + "' URI signing keys: " + err.Error())
+			}
+			dsPlugins[*ds.XMLID] = map[string]interface{}{"uri_signing": json.RawMessage(keys)}
+		}
+	}
+	return dsPlugins, nil
+}
 
 func makeProfileNameMap(profiles []tc.Profile) map[string]tc.Profile {
 	m := map[string]tc.Profile{}
@@ -697,26 +619,6 @@ func makeDSCertMap(sslKeys []tc.CDNSSLKeys) map[string]tc.CDNSSLKeys {
 	return m
 }
 
-func getParents(hostname string, servers map[string]tc.Server, cachegroups map[string]tc.CacheGroupNullable) ([]tc.Server, error) {
-	server, ok := servers[hostname]
-	if !ok {
-		return nil, fmt.Errorf("hostname not found in Servers")
-	}
-
-	cachegroup, ok := cachegroups[server.Cachegroup]
-	if !ok {
-		return nil, fmt.Errorf("server cachegroup '%v' not found in Cachegroups", server.Cachegroup)
-	}
-
-	parents := []tc.Server{}
-	for _, server := range servers {
-		if cachegroup.ParentName != nil && server.Cachegroup == *cachegroup.ParentName {
-			parents = append(parents, server)
-		}
-	}
-	return parents, nil
-}
-
 func filterParents(parents []tc.Server, include func(tc.Server) bool) []tc.Server {
 	newParents := []tc.Server{}
 	for _, parent := range parents {
@@ -771,28 +673,14 @@ func dsTypeSkipsMid(ttype string) bool {
 	return false
 }
 
-// buildTo returns the to URL, and the Proxy URL (if any)
-func buildTo(parentServer tc.Server, protocol string, originURI string, dsType string) (string, string) {
+// buildTo returns the to URL, and the Proxy URL of the parent server.
+func buildTo(parentServer tc.Server, protocol string, originURI string) (string, string) {
 	// TODO add port?
 	to := originURI
-	proxy := ""
-	if !dsTypeSkipsMid(dsType) {
-		proxy = "http://" + parentServer.HostName + "." + parentServer.DomainName + ":" + strconv.Itoa(parentServer.TCPPort)
-	}
+	proxy := "http://" + parentServer.HostName + "." + parentServer.DomainName + ":" + strconv.Itoa(parentServer.TCPPort)
 	return to, proxy
 }
 
-// // buildToNew returns the to URL, and the Proxy URL (if any)
-// func buildToNew(parent tc.CacheConfigParent, protocol string, originURI string, dsType string) (string, string) {
-// 	// TODO add port?
-// 	to := originURI
-// 	proxy := ""
-// 	if !dsTypeSkipsMid(dsType) {
-// 		proxy = "http://" + parent.Host + "." + parent.Domain + ":" + strconv.FormatUint(uint64(parent.Port), 10)
-// 	}
-// 	return to, proxy
-// }
-
 const DeliveryServiceQueryStringCacheAndRemap = 0
 const DeliveryServiceQueryStringNoCacheRemap = 1
 const DeliveryServiceQueryStringNoCacheNoRemap = 2
@@ -823,6 +711,7 @@ const DefaultRetryNum = 5
 const DefaultTimeout = time.Millisecond * 5000
 const DefaultRuleConnectionClose = false
 const DefaultRuleParentSelection = remapdata.ParentSelectionTypeConsistentHash
+const DefaultURLSigErrorURL = "403"
 
 func getAllowIP(params []tc.Parameter) ([]*net.IPNet, error) {
 	ips := []string{}
@@ -854,15 +743,17 @@ func makeAllowIP(ips []string) ([]*net.IPNet, error) {
 	return cidrs, nil
 }
 
-func createRulesOld(
+// createRules returns the remap rules of the given delivery services. The dsTiers are the host's place in each delivery service, keyed by XMLID.
+func createRules(
 	hostname string,
 	dses []tc.DeliveryServiceNullable,
-	parents []tc.Server,
+	dsTiers map[string]dsTier,
 	dsRegexes map[string][]tc.DeliveryServiceRegex,
 	cdns map[string]tc.CDN,
 	hostParams []tc.Parameter,
 	dsCerts map[string]tc.CDNSSLKeys,
 	certDir string,
+	dsSigningPlugins map[string]map[string]interface{},
 ) (remap.RemapRules, error) {
 	rules := []remapdata.RemapRule{}
 	allowedIPs, err := getAllowIP(hostParams)
@@ -916,10 +807,19 @@ func createRulesOld(
 			continue
 		}
 
-		toClientHeaders, toOriginHeaders, err := makeModHdrs(ds.EdgeHeaderRewrite, ds.RemapText)
+		tier := dsTiers[*ds.XMLID]
+		headerRewrite := ds.MidHeaderRewrite
+		if tier.FirstTier {
+			headerRewrite = ds.EdgeHeaderRewrite
+		}
+		toClientHeaders, toOriginHeaders, err := makeModHdrs(headerRewrite, ds.RemapText)
 		if err != nil {
 			return remap.RemapRules{}, errors.New("Making headers for delivery service '" + *ds.XMLID + "':" + err.Error())
 		}
+		regexRemap := remapdata.RegexRemapRules(nil)
+		if tier.FirstTier && ds.RegexRemap != nil {
+			regexRemap = makeRegexRemap(*ds.XMLID, *ds.RegexRemap)
+		}
 		dsRemap := ""
 		if ds.RemapText != nil {
 			dsRemap = *ds.RemapText
@@ -954,9 +854,10 @@ func createRulesOld(
 				}
 
 				rule.PluginsShared = map[string]json.RawMessage{}
-				// if the delivery service skips the mid's ie, http_no_cache, http_live, and dns_live
+				rule.RegexRemap = regexRemap
+				// if this is the last tier, e.g. the last node of the topology, or the delivery service skips the mids (i.e. http_no_cache, http_live, and dns_live),
 				// only add the url rule to the origin.
-				if dsTypeSkipsMid(dsType) {
+				if tier.LastTier {
 					var proxyURLStr = ""
 					proxyURL, err := url.Parse(proxyURLStr)
 					if err != nil {
@@ -989,8 +890,8 @@ func createRulesOld(
 					}
 					rule.PluginsShared[web.RemapTextKey] = remapTextJSON
 				} else {
-					for _, parent := range parents {
-						to, proxyURLStr := buildTo(parent, protocolStr.To, orgServerFQDN, dsType)
+					for _, parent := range tier.Parents {
+						to, proxyURLStr := buildTo(parent, protocolStr.To, orgServerFQDN)
 						proxyURL, err := url.Parse(proxyURLStr)
 						if err != nil {
 							return remap.RemapRules{}, fmt.Errorf("error parsing deliveryservice %v parent %v proxy_url: %v", *ds.XMLID, parent.HostName, proxyURLStr)
@@ -1026,6 +927,9 @@ func createRulesOld(
 						rule.PluginsShared[web.RemapTextKey] = remapTextJSON
 					}
 				}
+				for pluginName, pluginCfg := range dsSigningPlugins[*ds.XMLID] {
+					rule.Plugins[pluginName] = pluginCfg
+				}
 				rules = append(rules, rule)
 			}
 		}
@@ -1194,3 +1098,36 @@ func makeModHdrs(edgeHRWin *string, remapTXTin *string) (web.ModHdrs, web.ModHdr
 
 	return toClientList, toOriginList, nil
 }
+
+// regexRemapUnsupportedVarRe matches the Apache Traffic Server regex_remap substitution variables other than regex groups, such as $h for the host, which Grove doesn't support.
+var regexRemapUnsupportedVarRe = regexp.MustCompile(`\$[a-zA-Z]`)
+
+// makeRegexRemap converts the delivery service regex_remap text, in the Apache Traffic Server regex_remap plugin config format, to Grove regex remap rules. Lines with options or variables Grove doesn't support are skipped with a warning.
+func makeRegexRemap(xmlID string, regexRemapTxt string) remapdata.RegexRemapRules {
+	rules := remapdata.RegexRemapRules{}
+	regexRemapTxt = strings.Replace(regexRemapTxt, "__RETURN__", "\n", -1)
+	for _, line := range strings.Split(regexRemapTxt, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: deliveryservice '" + xmlID + "' regex remap line '" + line + "' malformed, skipping")
+			continue
+		}
+		if len(fields) > 2 {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: deliveryservice '" + xmlID + "' regex remap line '" + line + "' options are not supported, skipping")
+			continue
+		}
+		if regexRemapUnsupportedVarRe.MatchString(fields[1]) {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: deliveryservice '" + xmlID + "' regex remap line '" + line + "' variables are not supported, skipping")
+			continue
+		}
+		if _, err := regexp.Compile(fields[0]); err != nil {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: deliveryservice '" + xmlID + "' regex remap line '" + line + "' invalid regex, skipping: " + err.Error())
+			continue
+		}
+		rules = append(rules, remapdata.RegexRemapRule{Regex: fields[0], Replacement: fields[1]})
+	}
+	return rules
+}
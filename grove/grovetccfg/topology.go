@@ -0,0 +1,231 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+// dsTier is the place of the host in a delivery service's path from clients to the origin.
+type dsTier struct {
+	// Parents are the available servers to request, if the host isn't the last tier.
+	Parents []tc.Server
+	// FirstTier is whether the host receives client requests, and thus uses the edge header rewrite and regex remap of the delivery service.
+	FirstTier bool
+	// LastTier is whether the host requests the origin directly.
+	LastTier bool
+}
+
+func makeTopologyNameMap(topologies []tc.Topology) map[string]tc.Topology {
+	m := map[string]tc.Topology{}
+	for _, topology := range topologies {
+		m[topology.Name] = topology
+	}
+	return m
+}
+
+// makeServerCapabilitiesMap returns the capabilities of each server, keyed by server ID.
+func makeServerCapabilitiesMap(sscs []tc.ServerServerCapability) map[int]map[string]struct{} {
+	m := map[int]map[string]struct{}{}
+	for _, ssc := range sscs {
+		if ssc.ServerID == nil || ssc.ServerCapability == nil {
+			continue
+		}
+		if _, ok := m[*ssc.ServerID]; !ok {
+			m[*ssc.ServerID] = map[string]struct{}{}
+		}
+		m[*ssc.ServerID][*ssc.ServerCapability] = struct{}{}
+	}
+	return m
+}
+
+// makeDSRequiredCapabilitiesMap returns the required capabilities of each delivery service, keyed by delivery service ID.
+func makeDSRequiredCapabilitiesMap(dsrcs []tc.DeliveryServicesRequiredCapability) map[int][]string {
+	m := map[int][]string{}
+	for _, dsrc := range dsrcs {
+		if dsrc.DeliveryServiceID == nil || dsrc.RequiredCapability == nil {
+			continue
+		}
+		m[*dsrc.DeliveryServiceID] = append(m[*dsrc.DeliveryServiceID], *dsrc.RequiredCapability)
+	}
+	return m
+}
+
+func hasCapabilities(serverCaps map[string]struct{}, requiredCaps []string) bool {
+	for _, capability := range requiredCaps {
+		if _, ok := serverCaps[capability]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// topologyNodeIndex returns the index of the node of the given cachegroup in the topology, or -1 if the cachegroup isn't in it.
+func topologyNodeIndex(topology tc.Topology, cachegroup string) int {
+	for i, node := range topology.Nodes {
+		if node.Cachegroup == cachegroup {
+			return i
+		}
+	}
+	return -1
+}
+
+// topologyIsFirstTier returns whether the given node is the first tier of the topology, that is, no other node has it as a parent.
+func topologyIsFirstTier(topology tc.Topology, nodeIndex int) bool {
+	for _, node := range topology.Nodes {
+		for _, parent := range node.Parents {
+			if parent == nodeIndex {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getHostDeliveryServices returns the delivery services the host serves: the active delivery services of its CDN whose topology contains its cachegroup, and the delivery services without a topology assigned to it. Delivery services with required capabilities the host lacks are excluded, per requiredCapabilities.
+func getHostDeliveryServices(
+	host tc.Server,
+	assignedDSes []tc.DeliveryServiceNullable,
+	cdnDSes []tc.DeliveryServiceNullable,
+	topologies map[string]tc.Topology,
+	serverCaps map[int]map[string]struct{},
+	dsCaps map[int][]string,
+) []tc.DeliveryServiceNullable {
+	dses := []tc.DeliveryServiceNullable{}
+	seen := map[string]struct{}{}
+	add := func(ds tc.DeliveryServiceNullable) {
+		if ds.XMLID == nil {
+			return
+		}
+		if _, ok := seen[*ds.XMLID]; ok {
+			return
+		}
+		if !hasCapabilities(serverCaps[host.ID], requiredCapabilities(host, ds, dsCaps)) {
+			return
+		}
+		seen[*ds.XMLID] = struct{}{}
+		dses = append(dses, ds)
+	}
+	for _, ds := range assignedDSes {
+		if ds.Topology == nil {
+			add(ds)
+		}
+	}
+	for _, ds := range cdnDSes {
+		if ds.Topology == nil || ds.Active == nil || !*ds.Active {
+			continue
+		}
+		if topology, ok := topologies[*ds.Topology]; ok && topologyNodeIndex(topology, host.Cachegroup) >= 0 {
+			add(ds)
+		}
+	}
+	return dses
+}
+
+// getDSTier returns the host's tier of the delivery service. Delivery services with a topology use the host's parent nodes in it, and others use the host's cachegroup's parents. The parents are the available servers of the primary parent cachegroup on the host's CDN with all the delivery service's required capabilities, per requiredCapabilities, or of the secondary parent cachegroup if there are none.
+func getDSTier(
+	host tc.Server,
+	ds tc.DeliveryServiceNullable,
+	servers map[string]tc.Server,
+	cachegroups map[string]tc.CacheGroupNullable,
+	topologies map[string]tc.Topology,
+	serverCaps map[int]map[string]struct{},
+	dsCaps map[int][]string,
+) (dsTier, error) {
+	tier := dsTier{}
+	primary, secondary := "", ""
+	if ds.Topology != nil {
+		topology, ok := topologies[*ds.Topology]
+		if !ok {
+			return dsTier{}, errors.New("topology '" + *ds.Topology + "' not found")
+		}
+		nodeIndex := topologyNodeIndex(topology, host.Cachegroup)
+		if nodeIndex < 0 {
+			return dsTier{}, errors.New("cachegroup '" + host.Cachegroup + "' not in topology '" + topology.Name + "'")
+		}
+		node := topology.Nodes[nodeIndex]
+		tier.FirstTier = topologyIsFirstTier(topology, nodeIndex)
+		tier.LastTier = len(node.Parents) == 0
+		parentCachegroup := func(i int) (string, error) {
+			if node.Parents[i] < 0 || node.Parents[i] >= len(topology.Nodes) {
+				return "", errors.New("topology '" + topology.Name + "' cachegroup '" + host.Cachegroup + "' has a nonexistent parent")
+			}
+			return topology.Nodes[node.Parents[i]].Cachegroup, nil
+		}
+		err := error(nil)
+		if len(node.Parents) > 0 {
+			if primary, err = parentCachegroup(0); err != nil {
+				return dsTier{}, err
+			}
+		}
+		if len(node.Parents) > 1 {
+			if secondary, err = parentCachegroup(1); err != nil {
+				return dsTier{}, err
+			}
+		}
+	} else {
+		cachegroup, ok := cachegroups[host.Cachegroup]
+		if !ok {
+			return dsTier{}, errors.New("server cachegroup '" + host.Cachegroup + "' not found in Cachegroups")
+		}
+		tier.FirstTier = strings.HasPrefix(host.Type, tc.EdgeTypePrefix)
+		tier.LastTier = ds.Type != nil && dsTypeSkipsMid(string(*ds.Type))
+		if cachegroup.ParentName != nil {
+			primary = *cachegroup.ParentName
+		}
+		if cachegroup.SecondaryParentName != nil {
+			secondary = *cachegroup.SecondaryParentName
+		}
+	}
+	if tier.LastTier {
+		return tier, nil
+	}
+
+	available := func(s tc.Server) bool {
+		_, statusAvailable := AvailableStatuses()[strings.ToLower(s.Status)]
+		return s.CDNName == host.CDNName && statusAvailable && hasCapabilities(serverCaps[s.ID], requiredCapabilities(s, ds, dsCaps))
+	}
+	if primary != "" {
+		tier.Parents = filterParents(getCachegroupServers(primary, servers), available)
+	}
+	if len(tier.Parents) == 0 && secondary != "" {
+		tier.Parents = filterParents(getCachegroupServers(secondary, servers), available)
+	}
+	return tier, nil
+}
+
+// requiredCapabilities returns the capabilities the server must have to serve the delivery service. As in Traffic Ops, a delivery service's required capabilities apply to every tier of its topology, but only to edges if it doesn't have a topology.
+func requiredCapabilities(server tc.Server, ds tc.DeliveryServiceNullable, dsCaps map[int][]string) []string {
+	if ds.ID == nil || (ds.Topology == nil && !strings.HasPrefix(server.Type, tc.EdgeTypePrefix)) {
+		return nil
+	}
+	return dsCaps[*ds.ID]
+}
+
+// getCachegroupServers returns the servers in the given cachegroup, sorted by hostname so generated rules don't change between runs.
+func getCachegroupServers(cachegroup string, servers map[string]tc.Server) []tc.Server {
+	cgServers := []tc.Server{}
+	for _, server := range servers {
+		if server.Cachegroup == cachegroup {
+			cgServers = append(cgServers, server)
+		}
+	}
+	sort.Slice(cgServers, func(i, j int) bool { return cgServers[i].HostName < cgServers[j].HostName })
+	return cgServers
+}
@@ -0,0 +1,136 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+func TestTopologyTiers(t *testing.T) {
+	str := func(s string) *string { return &s }
+	id := func(i int) *int { return &i }
+	active := true
+
+	topologies := makeTopologyNameMap([]tc.Topology{{
+		Name: "top",
+		Nodes: []tc.TopologyNode{
+			{Cachegroup: "edge", Parents: []int{1, 2}},
+			{Cachegroup: "mid1"},
+			{Cachegroup: "mid2"},
+		},
+	}})
+	servers := makeServersHostnameMap([]tc.Server{
+		{ID: 1, HostName: "edge0", Cachegroup: "edge", CDNName: "cdn", Status: "REPORTED", Type: "EDGE"},
+		{ID: 2, HostName: "mid1a", Cachegroup: "mid1", CDNName: "cdn", Status: "OFFLINE", Type: "MID"},
+		{ID: 3, HostName: "mid1b", Cachegroup: "mid1", CDNName: "cdn", Status: "REPORTED", Type: "MID"},
+		{ID: 4, HostName: "mid2a", Cachegroup: "mid2", CDNName: "cdn", Status: "REPORTED", Type: "MID"},
+	})
+	serverCaps := makeServerCapabilitiesMap([]tc.ServerServerCapability{
+		{ServerID: id(1), ServerCapability: str("ram")},
+		{ServerID: id(4), ServerCapability: str("ram")},
+	})
+	dsCaps := makeDSRequiredCapabilitiesMap([]tc.DeliveryServicesRequiredCapability{
+		{DeliveryServiceID: id(20), RequiredCapability: str("ram")},
+		{DeliveryServiceID: id(30), RequiredCapability: str("disk")},
+	})
+
+	ds := func(dsID int, xmlID string, topology string) tc.DeliveryServiceNullable {
+		ds := tc.DeliveryServiceNullable{}
+		ds.ID, ds.XMLID, ds.Active = id(dsID), str(xmlID), &active
+		if topology != "" {
+			ds.Topology = str(topology)
+		}
+		return ds
+	}
+	cdnDSes := []tc.DeliveryServiceNullable{ds(10, "plain", "top"), ds(20, "ram", "top"), ds(30, "disk", "top"), ds(40, "other", "nope")}
+
+	dses := getHostDeliveryServices(servers["edge0"], nil, cdnDSes, topologies, serverCaps, dsCaps)
+	if len(dses) != 2 || *dses[0].XMLID != "plain" || *dses[1].XMLID != "ram" {
+		t.Fatalf("host delivery services: expected plain and ram, actual %+v", dses)
+	}
+
+	tier, err := getDSTier(servers["edge0"], dses[0], servers, nil, topologies, serverCaps, dsCaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tier.FirstTier || tier.LastTier || len(tier.Parents) != 1 || tier.Parents[0].HostName != "mid1b" {
+		t.Errorf("edge tier: expected first tier with the available primary parent mid1b, actual %+v", tier)
+	}
+
+	// the primary parents lack the required capability, so the secondary parents are used
+	tier, err = getDSTier(servers["edge0"], dses[1], servers, nil, topologies, serverCaps, dsCaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tier.Parents) != 1 || tier.Parents[0].HostName != "mid2a" {
+		t.Errorf("edge tier with capabilities: expected secondary parent mid2a, actual %+v", tier)
+	}
+
+	tier, err = getDSTier(servers["mid1b"], dses[0], servers, nil, topologies, serverCaps, dsCaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier.FirstTier || !tier.LastTier || len(tier.Parents) != 0 {
+		t.Errorf("mid tier: expected last tier without parents, actual %+v", tier)
+	}
+}
+
+func TestNoTopologyCapabilities(t *testing.T) {
+	str := func(s string) *string { return &s }
+	id := func(i int) *int { return &i }
+
+	servers := makeServersHostnameMap([]tc.Server{
+		{ID: 1, HostName: "edge0", Cachegroup: "edge", CDNName: "cdn", Status: "REPORTED", Type: "EDGE"},
+		{ID: 2, HostName: "edge1", Cachegroup: "edge", CDNName: "cdn", Status: "REPORTED", Type: "EDGE"},
+		{ID: 3, HostName: "mid0", Cachegroup: "mid", CDNName: "cdn", Status: "REPORTED", Type: "MID"},
+	})
+	cachegroups := map[string]tc.CacheGroupNullable{"edge": {ParentName: str("mid")}, "mid": {}}
+	serverCaps := makeServerCapabilitiesMap([]tc.ServerServerCapability{
+		{ServerID: id(1), ServerCapability: str("ram")},
+	})
+	dsCaps := makeDSRequiredCapabilitiesMap([]tc.DeliveryServicesRequiredCapability{
+		{DeliveryServiceID: id(20), RequiredCapability: str("ram")},
+	})
+	ds := tc.DeliveryServiceNullable{}
+	ds.ID, ds.XMLID = id(20), str("ram")
+	assigned := []tc.DeliveryServiceNullable{ds}
+
+	if dses := getHostDeliveryServices(servers["edge0"], assigned, nil, nil, serverCaps, dsCaps); len(dses) != 1 {
+		t.Errorf("edge with the required capabilities: expected the delivery service, actual %+v", dses)
+	}
+	if dses := getHostDeliveryServices(servers["edge1"], assigned, nil, nil, serverCaps, dsCaps); len(dses) != 0 {
+		t.Errorf("edge without the required capabilities: expected no delivery services, actual %+v", dses)
+	}
+	if dses := getHostDeliveryServices(servers["mid0"], assigned, nil, nil, serverCaps, dsCaps); len(dses) != 1 {
+		t.Errorf("mid without the required capabilities: expected the delivery service, as they only apply to edges without a topology, actual %+v", dses)
+	}
+
+	tier, err := getDSTier(servers["edge0"], ds, servers, cachegroups, nil, serverCaps, dsCaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tier.Parents) != 1 || tier.Parents[0].HostName != "mid0" {
+		t.Errorf("edge tier: expected parent mid0 without the required capabilities, actual %+v", tier)
+	}
+}
+
+func TestMakeRegexRemap(t *testing.T) {
+	rules := makeRegexRemap("ds", `^/a/(.*) http://origin/b/$1__RETURN__^/c /d @status=301__RETURN__^/e http://$h/f__RETURN__^/(?=g) /h__RETURN__`)
+	if len(rules) != 1 || rules[0].Regex != `^/a/(.*)` || rules[0].Replacement != `http://origin/b/$1` {
+		t.Errorf("expected only the first line to be converted, actual %+v", rules)
+	}
+}
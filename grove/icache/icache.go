@@ -26,6 +26,8 @@ type Cache interface {
 	Get(key string) (*cacheobj.CacheObj, bool)
 	Peek(key string) (*cacheobj.CacheObj, bool)
 	Keys() []string
+	// Remove removes the key from the cache. Returns whether the key existed.
+	Remove(key string) bool
 	Size() uint64
 	Close()
 }
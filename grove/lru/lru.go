@@ -48,6 +48,17 @@ func (c *LRU) Add(key string, size uint64) uint64 {
 	return 0
 }
 
+// AddOldest adds the key to the LRU as the least recently used, with the given size, if it doesn't already exist. Returns whether the key was added. This is used to rebuild an LRU from newest to oldest, without demoting keys added concurrently.
+func (c *LRU) AddOldest(key string, size uint64) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, ok := c.lElems[key]; ok {
+		return false
+	}
+	c.lElems[key] = c.l.PushBack(&listObj{key, size})
+	return true
+}
+
 // RemoveOldest returns the key, size, and true if the LRU is nonempty; else false.
 func (c *LRU) RemoveOldest() (string, uint64, bool) {
 	c.m.Lock()
@@ -63,6 +74,19 @@ func (c *LRU) RemoveOldest() (string, uint64, bool) {
 	return obj.key, obj.size, true
 }
 
+// Remove removes the key from the LRU. Returns the size of the removed key, and true if it existed; else false.
+func (c *LRU) Remove(key string) (uint64, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	elem, ok := c.lElems[key]
+	if !ok {
+		return 0, false
+	}
+	c.l.Remove(elem)
+	delete(c.lElems, key)
+	return elem.Value.(*listObj).size, true
+}
+
 // Keys returns a string array of the keys
 func (c *LRU) Keys() []string {
 	c.m.RLock()
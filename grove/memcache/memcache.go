@@ -66,15 +66,16 @@ func (c *MemCache) Peek(key string) (*cacheobj.CacheObj, bool) {
 }
 
 func (c *MemCache) Add(key string, val *cacheobj.CacheObj) bool {
+	// the map and LRU are changed under the same lock, so a concurrent Remove or GC of the same key can't leave the key in one but not the other
 	c.cacheM.Lock()
 	c.cache[key] = val
-	c.cacheM.Unlock()
 	oldSize := c.lru.Add(key, val.Size)
 	sizeChange := val.Size - oldSize
+	newSizeBytes := atomic.AddUint64(&c.sizeBytes, sizeChange)
+	c.cacheM.Unlock()
 	if sizeChange == 0 {
 		return false
 	}
-	newSizeBytes := atomic.AddUint64(&c.sizeBytes, sizeChange)
 	if newSizeBytes <= c.maxSizeBytes {
 		return false
 	}
@@ -82,6 +83,19 @@ func (c *MemCache) Add(key string, val *cacheobj.CacheObj) bool {
 	return false // TODO remove eviction from interface; it's unnecessary and expensive
 }
 
+// Remove removes the key from the cache. Returns whether the key existed.
+func (c *MemCache) Remove(key string) bool {
+	c.cacheM.Lock()
+	defer c.cacheM.Unlock()
+	delete(c.cache, key)
+	sizeBytes, exists := c.lru.Remove(key)
+	if !exists {
+		return false
+	}
+	atomic.AddUint64(&c.sizeBytes, ^uint64(sizeBytes-1)) // subtract sizeBytes
+	return true
+}
+
 func (c *MemCache) Size() uint64 { return atomic.LoadUint64(&c.sizeBytes) }
 func (c *MemCache) Close()       {}
 
@@ -104,8 +118,10 @@ func (c *MemCache) gcManager(gcChan <-chan uint64) {
 func (c *MemCache) gc(cacheSizeBytes uint64) {
 	for cacheSizeBytes > c.maxSizeBytes {
 		log.Debugf("MemCache.gc cacheSizeBytes %+v > c.maxSizeBytes %+v\n", cacheSizeBytes, c.maxSizeBytes)
+		c.cacheM.Lock()
 		key, sizeBytes, exists := c.lru.RemoveOldest() // TODO change lru to use strings
 		if !exists {
+			c.cacheM.Unlock()
 			// should never happen
 			log.Errorf("MemCache.gc sizeBytes %v > %v maxSizeBytes, but LRU is empty!? Setting cache size to 0!\n", cacheSizeBytes, c.maxSizeBytes)
 			atomic.StoreUint64(&c.sizeBytes, 0)
@@ -113,11 +129,9 @@ func (c *MemCache) gc(cacheSizeBytes uint64) {
 		}
 
 		log.Debugf("MemCache.gc deleting key '" + key + "'")
-		c.cacheM.Lock()
 		delete(c.cache, key)
-		c.cacheM.Unlock()
-
 		cacheSizeBytes = atomic.AddUint64(&c.sizeBytes, ^uint64(sizeBytes-1)) // subtract sizeBytes
+		c.cacheM.Unlock()
 	}
 }
 
@@ -0,0 +1,77 @@
+package memcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+)
+
+func TestRemove(t *testing.T) {
+	c := New(1024 * 1024)
+	c.Add("a", &cacheobj.CacheObj{Size: 10})
+	c.Add("b", &cacheobj.CacheObj{Size: 20})
+
+	if !c.Remove("a") {
+		t.Errorf("Remove of existing key expected true, actual false")
+	}
+	if c.Remove("a") {
+		t.Errorf("Remove of removed key expected false, actual true")
+	}
+	if _, ok := c.Peek("a"); ok {
+		t.Errorf("Peek of removed key expected not found, actual found")
+	}
+	if size := c.Size(); size != 20 {
+		t.Errorf("Size after Remove expected 20, actual %v", size)
+	}
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("Keys after Remove expected [b], actual %v", keys)
+	}
+}
+
+// TestAddRemoveConcurrent tests that concurrent adds and removes of the same key leave the map, LRU, and size consistent.
+func TestAddRemoveConcurrent(t *testing.T) {
+	c := New(1024 * 1024)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if (i+j)%2 == 0 {
+					c.Add("key", &cacheobj.CacheObj{Size: 10})
+				} else {
+					c.Remove("key")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, inMap := c.Peek("key")
+	inLRU := len(c.Keys()) == 1
+	if inMap != inLRU {
+		t.Fatalf("expected key in both map and LRU or neither, actual map %v LRU %v", inMap, inLRU)
+	}
+	expectedSize := uint64(0)
+	if inMap {
+		expectedSize = 10
+	}
+	if size := c.Size(); size != expectedSize {
+		t.Errorf("Size expected %v, actual %v", expectedSize, size)
+	}
+}
@@ -0,0 +1,530 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/trace"
+	"github.com/apache/trafficcontrol/grove/web"
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// AccessLogConfig is the config of the access_log plugin. The Logs are only read from the global plugins config, and opened on startup. The Filter may be given globally, or per remap rule to override it.
+type AccessLogConfig struct {
+	Logs   []AccessLogFileConfig `json:"logs"`
+	Filter *AccessLogFilter      `json:"filter"`
+}
+
+// AccessLogFileConfig is the config of a single access log file.
+type AccessLogFileConfig struct {
+	// Name identifies the log in filters and metrics. The default is the path.
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Format is one of AccessLogFormatJSON, AccessLogFormatW3C, or AccessLogFormatCustom.
+	Format string `json:"format"`
+	// Fields are the fields to log, for the json and w3c formats. The default is DefaultAccessLogFields.
+	Fields []string `json:"fields"`
+	// CustomFormat is the line format of the custom format, in the style of Apache Traffic Server logging.yaml formats, e.g. "%<cqtq> %<chi> %<cqhm> %<cquc> %<pssc>".
+	CustomFormat string           `json:"custom_format"`
+	Filter       *AccessLogFilter `json:"filter"`
+	// RotateBytes is the size after which the file is rotated. If 0, the file isn't rotated by size.
+	RotateBytes int64 `json:"rotate_bytes"`
+	// RotateIntervalMS is how long in milliseconds to write to a file before it's rotated. If 0, the file isn't rotated by time.
+	RotateIntervalMS int `json:"rotate_interval_ms"`
+	// MaxFiles is the number of rotated files to keep. If 0, all rotated files are kept.
+	MaxFiles int `json:"max_files"`
+	// BufferLines is the number of lines which may be waiting to be written, after which lines are dropped rather than blocking requests. The default is DefaultAccessLogBufferLines.
+	BufferLines int `json:"buffer_lines"`
+}
+
+// AccessLogFilter selects which requests are logged. Each non-empty list must contain the request's value for it to be logged.
+type AccessLogFilter struct {
+	// Disabled is whether to log nothing.
+	Disabled bool `json:"disabled"`
+	// LogNames are the names of the logs to write to. If empty, all logs are written.
+	LogNames []string `json:"log_names"`
+	// Codes are the response codes to log. Each may be a code, such as "404", or a class, such as "5xx".
+	Codes []string `json:"codes"`
+	// Methods are the request methods to log.
+	Methods []string `json:"methods"`
+	// CacheResults are the cache results to log, as logged in the crc field, such as "TCP_MISS".
+	CacheResults []string `json:"cache_results"`
+}
+
+const AccessLogFormatJSON = "json"
+const AccessLogFormatW3C = "w3c"
+const AccessLogFormatCustom = "custom"
+
+const DefaultAccessLogBufferLines = 4096
+
+var DefaultAccessLogFields = []string{"cqtq", "chi", "phn", "shn", "cqhm", "cquc", "cqhv", "pssc", "ttms", "psql", "sssc", "sscl", "cfsc", "pfsc", "crc", "phr", "pqsn", "{User-Agent}cqh", "reqid"}
+
+var DefaultAccessLogW3CFields = []string{"cqtd", "cqtt", "chi", "cqhm", "cqup", "cquq", "pssc", "psql", "ttms", "crc", "{User-Agent}cqh"}
+
+type accessLogConfig struct {
+	logs   []accessLogFile
+	filter *AccessLogFilter
+}
+
+type accessLogFile struct {
+	cfg    AccessLogFileConfig
+	format accessLogFormatter
+	header []byte
+}
+
+// accessLogs is the startup context, the open logs shared by all requests.
+type accessLogs struct {
+	logs []accessLog
+}
+
+type accessLog struct {
+	file   accessLogFile
+	writer *accessLogWriter
+}
+
+var accessLogsMutex sync.Mutex
+
+// openAccessLogs are the logs opened by the last startup, by name. When the config is reloaded, their writers are kept if their file config is unchanged, and closed otherwise.
+var openAccessLogs = map[string]accessLog{}
+
+func init() {
+	AddPlugin(20000, Funcs{load: accessLogLoad, startup: accessLogStartup, afterRespond: accessLogAfterRespond})
+}
+
+func accessLogLoad(b json.RawMessage) interface{} {
+	cfg := AccessLogConfig{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		log.Errorln("access_log loading config, unmarshalling JSON: " + err.Error())
+		return nil
+	}
+	logs := []accessLogFile{}
+	names := map[string]struct{}{}
+	for _, fileCfg := range cfg.Logs {
+		if fileCfg.Name == "" {
+			fileCfg.Name = fileCfg.Path
+		}
+		if _, ok := names[fileCfg.Name]; ok {
+			log.Errorln("access_log loading config: duplicate log name '" + fileCfg.Name + "', ignoring")
+			continue
+		}
+		file, err := makeAccessLogFile(fileCfg)
+		if err != nil {
+			log.Errorln("access_log loading config: log '" + fileCfg.Name + "': " + err.Error() + ", ignoring")
+			continue
+		}
+		names[fileCfg.Name] = struct{}{}
+		logs = append(logs, file)
+	}
+	log.Debugf("access_log load success: %+v\n", cfg)
+	return &accessLogConfig{logs: logs, filter: cfg.Filter}
+}
+
+func makeAccessLogFile(cfg AccessLogFileConfig) (accessLogFile, error) {
+	if cfg.Path == "" {
+		return accessLogFile{}, errors.New("missing path")
+	}
+	if cfg.BufferLines <= 0 {
+		cfg.BufferLines = DefaultAccessLogBufferLines
+	}
+	file := accessLogFile{cfg: cfg}
+	err := error(nil)
+	switch cfg.Format {
+	case AccessLogFormatJSON, "":
+		file.cfg.Format = AccessLogFormatJSON
+		file.format, err = makeAccessLogJSONFormat(cfg.Fields)
+	case AccessLogFormatW3C:
+		file.format, file.header, err = makeAccessLogW3CFormat(cfg.Fields)
+	case AccessLogFormatCustom:
+		file.format, err = makeAccessLogCustomFormat(cfg.CustomFormat)
+	default:
+		err = errors.New("unknown format '" + cfg.Format + "'")
+	}
+	return file, err
+}
+
+// accessLogStartup opens the configured logs, and closes the logs of the previous config, if it was reloaded.
+// Logs whose file config is unchanged keep their writer, so lines from requests still in flight with the previous config aren't lost. The others are closed before new writers are opened, so two writers never append to the same file; lines written to them by requests in flight are dropped and counted.
+func accessLogStartup(icfg interface{}, d StartupData) {
+	accessLogsMutex.Lock()
+	defer accessLogsMutex.Unlock()
+
+	cfg, ok := icfg.(*accessLogConfig)
+	if !ok && icfg != nil {
+		log.Errorf("access_log config '%v' type '%T' expected *accessLogConfig\n", icfg, icfg)
+	}
+	kept := map[string]*accessLogWriter{}
+	if ok {
+		for _, file := range cfg.logs {
+			if old, ok := openAccessLogs[file.cfg.Name]; ok && accessLogWriterUnchanged(old.file, file) {
+				kept[file.cfg.Name] = old.writer
+			}
+		}
+	}
+	for name, old := range openAccessLogs {
+		if _, ok := kept[name]; !ok {
+			old.writer.Close()
+		}
+	}
+	openAccessLogs = map[string]accessLog{}
+	if !ok {
+		return
+	}
+
+	logs := &accessLogs{}
+	for _, file := range cfg.logs {
+		w, ok := kept[file.cfg.Name]
+		if !ok {
+			err := error(nil)
+			w, err = newAccessLogWriter(file.cfg.Name, file.cfg.Path, file.header, file.cfg.RotateBytes, time.Duration(file.cfg.RotateIntervalMS)*time.Millisecond, file.cfg.MaxFiles, file.cfg.BufferLines)
+			if err != nil {
+				log.Errorln("access_log opening log '" + file.cfg.Name + "': " + err.Error())
+				continue
+			}
+		}
+		l := accessLog{file: file, writer: w}
+		openAccessLogs[file.cfg.Name] = l
+		logs.logs = append(logs.logs, l)
+	}
+	*d.Context = logs
+}
+
+// accessLogWriterUnchanged returns whether the writer of the old log file config can be used for the new one, because everything the writer uses is the same.
+func accessLogWriterUnchanged(old accessLogFile, new accessLogFile) bool {
+	return old.cfg.Path == new.cfg.Path &&
+		bytes.Equal(old.header, new.header) &&
+		old.cfg.RotateBytes == new.cfg.RotateBytes &&
+		old.cfg.RotateIntervalMS == new.cfg.RotateIntervalMS &&
+		old.cfg.MaxFiles == new.cfg.MaxFiles &&
+		old.cfg.BufferLines == new.cfg.BufferLines
+}
+
+func accessLogAfterRespond(icfg interface{}, d AfterRespondData) {
+	logs, ok := (*d.Context).(*accessLogs)
+	if !ok || len(logs.logs) == 0 {
+		return
+	}
+	ruleFilter := (*AccessLogFilter)(nil)
+	if cfg, ok := icfg.(*accessLogConfig); ok {
+		ruleFilter = cfg.filter
+	}
+	if ruleFilter != nil && ruleFilter.Disabled {
+		return
+	}
+
+	now := time.Now()
+	e := accessLogEntry{d: d, now: now, bytesSent: web.TryGetBytesWritten(d.W, d.Conn, d.BytesWritten)}
+	for _, l := range logs.logs {
+		if !ruleFilter.accepts(l.file.cfg.Name, e) || !l.file.cfg.Filter.accepts(l.file.cfg.Name, e) {
+			continue
+		}
+		l.writer.Write(l.file.format(e))
+	}
+}
+
+// accepts returns whether the filter accepts the request for the given log. A nil filter accepts everything.
+func (f *AccessLogFilter) accepts(logName string, e accessLogEntry) bool {
+	if f == nil {
+		return true
+	}
+	if f.Disabled {
+		return false
+	}
+	if len(f.LogNames) > 0 && !containsStr(f.LogNames, logName) {
+		return false
+	}
+	if len(f.Methods) > 0 && !containsStr(f.Methods, e.d.Req.Method) {
+		return false
+	}
+	if len(f.CacheResults) > 0 && !containsStr(f.CacheResults, getCacheHitStr(e.d.CacheHit, e.d.OriginConnectFailed)) {
+		return false
+	}
+	if len(f.Codes) > 0 {
+		code := strconv.Itoa(e.d.RespCode)
+		class := code[:1] + "xx"
+		match := false
+		for _, c := range f.Codes {
+			if c == code || strings.ToLower(c) == class {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+func containsStr(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessLogDropped returns the number of lines each access log has dropped, because its writer fell behind, keyed by log name. Counts are kept across config reloads.
+func AccessLogDropped() map[string]uint64 {
+	return accessLogDrops.Get()
+}
+
+// accessLogEntry is the data of a single request, from which fields are logged.
+type accessLogEntry struct {
+	d         AfterRespondData
+	now       time.Time
+	bytesSent uint64
+}
+
+type accessLogFormatter func(e accessLogEntry) []byte
+
+// accessLogField returns the value of a field, and whether it's numeric, in which case it isn't quoted in JSON.
+type accessLogField struct {
+	val     func(e accessLogEntry) string
+	numeric bool
+}
+
+// accessLogFields are the fields which may be logged, named after the Apache Traffic Server log fields. In addition, "{Name}cqh" logs the client request header Name.
+var accessLogFields = map[string]accessLogField{
+	"cqtq": {val: func(e accessLogEntry) string { return accessLogTimestamp(e.now) }, numeric: true},
+	"cqtd": {val: func(e accessLogEntry) string { return e.now.UTC().Format("2006-01-02") }},
+	"cqtt": {val: func(e accessLogEntry) string { return e.now.UTC().Format("15:04:05") }},
+	"ttms": {val: func(e accessLogEntry) string {
+		return strconv.FormatInt(int64(e.now.Sub(e.d.ReqTime)/time.Millisecond), 10)
+	}, numeric: true},
+	"chi":  {val: func(e accessLogEntry) string { return e.d.ClientIP }},
+	"phn":  {val: func(e accessLogEntry) string { return e.d.Hostname }},
+	"php":  {val: func(e accessLogEntry) string { return e.d.Port }},
+	"shn":  {val: func(e accessLogEntry) string { return e.d.ToFQDN }},
+	"cqhm": {val: func(e accessLogEntry) string { return e.d.Req.Method }},
+	"cquc": {val: func(e accessLogEntry) string { return e.d.Scheme + "://" + e.d.Req.Host + e.d.Req.URL.String() }},
+	"cqup": {val: func(e accessLogEntry) string { return e.d.Req.URL.Path }},
+	"cquq": {val: func(e accessLogEntry) string { return e.d.Req.URL.RawQuery }},
+	"cqhv": {val: func(e accessLogEntry) string { return e.d.Req.Proto }},
+	"pssc": {val: func(e accessLogEntry) string { return strconv.Itoa(e.d.RespCode) }, numeric: true},
+	"psql": {val: func(e accessLogEntry) string { return strconv.FormatUint(e.bytesSent, 10) }, numeric: true},
+	"sssc": {val: func(e accessLogEntry) string { return strconv.Itoa(e.d.OriginCode) }, numeric: true},
+	"sscl": {val: func(e accessLogEntry) string { return strconv.FormatUint(e.d.OriginBytes, 10) }, numeric: true},
+	"cfsc": {val: func(e accessLogEntry) string { return finOrIntr(e.d.RespSuccess) }},
+	"pfsc": {val: func(e accessLogEntry) string { return finOrIntr(e.d.OriginReqSuccess) }},
+	"crc":  {val: func(e accessLogEntry) string { return getCacheHitStr(e.d.CacheHit, e.d.OriginConnectFailed) }},
+	"phr": {val: func(e accessLogEntry) string {
+		phr, _ := getParentStrings(e.d.RespCode, e.d.CacheHit, e.d.ProxyStr, e.d.ToFQDN)
+		return phr
+	}},
+	"pqsn": {val: func(e accessLogEntry) string {
+		_, pqsn := getParentStrings(e.d.RespCode, e.d.CacheHit, e.d.ProxyStr, e.d.ToFQDN)
+		return pqsn
+	}},
+	"reqid": {val: func(e accessLogEntry) string { return strconv.FormatUint(e.d.RequestID, 10) }, numeric: true},
+	"traceid": {val: func(e accessLogEntry) string {
+		if traceID := trace.FromContext(e.d.Req.Context()).Context().TraceID; traceID.IsValid() {
+			return traceID.String()
+		}
+		return "-"
+	}},
+}
+
+// accessLogW3CNames are the W3C Extended Log Format names of fields. Fields without a W3C name are logged as "x-" followed by the field name.
+var accessLogW3CNames = map[string]string{
+	"cqtd": "date",
+	"cqtt": "time",
+	"chi":  "c-ip",
+	"phn":  "s-dns",
+	"php":  "s-port",
+	"cqhm": "cs-method",
+	"cquc": "cs-uri",
+	"cqup": "cs-uri-stem",
+	"cquq": "cs-uri-query",
+	"cqhv": "cs-version",
+	"pssc": "sc-status",
+	"psql": "sc-bytes",
+}
+
+const accessLogHeaderFieldSuffix = "cqh"
+
+// getAccessLogField returns the named field, which may be a known field or a client request header field.
+func getAccessLogField(name string) (accessLogField, bool) {
+	if f, ok := accessLogFields[name]; ok {
+		return f, true
+	}
+	if !strings.HasPrefix(name, "{") || !strings.HasSuffix(name, "}"+accessLogHeaderFieldSuffix) || len(name) <= len("{}"+accessLogHeaderFieldSuffix) {
+		return accessLogField{}, false
+	}
+	hdr := name[1 : len(name)-len("}"+accessLogHeaderFieldSuffix)]
+	return accessLogField{val: func(e accessLogEntry) string { return e.d.Req.Header.Get(hdr) }}, true
+}
+
+func getAccessLogFields(names []string) ([]accessLogField, error) {
+	fields := make([]accessLogField, 0, len(names))
+	for _, name := range names {
+		f, ok := getAccessLogField(name)
+		if !ok {
+			return nil, errors.New("unknown field '" + name + "'")
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func makeAccessLogJSONFormat(names []string) (accessLogFormatter, error) {
+	if len(names) == 0 {
+		names = DefaultAccessLogFields
+	}
+	fields, err := getAccessLogFields(names)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(names))
+	for i, name := range names {
+		key, _ := json.Marshal(name)
+		keys[i] = append(key, ':')
+	}
+	return func(e accessLogEntry) []byte {
+		b := bytes.Buffer{}
+		b.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.Write(keys[i])
+			val := f.val(e)
+			if f.numeric {
+				b.WriteString(val)
+				continue
+			}
+			quoted, _ := json.Marshal(val) // can't fail for a string
+			b.Write(quoted)
+		}
+		b.WriteString("}\n")
+		return b.Bytes()
+	}, nil
+}
+
+// makeAccessLogW3CFormat returns the formatter and file header of the W3C Extended Log Format with the given fields.
+func makeAccessLogW3CFormat(names []string) (accessLogFormatter, []byte, error) {
+	if len(names) == 0 {
+		names = DefaultAccessLogW3CFields
+	}
+	fields, err := getAccessLogFields(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	w3cNames := make([]string, len(names))
+	for i, name := range names {
+		w3cNames[i] = accessLogW3CName(name)
+	}
+	header := []byte("#Version: 1.0\n#Software: Grove\n#Fields: " + strings.Join(w3cNames, " ") + "\n")
+	return func(e accessLogEntry) []byte {
+		b := bytes.Buffer{}
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(w3cValue(f.val(e)))
+		}
+		b.WriteByte('\n')
+		return b.Bytes()
+	}, header, nil
+}
+
+func accessLogW3CName(name string) string {
+	if w3cName, ok := accessLogW3CNames[name]; ok {
+		return w3cName
+	}
+	if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}"+accessLogHeaderFieldSuffix) {
+		return "cs(" + name[1:len(name)-len("}"+accessLogHeaderFieldSuffix)] + ")"
+	}
+	return "x-" + name
+}
+
+// w3cValue returns the value as a W3C Extended Log Format field: "-" if empty, and quoted if it contains whitespace or quotes, with quotes doubled.
+func w3cValue(val string) string {
+	if val == "" {
+		return "-"
+	}
+	if !strings.ContainsAny(val, " \t\r\n\"") {
+		return val
+	}
+	val = strings.NewReplacer("\"", "\"\"", "\r", " ", "\n", " ").Replace(val)
+	return `"` + val + `"`
+}
+
+// makeAccessLogCustomFormat returns a formatter for the given Apache Traffic Server style format, in which "%<field>" is replaced with the field value, or "-" if it's empty.
+func makeAccessLogCustomFormat(format string) (accessLogFormatter, error) {
+	if format == "" {
+		return nil, errors.New("missing custom_format")
+	}
+	literals := []string{}
+	fields := []accessLogField{}
+	for {
+		start := strings.Index(format, "%<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(format[start:], ">")
+		if end < 0 {
+			return nil, errors.New("custom_format has unterminated field '" + format[start:] + "'")
+		}
+		end += start
+		name := format[start+len("%<") : end]
+		f, ok := getAccessLogField(name)
+		if !ok {
+			return nil, errors.New("custom_format has unknown field '" + name + "'")
+		}
+		literals = append(literals, format[:start])
+		fields = append(fields, f)
+		format = format[end+1:]
+	}
+	literals = append(literals, format)
+	return func(e accessLogEntry) []byte {
+		b := bytes.Buffer{}
+		for i, f := range fields {
+			b.WriteString(literals[i])
+			val := f.val(e)
+			if val == "" {
+				val = "-"
+			}
+			b.WriteString(val)
+		}
+		b.WriteString(literals[len(literals)-1])
+		b.WriteByte('\n')
+		return b.Bytes()
+	}, nil
+}
+
+// accessLogTimestamp returns the time as Unix seconds with three decimal places, like the Apache Traffic Server cqtq field.
+func accessLogTimestamp(t time.Time) string {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	frac := strconv.FormatInt(ms%1000, 10)
+	for len(frac) < 3 {
+		frac = "0" + frac
+	}
+	return strconv.FormatInt(ms/1000, 10) + "." + frac
+}
+
+func finOrIntr(success bool) string {
+	if success {
+		return "FIN"
+	}
+	return "INTR"
+}
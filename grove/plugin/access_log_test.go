@@ -0,0 +1,221 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cachedata"
+)
+
+func testAccessLogEntry(t *testing.T) accessLogEntry {
+	req, err := http.NewRequest("GET", "/foo/bar?a=b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.net"
+	req.Header.Set("User-Agent", `curl "quoted"`)
+	reqTime := time.Unix(1563936732, 547000000)
+	return accessLogEntry{
+		d: AfterRespondData{
+			ReqData:  cachedata.ReqData{Req: req, ClientIP: "192.0.2.1", ReqTime: reqTime},
+			SrvrData: cachedata.SrvrData{Hostname: "grove01", Port: "80", Scheme: "http"},
+			RespData: cachedata.RespData{RespCode: 503, BytesWritten: 42, RespSuccess: true},
+		},
+		now:       reqTime.Add(12 * time.Millisecond),
+		bytesSent: 42,
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	e := testAccessLogEntry(t)
+
+	jsonFormat, err := makeAccessLogJSONFormat([]string{"cqtq", "chi", "cquc", "pssc", "{User-Agent}cqh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(jsonFormat(e), &obj); err != nil {
+		t.Fatalf("json format: invalid JSON: %v", err)
+	}
+	if obj["cqtq"] != 1563936732.559 || obj["chi"] != "192.0.2.1" || obj["cquc"] != "http://example.net/foo/bar?a=b" || obj["pssc"] != float64(503) || obj["{User-Agent}cqh"] != `curl "quoted"` {
+		t.Errorf("json format: unexpected fields %+v", obj)
+	}
+
+	w3cFormat, header, err := makeAccessLogW3CFormat([]string{"cqtd", "cqtt", "chi", "cqup", "cquq", "ttms", "{User-Agent}cqh", "{X-None}cqh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(header), "#Fields: date time c-ip cs-uri-stem cs-uri-query x-ttms cs(User-Agent) cs(X-None)\n") {
+		t.Errorf("w3c format: unexpected header %q", header)
+	}
+	if line, expected := string(w3cFormat(e)), `2019-07-24 02:52:12 192.0.2.1 /foo/bar a=b 12 "curl ""quoted""" -`+"\n"; line != expected {
+		t.Errorf("w3c format: expected %q actual %q", expected, line)
+	}
+
+	customFormat, err := makeAccessLogCustomFormat("%<chi> [%<crc>] %<cqhm> %<sssc>/%<phr> %<{X-None}cqh>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, expected := string(customFormat(e)), "192.0.2.1 [TCP_MISS] GET 0/DIRECT -\n"; line != expected {
+		t.Errorf("custom format: expected %q actual %q", expected, line)
+	}
+
+	for _, format := range []string{"%<nope>", "%<chi", "%<{}cqh>"} {
+		if _, err := makeAccessLogCustomFormat(format); err == nil {
+			t.Errorf("custom format %q: expected error, actual nil", format)
+		}
+	}
+}
+
+func TestAccessLogFilter(t *testing.T) {
+	e := testAccessLogEntry(t)
+	tests := []struct {
+		filter   *AccessLogFilter
+		accepted bool
+	}{
+		{nil, true},
+		{&AccessLogFilter{}, true},
+		{&AccessLogFilter{Disabled: true}, false},
+		{&AccessLogFilter{LogNames: []string{"a"}}, true},
+		{&AccessLogFilter{LogNames: []string{"b"}}, false},
+		{&AccessLogFilter{Codes: []string{"5XX"}}, true},
+		{&AccessLogFilter{Codes: []string{"404", "503"}}, true},
+		{&AccessLogFilter{Codes: []string{"4xx"}}, false},
+		{&AccessLogFilter{Methods: []string{"HEAD"}}, false},
+		{&AccessLogFilter{Methods: []string{"GET"}, CacheResults: []string{"TCP_MISS"}}, true},
+		{&AccessLogFilter{CacheResults: []string{"TCP_HIT"}}, false},
+	}
+	for _, test := range tests {
+		if accepted := test.filter.accepts("a", e); accepted != test.accepted {
+			t.Errorf("filter %+v: expected accepted %v actual %v", test.filter, test.accepted, accepted)
+		}
+	}
+}
+
+func TestAccessLogWriterRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	header := []byte("#header\n")
+	w, err := newAccessLogWriter("test-rotates", path, header, 20, 0, 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Write([]byte("0123456789\n"))
+	}
+	w.Close()
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Errorf("expected 2 rotated files, actual %v", rotated)
+	}
+	for _, name := range append(rotated, path) {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "#header\n0123456789\n" {
+			t.Errorf("file %s: expected one line after the header, actual %q", name, b)
+		}
+	}
+	if dropped := AccessLogDropped()["test-rotates"]; dropped != 0 {
+		t.Errorf("expected 0 dropped lines, actual %v", dropped)
+	}
+}
+
+func TestAccessLogWriterReopens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logDir := filepath.Join(dir, "logs")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(logDir, "access.log")
+
+	droppedBefore := AccessLogDropped()["test-reopens"]
+	w, err := newAccessLogWriter("test-reopens", path, nil, 20, 0, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("0123456789\n"))
+	if err := os.RemoveAll(logDir); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("0123456789\n")) // rotates, and fails to open the new file
+	w.Write([]byte("0123456789\n"))
+	time.Sleep(accessLogRotateCheckInterval + 100*time.Millisecond) // lines are written asynchronously, so the open may have failed after the Write returned
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("reopened\n"))
+	w.Close()
+
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "reopened\n" {
+		t.Errorf("expected the file to be reopened with the line written after it failed, actual %q error %v", b, err)
+	}
+	if dropped := AccessLogDropped()["test-reopens"] - droppedBefore; dropped != 2 {
+		t.Errorf("expected 2 dropped lines, actual %v", dropped)
+	}
+}
+
+func TestAccessLogStartupKeepsWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	startup := func(format string) *accessLogs {
+		cfg := accessLogLoad(json.RawMessage(`{"logs": [{"name": "test-reload", "path": "` + path + `", "format": "custom", "custom_format": "` + format + `"}]}`))
+		ctx := interface{}(nil)
+		accessLogStartup(cfg, StartupData{Context: &ctx})
+		return ctx.(*accessLogs)
+	}
+	old := startup("%<cqhm>")
+	reloaded := startup("%<cqup>")
+	if old.logs[0].writer != reloaded.logs[0].writer {
+		t.Errorf("reload with unchanged log file config expected the writer to be kept, actual new writer")
+	}
+	old.logs[0].writer.Write([]byte("in flight\n")) // from a request which started before the reload
+	accessLogStartup(nil, StartupData{})
+
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "in flight\n" {
+		t.Errorf("expected the line written after reload to be written, actual %q error %v", b, err)
+	}
+	old.logs[0].writer.Write([]byte("after close\n"))
+	if dropped := AccessLogDropped()["test-reload"]; dropped != 1 {
+		t.Errorf("expected 1 dropped line written after the log was closed, actual %v", dropped)
+	}
+}
@@ -0,0 +1,294 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// AccessLogRotateTimeFormat is the format of the time suffix of rotated log files, which sorts in the order the files were rotated.
+const AccessLogRotateTimeFormat = "20060102T150405.000000000Z"
+
+// accessLogRotateCheckInterval is how often a writer with a rotation interval checks whether it's time to rotate, when no lines are being written. It's also how often a writer whose file failed to open tries to open it again.
+const accessLogRotateCheckInterval = time.Second
+
+// accessLogWriter writes lines to a log file in the background, so requests never wait on the disk. If the writer falls behind by more than its buffer, lines are dropped and counted.
+type accessLogWriter struct {
+	name           string
+	path           string
+	header         []byte
+	rotateBytes    int64
+	rotateInterval time.Duration
+	maxFiles       int
+	lines          chan []byte
+	dropped        *uint64
+	done           chan struct{}
+	stopped        chan struct{}
+	closeM         sync.RWMutex // held for reading while a line is queued, so lines can't be queued after the queue is drained on Close
+	closed         bool
+
+	file       *os.File
+	buf        *bufio.Writer
+	size       int64
+	opened     time.Time
+	openFailed time.Time
+}
+
+// newAccessLogWriter opens the log file for appending, and starts writing lines to it. The header is written at the start of each new file.
+func newAccessLogWriter(name string, path string, header []byte, rotateBytes int64, rotateInterval time.Duration, maxFiles int, bufferLines int) (*accessLogWriter, error) {
+	w := &accessLogWriter{
+		name:           name,
+		path:           path,
+		header:         header,
+		rotateBytes:    rotateBytes,
+		rotateInterval: rotateInterval,
+		maxFiles:       maxFiles,
+		lines:          make(chan []byte, bufferLines),
+		dropped:        accessLogDrops.Counter(name),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues the line to be written, or drops it if the queue is full or the writer is closed. It never blocks.
+func (w *accessLogWriter) Write(line []byte) {
+	w.closeM.RLock()
+	defer w.closeM.RUnlock()
+	if w.closed {
+		atomic.AddUint64(w.dropped, 1)
+		return
+	}
+	select {
+	case w.lines <- line:
+	default:
+		atomic.AddUint64(w.dropped, 1)
+	}
+}
+
+// Close writes the queued lines and closes the file. Lines written after Close are dropped.
+func (w *accessLogWriter) Close() {
+	w.closeM.Lock()
+	w.closed = true
+	w.closeM.Unlock()
+	close(w.done)
+	<-w.stopped
+}
+
+func (w *accessLogWriter) run() {
+	defer close(w.stopped)
+	rotateCheck := (<-chan time.Time)(nil)
+	if w.rotateInterval > 0 {
+		ticker := time.NewTicker(accessLogRotateCheckInterval)
+		defer ticker.Stop()
+		rotateCheck = ticker.C
+	}
+	for {
+		select {
+		case line := <-w.lines:
+			w.writeLine(line)
+			if len(w.lines) == 0 {
+				w.flush()
+			}
+		case <-rotateCheck:
+			if w.file == nil {
+				w.reopen()
+			}
+			if w.size > int64(len(w.header)) && time.Since(w.opened) >= w.rotateInterval {
+				w.rotate()
+			}
+		case <-w.done:
+			for len(w.lines) > 0 {
+				w.writeLine(<-w.lines)
+			}
+			w.close()
+			return
+		}
+	}
+}
+
+func (w *accessLogWriter) writeLine(line []byte) {
+	if w.file == nil {
+		w.reopen()
+	}
+	if w.size > int64(len(w.header)) && ((w.rotateBytes > 0 && w.size+int64(len(line)) > w.rotateBytes) || (w.rotateInterval > 0 && time.Since(w.opened) >= w.rotateInterval)) {
+		w.rotate()
+	}
+	if w.file == nil {
+		atomic.AddUint64(w.dropped, 1)
+		return
+	}
+	n, err := w.buf.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		log.Errorln("access_log writing log '" + w.name + "': " + err.Error())
+	}
+}
+
+func (w *accessLogWriter) flush() {
+	if w.buf == nil {
+		return
+	}
+	if err := w.buf.Flush(); err != nil {
+		log.Errorln("access_log writing log '" + w.name + "': " + err.Error())
+	}
+}
+
+func (w *accessLogWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.buf = bufio.NewWriter(file)
+	w.size = info.Size()
+	w.opened = time.Now()
+	if w.size == 0 && len(w.header) > 0 {
+		n, err := w.buf.Write(w.header)
+		w.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *accessLogWriter) close() {
+	if w.file == nil {
+		return
+	}
+	w.flush()
+	if err := w.file.Close(); err != nil {
+		log.Errorln("access_log closing log '" + w.name + "': " + err.Error())
+	}
+	w.file = nil
+	w.buf = nil
+}
+
+// rotate renames the current file with the time as a suffix, opens a new file, and removes the oldest rotated files over maxFiles. If the new file can't be opened, lines are dropped until it's reopened.
+func (w *accessLogWriter) rotate() {
+	w.close()
+	rotatedPath := w.path + "." + time.Now().UTC().Format(AccessLogRotateTimeFormat)
+	if err := os.Rename(w.path, rotatedPath); err != nil {
+		log.Errorln("access_log rotating log '" + w.name + "': " + err.Error())
+	}
+	if err := w.open(); err != nil {
+		log.Errorln("access_log opening rotated log '" + w.name + "': " + err.Error())
+		w.size = 0
+		w.openFailed = time.Now()
+	}
+	w.removeOldFiles()
+}
+
+// reopen tries to open the file again after it failed to open. It's tried at most once per accessLogRotateCheckInterval, so a failing disk isn't retried for every line.
+func (w *accessLogWriter) reopen() {
+	if time.Since(w.openFailed) < accessLogRotateCheckInterval {
+		return
+	}
+	if err := w.open(); err != nil {
+		log.Errorln("access_log reopening log '" + w.name + "': " + err.Error())
+		w.openFailed = time.Now()
+		return
+	}
+	log.Infoln("access_log reopened log '" + w.name + "'")
+}
+
+func (w *accessLogWriter) removeOldFiles() {
+	if w.maxFiles <= 0 {
+		return
+	}
+	rotated := []string{}
+	dir, base := filepath.Split(w.path)
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Errorln("access_log listing rotated logs '" + w.name + "': " + err.Error())
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		log.Errorln("access_log listing rotated logs '" + w.name + "': " + err.Error())
+		return
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		if _, err := time.Parse(AccessLogRotateTimeFormat, name[len(base)+1:]); err != nil {
+			continue // not a rotated file
+		}
+		rotated = append(rotated, name)
+	}
+	if len(rotated) <= w.maxFiles {
+		return
+	}
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-w.maxFiles] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Errorln("access_log removing rotated log '" + w.name + "': " + err.Error())
+		}
+	}
+}
+
+// accessLogDropCounters are the counts of dropped lines of each log name. They're kept separately from writers, so counts aren't lost when the config is reloaded.
+type accessLogDropCounters struct {
+	m        sync.Mutex
+	counters map[string]*uint64
+}
+
+var accessLogDrops = &accessLogDropCounters{counters: map[string]*uint64{}}
+
+// Counter returns the counter of the given log name, creating it if it doesn't exist.
+func (c *accessLogDropCounters) Counter(name string) *uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if counter, ok := c.counters[name]; ok {
+		return counter
+	}
+	counter := new(uint64)
+	c.counters[name] = counter
+	return counter
+}
+
+func (c *accessLogDropCounters) Get() map[string]uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	counts := make(map[string]uint64, len(c.counters))
+	for name, counter := range c.counters {
+		counts[name] = atomic.LoadUint64(counter)
+	}
+	return counts
+}
@@ -0,0 +1,426 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/rfc"
+	"github.com/apache/trafficcontrol/grove/web"
+	"github.com/apache/trafficcontrol/lib/go-log"
+
+	"github.com/andybalholm/brotli"
+)
+
+// CompressConfig is the remap rule config of the compress plugin. It's modelled on the Apache Traffic Server compress plugin config.
+type CompressConfig struct {
+	// SupportedAlgorithms is the list of content codings to compress with, in order of preference when the client accepts several equally. The default is gzip.
+	SupportedAlgorithms []string `json:"supported_algorithms"`
+	// CompressibleContentTypes is the list of response media types to compress. A type may end in "/*" to match all subtypes. The default is DefaultCompressibleContentTypes.
+	CompressibleContentTypes []string `json:"compressible_content_types"`
+	// MinimumContentLength is the smallest body to compress, in bytes. The default is DefaultCompressMinimumContentLength.
+	MinimumContentLength *int `json:"minimum_content_length"`
+	// RemoveAcceptEncoding is whether to remove the Accept-Encoding header from parent requests, so parents always send the identity body for Grove to compress.
+	RemoveAcceptEncoding bool `json:"remove_accept_encoding"`
+}
+
+// CompressCacheKeySeparator separates the cache key of an object from the content coding of its compressed variant.
+const CompressCacheKeySeparator = remapdata.CacheKeySeparator + "encoding:"
+
+const DefaultCompressMinimumContentLength = 1024
+
+var DefaultCompressibleContentTypes = []string{"text/*", "application/javascript", "application/json", "application/xml", "image/svg+xml"}
+
+// compressWriter is a compressing writer, which can flush the bytes compressed so far.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressEncoders are the content codings which may be configured.
+var compressEncoders = map[string]func(w io.Writer) compressWriter{
+	"gzip": func(w io.Writer) compressWriter { return gzip.NewWriter(w) },
+	"br":   func(w io.Writer) compressWriter { return brotli.NewWriter(w) },
+}
+
+// compressEncodings returns the content codings the compress plugin may compress with, and therefore cache variants of.
+func compressEncodings() []string {
+	encodings := []string{}
+	for encoding := range compressEncoders {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+	return encodings
+}
+
+type compressConfig struct {
+	algorithms           []string
+	contentTypes         []string
+	minimumContentLength int
+	removeAcceptEncoding bool
+}
+
+// compressContext is the per-request data passed from the beforeCacheLookUp hook to the beforeParentRequest and beforeRespond hooks.
+type compressContext struct {
+	encoding string
+	key      string // the cache key of the request, before it's changed to a variant's
+	cache    icache.Cache
+}
+
+func init() {
+	// run after other beforeCacheLookUp plugins, so the variant key includes their cache key changes.
+	AddPlugin(20000, Funcs{load: compressLoad, beforeCacheLookUp: compressBeforeCacheLookUp, beforeParentRequest: compressBeforeParentRequest, beforeRespond: compressBeforeRespond, purge: compressPurge})
+}
+
+func compressLoad(b json.RawMessage) interface{} {
+	rawCfg := CompressConfig{}
+	if err := json.Unmarshal(b, &rawCfg); err != nil {
+		log.Errorln("compress loading config, unmarshalling JSON: " + err.Error())
+		return nil
+	}
+	cfg := &compressConfig{contentTypes: DefaultCompressibleContentTypes, minimumContentLength: DefaultCompressMinimumContentLength, removeAcceptEncoding: rawCfg.RemoveAcceptEncoding}
+	if len(rawCfg.SupportedAlgorithms) == 0 {
+		rawCfg.SupportedAlgorithms = []string{"gzip"}
+	}
+	for _, alg := range rawCfg.SupportedAlgorithms {
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		if _, ok := compressEncoders[alg]; !ok {
+			log.Errorln("compress loading config: unsupported algorithm '" + alg + "', ignoring")
+			continue
+		}
+		cfg.algorithms = append(cfg.algorithms, alg)
+	}
+	if len(rawCfg.CompressibleContentTypes) > 0 {
+		cfg.contentTypes = nil
+		for _, contentType := range rawCfg.CompressibleContentTypes {
+			cfg.contentTypes = append(cfg.contentTypes, strings.ToLower(strings.TrimSpace(contentType)))
+		}
+	}
+	if rawCfg.MinimumContentLength != nil {
+		cfg.minimumContentLength = *rawCfg.MinimumContentLength
+	}
+	return cfg
+}
+
+// compressBeforeCacheLookUp negotiates the content coding of the response, and if the compressed variant of the cached object is in the cache, serves it by using the variant's cache key.
+// The variant is only served if it was compressed from the object as it's currently cached, and the object can be reused without revalidating it. Otherwise the object is looked up, revalidated if necessary, and compressed again, so the variant is never revalidated itself, and is refreshed whenever the object is.
+func compressBeforeCacheLookUp(icfg interface{}, d BeforeCacheLookUpData) {
+	if icfg == nil {
+		return // the rule doesn't compress
+	}
+	cfg, ok := icfg.(*compressConfig)
+	if !ok {
+		log.Errorf("compress config '%v' type '%T' expected *compressConfig\n", icfg, icfg)
+		return
+	}
+	if d.Req.Method != http.MethodGet || d.Req.Header.Get("Range") != "" {
+		return // ranges of compressed bodies are ranges of different bytes than the client requested
+	}
+	encoding := negotiateEncoding(d.Req.Header.Get("Accept-Encoding"), cfg.algorithms)
+	if encoding == "" {
+		return
+	}
+	key := d.CacheKey()
+	*d.Context = &compressContext{encoding: encoding, key: key, cache: d.Cache}
+
+	obj, ok := d.Cache.Peek(key)
+	if ok && obj.IsVaryIndex() {
+		obj, ok = d.Cache.Peek(rfc.VaryKey(key, obj.VaryHeaders, d.Req.Header))
+	}
+	if !ok {
+		return
+	}
+	variantKey := compressVariantKey(key, obj, encoding)
+	variant, ok := d.Cache.Peek(variantKey)
+	if !ok || !variant.ReqRespTime.Equal(obj.ReqRespTime) || !variant.RespRespTime.Equal(obj.RespRespTime) {
+		return // not cached, or compressed from an older copy of the object
+	}
+	if rfc.CanReuseStored(d.Req.Header, obj.RespHeaders, web.ParseCacheControl(d.Req.Header), obj.RespCacheControl, obj.ReqHeaders, obj.ReqRespTime, obj.RespRespTime, true) != remapdata.ReuseCan {
+		return
+	}
+	log.Debugf("compress: serving variant '%v'\n", variantKey)
+	d.CacheKeyOverrideFunc(variantKey)
+}
+
+// compressVariantKey returns the cache key of the given object's variant compressed with the given content coding. This is the key the object is cached under, which is its Vary secondary key if it has one, followed by the CompressCacheKeySeparator and the coding.
+func compressVariantKey(key string, obj *cacheobj.CacheObj, encoding string) string {
+	if varyHdrs := rfc.VaryHeaders(obj.RespHeaders); len(varyHdrs) > 0 && !rfc.VaryAny(obj.RespHeaders) {
+		key = rfc.VaryKey(key, varyHdrs, obj.ReqHeaders)
+	}
+	return key + CompressCacheKeySeparator + encoding
+}
+
+// compressPurge returns the keys of the purged object's compressed variants, with every coding, in case the rule's config changed since they were cached. The compressed variants of the object's Vary variants are removed with them, as their keys begin with the Vary variant's key.
+func compressPurge(icfg interface{}, d PurgeData) []string {
+	keys := []string{}
+	for _, encoding := range compressEncodings() {
+		keys = append(keys, d.CacheKey+CompressCacheKeySeparator+encoding)
+	}
+	return keys
+}
+
+func compressBeforeParentRequest(icfg interface{}, d BeforeParentRequestData) {
+	if icfg == nil {
+		return // the rule doesn't compress
+	}
+	cfg, ok := icfg.(*compressConfig)
+	if !ok {
+		log.Errorf("compress config '%v' type '%T' expected *compressConfig\n", icfg, icfg)
+		return
+	}
+	if cfg.removeAcceptEncoding {
+		d.Req.Header.Del("Accept-Encoding")
+	}
+	// clients revalidate compressed variants with their suffixed ETags, which the parent never sent
+	for _, name := range []string{"If-None-Match", "If-Match"} {
+		if vals, ok := d.Req.Header[name]; ok {
+			d.Req.Header[name] = withoutEncodingETagSuffixes(vals, cfg.algorithms)
+		}
+	}
+}
+
+// withoutEncodingETagSuffixes returns the given If-None-Match or If-Match values, with the content coding suffixes added to compressed variants' ETags removed.
+func withoutEncodingETagSuffixes(vals []string, encodings []string) []string {
+	newVals := make([]string, 0, len(vals))
+	for _, val := range vals {
+		etags := strings.Split(val, ",")
+		for i, etag := range etags {
+			etag = strings.TrimSpace(etag)
+			for _, encoding := range encodings {
+				if suffix := "-" + encoding + `"`; strings.HasSuffix(etag, suffix) {
+					etag = etag[:len(etag)-len(suffix)] + `"`
+					break
+				}
+			}
+			etags[i] = etag
+		}
+		newVals = append(newVals, strings.Join(etags, ", "))
+	}
+	return newVals
+}
+
+// compressBeforeRespond compresses eligible identity responses with the negotiated content coding, and caches the compressed variant, so it isn't compressed again for later requests.
+// Bodies still being received from the parent are compressed as they're received, and sent to the client as they're compressed.
+func compressBeforeRespond(icfg interface{}, d BeforeRespondData) {
+	if icfg == nil {
+		return // the rule doesn't compress
+	}
+	cfg, ok := icfg.(*compressConfig)
+	if !ok {
+		log.Errorf("compress config '%v' type '%T' expected *compressConfig\n", icfg, icfg)
+		return
+	}
+	if *d.Code != http.StatusOK || d.CacheObj == nil || !compressible(cfg, *d.Hdr) {
+		return
+	}
+	// Compressible responses vary on Accept-Encoding whether or not they're compressed, so downstream caches don't serve identity bodies to clients which accept compression, or vice versa.
+	// Cached variants don't store it, because the variant is already selected by the cache key, and the Accept-Encoding sent to the parent may have been removed.
+	defer func() { *d.Hdr = withVaryAcceptEncoding(*d.Hdr) }()
+
+	if (*d.Hdr).Get("Content-Encoding") != "" {
+		return // already compressed, either by the parent, or a cached variant
+	}
+	ctx, ok := (*d.Context).(*compressContext)
+	if !ok || ctx == nil {
+		return
+	}
+
+	hdr := withoutVaryAcceptEncoding(*d.Hdr)
+	hdr.Set("Content-Encoding", ctx.encoding)
+	hdr.Del("Accept-Ranges")
+	if etag := hdr.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		hdr.Set("ETag", etag[:len(etag)-1]+"-"+ctx.encoding+`"`) // the compressed body is a different representation, and must not match the identity ETag
+	}
+	variantKey := compressVariantKey(ctx.key, d.CacheObj, ctx.encoding)
+	cacheVariant := func(compressed []byte) {
+		if !rfc.CanCache(d.Req.Method, d.CacheObj.ReqHeaders, d.CacheObj.Code, d.CacheObj.RespHeaders, true) {
+			return
+		}
+		variant := *d.CacheObj
+		variant.RespHeaders = web.CopyHeader(hdr)
+		variant.RespHeaders.Set("Content-Length", strconv.Itoa(len(compressed)))
+		ctx.cache.Add(variantKey, variant.Complete(compressed))
+		log.Debugf("compress: cached variant '%v' %v bytes\n", variantKey, len(compressed))
+	}
+
+	if body := *d.Body; body != nil {
+		if len(body) < cfg.minimumContentLength {
+			return
+		}
+		compressed, err := compress(ctx.encoding, body)
+		if err != nil {
+			log.Errorln("compress: compressing with " + ctx.encoding + ": " + err.Error() + ", responding uncompressed")
+			return
+		}
+		hdr.Set("Content-Length", strconv.Itoa(len(compressed)))
+		cacheVariant(compressed)
+		*d.Hdr = hdr
+		*d.Body = compressed
+		return
+	}
+
+	if d.BodyReader == nil || *d.BodyReader == nil {
+		return
+	}
+	if contentLength, err := strconv.Atoi((*d.Hdr).Get("Content-Length")); err == nil && contentLength < cfg.minimumContentLength {
+		return
+	}
+	compressed := cacheobj.NewStream(0)
+	go func(src io.Reader) {
+		if err := compressStream(ctx.encoding, src, compressed); err != nil {
+			log.Errorln("compress: compressing parent body with " + ctx.encoding + ": " + err.Error())
+			return
+		}
+		body, _ := compressed.Wait()
+		cacheVariant(body)
+	}(*d.BodyReader)
+	hdr.Del("Content-Length")
+	*d.Hdr = hdr
+	*d.BodyReader = compressed.NewReader()
+}
+
+// withVaryAcceptEncoding returns a copy of the given response headers, whose Vary includes Accept-Encoding.
+func withVaryAcceptEncoding(hdr http.Header) http.Header {
+	hdr = web.CopyHeader(hdr)
+	for _, name := range rfc.VaryHeaders(hdr) {
+		if name == "Accept-Encoding" {
+			return hdr
+		}
+	}
+	hdr.Add("Vary", "Accept-Encoding")
+	return hdr
+}
+
+// withoutVaryAcceptEncoding returns a copy of the given response headers, whose Vary doesn't include Accept-Encoding.
+func withoutVaryAcceptEncoding(hdr http.Header) http.Header {
+	hdr = web.CopyHeader(hdr)
+	if rfc.VaryAny(hdr) {
+		return hdr
+	}
+	names := []string{}
+	for _, name := range rfc.VaryHeaders(hdr) {
+		if name != "Accept-Encoding" {
+			names = append(names, name)
+		}
+	}
+	hdr.Del("Vary")
+	if len(names) > 0 {
+		hdr.Set("Vary", strings.Join(names, ", "))
+	}
+	return hdr
+}
+
+// compressible returns whether the response with the given headers may be compressed, per its content type and cache control.
+func compressible(cfg *compressConfig, hdr http.Header) bool {
+	if _, ok := web.ParseCacheControl(hdr)["no-transform"]; ok {
+		return false
+	}
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(hdr.Get("Content-Type"), ";")[0]))
+	if contentType == "" {
+		return false
+	}
+	for _, pattern := range cfg.contentTypes {
+		if pattern == contentType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[:len(pattern)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding returns the supported content coding the client most prefers, per RFC7231§5.3.4, or the empty string if the client accepts none of them. Ties are broken by the order of supported.
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	qualities := map[string]float64{}
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, alg := range supported {
+		q, ok := qualities[alg]
+		if !ok {
+			if q, ok = qualities["*"]; !ok {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = alg, q
+		}
+	}
+	return best
+}
+
+func compress(encoding string, body []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	w := compressEncoders[encoding](&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressStream compresses src into dst as it's read, flushing after each read, so the bytes received so far are available to dst's readers without waiting for the rest. The dst is closed when src is finished, with the error reading or compressing, if any.
+func compressStream(encoding string, src io.Reader, dst *cacheobj.Stream) error {
+	w := compressEncoders[encoding](dst)
+	buf := make([]byte, web.StreamBufferBytes)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				dst.Close(writeErr)
+				return writeErr
+			}
+			if flushErr := w.Flush(); flushErr != nil {
+				dst.Close(flushErr)
+				return flushErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			dst.Close(err)
+			return err
+		}
+	}
+	err := w.Close()
+	dst.Close(err)
+	return err
+}
@@ -0,0 +1,144 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/memcache"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"gzip", "br"}
+	tests := map[string]string{
+		"":                   "",
+		"identity":           "",
+		"gzip":               "gzip",
+		"GZIP":               "gzip",
+		"br, gzip":           "gzip",
+		"br, gzip;q=0.5":     "br",
+		"gzip;q=0, br;q=0.1": "br",
+		"gzip;q=0":           "",
+		"*":                  "gzip",
+		"*;q=0.5, br;q=0.8":  "br",
+		"deflate":            "",
+	}
+	for acceptEncoding, expected := range tests {
+		if actual := negotiateEncoding(acceptEncoding, supported); actual != expected {
+			t.Errorf("negotiateEncoding '%v' expected '%v' actual '%v'", acceptEncoding, expected, actual)
+		}
+	}
+}
+
+func TestCompressCachesVariant(t *testing.T) {
+	cfg := compressLoad(json.RawMessage(`{"supported_algorithms": ["gzip", "deflate", "br"], "minimum_content_length": 10}`)).(*compressConfig)
+	if expected := []string{"gzip", "br"}; !reflect.DeepEqual(cfg.algorithms, expected) {
+		t.Fatalf("compressLoad expected algorithms %v, actual %v", expected, cfg.algorithms)
+	}
+
+	cache := memcache.New(1024 * 1024)
+	const key = "GET:http://example.net/obj"
+	body := []byte(strings.Repeat("compressible ", 100))
+	respHdr := http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}
+	now := time.Now()
+	obj := cacheobj.New(http.Header{}, body, http.StatusOK, http.StatusOK, "", respHdr, now, now, now, now)
+	cache.Add(key, obj)
+
+	lookUp := func() (string, *interface{}) {
+		ctx := interface{}(nil)
+		cacheKey := key
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{"Accept-Encoding": {"gzip"}}}
+		compressBeforeCacheLookUp(cfg, BeforeCacheLookUpData{Req: req, DefaultCacheKey: key, CacheKey: func() string { return cacheKey }, CacheKeyOverrideFunc: func(k string) { cacheKey = k }, Cache: cache, Context: &ctx})
+		return cacheKey, &ctx
+	}
+
+	cacheKey, ctx := lookUp()
+	if cacheKey != key {
+		t.Fatalf("compress before the variant is cached expected key '%v' actual '%v'", key, cacheKey)
+	}
+
+	code, hdr, respBody := obj.Code, obj.RespHeaders, obj.Body
+	compressBeforeRespond(cfg, BeforeRespondData{Req: &http.Request{Method: http.MethodGet}, CacheObj: obj, Code: &code, Hdr: &hdr, Body: &respBody, Context: ctx})
+	if hdr.Get("Content-Encoding") != "gzip" || hdr.Get("Vary") != "Accept-Encoding" || hdr.Get("ETag") != `"v1-gzip"` {
+		t.Errorf("compress expected gzip headers, actual %+v", hdr)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(respBody))
+	if err != nil {
+		t.Fatalf("compress response gzip error: %v", err)
+	}
+	if decompressed, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(decompressed, body) {
+		t.Errorf("compress response expected to decompress to the body, actual err %v len %v", err, len(decompressed))
+	}
+
+	variant, ok := cache.Get(key + CompressCacheKeySeparator + "gzip")
+	if !ok {
+		t.Fatalf("compress expected variant to be cached")
+	}
+	if !bytes.Equal(variant.Body, respBody) || variant.RespHeaders.Get("Vary") != "" {
+		t.Errorf("compress expected cached variant with the compressed body and no Vary, actual len %v headers %+v", len(variant.Body), variant.RespHeaders)
+	}
+
+	if cacheKey, _ := lookUp(); cacheKey != key+CompressCacheKeySeparator+"gzip" {
+		t.Errorf("compress after the variant is cached expected key '%v' actual '%v'", key+CompressCacheKeySeparator+"gzip", cacheKey)
+	}
+
+	refreshed := cacheobj.New(http.Header{}, body, http.StatusOK, http.StatusOK, "", respHdr, now, now.Add(time.Second), now.Add(time.Second), now)
+	cache.Add(key, refreshed)
+	if cacheKey, _ := lookUp(); cacheKey != key {
+		t.Errorf("compress after the object is refreshed expected key '%v' actual '%v'", key, cacheKey)
+	}
+}
+
+func TestCompressBeforeParentRequestETags(t *testing.T) {
+	cfg := compressLoad(json.RawMessage(`{"supported_algorithms": ["gzip", "br"]}`)).(*compressConfig)
+	req := &http.Request{Header: http.Header{"If-None-Match": {`"a-gzip", W/"b-br"`, `"c"`}, "If-Match": {`"d-gzip"`}}}
+	compressBeforeParentRequest(cfg, BeforeParentRequestData{Req: req})
+	if expected := []string{`"a", W/"b"`, `"c"`}; !reflect.DeepEqual(req.Header["If-None-Match"], expected) {
+		t.Errorf("If-None-Match expected %v, actual %v", expected, req.Header["If-None-Match"])
+	}
+	if expected := []string{`"d"`}; !reflect.DeepEqual(req.Header["If-Match"], expected) {
+		t.Errorf("If-Match expected %v, actual %v", expected, req.Header["If-Match"])
+	}
+}
+
+func TestCompressBrotli(t *testing.T) {
+	body := []byte(strings.Repeat("compressible ", 100))
+	compressed, err := compress("br", body)
+	if err != nil {
+		t.Fatalf("compress br error: %v", err)
+	}
+	if decompressed, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(compressed))); err != nil || !bytes.Equal(decompressed, body) {
+		t.Errorf("compress br expected to decompress to the body, actual err %v len %v", err, len(decompressed))
+	}
+
+	stream := cacheobj.NewStream(0)
+	if err := compressStream("br", bytes.NewReader(body), stream); err != nil {
+		t.Fatalf("compressStream br error: %v", err)
+	}
+	if decompressed, err := ioutil.ReadAll(brotli.NewReader(stream.NewReader())); err != nil || !bytes.Equal(decompressed, body) {
+		t.Errorf("compressStream br expected to decompress to the body, actual err %v len %v", err, len(decompressed))
+	}
+}
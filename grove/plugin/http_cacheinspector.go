@@ -121,6 +121,9 @@ func cacheinspect(icfg interface{}, d OnRequestData) bool {
 			w.Write([]byte(fmt.Sprintf("  RespRespTime:                 %v\n", cacheObject.RespRespTime)))
 			w.Write([]byte(fmt.Sprintf("  LastModified:                 %v\n", cacheObject.LastModified)))
 			w.Write([]byte(fmt.Sprintf("  HitCount:                     %v\n", cacheObject.HitCount)))
+			if cacheObject.IsVaryIndex() {
+				w.Write([]byte(fmt.Sprintf("  VaryHeaders:                  %s\n", strings.Join(cacheObject.VaryHeaders, ","))))
+			}
 		} else {
 			w.Write([]byte("Not Found"))
 		}
@@ -0,0 +1,153 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+func init() {
+	AddPlugin(10000, Funcs{onRequest: invalidate})
+}
+
+const InvalidateEndpoint = "/_invalidate"
+
+// InvalidateResp is the response body of the invalidate endpoint.
+type InvalidateResp struct {
+	Removed uint64 `json:"removed"`
+}
+
+// invalidate removes all objects whose URL matches the regex or prefix query parameter, from the cache given by the cache query parameter, or from all caches if it's absent.
+func invalidate(icfg interface{}, d OnRequestData) bool {
+	if !strings.HasPrefix(d.R.URL.Path, InvalidateEndpoint) {
+		return false
+	}
+	reqTime := time.Now()
+
+	log.Debugf("plugin onrequest http_invalidate calling\n")
+
+	w := d.W
+	req := d.R
+
+	ip, err := web.GetIP(req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Errorln("http_invalidate failed to get IP: " + err.Error())
+		return true
+	}
+	if !d.StatRules.Allowed(ip) {
+		code := http.StatusForbidden
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Debugln("http_invalidate IP " + ip.String() + " FORBIDDEN")
+		return true
+	}
+
+	if req.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		return true
+	}
+
+	match, err := invalidateMatchFunc(req)
+	if err != nil {
+		code := http.StatusBadRequest
+		w.WriteHeader(code)
+		w.Write([]byte(err.Error()))
+		return true
+	}
+
+	cacheNames := d.Stats.CacheNames()
+	if qCacheNames, ok := req.URL.Query()["cache"]; ok {
+		cacheNames = qCacheNames
+	}
+
+	resp := InvalidateResp{}
+	for _, cacheName := range cacheNames {
+		for _, key := range d.Stats.CacheKeys(cacheName) {
+			if !match(invalidateKeyURL(key)) {
+				continue
+			}
+			if d.Stats.CacheRemove(key, cacheName) {
+				log.Debugf("http_invalidate removed '%v' from cache '%v'\n", key, cacheName)
+				resp.Removed++
+			}
+		}
+	}
+
+	bts, err := json.Marshal(resp)
+	if err != nil {
+		code := http.StatusInternalServerError
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Errorln("http_invalidate marshalling response: " + err.Error())
+		return true
+	}
+
+	respCode := http.StatusOK
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(respCode)
+	w.Write(bts)
+
+	clientIP, _ := web.GetClientIPPort(req)
+
+	now := time.Now()
+	// log, so we know who invalidated what. Invalidations can cause a thundering herd to the origin.
+	log.EventRaw(atsEventLogStr(now, clientIP, d.Hostname, req.Host, d.Port, "-", d.Scheme, req.URL.String(), req.Method, req.Proto, respCode, now.Sub(reqTime), uint64(len(bts)), 0, 0, true, true, getCacheHitStr(true, false), "-", "-", req.UserAgent(), req.Header.Get("X-Money-Trace"), d.RequestID))
+
+	return true
+}
+
+// invalidateMatchFunc returns a func matching URLs against the regex or prefix query parameter of the request. Exactly one must be given.
+func invalidateMatchFunc(req *http.Request) (func(string) bool, error) {
+	regexStr := req.URL.Query().Get("regex")
+	prefix := req.URL.Query().Get("prefix")
+	if (regexStr == "") == (prefix == "") {
+		return nil, errors.New("exactly one of 'regex' or 'prefix' must be given")
+	}
+	if prefix != "" {
+		return func(u string) bool { return strings.HasPrefix(u, prefix) }, nil
+	}
+	re, err := regexp.Compile(regexStr)
+	if err != nil {
+		return nil, errors.New("invalid regex: " + err.Error())
+	}
+	return re.MatchString, nil
+}
+
+// invalidateKeyURL returns the URL of the given cache key, without the method, header and cookie components, or Vary variant, so variants are invalidated with their primary object.
+func invalidateKeyURL(key string) string {
+	if i := strings.Index(key, ":"); i != -1 {
+		key = key[i+1:]
+	}
+	if i := strings.Index(key, remapdata.CacheKeySeparator); i != -1 { // Vary keys also begin with the separator
+		key = key[:i]
+	}
+	return key
+}
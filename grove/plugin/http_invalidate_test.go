@@ -0,0 +1,91 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/memcache"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/stat"
+)
+
+func TestInvalidate(t *testing.T) {
+	newCaches := func() map[string]icache.Cache {
+		c := memcache.New(1024 * 1024)
+		for _, key := range []string{
+			"GET:http://foo.example/images/a.jpg",
+			"GET:http://foo.example/images/a.jpg" + remapdata.CacheKeySeparator + "variant",
+			"GET:http://foo.example/images/b.png",
+			"GET:http://foo.example/video/c.jpg",
+		} {
+			c.Add(key, &cacheobj.CacheObj{Size: 1})
+		}
+		return map[string]icache.Cache{"": c}
+	}
+	invalidateReq := func(caches map[string]icache.Cache, method string, query string, statRules remapdata.RemapRulesStats) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, InvalidateEndpoint+query, nil)
+		d := OnRequestData{W: w, R: r, Stats: stat.New(nil, caches, 1024*1024, nil, nil, nil, "test"), StatRules: statRules}
+		if !invalidate(nil, d) {
+			t.Fatalf("invalidate expected to handle %v, actual not handled", r.URL)
+		}
+		return w
+	}
+
+	tests := []struct {
+		query     string
+		body      string
+		remaining []string
+	}{
+		{"?prefix=http://foo.example/images/", `{"removed":3}`, []string{"GET:http://foo.example/video/c.jpg"}},
+		{`?regex=\.jpg$`, `{"removed":3}`, []string{"GET:http://foo.example/images/b.png"}},
+		{"?prefix=http://foo.example/&cache=nonexistent", `{"removed":0}`, nil},
+	}
+	for _, test := range tests {
+		caches := newCaches()
+		w := invalidateReq(caches, http.MethodPost, test.query, remapdata.RemapRulesStats{})
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("invalidate %v expected 200 %v, actual %v %v", test.query, test.body, w.Code, w.Body.String())
+		}
+		if test.remaining == nil {
+			continue
+		}
+		remaining := caches[""].Keys()
+		sort.Strings(remaining)
+		if !reflect.DeepEqual(test.remaining, remaining) {
+			t.Errorf("invalidate %v expected remaining keys %v, actual %v", test.query, test.remaining, remaining)
+		}
+	}
+
+	if w := invalidateReq(newCaches(), http.MethodGet, "?prefix=/", remapdata.RemapRulesStats{}); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("invalidate GET expected 405, actual %v", w.Code)
+	}
+	if w := invalidateReq(newCaches(), http.MethodPost, "?prefix=/&regex=.*", remapdata.RemapRulesStats{}); w.Code != http.StatusBadRequest {
+		t.Errorf("invalidate with both prefix and regex expected 400, actual %v", w.Code)
+	}
+	_, denyAll, _ := net.ParseCIDR("0.0.0.0/0")
+	caches := newCaches()
+	if w := invalidateReq(caches, http.MethodPost, "?prefix=/", remapdata.RemapRulesStats{Deny: []*net.IPNet{denyAll}}); w.Code != http.StatusForbidden || len(caches[""].Keys()) != 4 {
+		t.Errorf("invalidate from a denied IP expected 403 and nothing removed, actual %v and %v keys", w.Code, len(caches[""].Keys()))
+	}
+}
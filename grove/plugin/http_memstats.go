@@ -59,7 +59,6 @@ func memstats(icfg interface{}, d OnRequestData) bool {
 		return true
 	}
 
-	// TODO gzip
 	// TODO cache for 1 second
 
 	stats := runtime.MemStats{}
@@ -72,6 +71,6 @@ func memstats(icfg interface{}, d OnRequestData) bool {
 		w.Write([]byte(http.StatusText(code)))
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(bytes)
+	writeGzipIfAccepted(w, req, bytes)
 	return true
 }
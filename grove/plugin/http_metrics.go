@@ -0,0 +1,216 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+func init() {
+	AddPlugin(10000, Funcs{onRequest: metrics})
+}
+
+// MetricsEndpoint is the path of the Prometheus metrics. Unlike the other stats endpoints, this must match exactly, so origin content under the path isn't shadowed.
+const MetricsEndpoint = "/metrics"
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func metrics(icfg interface{}, d OnRequestData) bool {
+	if d.R.URL.Path != MetricsEndpoint {
+		log.Debugf("plugin onrequest http_metrics returning, not in path '%v'\n", d.R.URL.Path)
+		return false
+	}
+
+	log.Debugf("plugin onrequest http_metrics calling\n")
+
+	w := d.W
+	req := d.R
+
+	ip, err := web.GetIP(req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Errorln("metrics ServeHTTP failed to get IP: " + err.Error())
+		return true
+	}
+	if !d.StatRules.Allowed(ip) {
+		code := http.StatusForbidden
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Debugln("metrics ServeHTTP IP " + ip.String() + " FORBIDDEN")
+		return true
+	}
+
+	body := writeMetrics(d.Stats)
+	w.Header().Set("Content-Type", MetricsContentType)
+	writeGzipIfAccepted(w, req, body)
+	return true
+}
+
+// writeGzipIfAccepted writes the body, gzipped if the request accepts gzip with a nonzero quality.
+func writeGzipIfAccepted(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if negotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}) != "gzip" {
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(body); err != nil {
+		log.Errorln("writing gzipped response: " + err.Error())
+	}
+	if err := gz.Close(); err != nil {
+		log.Errorln("writing gzipped response: " + err.Error())
+	}
+}
+
+// writeMetrics returns the stats in the Prometheus text exposition format. Remap rule metrics are labelled by the rule's FQDN, the same as the remap stats in the astats endpoint.
+func writeMetrics(stats stat.Stats) []byte {
+	b := &bytes.Buffer{}
+
+	remaps := stats.Remap()
+	rules := remaps.Rules()
+	sort.Strings(rules)
+	remapStats := make([]stat.StatsRemap, 0, len(rules))
+	remapLabels := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if s, ok := remaps.Stats(rule); ok {
+			remapStats = append(remapStats, s)
+			remapLabels = append(remapLabels, `remap="`+escapeLabel(rule)+`"`)
+		}
+	}
+
+	remapCounter := func(name string, help string, val func(stat.StatsRemap) uint64) {
+		writeMetricHeader(b, name, help, "counter")
+		for i, s := range remapStats {
+			writeMetric(b, name, remapLabels[i], strconv.FormatUint(val(s), 10))
+		}
+	}
+	remapCounter("grove_remap_cache_hits_total", "Client requests served from the cache.", stat.StatsRemap.CacheHits)
+	remapCounter("grove_remap_cache_misses_total", "Client requests not served from the cache.", stat.StatsRemap.CacheMisses)
+	remapCounter("grove_remap_in_bytes_total", "Bytes read from clients.", stat.StatsRemap.InBytes)
+	remapCounter("grove_remap_out_bytes_total", "Bytes written to clients.", stat.StatsRemap.OutBytes)
+	remapCounter("grove_remap_parent_failures_total", "Parent requests which failed to connect, or returned a retry code.", stat.StatsRemap.ParentFailures)
+
+	writeMetricHeader(b, "grove_remap_responses_total", "Client responses, by status code class.", "counter")
+	for i, s := range remapStats {
+		writeMetric(b, "grove_remap_responses_total", remapLabels[i]+`,code="2xx"`, strconv.FormatUint(s.Status2xx(), 10))
+		writeMetric(b, "grove_remap_responses_total", remapLabels[i]+`,code="3xx"`, strconv.FormatUint(s.Status3xx(), 10))
+		writeMetric(b, "grove_remap_responses_total", remapLabels[i]+`,code="4xx"`, strconv.FormatUint(s.Status4xx(), 10))
+		writeMetric(b, "grove_remap_responses_total", remapLabels[i]+`,code="5xx"`, strconv.FormatUint(s.Status5xx(), 10))
+	}
+
+	writeMetricHeader(b, "grove_remap_rate_limited_total", "Client requests rejected with a 429, by the limit exceeded.", "counter")
+	for i, s := range remapStats {
+		for _, limit := range remapdata.RateLimitTypes {
+			writeMetric(b, "grove_remap_rate_limited_total", remapLabels[i]+`,limit="`+limit.String()+`"`, strconv.FormatUint(s.RateLimited(limit), 10))
+		}
+	}
+
+	const latencyName = "grove_remap_request_duration_seconds"
+	writeMetricHeader(b, latencyName, "Client request latency, from receiving the request to finishing the response.", "histogram")
+	for i, s := range remapStats {
+		writeHistogram(b, latencyName, remapLabels[i], s.Latency())
+	}
+
+	cacheNames := stats.CacheNames()
+	sort.Strings(cacheNames)
+	writeMetricHeader(b, "grove_cache_size_bytes", "Bytes stored in each cache. The default memory cache has the empty name.", "gauge")
+	for _, name := range cacheNames {
+		if size, ok := stats.CacheSizeByName(name); ok {
+			writeMetric(b, "grove_cache_size_bytes", `cache="`+escapeLabel(name)+`"`, strconv.FormatUint(size, 10))
+		}
+	}
+	writeMetricHeader(b, "grove_cache_capacity_bytes", "Maximum bytes stored in each cache.", "gauge")
+	for _, name := range cacheNames {
+		if capacity, ok := stats.CacheCapacityByName(name); ok {
+			writeMetric(b, "grove_cache_capacity_bytes", `cache="`+escapeLabel(name)+`"`, strconv.FormatUint(capacity, 10))
+		}
+	}
+
+	dropped := AccessLogDropped()
+	logNames := make([]string, 0, len(dropped))
+	for name := range dropped {
+		logNames = append(logNames, name)
+	}
+	sort.Strings(logNames)
+	writeMetricHeader(b, "grove_access_log_dropped_lines_total", "Access log lines dropped because the log writer fell behind.", "counter")
+	for _, name := range logNames {
+		writeMetric(b, "grove_access_log_dropped_lines_total", `log="`+escapeLabel(name)+`"`, strconv.FormatUint(dropped[name], 10))
+	}
+
+	parentConns := stats.ParentConns()
+	writeMetricHeader(b, "grove_parent_connections", "Open parent connections.", "gauge")
+	writeMetric(b, "grove_parent_connections", "", strconv.FormatUint(parentConns.Open(), 10))
+	writeMetricHeader(b, "grove_parent_connections_opened_total", "Parent connections opened.", "counter")
+	writeMetric(b, "grove_parent_connections_opened_total", "", strconv.FormatUint(parentConns.Opened(), 10))
+	writeMetricHeader(b, "grove_parent_dial_errors_total", "Parent connections which failed to dial.", "counter")
+	writeMetric(b, "grove_parent_dial_errors_total", "", strconv.FormatUint(parentConns.DialErrors(), 10))
+	writeMetricHeader(b, "grove_parent_requests_total", "Parent requests which obtained a connection.", "counter")
+	writeMetric(b, "grove_parent_requests_total", "", strconv.FormatUint(parentConns.Requests(), 10))
+	writeMetricHeader(b, "grove_parent_requests_reused_total", "Parent requests made on an already-open connection, including HTTP/2 requests multiplexed onto one.", "counter")
+	writeMetric(b, "grove_parent_requests_reused_total", "", strconv.FormatUint(parentConns.Reused(), 10))
+	const dialName = "grove_parent_dial_duration_seconds"
+	writeMetricHeader(b, dialName, "Time taken to dial parent connections, not including TLS handshakes.", "histogram")
+	writeHistogram(b, dialName, "", parentConns.DialLatency())
+
+	writeMetricHeader(b, "grove_client_connections", "Open client connections.", "gauge")
+	writeMetric(b, "grove_client_connections", "", strconv.FormatUint(stats.Connections(), 10))
+	return b.Bytes()
+}
+
+func writeMetricHeader(b *bytes.Buffer, name string, help string, typ string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeHistogram writes the buckets, sum, and count of the histogram h. The labels may be empty.
+func writeHistogram(b *bytes.Buffer, name string, labels string, h stat.Histogram) {
+	bucketLabels := labels
+	if bucketLabels != "" {
+		bucketLabels += ","
+	}
+	for i, upper := range stat.LatencyBuckets {
+		writeMetric(b, name+"_bucket", bucketLabels+`le="`+strconv.FormatFloat(upper, 'g', -1, 64)+`"`, strconv.FormatUint(h.Buckets[i], 10))
+	}
+	writeMetric(b, name+"_bucket", bucketLabels+`le="+Inf"`, strconv.FormatUint(h.Count, 10))
+	writeMetric(b, name+"_sum", labels, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	writeMetric(b, name+"_count", labels, strconv.FormatUint(h.Count, 10))
+}
+
+func writeMetric(b *bytes.Buffer, name string, labels string, val string) {
+	if labels == "" {
+		fmt.Fprintf(b, "%s %s\n", name, val)
+		return
+	}
+	fmt.Fprintf(b, "%s{%s} %s\n", name, labels, val)
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
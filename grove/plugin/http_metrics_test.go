@@ -0,0 +1,46 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteGzipIfAccepted(t *testing.T) {
+	acceptEncodings := map[string]string{
+		"":                  "",
+		"gzip":              "gzip",
+		"deflate, gzip":     "gzip",
+		"gzip;q=0":          "",
+		"*":                 "gzip",
+		"*;q=0":             "",
+		"gzip;q=0, *;q=1":   "",
+		"identity, *;q=0.5": "gzip",
+	}
+	for acceptEncoding, expected := range acceptEncodings {
+		r := httptest.NewRequest(http.MethodGet, "/_metrics", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		writeGzipIfAccepted(w, r, []byte("body"))
+		if actual := w.Header().Get("Content-Encoding"); actual != expected {
+			t.Errorf("Accept-Encoding '%v' expected Content-Encoding '%v', actual '%v'", acceptEncoding, expected, actual)
+		}
+		if actual := w.Header().Get("Vary"); actual != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding '%v' expected Vary 'Accept-Encoding', actual '%v'", acceptEncoding, actual)
+		}
+	}
+}
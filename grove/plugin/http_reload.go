@@ -0,0 +1,88 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+func init() {
+	AddPlugin(10000, Funcs{onRequest: reload})
+}
+
+const ReloadEndpoint = "/_reload"
+
+// reload reloads the config, remap rules, and certificates, the same as a SIGHUP, and responds with whether the reload succeeded.
+func reload(icfg interface{}, d OnRequestData) bool {
+	if !strings.HasPrefix(d.R.URL.Path, ReloadEndpoint) {
+		return false
+	}
+	reqTime := time.Now()
+
+	log.Debugf("plugin onrequest http_reload calling\n")
+
+	w := d.W
+	req := d.R
+
+	ip, err := web.GetIP(req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Errorln("http_reload failed to get IP: " + err.Error())
+		return true
+	}
+	if !d.StatRules.Allowed(ip) {
+		code := http.StatusForbidden
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Debugln("http_reload IP " + ip.String() + " FORBIDDEN")
+		return true
+	}
+
+	if req.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		return true
+	}
+
+	respCode := http.StatusNoContent
+	respBody := []byte(nil)
+	if d.Reload == nil {
+		respCode = http.StatusNotImplemented
+		respBody = []byte(http.StatusText(respCode))
+	} else if err := d.Reload(); err != nil {
+		respCode = http.StatusInternalServerError
+		respBody = []byte("reload failed, existing config is still in use: " + err.Error())
+	}
+	w.WriteHeader(respCode)
+	w.Write(respBody)
+
+	clientIP, _ := web.GetClientIPPort(req)
+
+	now := time.Now()
+	// log, so we know who reloaded, and when.
+	log.EventRaw(atsEventLogStr(now, clientIP, d.Hostname, req.Host, d.Port, "-", d.Scheme, req.URL.String(), req.Method, req.Proto, respCode, now.Sub(reqTime), uint64(len(respBody)), 0, 0, true, true, getCacheHitStr(true, false), "-", "-", req.UserAgent(), req.Header.Get("X-Money-Trace"), d.RequestID))
+
+	return true
+}
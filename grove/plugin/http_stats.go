@@ -25,6 +25,7 @@ import (
 	"strings"
 	"unicode"
 
+	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/stat"
 	"github.com/apache/trafficcontrol/grove/web"
 
@@ -65,7 +66,6 @@ func stats(icfg interface{}, d OnRequestData) bool {
 		return true
 	}
 
-	// TODO gzip
 	system := LoadSystemStats(d.Stats, d.InterfaceName) // TODO goroutine on a timer?
 	ats := map[string]interface{}{"server": "6.2.1"}
 	if req.URL.Query().Get("application") != "system" {
@@ -80,7 +80,7 @@ func stats(icfg interface{}, d OnRequestData) bool {
 		w.Write([]byte(http.StatusText(code)))
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(bytes)
+	writeGzipIfAccepted(w, req, bytes)
 	return true
 }
 
@@ -119,9 +119,15 @@ func LoadRemapStats(stats stat.Stats, httpConns *web.ConnMap, httpsConns *web.Co
 		jsonStats["plugin.remap_stats."+ruleName+".status_5xx"] = statsRemap.Status5xx()
 		jsonStats["plugin.remap_stats."+ruleName+".cache_hits"] = statsRemap.CacheHits()
 		jsonStats["plugin.remap_stats."+ruleName+".cache_misses"] = statsRemap.CacheMisses()
+		for _, limit := range remapdata.RateLimitTypes {
+			jsonStats["plugin.remap_stats."+ruleName+".rate_limited_"+limit.String()] = statsRemap.RateLimited(limit)
+		}
 	}
 
 	jsonStats["proxy.process.http.current_client_connections"] = httpConns.Len() + httpsConns.Len()
+	jsonStats["proxy.process.http.current_server_connections"] = stats.ParentConns().Open()
+	jsonStats["proxy.process.http.total_server_connections"] = stats.ParentConns().Opened()
+	jsonStats["plugin.grove.parent_connection_reuse_ratio"] = stats.ParentConns().ReuseRatio()
 	jsonStats["proxy.process.http.cache_hits"] = stats.CacheHits()
 	jsonStats["proxy.process.http.cache_misses"] = stats.CacheMisses()
 	jsonStats["proxy.process.http.cache_capacity_bytes"] = stats.CacheCapacity()
@@ -17,6 +17,7 @@ package plugin
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path"
@@ -28,8 +29,10 @@ import (
 	"github.com/apache/trafficcontrol/grove/cachedata"
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/config"
+	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/trace"
 	"github.com/apache/trafficcontrol/grove/web"
 )
 
@@ -51,6 +54,7 @@ type Funcs struct {
 	beforeParentRequest BeforeParentRequestFunc
 	beforeRespond       BeforeRespondFunc
 	afterRespond        AfterRespondFunc
+	purge               PurgeFunc
 }
 
 type StartupData struct {
@@ -69,7 +73,9 @@ type OnRequestData struct {
 	HTTPConns     *web.ConnMap
 	HTTPSConns    *web.ConnMap
 	RequestID     uint64
-	Context       *interface{}
+	// Reload reloads the config, remap rules, and certificates, and swaps them in atomically. It returns an error if the reload failed, in which case the old config is still in use.
+	Reload  func() error
+	Context *interface{}
 	cachedata.SrvrData
 }
 
@@ -84,19 +90,28 @@ type BeforeParentRequestData struct {
 type BeforeRespondData struct {
 	Req *http.Request
 	// CacheObj is the object to be cached, containing information about the origin request. The code, headers, and body should not be considered authoritative. Look at Code, Hdr, and Body instead, as the actual values about to be sent. Note CacheObj may be nil, if an error occurred (e.g. the Origin failed to respond).
-	CacheObj  *cacheobj.CacheObj
-	Code      *int
-	Hdr       *http.Header
-	Body      *[]byte
-	RemapRule string
-	Context   *interface{}
+	CacheObj *cacheobj.CacheObj
+	Code     *int
+	Hdr      *http.Header
+	// Body is the body about to be sent. If the CacheObj is streaming from the parent, Body is nil, and the body will be copied from the CacheObj.Stream() as it's received, unless a plugin sets Body.
+	Body *[]byte
+	// BodyReader is the reader the body is copied from, if Body is nil, e.g. a reader of the CacheObj.Stream(). A plugin may set it to a reader which transforms the body as it's read. BodyReader may be nil, as may the reader it points to.
+	BodyReader *io.Reader
+	RemapRule  string
+	Context    *interface{}
 }
 
 type BeforeCacheLookUpData struct {
 	Req                  *http.Request
 	CacheKeyOverrideFunc func(string)
 	DefaultCacheKey      string
-	Context              *interface{}
+	// CacheKey returns the current cache key, which is the DefaultCacheKey unless a plugin run before this one overrode it.
+	CacheKey func() string
+	// Cache is the cache of the request's remap rule.
+	Cache icache.Cache
+	// Reject stops processing the request, and responds to the client with the given code and headers, without looking up the cache or requesting a parent. If multiple plugins reject a request, the first rejection is used.
+	Reject  func(code int, hdr http.Header)
+	Context *interface{}
 }
 
 type AfterRespondData struct {
@@ -110,6 +125,16 @@ type AfterRespondData struct {
 	Context *interface{}
 }
 
+// PurgeData is the object being removed from the cache by a PURGE request.
+type PurgeData struct {
+	Req *http.Request
+	// CacheKey is the cache key of the object being purged.
+	CacheKey string
+	// Cache is the cache of the request's remap rule.
+	Cache   icache.Cache
+	Context *interface{}
+}
+
 type LoadFunc func(json.RawMessage) interface{}
 type StartupFunc func(icfg interface{}, d StartupData)
 type OnRequestFunc func(icfg interface{}, d OnRequestData) bool
@@ -118,6 +143,9 @@ type BeforeParentRequestFunc func(icfg interface{}, d BeforeParentRequestData)
 type BeforeRespondFunc func(icfg interface{}, d BeforeRespondData)
 type AfterRespondFunc func(icfg interface{}, d AfterRespondData)
 
+// PurgeFunc returns the cache keys of any variants of the purged object the plugin caches under their own keys, which are removed with the object.
+type PurgeFunc func(icfg interface{}, d PurgeData) []string
+
 type pluginObj struct {
 	funcs    Funcs
 	priority uint64
@@ -156,6 +184,7 @@ type Plugins interface {
 	OnBeforeParentRequest(cfgs map[string]interface{}, context map[string]*interface{}, d BeforeParentRequestData)
 	OnBeforeRespond(cfgs map[string]interface{}, context map[string]*interface{}, d BeforeRespondData)
 	OnAfterRespond(cfgs map[string]interface{}, context map[string]*interface{}, d AfterRespondData)
+	OnPurge(cfgs map[string]interface{}, context map[string]*interface{}, d PurgeData) []string
 }
 
 func (plugins pluginsSlice) LoadFuncs() map[string]LoadFunc {
@@ -206,7 +235,9 @@ func (ps pluginsSlice) OnBeforeCacheLookup(cfgs map[string]interface{}, context
 	}
 }
 
+// OnBeforeParentRequest sets the request's W3C trace context headers to its span, if it's traced, so plugins see the headers the parent will, and then runs the plugins.
 func (ps pluginsSlice) OnBeforeParentRequest(cfgs map[string]interface{}, context map[string]*interface{}, d BeforeParentRequestData) {
+	trace.Inject(d.Req)
 	for _, p := range ps {
 		if p.funcs.beforeParentRequest == nil {
 			continue
@@ -235,3 +266,16 @@ func (ps pluginsSlice) OnAfterRespond(cfgs map[string]interface{}, context map[s
 		p.funcs.afterRespond(cfgs[p.name], d)
 	}
 }
+
+// OnPurge returns the cache keys of the plugins' variants of the purged object, which should be removed with it.
+func (ps pluginsSlice) OnPurge(cfgs map[string]interface{}, context map[string]*interface{}, d PurgeData) []string {
+	keys := []string{}
+	for _, p := range ps {
+		if p.funcs.purge == nil {
+			continue
+		}
+		d.Context = context[p.name]
+		keys = append(keys, p.funcs.purge(cfgs[p.name], d)...)
+	}
+	return keys
+}
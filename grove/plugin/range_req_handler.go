@@ -149,8 +149,20 @@ func rangeReqHandleBeforeRespond(icfg interface{}, d BeforeRespondData) {
 	if cfg.Mode == "store_ranges" {
 		return // no need to do anything here.
 	}
+	if *d.Code == http.StatusPartialContent {
+		return // the range was already served, e.g. from the rule's range_chunk_bytes chunks.
+	}
 
 	// mode != store_ranges
+	if *d.Body == nil && d.CacheObj != nil && d.CacheObj.Stream() != nil {
+		// ranges are served from the whole object, so a streaming object must be completely received first.
+		body, err := d.CacheObj.Stream().Wait()
+		if err != nil {
+			log.Errorf("range_req_handler: receiving streaming body: %v\n", err)
+			return
+		}
+		*d.Body = body
+	}
 	multipartBoundaryString := cfg.MultiPartBoundary
 	multipart := false
 	originalContentType := d.Hdr.Get("Content-type")
@@ -14,10 +14,17 @@ package plugin
    limitations under the License.
 */
 
+import (
+	"time"
+)
+
 func init() {
 	AddPlugin(10000, Funcs{afterRespond: recordStats})
 }
 
 func recordStats(icfg interface{}, d AfterRespondData) {
 	d.Stats.Write(d.W, d.Conn, d.Req.Host, d.Req.RemoteAddr, d.RespCode, d.BytesWritten, d.CacheHit)
+	if remapStats, ok := d.Stats.Remap().Stats(d.Req.Host); ok {
+		remapStats.AddLatency(time.Since(d.ReqTime))
+	}
 }
@@ -0,0 +1,276 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// URISigningTokenName is the name of the query parameter or cookie containing the signed JWT.
+const URISigningTokenName = "URISigningPackage"
+
+// URISigningVersion is the only supported value of the cdniv claim.
+const URISigningVersion = 1
+
+// URISigningIssuerKeys is the key set of a single issuer, as stored in Traffic Ops.
+type URISigningIssuerKeys struct {
+	RenewalKID string          `json:"renewal_kid"`
+	Keys       []URISigningJWK `json:"keys"`
+}
+
+// URISigningJWK is a symmetric JSON Web Key, RFC 7517. The key K is base64url encoded.
+type URISigningJWK struct {
+	Alg string `json:"alg"`
+	KID string `json:"kid"`
+	Kty string `json:"kty"`
+	K   string `json:"k"`
+}
+
+// URISigningConfig is the remap rule config of the uri_signing plugin. It's the Traffic Ops URI signing key JSON, a map of issuers to their keys.
+type URISigningConfig map[string]URISigningIssuerKeys
+
+type uriSigningKey struct {
+	alg string
+	kid string
+	key []byte
+}
+
+type uriSigningConfig struct {
+	issuers map[string][]uriSigningKey
+}
+
+type uriSigningClaims struct {
+	Iss    *string `json:"iss"`
+	Exp    *int64  `json:"exp"`
+	Nbf    *int64  `json:"nbf"`
+	CDNIV  *int    `json:"cdniv"`
+	CDNIUC *string `json:"cdniuc"`
+}
+
+type uriSigningHeader struct {
+	Alg string `json:"alg"`
+	KID string `json:"kid"`
+}
+
+func init() {
+	AddPlugin(10000, Funcs{load: uriSigningLoad, beforeCacheLookUp: uriSigningBeforeCacheLookUp})
+}
+
+func uriSigningLoad(b json.RawMessage) interface{} {
+	rawCfg := URISigningConfig{}
+	if err := json.Unmarshal(b, &rawCfg); err != nil {
+		log.Errorln("uri_signing loading config, unmarshalling JSON: " + err.Error() + ", all requests will be rejected")
+		return &uriSigningConfig{issuers: map[string][]uriSigningKey{}} // no issuers, so no token is valid
+	}
+	cfg := &uriSigningConfig{issuers: map[string][]uriSigningKey{}}
+	for issuer, issuerKeys := range rawCfg {
+		for _, jwk := range issuerKeys.Keys {
+			if jwk.Kty != "" && jwk.Kty != "oct" {
+				log.Errorln("uri_signing loading config: issuer '" + issuer + "' key '" + jwk.KID + "' has unsupported type '" + jwk.Kty + "', ignoring")
+				continue
+			}
+			if uriSigningHashFunc(jwk.Alg) == nil {
+				log.Errorln("uri_signing loading config: issuer '" + issuer + "' key '" + jwk.KID + "' has unsupported algorithm '" + jwk.Alg + "', ignoring")
+				continue
+			}
+			key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+			if err != nil {
+				log.Errorln("uri_signing loading config: issuer '" + issuer + "' key '" + jwk.KID + "' decoding: " + err.Error() + ", ignoring")
+				continue
+			}
+			cfg.issuers[issuer] = append(cfg.issuers[issuer], uriSigningKey{alg: jwk.Alg, kid: jwk.KID, key: key})
+		}
+	}
+	return cfg
+}
+
+func uriSigningBeforeCacheLookUp(icfg interface{}, d BeforeCacheLookUpData) {
+	if icfg == nil {
+		return // the rule doesn't require signed URIs
+	}
+	cfg, ok := icfg.(*uriSigningConfig)
+	if !ok {
+		log.Errorf("uri_signing config '%v' type '%T' expected *uriSigningConfig\n", icfg, icfg)
+		// fail closed: a rule configured to require signed URIs must never serve unsigned ones.
+		d.Reject(http.StatusForbidden, nil)
+		return
+	}
+	stripToken := func(name string) bool { return name == URISigningTokenName }
+	if d.Req.Method == remapdata.MethodPurge {
+		d.CacheKeyOverrideFunc(cacheKeyWithoutQueryParams(d.CacheKey(), stripToken))
+		return // purges are authorized by the rule's IP allow list, not tokens
+	}
+	if err := uriSigningValidate(cfg, d.Req, time.Now()); err != nil {
+		log.Debugln("uri_signing rejecting " + d.Req.RemoteAddr + " " + d.Req.Host + d.Req.RequestURI + ": " + err.Error())
+		d.Reject(http.StatusForbidden, nil)
+		return
+	}
+	// all tokens for the same object are the same object, so cache them once.
+	d.CacheKeyOverrideFunc(cacheKeyWithoutQueryParams(d.CacheKey(), stripToken))
+}
+
+// uriSigningToken returns the token from the request query string, or else the request cookie, and the request URL without the token. It returns an error if the query string has more than one token, so the token validated can't differ from one used elsewhere.
+func uriSigningToken(r *http.Request) (string, string, error) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	uri := scheme + "://" + r.Host + r.RequestURI
+	token := ""
+	if queryStart := strings.Index(uri, "?"); queryStart >= 0 {
+		kept := []string{}
+		for _, param := range strings.Split(uri[queryStart+1:], "&") {
+			if kv := strings.SplitN(param, "=", 2); kv[0] == URISigningTokenName && len(kv) == 2 {
+				if token != "" {
+					return "", "", errors.New("duplicate token")
+				}
+				token = kv[1]
+				continue
+			}
+			kept = append(kept, param)
+		}
+		uri = uri[:queryStart]
+		if len(kept) > 0 {
+			uri += "?" + strings.Join(kept, "&")
+		}
+	}
+	if token == "" {
+		if cookie, err := r.Cookie(URISigningTokenName); err == nil {
+			token = cookie.Value
+		}
+	}
+	return token, uri, nil
+}
+
+// uriSigningValidate returns nil if the request contains a JWT signed by a configured issuer, whose claims allow this request at the given time; otherwise it returns an error describing why it isn't valid.
+func uriSigningValidate(cfg *uriSigningConfig, r *http.Request, now time.Time) error {
+	token, uri, err := uriSigningToken(r)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("no token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token: expected 3 parts, got " + strconv.Itoa(len(parts)))
+	}
+
+	header := uriSigningHeader{}
+	if err := uriSigningDecodePart(parts[0], &header); err != nil {
+		return errors.New("malformed token header: " + err.Error())
+	}
+	claims := uriSigningClaims{}
+	if err := uriSigningDecodePart(parts[1], &claims); err != nil {
+		return errors.New("malformed token claims: " + err.Error())
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature: " + err.Error())
+	}
+
+	if claims.Iss == nil {
+		return errors.New("no issuer")
+	}
+	keys, ok := cfg.issuers[*claims.Iss]
+	if !ok {
+		return errors.New("unknown issuer '" + *claims.Iss + "'")
+	}
+	verified := false
+	for _, key := range keys {
+		if key.alg != header.Alg || (header.KID != "" && key.kid != header.KID) {
+			continue
+		}
+		mac := hmac.New(uriSigningHashFunc(key.alg), key.key)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("signature doesn't match any key of issuer '" + *claims.Iss + "'")
+	}
+
+	if claims.CDNIV != nil && *claims.CDNIV != URISigningVersion {
+		return errors.New("unsupported version " + strconv.Itoa(*claims.CDNIV))
+	}
+	if claims.Exp != nil && *claims.Exp < now.Unix() {
+		return errors.New("expired at " + time.Unix(*claims.Exp, 0).Format(time.RFC3339))
+	}
+	if claims.Nbf != nil && *claims.Nbf > now.Unix() {
+		return errors.New("not valid before " + time.Unix(*claims.Nbf, 0).Format(time.RFC3339))
+	}
+	if claims.CDNIUC != nil {
+		if err := uriSigningMatchContainer(*claims.CDNIUC, uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uriSigningMatchContainer returns nil if the URI matches the cdniuc URI container. Only regex containers are supported; any other container type is rejected, because it can't be verified.
+func uriSigningMatchContainer(container string, uri string) error {
+	const regexPrefix = "regex:"
+	if !strings.HasPrefix(container, regexPrefix) {
+		return errors.New("unsupported URI container '" + container + "'")
+	}
+	re, err := regexp.Compile(container[len(regexPrefix):])
+	if err != nil {
+		return errors.New("malformed URI container regex: " + err.Error())
+	}
+	if !re.MatchString(uri) {
+		if unescaped, err := url.PathUnescape(uri); err != nil || !re.MatchString(unescaped) {
+			return errors.New("URI '" + uri + "' doesn't match container '" + container + "'")
+		}
+	}
+	return nil
+}
+
+func uriSigningDecodePart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// uriSigningHashFunc returns the hash of the given JWS HMAC algorithm, or nil if the algorithm isn't supported.
+func uriSigningHashFunc(alg string) func() hash.Hash {
+	switch alg {
+	case "HS256":
+		return sha256.New
+	case "HS384":
+		return sha512.New384
+	case "HS512":
+		return sha512.New
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestURISigningValidate(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cfg := uriSigningLoad(json.RawMessage(`{"issuer0": {"renewal_kid": "k1", "keys": [{"alg": "HS256", "kid": "k1", "kty": "oct", "k": "` + base64.RawURLEncoding.EncodeToString(key) + `"}]}}`)).(*uriSigningConfig)
+	now := time.Unix(1500000000, 0)
+
+	sign := func(key []byte, claims string) string {
+		signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"k1"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		cookie bool
+		valid  bool
+	}{
+		{"valid", sign(key, `{"iss":"issuer0","exp":1500000060}`), false, true},
+		{"valid cookie", sign(key, `{"iss":"issuer0","exp":1500000060}`), true, true},
+		{"matching container", sign(key, `{"iss":"issuer0","cdniv":1,"cdniuc":"regex:http://example\\.net/path/.*"}`), false, true},
+		{"other container", sign(key, `{"iss":"issuer0","cdniuc":"regex:http://example\\.net/other/.*"}`), false, false},
+		{"hash container", sign(key, `{"iss":"issuer0","cdniuc":"hash:abc"}`), false, false},
+		{"expired", sign(key, `{"iss":"issuer0","exp":1499999940}`), false, false},
+		{"not yet valid", sign(key, `{"iss":"issuer0","nbf":1500000060}`), false, false},
+		{"unknown issuer", sign(key, `{"iss":"issuer1"}`), false, false},
+		{"unknown version", sign(key, `{"iss":"issuer0","cdniv":2}`), false, false},
+		{"wrong key", sign([]byte("wrong"), `{"iss":"issuer0"}`), false, false},
+		{"no token", "", false, false},
+		{"duplicate token", sign(key, `{"iss":"issuer0","exp":1500000060}`) + "&" + URISigningTokenName + "=" + sign(key, `{"iss":"issuer0","exp":1500000060}`), false, false},
+	}
+	for _, test := range tests {
+		r := &http.Request{Host: "example.net", RequestURI: "/path/obj", Header: http.Header{}}
+		if test.cookie {
+			r.AddCookie(&http.Cookie{Name: URISigningTokenName, Value: test.token})
+		} else if test.token != "" {
+			r.RequestURI += "?" + URISigningTokenName + "=" + test.token
+		}
+		if err := uriSigningValidate(cfg, r, now); (err == nil) != test.valid {
+			t.Errorf("uriSigningValidate %v expected valid %v, actual error %v", test.name, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/web"
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// URLSigConfig is the remap rule config of the url_sig plugin. It mirrors the Apache Traffic Server url_sig plugin config file.
+type URLSigConfig struct {
+	// Keys is the map of key names to secrets, where names are "key0" through "key15", as stored in Traffic Ops.
+	Keys map[string]string `json:"keys"`
+	// ErrorURL is the response to failed validations, either a code such as "403", or "302 http://example.net/denied".
+	ErrorURL string `json:"error_url"`
+	// ExcludeRegex is an optional regular expression. Requests whose URL matches are not validated.
+	ExcludeRegex string `json:"excl_regex"`
+}
+
+const URLSigMaxKeys = 16
+
+const (
+	URLSigParamClientIP   = "C"
+	URLSigParamExpiration = "E"
+	URLSigParamAlgorithm  = "A"
+	URLSigParamKeyIndex   = "K"
+	URLSigParamParts      = "P"
+	URLSigParamSignature  = "S"
+)
+
+const (
+	URLSigAlgorithmHMACSHA1 = 1
+	URLSigAlgorithmHMACMD5  = 2
+)
+
+const URLSigDefaultErrorCode = http.StatusForbidden
+
+type urlSigConfig struct {
+	keys         [URLSigMaxKeys][]byte
+	errCode      int
+	errLocation  string
+	excludeRegex *regexp.Regexp
+}
+
+func init() {
+	AddPlugin(10000, Funcs{load: urlSigLoad, beforeCacheLookUp: urlSigBeforeCacheLookUp})
+}
+
+func urlSigLoad(b json.RawMessage) interface{} {
+	rawCfg := URLSigConfig{}
+	if err := json.Unmarshal(b, &rawCfg); err != nil {
+		log.Errorln("url_sig loading config, unmarshalling JSON: " + err.Error() + ", all requests will be rejected")
+		return &urlSigConfig{errCode: URLSigDefaultErrorCode} // no keys, so no signature is valid
+	}
+	cfg := &urlSigConfig{errCode: URLSigDefaultErrorCode}
+	for name, key := range rawCfg.Keys {
+		i, err := strconv.Atoi(strings.TrimPrefix(name, "key"))
+		if !strings.HasPrefix(name, "key") || err != nil || i < 0 || i >= URLSigMaxKeys {
+			log.Errorln("url_sig loading config: invalid key name '" + name + "', must be key0 through key" + strconv.Itoa(URLSigMaxKeys-1) + ", ignoring")
+			continue
+		}
+		cfg.keys[i] = []byte(key)
+	}
+	if rawCfg.ErrorURL != "" {
+		fields := strings.Fields(rawCfg.ErrorURL)
+		code, err := strconv.Atoi(fields[0])
+		if err != nil || code < 100 || code > 599 {
+			log.Errorln("url_sig loading config: invalid error_url '" + rawCfg.ErrorURL + "', using " + strconv.Itoa(URLSigDefaultErrorCode))
+		} else {
+			cfg.errCode = code
+			if len(fields) > 1 {
+				cfg.errLocation = fields[1]
+			}
+		}
+	}
+	if rawCfg.ExcludeRegex != "" {
+		re, err := regexp.Compile(rawCfg.ExcludeRegex)
+		if err != nil {
+			log.Errorln("url_sig loading config: compiling excl_regex '" + rawCfg.ExcludeRegex + "': " + err.Error() + ", all requests will be validated")
+		} else {
+			cfg.excludeRegex = re
+		}
+	}
+	return cfg
+}
+
+func urlSigBeforeCacheLookUp(icfg interface{}, d BeforeCacheLookUpData) {
+	if icfg == nil {
+		return // the rule doesn't require signed URLs
+	}
+	cfg, ok := icfg.(*urlSigConfig)
+	if !ok {
+		log.Errorf("url_sig config '%v' type '%T' expected *urlSigConfig\n", icfg, icfg)
+		// fail closed: a rule configured to require signed URLs must never serve unsigned ones.
+		d.Reject(URLSigDefaultErrorCode, nil)
+		return
+	}
+	// purges are authorized by the rule's IP allow list, not signatures
+	if d.Req.Method == remapdata.MethodPurge || (cfg.excludeRegex != nil && cfg.excludeRegex.MatchString(urlSigURLNoScheme(d.Req))) {
+		d.CacheKeyOverrideFunc(cacheKeyWithoutQueryParams(d.CacheKey(), urlSigIsParam))
+		return
+	}
+	clientIP, _ := web.GetClientIPPort(d.Req)
+	if err := urlSigValidate(cfg, d.Req, clientIP, time.Now()); err != nil {
+		log.Debugln("url_sig rejecting " + d.Req.RemoteAddr + " " + d.Req.Host + d.Req.RequestURI + ": " + err.Error())
+		hdr := http.Header(nil)
+		if cfg.errLocation != "" {
+			hdr = http.Header{"Location": {cfg.errLocation}}
+		}
+		d.Reject(cfg.errCode, hdr)
+		return
+	}
+	// all signed URLs for the same object are the same object, so cache them once.
+	d.CacheKeyOverrideFunc(cacheKeyWithoutQueryParams(d.CacheKey(), urlSigIsParam))
+}
+
+// urlSigURLNoScheme returns the request URL without the scheme, i.e. the host, path, and query. This is the URL the signature parts refer to.
+func urlSigURLNoScheme(r *http.Request) string {
+	return r.Host + r.RequestURI
+}
+
+func urlSigIsParam(name string) bool {
+	switch name {
+	case URLSigParamClientIP, URLSigParamExpiration, URLSigParamAlgorithm, URLSigParamKeyIndex, URLSigParamParts, URLSigParamSignature:
+		return true
+	}
+	return false
+}
+
+// urlSigValidate returns nil if the request is signed with one of the configured keys, isn't expired, and is from the signed client IP, if any; otherwise it returns an error describing why it isn't valid.
+func urlSigValidate(cfg *urlSigConfig, r *http.Request, clientIP string, now time.Time) error {
+	url := urlSigURLNoScheme(r)
+	queryStart := strings.Index(url, "?")
+	if queryStart < 0 {
+		return errors.New("no query string")
+	}
+	path, query := url[:queryStart], url[queryStart+1:]
+
+	// Only the query up to the signature is signed, so only the parameters before it are used. Signing parameters may not be repeated anywhere, so an unsigned duplicate can't be mistaken for the signed one.
+	sigStart := strings.Index("&"+query, "&"+URLSigParamSignature+"=")
+	if sigStart < 0 {
+		return errors.New("no signature")
+	}
+	signedQuery := query[:sigStart+len(URLSigParamSignature+"=")]
+	params := map[string]string{}
+	seen := map[string]struct{}{}
+	paramStart := 0
+	for _, param := range strings.Split(query, "&") {
+		signedParam := paramStart <= sigStart // the signature itself starts at sigStart
+		paramStart += len(param) + len("&")
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if urlSigIsParam(kv[0]) {
+			if _, ok := seen[kv[0]]; ok {
+				return errors.New("duplicate parameter '" + kv[0] + "'")
+			}
+			seen[kv[0]] = struct{}{}
+		}
+		if signedParam {
+			params[kv[0]] = kv[1]
+		}
+	}
+
+	if ip, ok := params[URLSigParamClientIP]; ok && ip != clientIP {
+		return errors.New("client IP '" + clientIP + "' doesn't match signed IP '" + ip + "'")
+	}
+
+	expiration, err := strconv.ParseInt(params[URLSigParamExpiration], 10, 64)
+	if err != nil {
+		return errors.New("malformed expiration '" + params[URLSigParamExpiration] + "'")
+	}
+	if expiration < now.Unix() {
+		return errors.New("expired at " + time.Unix(expiration, 0).Format(time.RFC3339))
+	}
+
+	newHash := (func() hash.Hash)(nil)
+	switch params[URLSigParamAlgorithm] {
+	case strconv.Itoa(URLSigAlgorithmHMACSHA1):
+		newHash = sha1.New
+	case strconv.Itoa(URLSigAlgorithmHMACMD5):
+		newHash = md5.New
+	default:
+		return errors.New("unknown algorithm '" + params[URLSigParamAlgorithm] + "'")
+	}
+
+	keyIndex, err := strconv.Atoi(params[URLSigParamKeyIndex])
+	if err != nil || keyIndex < 0 || keyIndex >= URLSigMaxKeys || len(cfg.keys[keyIndex]) == 0 {
+		return errors.New("unknown key index '" + params[URLSigParamKeyIndex] + "'")
+	}
+
+	parts := params[URLSigParamParts]
+	if parts == "" || strings.Trim(parts, "01") != "" {
+		return errors.New("malformed parts '" + parts + "'")
+	}
+
+	sig, err := hex.DecodeString(params[URLSigParamSignature])
+	if err != nil || len(sig) == 0 {
+		return errors.New("malformed signature '" + params[URLSigParamSignature] + "'")
+	}
+
+	signed := urlSigSignedParts(path, parts) + "?" + signedQuery
+
+	mac := hmac.New(newHash, cfg.keys[keyIndex])
+	mac.Write([]byte(signed))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("signature doesn't match")
+	}
+	return nil
+}
+
+// urlSigSignedParts returns the parts of the host and path selected by the parts string, joined by slashes. Each character of parts is 1 if the corresponding part is signed, or 0 if it isn't; the last character applies to all remaining parts.
+func urlSigSignedParts(hostPath string, parts string) string {
+	signed := []string{}
+	i := 0
+	for _, part := range strings.Split(hostPath, "/") {
+		if part == "" {
+			continue
+		}
+		if parts[i] == '1' {
+			signed = append(signed, part)
+		}
+		if i < len(parts)-1 {
+			i++
+		}
+	}
+	return strings.Join(signed, "/")
+}
+
+// cacheKeyWithoutQueryParams returns the cache key with the query parameters for which remove returns true removed. Any key suffixes, such as headers or chunk numbers, are preserved.
+func cacheKeyWithoutQueryParams(key string, remove func(name string) bool) string {
+	suffix := ""
+	if i := strings.Index(key, remapdata.CacheKeySeparator); i >= 0 {
+		key, suffix = key[:i], key[i:]
+	}
+	queryStart := strings.Index(key, "?")
+	if queryStart < 0 {
+		return key + suffix
+	}
+	kept := []string{}
+	for _, param := range strings.Split(key[queryStart+1:], "&") {
+		if !remove(strings.SplitN(param, "=", 2)[0]) {
+			kept = append(kept, param)
+		}
+	}
+	if len(kept) == 0 {
+		return key[:queryStart] + suffix
+	}
+	return key[:queryStart+1] + strings.Join(kept, "&") + suffix
+}
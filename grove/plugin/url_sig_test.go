@@ -0,0 +1,83 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestURLSigValidate(t *testing.T) {
+	cfg := urlSigLoad(json.RawMessage(`{"keys": {"key3": "secret"}}`)).(*urlSigConfig)
+	now := time.Unix(1500000000, 0)
+
+	sign := func(hostPath string, query string) string {
+		mac := hmac.New(sha1.New, []byte("secret"))
+		mac.Write([]byte(hostPath + "?" + query + "S="))
+		return query + "S=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	unexpired := strconv.FormatInt(now.Unix()+60, 10)
+	expired := strconv.FormatInt(now.Unix()-60, 10)
+
+	tests := []struct {
+		name       string
+		requestURI string
+		valid      bool
+	}{
+		{"all parts", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=1&K=3&P=1&"), true},
+		{"host not signed", "/path/to/obj?" + sign("path/to/obj", "E="+unexpired+"&A=1&K=3&P=01&"), true},
+		{"leading params", "/path/to/obj?" + sign("example.net/path/to/obj", "a=b&E="+unexpired+"&A=1&K=3&P=1&"), true},
+		{"client IP", "/path/to/obj?" + sign("example.net/path/to/obj", "C=192.0.2.1&E="+unexpired+"&A=1&K=3&P=1&"), true},
+		{"wrong client IP", "/path/to/obj?" + sign("example.net/path/to/obj", "C=192.0.2.2&E="+unexpired+"&A=1&K=3&P=1&"), false},
+		{"expired", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+expired+"&A=1&K=3&P=1&"), false},
+		{"unknown key", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=1&K=2&P=1&"), false},
+		{"unknown algorithm", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=3&K=3&P=1&"), false},
+		{"modified path", "/path/to/other?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=1&K=3&P=1&"), false},
+		{"unsigned", "/path/to/obj", false},
+		{"unsigned trailing params", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=1&K=3&P=1&") + "&a=b", true},
+		{"unsigned expiration after signature", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+expired+"&A=1&K=3&P=1&") + "&E=" + unexpired, false},
+		{"expiration only after signature", "/path/to/obj?" + sign("example.net/path/to/obj", "A=1&K=3&P=1&") + "&E=" + unexpired, false},
+		{"unsigned parts after signature", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=1&K=3&P=01&") + "&P=1", false},
+		{"duplicate signed expiration", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+expired+"&E="+unexpired+"&A=1&K=3&P=1&"), false},
+		{"duplicate signature", "/path/to/obj?" + sign("example.net/path/to/obj", "E="+unexpired+"&A=1&K=3&P=1&") + "&S=00", false},
+	}
+	for _, test := range tests {
+		r := &http.Request{Host: "example.net", RequestURI: test.requestURI}
+		if err := urlSigValidate(cfg, r, "192.0.2.1", now); (err == nil) != test.valid {
+			t.Errorf("urlSigValidate %v expected valid %v, actual error %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestCacheKeyWithoutQueryParams(t *testing.T) {
+	tests := map[string]string{
+		"GET:http://example.net/obj":                            "GET:http://example.net/obj",
+		"GET:http://example.net/obj?E=1&A=1&K=0&P=1&S=ab":       "GET:http://example.net/obj",
+		"GET:http://example.net/obj?a=b&E=1&A=1&K=0&P=1&S=ab":   "GET:http://example.net/obj?a=b",
+		"GET:http://example.net/obj?E=1&S=ab#header:Accept=*/*": "GET:http://example.net/obj#header:Accept=*/*",
+		"GET:http://example.net/obj?Se=1&a=b&S=ab#chunk:3":      "GET:http://example.net/obj?Se=1&a=b#chunk:3",
+	}
+	for key, expected := range tests {
+		if actual := cacheKeyWithoutQueryParams(key, urlSigIsParam); actual != expected {
+			t.Errorf("cacheKeyWithoutQueryParams '%v' expected '%v' actual '%v'", key, expected, actual)
+		}
+	}
+}
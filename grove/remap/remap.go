@@ -15,6 +15,8 @@ package remap
 */
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,9 +32,12 @@ import (
 	"github.com/apache/trafficcontrol/grove/plugin"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/rfc"
+	"github.com/apache/trafficcontrol/grove/thread"
 	"github.com/apache/trafficcontrol/grove/web"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
+
+	"golang.org/x/net/http2"
 )
 
 type HTTPRequestRemapper interface {
@@ -108,15 +113,19 @@ type Remapping struct {
 	RetryCodes      map[int]struct{}
 	Cache           icache.Cache
 	Transport       *http.Transport
+	Stream          bool
+	ParentHealth    *remapdata.ParentHealth
+	Streams         thread.Throttler
 }
 
 // RemappingProducer takes an HTTP Request and returns a Remapping to be used for that request.
 // TODO rename? interface?
 type RemappingProducer struct {
-	oldURI   string
-	rule     remapdata.RemapRule
-	cacheKey string
-	failures int
+	oldURI      string
+	rule        remapdata.RemapRule
+	cacheKey    string
+	failures    int
+	parentOrder *remapdata.ParentOrder
 }
 
 func (p *RemappingProducer) CacheKey() string                  { return p.cacheKey }
@@ -126,6 +135,21 @@ func (p *RemappingProducer) Name() string                      { return p.rule.N
 func (p *RemappingProducer) DSCP() int                         { return p.rule.DSCP }
 func (p *RemappingProducer) PluginCfg() map[string]interface{} { return p.rule.Plugins }
 func (p *RemappingProducer) Cache() icache.Cache               { return p.rule.Cache }
+func (p *RemappingProducer) RetryCodes() map[int]struct{}      { return p.rule.RetryCodes }
+func (p *RemappingProducer) StaleWhileRevalidate() time.Duration {
+	return p.rule.StaleWhileRevalidate
+}
+func (p *RemappingProducer) StaleIfError() time.Duration { return p.rule.StaleIfError }
+func (p *RemappingProducer) RangeChunkBytes() int64      { return p.rule.RangeChunkBytes }
+func (p *RemappingProducer) Stream() bool                { return p.rule.Stream }
+func (p *RemappingProducer) RateLimiter() *remapdata.RateLimiter {
+	return p.rule.RateLimiter
+}
+
+// WithCacheKey returns a new RemappingProducer for the same request and rule, with the given cache key and no failures. This is used to make separate parent requests for parts of the same object, such as range chunks, each with its own retries, and for background revalidations, which must not share the request's producer.
+func (p *RemappingProducer) WithCacheKey(cacheKey string) *RemappingProducer {
+	return &RemappingProducer{rule: p.rule, oldURI: p.oldURI, cacheKey: cacheKey}
+}
 func (p *RemappingProducer) FirstFQDN() string {
 	// TODO verify To is not allowed to be constructed with < 1 element
 	return strings.TrimPrefix(strings.TrimPrefix(p.rule.To[0].URL, "http://"), "https://")
@@ -160,7 +184,7 @@ func (hr simpleHTTPRequestRemapper) RemappingProducer(r *http.Request, scheme st
 		log.Debugf("Allowed %v\n", ip)
 	}
 
-	cacheKey := rule.CacheKey(r.Method, uri)
+	cacheKey := rule.CacheKey(r.Method, uri, r.Header)
 
 	return &RemappingProducer{
 		rule:     rule,
@@ -175,7 +199,13 @@ func (p *RemappingProducer) GetNext(r *http.Request) (Remapping, bool, error) {
 		return Remapping{}, false, ErrNoMoreRetries
 	}
 
-	newURI, proxyURL, transport := p.rule.URI(p.oldURI, r.URL.Path, r.URL.RawQuery, p.failures)
+	if p.parentOrder == nil {
+		p.parentOrder = p.rule.NewParentOrder() // created on the first parent request, so cache hits don't advance round robin
+	}
+	newURI, proxyURL, transport, parentHealth, streams := p.rule.URI(p.oldURI, r.URL.Path, r.URL.RawQuery, p.failures, p.parentOrder)
+	if streams == nil {
+		streams = thread.NewNoThrottler()
+	}
 	p.failures++
 	newReq, err := http.NewRequest(r.Method, newURI, nil)
 	if err != nil {
@@ -201,6 +231,9 @@ func (p *RemappingProducer) GetNext(r *http.Request) (Remapping, bool, error) {
 		RetryCodes:      p.rule.RetryCodes,
 		Cache:           p.rule.Cache,
 		Transport:       transport,
+		Stream:          p.rule.Stream,
+		ParentHealth:    parentHealth,
+		Streams:         streams,
 	}, retryAllowed, nil
 }
 
@@ -253,7 +286,7 @@ func (r literalPrefixRemapper) Remap(s string) (remapdata.RemapRule, bool) {
 }
 
 func (r literalPrefixRemapper) Rules() []remapdata.RemapRule {
-	rules := make([]remapdata.RemapRule, len(r.remap))
+	rules := make([]remapdata.RemapRule, 0, len(r.remap))
 	for _, rule := range r.remap {
 		rules = append(rules, rule)
 	}
@@ -276,23 +309,39 @@ type RemapRulesBase struct {
 
 type RemapRulesJSON struct {
 	RemapRulesBase
-	Rules           []RemapRuleJSON            `json:"rules"`
-	RetryCodes      *[]int                     `json:"retry_codes"`
-	TimeoutMS       *int                       `json:"timeout_ms"`
-	ParentSelection *string                    `json:"parent_selection"`
-	Stats           RemapRulesStatsJSON        `json:"stats"`
-	Plugins         map[string]json.RawMessage `json:"plugins"`
+	Rules                  []RemapRuleJSON                 `json:"rules"`
+	RetryCodes             *[]int                          `json:"retry_codes"`
+	TimeoutMS              *int                            `json:"timeout_ms"`
+	ParentSelection        *string                         `json:"parent_selection"`
+	StaleWhileRevalidateMS *int                            `json:"stale_while_revalidate_ms"`
+	StaleIfErrorMS         *int                            `json:"stale_if_error_ms"`
+	ParentMaxFailures      *int                            `json:"parent_max_failures"`
+	ParentCooldownMS       *int                            `json:"parent_cooldown_ms"`
+	ParentHTTP2            *bool                           `json:"parent_http2"`
+	ParentHTTP2MaxStreams  *int                            `json:"parent_http2_max_concurrent_streams"`
+	RateLimit              *remapdata.RateLimitConfig      `json:"rate_limit"`
+	GlobalRateLimit        remapdata.GlobalRateLimitConfig `json:"global_rate_limit"`
+	Stats                  RemapRulesStatsJSON             `json:"stats"`
+	Plugins                map[string]json.RawMessage      `json:"plugins"`
 }
 
 type RemapRules struct {
 	RemapRulesBase
-	Rules           []remapdata.RemapRule
-	RetryCodes      map[int]struct{}
-	Timeout         *time.Duration
-	ParentSelection *remapdata.ParentSelectionType
-	Stats           remapdata.RemapRulesStats
-	Plugins         map[string]interface{}
-	Cache           icache.Cache
+	Rules                 []remapdata.RemapRule
+	RetryCodes            map[int]struct{}
+	Timeout               *time.Duration
+	ParentSelection       *remapdata.ParentSelectionType
+	StaleWhileRevalidate  time.Duration
+	StaleIfError          time.Duration
+	ParentMaxFailures     int
+	ParentCooldown        time.Duration
+	ParentHTTP2           bool
+	ParentHTTP2MaxStreams int
+	RateLimit             *remapdata.RateLimitConfig
+	GlobalRateLimit       *thread.TokenBucket
+	Stats                 remapdata.RemapRulesStats
+	Plugins               map[string]interface{}
+	Cache                 icache.Cache
 }
 
 type RemapRuleToJSON struct {
@@ -308,14 +357,21 @@ type HdrModder interface {
 
 type RemapRuleJSON struct {
 	remapdata.RemapRuleBase
-	TimeoutMS       *int                       `json:"timeout_ms"`
-	ParentSelection *string                    `json:"parent_selection"`
-	To              []RemapRuleToJSON          `json:"to"`
-	Allow           []string                   `json:"allow"`
-	Deny            []string                   `json:"deny"`
-	RetryCodes      *[]int                     `json:"retry_codes"`
-	CacheName       *string                    `json:"cache_name"`
-	Plugins         map[string]json.RawMessage `json:"plugins"`
+	TimeoutMS              *int                       `json:"timeout_ms"`
+	ParentSelection        *string                    `json:"parent_selection"`
+	StaleWhileRevalidateMS *int                       `json:"stale_while_revalidate_ms"`
+	StaleIfErrorMS         *int                       `json:"stale_if_error_ms"`
+	ParentMaxFailures      *int                       `json:"parent_max_failures"`
+	ParentCooldownMS       *int                       `json:"parent_cooldown_ms"`
+	ParentHTTP2            *bool                      `json:"parent_http2"`
+	ParentHTTP2MaxStreams  *int                       `json:"parent_http2_max_concurrent_streams"`
+	RateLimit              *remapdata.RateLimitConfig `json:"rate_limit"`
+	To                     []RemapRuleToJSON          `json:"to"`
+	Allow                  []string                   `json:"allow"`
+	Deny                   []string                   `json:"deny"`
+	RetryCodes             *[]int                     `json:"retry_codes"`
+	CacheName              *string                    `json:"cache_name"`
+	Plugins                map[string]json.RawMessage `json:"plugins"`
 }
 
 // LoadRemapRules returns the loaded rules, the global plugins, the Stats remap rules, and any error
@@ -352,6 +408,38 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 			return nil, nil, nil, fmt.Errorf("error parsing rules: timeout must be positive: %v", remapRules.Timeout)
 		}
 	}
+	if remapRulesJSON.StaleWhileRevalidateMS != nil {
+		if remapRules.StaleWhileRevalidate = time.Duration(*remapRulesJSON.StaleWhileRevalidateMS) * time.Millisecond; remapRules.StaleWhileRevalidate < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rules: stale_while_revalidate_ms must be positive: %v", remapRules.StaleWhileRevalidate)
+		}
+	}
+	if remapRulesJSON.StaleIfErrorMS != nil {
+		if remapRules.StaleIfError = time.Duration(*remapRulesJSON.StaleIfErrorMS) * time.Millisecond; remapRules.StaleIfError < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rules: stale_if_error_ms must be positive: %v", remapRules.StaleIfError)
+		}
+	}
+	if remapRulesJSON.ParentMaxFailures != nil {
+		if remapRules.ParentMaxFailures = *remapRulesJSON.ParentMaxFailures; remapRules.ParentMaxFailures < 1 {
+			return nil, nil, nil, fmt.Errorf("error parsing rules: parent_max_failures must be at least 1: %v", remapRules.ParentMaxFailures)
+		}
+	}
+	if remapRulesJSON.ParentCooldownMS != nil {
+		if remapRules.ParentCooldown = time.Duration(*remapRulesJSON.ParentCooldownMS) * time.Millisecond; remapRules.ParentCooldown < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rules: parent_cooldown_ms must be positive: %v", remapRules.ParentCooldown)
+		}
+	}
+	if remapRulesJSON.ParentHTTP2 != nil {
+		remapRules.ParentHTTP2 = *remapRulesJSON.ParentHTTP2
+	}
+	if remapRulesJSON.ParentHTTP2MaxStreams != nil {
+		if remapRules.ParentHTTP2MaxStreams = *remapRulesJSON.ParentHTTP2MaxStreams; remapRules.ParentHTTP2MaxStreams < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rules: parent_http2_max_concurrent_streams must be positive: %v", remapRules.ParentHTTP2MaxStreams)
+		}
+	}
+	remapRules.RateLimit = remapRulesJSON.RateLimit
+	if remapRules.GlobalRateLimit, err = remapdata.NewGlobalRateLimit(remapRulesJSON.GlobalRateLimit); err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing rules: global_rate_limit: %v", err)
+	}
 	if remapRulesJSON.ParentSelection != nil {
 		ps := remapdata.ParentSelectionTypeFromString(*remapRulesJSON.ParentSelection)
 		if remapRules.ParentSelection = &ps; *remapRules.ParentSelection == remapdata.ParentSelectionTypeInvalid {
@@ -414,6 +502,72 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 			rule.Timeout = remapRules.Timeout
 		}
 
+		if jsonRule.StaleWhileRevalidateMS != nil {
+			if rule.StaleWhileRevalidate = time.Duration(*jsonRule.StaleWhileRevalidateMS) * time.Millisecond; rule.StaleWhileRevalidate < 0 {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v stale_while_revalidate_ms must be positive: %v", rule.Name, rule.StaleWhileRevalidate)
+			}
+		} else {
+			rule.StaleWhileRevalidate = remapRules.StaleWhileRevalidate
+		}
+
+		if jsonRule.StaleIfErrorMS != nil {
+			if rule.StaleIfError = time.Duration(*jsonRule.StaleIfErrorMS) * time.Millisecond; rule.StaleIfError < 0 {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v stale_if_error_ms must be positive: %v", rule.Name, rule.StaleIfError)
+			}
+		} else {
+			rule.StaleIfError = remapRules.StaleIfError
+		}
+
+		if rule.RangeChunkBytes < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v range_chunk_bytes must be positive: %v", rule.Name, rule.RangeChunkBytes)
+		}
+
+		if err := rule.CacheKeyPolicy.Validate(); err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v cache_key: %v", rule.Name, err)
+		}
+
+		if err := rule.RegexRemap.Compile(); err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v regex_remap: %v", rule.Name, err)
+		}
+
+		if jsonRule.ParentMaxFailures != nil {
+			if rule.ParentMaxFailures = *jsonRule.ParentMaxFailures; rule.ParentMaxFailures < 1 {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v parent_max_failures must be at least 1: %v", rule.Name, rule.ParentMaxFailures)
+			}
+		} else {
+			rule.ParentMaxFailures = remapRules.ParentMaxFailures
+		}
+
+		if jsonRule.ParentCooldownMS != nil {
+			if rule.ParentCooldown = time.Duration(*jsonRule.ParentCooldownMS) * time.Millisecond; rule.ParentCooldown < 0 {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v parent_cooldown_ms must be positive: %v", rule.Name, rule.ParentCooldown)
+			}
+		} else {
+			rule.ParentCooldown = remapRules.ParentCooldown
+		}
+
+		if jsonRule.ParentHTTP2 != nil {
+			rule.ParentHTTP2 = *jsonRule.ParentHTTP2
+		} else {
+			rule.ParentHTTP2 = remapRules.ParentHTTP2
+		}
+
+		if jsonRule.ParentHTTP2MaxStreams != nil {
+			if rule.ParentHTTP2MaxConcurrentStreams = *jsonRule.ParentHTTP2MaxStreams; rule.ParentHTTP2MaxConcurrentStreams < 0 {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v parent_http2_max_concurrent_streams must be positive: %v", rule.Name, rule.ParentHTTP2MaxConcurrentStreams)
+			}
+		} else {
+			rule.ParentHTTP2MaxConcurrentStreams = remapRules.ParentHTTP2MaxStreams
+		}
+
+		rateLimit := jsonRule.RateLimit
+		if rateLimit == nil {
+			rateLimit = remapRules.RateLimit
+		}
+		if rule.RateLimiter, err = remapdata.NewRateLimiter(rateLimit, remapRules.GlobalRateLimit); err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v rate_limit: %v", rule.Name, err)
+		}
+
 		if rule.RetryNum == nil {
 			rule.RetryNum = remapRules.RetryNum
 		}
@@ -459,7 +613,8 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 
 		if *rule.ParentSelection == remapdata.ParentSelectionTypeConsistentHash {
 			rule.ConsistentHash = makeRuleHash(rule)
-		} else {
+		} else if *rule.ParentSelection == remapdata.ParentSelectionTypeRoundRobin {
+			rule.RoundRobinCount = new(uint64)
 		}
 		rules[i] = rule
 	}
@@ -533,11 +688,55 @@ func makeTo(tosJSON []RemapRuleToJSON, rule remapdata.RemapRule, baseTransport *
 		} else if to.RetryCodes == nil {
 			return nil, fmt.Errorf("error parsing to %v - no retry_codes - must be set at rules, rule, or to level", to.URL)
 		}
+		to.Health = remapdata.NewParentHealth(rule.Name+" "+to.URL, rule.ParentMaxFailures, rule.ParentCooldown)
+
+		to.Streams = thread.NewNoThrottler()
+		if rule.ParentHTTP2 && to.ProxyURL != nil {
+			log.Warnf("rule %v to %v has a proxy_url, not requesting it over HTTP/2\n", rule.Name, to.URL)
+		} else if rule.ParentHTTP2 {
+			h2Transport, err := makeHTTP2Transport(to.URL, to.Transport, rule.ParentHTTP2MaxConcurrentStreams)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing to %v: %v", to.URL, err)
+			}
+			to.Transport = h2Transport
+			to.Streams = thread.NewThrottler(uint64(rule.ParentHTTP2MaxConcurrentStreams))
+		}
 		tos[i] = to
 	}
 	return tos, nil
 }
 
+// makeHTTP2Transport returns a copy of transport which requests the given parent URL over HTTP/2. Parents with the https scheme negotiate HTTP/2 with ALPN, falling back to HTTP/1.1, and parents with the http scheme are requested over unencrypted HTTP/2 (h2c) with prior knowledge, so they must support it. For h2c, if maxStreams is not 0, requests wait for a free stream on an open connection, rather than opening another connection when the parent's limit is reached.
+func makeHTTP2Transport(parentURL string, transport *http.Transport, maxStreams int) (*http.Transport, error) {
+	u, err := url.Parse(parentURL)
+	if err != nil {
+		return nil, errors.New("parsing url: " + err.Error())
+	}
+	h2Transport := transport.Clone()
+	switch u.Scheme {
+	case "https":
+		if err := http2.ConfigureTransport(h2Transport); err != nil {
+			return nil, errors.New("configuring HTTP/2: " + err.Error())
+		}
+	case "http":
+		dial := h2Transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		h2Transport.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP: true,
+			// DialTLS dials without TLS, for h2c
+			DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+			StrictMaxConcurrentStreams: maxStreams > 0,
+		})
+	default:
+		return nil, errors.New("parent_http2 requires an http or https url, not '" + u.Scheme + "'")
+	}
+	return h2Transport, nil
+}
+
 func makeIPNets(netStrs []string) ([]*net.IPNet, error) {
 	nets := make([]*net.IPNet, 0, len(netStrs))
 	for _, netStr := range netStrs {
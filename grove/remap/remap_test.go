@@ -0,0 +1,65 @@
+package remap
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestMakeHTTP2Transport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	h2cSrv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cSrv.Close()
+
+	for _, srv := range []*httptest.Server{tlsSrv, h2cSrv} {
+		base := NewRemappingTransport(5*time.Second, 5*time.Second, 10, 5*time.Second)
+		base.TLSClientConfig = tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig
+		transport, err := makeHTTP2Transport(srv.URL, base, 1)
+		if err != nil {
+			t.Fatalf("making transport for %v: %v", srv.URL, err)
+		}
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("requesting %v: %v", srv.URL, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "HTTP/2.0" {
+			t.Errorf("requesting %v expected HTTP/2.0, actual %v", srv.URL, string(body))
+		}
+	}
+
+	if _, err := makeHTTP2Transport("ftp://parent.test", NewRemappingTransport(time.Second, time.Second, 1, time.Second), 0); err == nil {
+		t.Errorf("making transport for an ftp url expected error, actual nil")
+	}
+}
@@ -0,0 +1,128 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strings"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// CacheKeyRule is the policy of which parts of a request make up its cache key.
+type CacheKeyRule struct {
+	// QueryInclude is the query parameters to include in the key. If set, all other parameters are ignored.
+	QueryInclude []string `json:"query_include"`
+	// QueryExclude is the query parameters to exclude from the key. If set, all other parameters are included.
+	QueryExclude []string `json:"query_exclude"`
+	// Headers is the request headers whose values are included in the key.
+	Headers []string `json:"headers"`
+	// Cookies is the request cookies whose values are included in the key.
+	Cookies []string `json:"cookies"`
+	// LowercasePath is whether to lowercase the path, for origins with case-insensitive paths.
+	LowercasePath bool `json:"lowercase_path"`
+	// NormalizePath is whether to remove `.` and `..` segments and duplicate slashes from the path.
+	NormalizePath bool `json:"normalize_path"`
+}
+
+// CacheKeySeparator separates the URI of a cache key from the header and cookie components appended by the CacheKeyRule. It can't occur in a request URI, because fragments aren't sent in requests.
+const CacheKeySeparator = "#"
+
+// componentEscaper escapes the characters of header and cookie values which delimit key components and multiple header values, so distinct values can't make the same key.
+var componentEscaper = strings.NewReplacer("%", "%25", CacheKeySeparator, "%23", ",", "%2C")
+
+// Validate returns an error if the policy is invalid.
+func (k CacheKeyRule) Validate() error {
+	if len(k.QueryInclude) > 0 && len(k.QueryExclude) > 0 {
+		return errors.New("query_include and query_exclude may not both be set")
+	}
+	return nil
+}
+
+// path returns the given request path, lowercased and normalized if the policy says to.
+func (k CacheKeyRule) path(path string) string {
+	if k.NormalizePath && path != "" {
+		hasLeadingSlash := strings.HasPrefix(path, "/")
+		hasTrailingSlash := strings.HasSuffix(path, "/")
+		path = pathpkg.Clean("/" + path)
+		if !hasLeadingSlash {
+			path = path[1:]
+		}
+		if hasTrailingSlash && !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+	}
+	if k.LowercasePath {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// query returns the given raw query string, filtered by the policy's included or excluded parameters, with parameters sorted so their order doesn't matter. If the policy includes and excludes nothing, the entire query is returned if includeAll is true, and none if it's false.
+func (k CacheKeyRule) query(query string, includeAll bool) string {
+	if query == "" {
+		return ""
+	}
+	if len(k.QueryInclude) == 0 && len(k.QueryExclude) == 0 {
+		if !includeAll {
+			return ""
+		}
+		return query
+	}
+	vals, err := url.ParseQuery(query)
+	if err != nil {
+		log.Debugf("cache key parsing query '%v', using the valid parameters: %v\n", query, err)
+	}
+	if len(k.QueryInclude) > 0 {
+		included := url.Values{}
+		for _, name := range k.QueryInclude {
+			if v, ok := vals[name]; ok {
+				included[name] = v
+			}
+		}
+		vals = included
+	}
+	for _, name := range k.QueryExclude {
+		delete(vals, name)
+	}
+	return vals.Encode()
+}
+
+// components returns the header and cookie components of the key, for the given request headers. Values are escaped, so they can't contain the CacheKeySeparator.
+func (k CacheKeyRule) components(reqHdr http.Header) string {
+	if len(k.Headers) == 0 && len(k.Cookies) == 0 {
+		return ""
+	}
+	key := ""
+	for _, name := range k.Headers {
+		vals := []string{}
+		for _, val := range reqHdr[http.CanonicalHeaderKey(name)] {
+			vals = append(vals, componentEscaper.Replace(val))
+		}
+		key += CacheKeySeparator + "header:" + name + "=" + strings.Join(vals, ",")
+	}
+	req := http.Request{Header: reqHdr}
+	for _, name := range k.Cookies {
+		val := ""
+		if cookie, err := req.Cookie(name); err == nil {
+			val = cookie.Value
+		}
+		key += CacheKeySeparator + "cookie:" + name + "=" + componentEscaper.Replace(val)
+	}
+	return key
+}
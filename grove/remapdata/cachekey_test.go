@@ -0,0 +1,68 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	rule := RemapRule{RemapRuleBase: RemapRuleBase{From: "http://foo.example"}}
+	rule.To = []RemapRuleTo{{RemapRuleToBase: RemapRuleToBase{URL: "http://parent0.example"}}}
+	hdr := http.Header{}
+
+	// test the key is independent of parents
+	key := rule.CacheKey(http.MethodGet, "http://foo.example/a/b?c=d", hdr)
+	rule.To = []RemapRuleTo{{RemapRuleToBase: RemapRuleToBase{URL: "http://parent1.example"}}}
+	if newKey := rule.CacheKey(http.MethodGet, "http://foo.example/a/b?c=d", hdr); key != newKey {
+		t.Errorf("CacheKey after changing parents expected '%v', actual '%v'", key, newKey)
+	}
+	if expected := "GET:http://foo.example/a/b"; key != expected {
+		t.Errorf("CacheKey without query-string cache expected '%v', actual '%v'", expected, key)
+	}
+
+	// test HEAD uses the GET key
+	if headKey := rule.CacheKey(http.MethodHead, "http://foo.example/a/b", hdr); headKey != key {
+		t.Errorf("CacheKey HEAD expected '%v', actual '%v'", key, headKey)
+	}
+
+	tests := []struct {
+		policy   CacheKeyRule
+		qstring  bool
+		uri      string
+		hdr      http.Header
+		expected string
+	}{
+		{CacheKeyRule{}, true, "http://foo.example/a?z=1&y=2", hdr, "GET:http://foo.example/a?z=1&y=2"},
+		{CacheKeyRule{QueryInclude: []string{"z", "x"}}, false, "http://foo.example/a?z=1&y=2&x=3", hdr, "GET:http://foo.example/a?x=3&z=1"},
+		{CacheKeyRule{QueryExclude: []string{"utm_source"}}, false, "http://foo.example/a?z=1&utm_source=b", hdr, "GET:http://foo.example/a?z=1"},
+		{CacheKeyRule{LowercasePath: true}, false, "http://foo.example/A/B", hdr, "GET:http://foo.example/a/b"},
+		{CacheKeyRule{NormalizePath: true}, false, "http://foo.example//a/./c/../b/", hdr, "GET:http://foo.example/a/b/"},
+		{CacheKeyRule{Headers: []string{"accept-language"}}, false, "http://foo.example/a", http.Header{"Accept-Language": {"en"}}, "GET:http://foo.example/a#header:accept-language=en"},
+		{CacheKeyRule{Cookies: []string{"tier"}}, false, "http://foo.example/a", http.Header{"Cookie": {"session=1; tier=gold"}}, "GET:http://foo.example/a#cookie:tier=gold"},
+		// values containing the separator or commas are escaped, so they can't make the same key as other components or values
+		{CacheKeyRule{Headers: []string{"x-a", "x-b"}}, false, "http://foo.example/a", http.Header{"X-A": {"1#header:x-b=2"}}, "GET:http://foo.example/a#header:x-a=1%23header:x-b=2#header:x-b="},
+		{CacheKeyRule{Headers: []string{"x-a"}}, false, "http://foo.example/a", http.Header{"X-A": {"1,2", "3%2C"}}, "GET:http://foo.example/a#header:x-a=1%2C2,3%252C"},
+		{CacheKeyRule{Cookies: []string{"tier"}}, false, "http://foo.example/a", http.Header{"Cookie": {"tier=gold#x"}}, "GET:http://foo.example/a#cookie:tier=gold%23x"},
+	}
+	for _, test := range tests {
+		rule.CacheKeyPolicy = test.policy
+		rule.QueryString.Cache = test.qstring
+		if key := rule.CacheKey(http.MethodGet, test.uri, test.hdr); key != test.expected {
+			t.Errorf("CacheKey policy %+v uri '%v' expected '%v', actual '%v'", test.policy, test.uri, test.expected, key)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/thread"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// ParentHealth is the passive health of a parent, determined from the results of requests made to it. A parent is marked down after MaxFailures consecutive failed requests, and skipped by parent selection until Cooldown has passed, after which it may be tried again. It also tracks the parent's response latency, for latency-aware parent selection. It is safe for concurrent use.
+type ParentHealth struct {
+	name        string
+	maxFailures int
+	cooldown    time.Duration
+	m           sync.Mutex
+	failures    int
+	downUntil   time.Time
+	latency     time.Duration
+}
+
+// LatencyEWMAWeight is the weight given to each new latency sample, in the exponentially weighted moving average of parent latencies.
+const LatencyEWMAWeight = 0.2
+
+// NewParentHealth creates a new ParentHealth for the given parent name. If cooldown is not positive, the parent is never marked down, but latency is still tracked.
+func NewParentHealth(name string, maxFailures int, cooldown time.Duration) *ParentHealth {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &ParentHealth{name: name, maxFailures: maxFailures, cooldown: cooldown}
+}
+
+// Report records the result of a request to the parent. The latency is only used for successful requests, because failures are frequently faster than real responses.
+func (h *ParentHealth) Report(success bool, latency time.Duration) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if success {
+		if h.failures >= h.maxFailures {
+			log.Infof("parent %v marked up\n", h.name)
+		}
+		h.failures = 0
+		h.downUntil = time.Time{}
+		if h.latency == 0 {
+			h.latency = latency
+		} else {
+			h.latency = time.Duration(float64(h.latency)*(1-LatencyEWMAWeight) + float64(latency)*LatencyEWMAWeight)
+		}
+		return
+	}
+	h.failures++
+	if h.cooldown > 0 && h.failures >= h.maxFailures {
+		h.downUntil = time.Now().Add(h.cooldown)
+		log.Warnf("parent %v marked down for %v after %v consecutive failures\n", h.name, h.cooldown, h.failures)
+	}
+}
+
+// Down returns whether the parent is marked down, and should be skipped by parent selection.
+func (h *ParentHealth) Down() bool {
+	if h == nil {
+		return false
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	return time.Now().Before(h.downUntil)
+}
+
+// Latency returns the moving average latency of successful requests to the parent, or 0 if there have been none.
+func (h *ParentHealth) Latency() time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.latency
+}
+
+// ParentOrder is the order in which a single request tries the parents of a rule with an ordered parent selection type, and the position of the next parent to try. It's created once per request, so retries step through the same order, rather than selecting again. It is not safe for concurrent use.
+type ParentOrder struct {
+	order []int // indices into the rule's To
+	next  int
+}
+
+// NewParentOrder returns the order for a new request to the rule's parents. For consistent hash, which selects from the hash ring instead, the order is empty.
+func (r RemapRule) NewParentOrder() *ParentOrder {
+	switch *r.ParentSelection {
+	case ParentSelectionTypeRoundRobin:
+		return &ParentOrder{order: r.orderRoundRobin()}
+	case ParentSelectionTypeWeightedRandom:
+		return &ParentOrder{order: r.orderWeightedRandom()}
+	case ParentSelectionTypeFirstHealthy:
+		return &ParentOrder{order: r.orderFirstHealthy()}
+	case ParentSelectionTypeLatencyAware:
+		return &ParentOrder{order: r.orderLatency()}
+	default:
+		return &ParentOrder{}
+	}
+}
+
+// uriGetToOrdered is a helper func for uriGetTo. It returns the next parent in the given order, skipping parents which are marked down, and advances the order past it. Once every parent has been tried, the order starts over. If all parents are down, they're tried anyway, in order.
+func (r RemapRule) uriGetToOrdered(o *ParentOrder) (string, *url.URL, *http.Transport, *ParentHealth, thread.Throttler) {
+	chosen := -1
+	for i := 0; i < len(o.order); i++ {
+		pos := (o.next + i) % len(o.order)
+		if !r.To[o.order[pos]].Health.Down() {
+			chosen = pos
+			break
+		}
+	}
+	if chosen == -1 {
+		log.Warnf("RemapRule.URI: Rule '%v': all parents are down, trying them anyway\n", r.Name)
+		chosen = o.next % len(o.order)
+	}
+	o.next = chosen + 1
+	to := r.To[o.order[chosen]]
+	return to.URL, to.ProxyURL, to.Transport, to.Health, to.Streams
+}
+
+// orderRoundRobin returns the indices of To, starting with the next parent in the rule's round robin, and advances the round robin.
+func (r RemapRule) orderRoundRobin() []int {
+	start := 0
+	if r.RoundRobinCount != nil {
+		count := atomic.AddUint64(r.RoundRobinCount, 1)
+		start = int((count - 1) % uint64(len(r.To)))
+	}
+	order := make([]int, len(r.To))
+	for i := range order {
+		order[i] = (start + i) % len(r.To)
+	}
+	return order
+}
+
+// orderFirstHealthy returns the indices of To, in the order they're configured.
+func (r RemapRule) orderFirstHealthy() []int {
+	order := make([]int, len(r.To))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+// orderWeightedRandom returns the indices of To in a random order, where each parent's chance of coming before the others is proportional to its weight.
+func (r RemapRule) orderWeightedRandom() []int {
+	remaining := r.orderFirstHealthy()
+	order := make([]int, 0, len(r.To))
+	for len(remaining) > 0 {
+		total := 0.0
+		for _, i := range remaining {
+			total += *r.To[i].Weight
+		}
+		pick := rand.Float64() * total
+		chosen := len(remaining) - 1
+		for j, i := range remaining {
+			if pick -= *r.To[i].Weight; pick < 0 {
+				chosen = j
+				break
+			}
+		}
+		order = append(order, remaining[chosen])
+		remaining = append(remaining[:chosen], remaining[chosen+1:]...)
+	}
+	return order
+}
+
+// orderLatency returns the indices of To, ordered by the average latency of successful requests. Parents with no successful requests yet are first, so they're measured.
+func (r RemapRule) orderLatency() []int {
+	order := r.orderFirstHealthy()
+	latencies := make([]time.Duration, len(r.To))
+	for i, to := range r.To {
+		latencies[i] = to.Health.Latency()
+	}
+	sort.SliceStable(order, func(a, b int) bool { return latencies[order[a]] < latencies[order[b]] })
+	return order
+}
+
+// healthByURL returns the health of the parent with the given URL, or nil if no such parent exists.
+func (r RemapRule) healthByURL(u string) *ParentHealth {
+	for _, to := range r.To {
+		if to.URL == u {
+			return to.Health
+		}
+	}
+	return nil
+}
+
+// streamsByURL returns the stream limit of the parent with the given URL, or nil if no such parent exists.
+func (r RemapRule) streamsByURL(u string) thread.Throttler {
+	for _, to := range r.To {
+		if to.URL == u {
+			return to.Streams
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"testing"
+	"time"
+)
+
+// newParentTestRule returns a rule with the given parent selection type, and parents named a, b, c, ..., each with weight 1, which are marked down after a single failure.
+func newParentTestRule(selection ParentSelectionType, parents int) RemapRule {
+	rule := RemapRule{RemapRuleBase: RemapRuleBase{Name: "test", From: "http://foo.example"}}
+	rule.ParentSelection = &selection
+	rule.RoundRobinCount = new(uint64)
+	for i := 0; i < parents; i++ {
+		weight := 1.0
+		url := "http://" + string(rune('a'+i)) + ".example"
+		rule.To = append(rule.To, RemapRuleTo{RemapRuleToBase: RemapRuleToBase{URL: url, Weight: &weight}, Health: NewParentHealth(url, 1, time.Minute)})
+	}
+	return rule
+}
+
+// parentURIs returns the parents selected for a request's first n attempts.
+func parentURIs(rule RemapRule, n int) []string {
+	order := rule.NewParentOrder()
+	uris := []string{}
+	for failures := 0; failures < n; failures++ {
+		uri, _, _, _, _ := rule.URI("http://foo.example/path", "/path", "", failures, order)
+		uris = append(uris, uri)
+	}
+	return uris
+}
+
+func TestParentOrderWeightedRandom(t *testing.T) {
+	rule := newParentTestRule(ParentSelectionTypeWeightedRandom, 3)
+	for i := 0; i < 100; i++ {
+		uris := parentURIs(rule, 3)
+		seen := map[string]struct{}{}
+		for _, uri := range uris {
+			seen[uri] = struct{}{}
+		}
+		if len(seen) != 3 {
+			t.Fatalf("weighted random retries expected to try 3 different parents, actual %v", uris)
+		}
+	}
+}
+
+func TestParentOrderMarkedDown(t *testing.T) {
+	rule := newParentTestRule(ParentSelectionTypeFirstHealthy, 3)
+	order := rule.NewParentOrder()
+	expected := []string{"http://a.example/path", "http://b.example/path", "http://c.example/path"}
+	for failures, expectedURI := range expected {
+		uri, _, _, health, _ := rule.URI("http://foo.example/path", "/path", "", failures, order)
+		if uri != expectedURI {
+			t.Errorf("attempt %v expected '%v', actual '%v'", failures, expectedURI, uri)
+		}
+		health.Report(false, 0) // marks the parent down, shrinking the healthy parents during the request
+	}
+
+	// all parents are down, so they're all tried anyway, in order
+	if uris := parentURIs(rule, 2); uris[0] != expected[0] || uris[1] != expected[1] {
+		t.Errorf("all parents down expected %v, actual %v", expected[:2], uris)
+	}
+}
+
+func TestParentOrderRoundRobin(t *testing.T) {
+	rule := newParentTestRule(ParentSelectionTypeRoundRobin, 3)
+	first := parentURIs(rule, 3)
+	second := parentURIs(rule, 3)
+	if first[0] == second[0] {
+		t.Errorf("round robin expected consecutive requests to start at different parents, actual both '%v'", first[0])
+	}
+	if first[1] != second[0] {
+		t.Errorf("round robin expected the second request to start at the first request's retry '%v', actual '%v'", first[1], second[0])
+	}
+}
@@ -0,0 +1,223 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/thread"
+)
+
+// RateLimitType is the limit which caused a request to be rejected.
+type RateLimitType int
+
+const (
+	RateLimitNone RateLimitType = iota
+	RateLimitClient
+	RateLimitRule
+	RateLimitGlobal
+	RateLimitConnections
+)
+
+// RateLimitTypes are the limits which may reject a request, for iterating over their stats.
+var RateLimitTypes = []RateLimitType{RateLimitClient, RateLimitRule, RateLimitGlobal, RateLimitConnections}
+
+func (t RateLimitType) String() string {
+	switch t {
+	case RateLimitNone:
+		return "none"
+	case RateLimitClient:
+		return "client"
+	case RateLimitRule:
+		return "rule"
+	case RateLimitGlobal:
+		return "global"
+	case RateLimitConnections:
+		return "connections"
+	default:
+		return "invalid"
+	}
+}
+
+// RateLimitConfig is the rate limit configuration of a remap rule. Rates are in requests per second, and a rate of 0 is unlimited. Bursts are the number of requests which may be made at once, above the rate, and default to one second of requests.
+type RateLimitConfig struct {
+	// ClientRequestsPerSecond limits the requests of each client. Clients are identified by their IP, masked to ClientIPv4Prefix or ClientIPv6Prefix bits.
+	ClientRequestsPerSecond float64 `json:"client_requests_per_second"`
+	ClientBurst             int     `json:"client_burst"`
+	// ClientIPv4Prefix is the prefix length of IPv4 clients. Clients in the same prefix share a limit. The default of 0 is 32, limiting each IP.
+	ClientIPv4Prefix int `json:"client_ipv4_prefix"`
+	// ClientIPv6Prefix is the prefix length of IPv6 clients. The default of 0 is 128, limiting each IP.
+	ClientIPv6Prefix int `json:"client_ipv6_prefix"`
+	// MaxClientConnections is the maximum number of connections each client IP may have open, when making a request to the rule. If 0, connections are unlimited.
+	MaxClientConnections int `json:"max_client_connections"`
+	// Clients override the client limits for clients in their CIDR. The first matching CIDR is used.
+	Clients []ClientRateLimitConfig `json:"clients"`
+	// RuleRequestsPerSecond limits the requests to the rule, from all clients.
+	RuleRequestsPerSecond float64 `json:"rule_requests_per_second"`
+	RuleBurst             int     `json:"rule_burst"`
+}
+
+// ClientRateLimitConfig is the rate limit of clients in a CIDR.
+type ClientRateLimitConfig struct {
+	CIDR              string  `json:"cidr"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	MaxConnections    int     `json:"max_connections"`
+}
+
+// GlobalRateLimitConfig is the rate limit of requests to all remap rules.
+type GlobalRateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// RateLimiter limits the requests to a remap rule. It is safe for concurrent use.
+type RateLimiter struct {
+	client   clientRateLimiter
+	clients  []clientRateLimiter
+	rule     *thread.TokenBucket // nil if unlimited
+	global   *thread.TokenBucket // nil if unlimited
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+}
+
+// clientRateLimiter is the limit of each client, optionally for clients in a network.
+type clientRateLimiter struct {
+	network  *net.IPNet
+	buckets  *thread.TokenBuckets // nil if unlimited
+	maxConns int
+}
+
+// NewGlobalRateLimit returns the token bucket of the given global limit, which is shared by the RateLimiters of all rules, or nil if it's unlimited.
+func NewGlobalRateLimit(cfg GlobalRateLimitConfig) (*thread.TokenBucket, error) {
+	if cfg.RequestsPerSecond < 0 || cfg.Burst < 0 {
+		return nil, errors.New("requests_per_second and burst must be positive")
+	}
+	if cfg.RequestsPerSecond == 0 {
+		return nil, nil
+	}
+	return thread.NewTokenBucket(cfg.RequestsPerSecond, cfg.Burst), nil
+}
+
+// NewRateLimiter returns the RateLimiter of the given config, which also takes from the global bucket, if it isn't nil. Returns nil if nothing is limited.
+func NewRateLimiter(cfg *RateLimitConfig, global *thread.TokenBucket) (*RateLimiter, error) {
+	if cfg == nil {
+		cfg = &RateLimitConfig{}
+	}
+	if cfg.ClientRequestsPerSecond < 0 || cfg.ClientBurst < 0 || cfg.RuleRequestsPerSecond < 0 || cfg.RuleBurst < 0 || cfg.MaxClientConnections < 0 {
+		return nil, errors.New("rates, bursts, and connections must be positive")
+	}
+	ipv4Prefix, ipv6Prefix := cfg.ClientIPv4Prefix, cfg.ClientIPv6Prefix
+	if ipv4Prefix == 0 {
+		ipv4Prefix = 32
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = 128
+	}
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, errors.New("client_ipv4_prefix must be between 1 and 32, and client_ipv6_prefix between 1 and 128")
+	}
+
+	limiter := &RateLimiter{
+		client:   clientRateLimiter{buckets: newClientBuckets(cfg.ClientRequestsPerSecond, cfg.ClientBurst), maxConns: cfg.MaxClientConnections},
+		global:   global,
+		ipv4Mask: net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask: net.CIDRMask(ipv6Prefix, 128),
+	}
+	for _, client := range cfg.Clients {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(client.CIDR))
+		if err != nil {
+			return nil, errors.New("parsing clients cidr '" + client.CIDR + "': " + err.Error())
+		}
+		if client.RequestsPerSecond < 0 || client.Burst < 0 || client.MaxConnections < 0 {
+			return nil, errors.New("clients cidr '" + client.CIDR + "' rate, burst, and connections must be positive")
+		}
+		limiter.clients = append(limiter.clients, clientRateLimiter{network: network, buckets: newClientBuckets(client.RequestsPerSecond, client.Burst), maxConns: client.MaxConnections})
+	}
+	if cfg.RuleRequestsPerSecond > 0 {
+		limiter.rule = thread.NewTokenBucket(cfg.RuleRequestsPerSecond, cfg.RuleBurst)
+	}
+
+	if limiter.rule == nil && limiter.global == nil && !limiter.client.limited() && len(limiter.clients) == 0 {
+		return nil, nil
+	}
+	return limiter, nil
+}
+
+func newClientBuckets(rate float64, burst int) *thread.TokenBuckets {
+	if rate == 0 {
+		return nil
+	}
+	return thread.NewTokenBuckets(rate, burst)
+}
+
+func (c clientRateLimiter) limited() bool { return c.buckets != nil || c.maxConns > 0 }
+
+// Allow takes a request from the given client IP, which has the given number of connections open. If the request is over a limit, it returns the limit and how long until the client may retry, and RateLimitNone if it's allowed. Limits are checked in the order connections, client, rule, global, and a request rejected by any limit doesn't count against the others, so clients aren't limited by requests which weren't served.
+func (l *RateLimiter) Allow(ip net.IP, conns int, now time.Time) (RateLimitType, time.Duration) {
+	if l == nil {
+		return RateLimitNone, 0
+	}
+	client := l.client
+	for _, c := range l.clients {
+		if ip != nil && c.network.Contains(ip) {
+			client = c
+			break
+		}
+	}
+	if client.maxConns > 0 && conns > client.maxConns {
+		return RateLimitConnections, time.Second
+	}
+	// tokens taken are refunded if a later limit rejects the request
+	clientKey := ""
+	if client.buckets != nil && ip != nil {
+		clientKey = l.clientKey(ip)
+		if ok, wait := client.buckets.Take(clientKey, now); !ok {
+			return RateLimitClient, wait
+		}
+	}
+	refundClient := func() {
+		if clientKey != "" {
+			client.buckets.Refund(clientKey)
+		}
+	}
+	if l.rule != nil {
+		if ok, wait := l.rule.Take(now); !ok {
+			refundClient()
+			return RateLimitRule, wait
+		}
+	}
+	if l.global != nil {
+		if ok, wait := l.global.Take(now); !ok {
+			refundClient()
+			if l.rule != nil {
+				l.rule.Refund()
+			}
+			return RateLimitGlobal, wait
+		}
+	}
+	return RateLimitNone, 0
+}
+
+// clientKey returns the key of the given client IP, masked to the client prefix.
+func (l *RateLimiter) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(l.ipv4Mask).String()
+	}
+	return ip.Mask(l.ipv6Mask).String()
+}
@@ -0,0 +1,115 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	global, err := NewGlobalRateLimit(GlobalRateLimitConfig{RequestsPerSecond: 100, Burst: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := NewRateLimiter(&RateLimitConfig{
+		ClientRequestsPerSecond: 1,
+		ClientBurst:             2,
+		ClientIPv6Prefix:        64,
+		MaxClientConnections:    2,
+		Clients:                 []ClientRateLimitConfig{{CIDR: "192.0.2.0/24", RequestsPerSecond: 0, MaxConnections: 10}},
+		RuleRequestsPerSecond:   2,
+		RuleBurst:               4,
+	}, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1000, 0)
+	a, b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	allow := func(ip net.IP, conns int, expected RateLimitType) time.Duration {
+		t.Helper()
+		limit, wait := limiter.Allow(ip, conns, now)
+		if limit != expected {
+			t.Errorf("Allow(%v, %v) at %v expected %v, actual %v", ip, conns, now.Unix(), expected, limit)
+		}
+		return wait
+	}
+
+	allow(a, 1, RateLimitNone)
+	allow(b, 1, RateLimitNone) // same /64 as a
+	if wait := allow(a, 1, RateLimitClient); wait != time.Second {
+		t.Errorf("client limit wait expected 1s, actual %v", wait)
+	}
+	allow(a, 3, RateLimitConnections)
+
+	// the override has no rate limit, and a higher connection limit, but still counts against the rule
+	override := net.ParseIP("192.0.2.7")
+	allow(override, 5, RateLimitNone)
+	allow(override, 5, RateLimitNone)
+	if wait := allow(override, 5, RateLimitRule); wait != 500*time.Millisecond {
+		t.Errorf("rule limit wait expected 500ms, actual %v", wait)
+	}
+
+	now = now.Add(time.Second)
+	allow(net.ParseIP("198.51.100.1"), 1, RateLimitNone)
+	allow(net.ParseIP("198.51.100.2"), 1, RateLimitNone)
+	allow(net.ParseIP("198.51.100.3"), 1, RateLimitRule)
+
+	if _, err := NewRateLimiter(&RateLimitConfig{Clients: []ClientRateLimitConfig{{CIDR: "nope"}}}, nil); err == nil {
+		t.Error("NewRateLimiter with an invalid CIDR expected error, actual nil")
+	}
+	if l, err := NewRateLimiter(nil, nil); l != nil || err != nil {
+		t.Errorf("NewRateLimiter with no limits expected nil, actual %v %v", l, err)
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	global, err := NewGlobalRateLimit(GlobalRateLimitConfig{RequestsPerSecond: 1, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLimiter := func(ruleRate float64) *RateLimiter {
+		t.Helper()
+		limiter, err := NewRateLimiter(&RateLimitConfig{ClientRequestsPerSecond: 0.001, ClientBurst: 1, RuleRequestsPerSecond: ruleRate, RuleBurst: 1}, global)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return limiter
+	}
+	// the client limits and b's rule barely refill, so later requests are only allowed if the rejected requests were refunded
+	limiterA, limiterB := newLimiter(1), newLimiter(0.001)
+
+	now := time.Unix(1000, 0)
+	x, y := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	allow := func(name string, limiter *RateLimiter, ip net.IP, expected RateLimitType) {
+		t.Helper()
+		if limit, _ := limiter.Allow(ip, 1, now); limit != expected {
+			t.Errorf("Allow(%v) on %v at %v expected %v, actual %v", ip, name, now.Unix(), expected, limit)
+		}
+	}
+
+	allow("a", limiterA, x, RateLimitNone)
+	allow("a", limiterA, y, RateLimitRule)   // refunds y's client
+	allow("b", limiterB, x, RateLimitGlobal) // refunds x's client and b's rule
+
+	now = now.Add(time.Second)
+	allow("b", limiterB, x, RateLimitNone)
+	allow("b", limiterB, x, RateLimitClient)
+
+	now = now.Add(time.Second)
+	allow("a", limiterA, y, RateLimitNone)
+}
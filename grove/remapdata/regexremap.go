@@ -0,0 +1,94 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// RegexRemapRule rewrites the path and query of parent requests, like a line of the Apache Traffic Server regex_remap plugin config. The Regex is matched against the request path, followed by "?" and the query if there is one. The Replacement is expanded with $0 as the matched text and $1 through $9 as the Regex's groups.
+type RegexRemapRule struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+	re          *regexp.Regexp
+	replacement string
+}
+
+// RegexRemapRules are the regex remaps of a rule. The first rule whose Regex matches is used.
+type RegexRemapRules []RegexRemapRule
+
+// regexRemapGroupRe matches the numbered group references of a replacement, which are braced so e.g. "$1abc" isn't taken to be the group named "1abc".
+var regexRemapGroupRe = regexp.MustCompile(`\$([0-9])`)
+
+// Compile compiles the rules' regexes, and returns an error if any is invalid. It must be called before Remap.
+func (rs RegexRemapRules) Compile() error {
+	for i, r := range rs {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return errors.New("compiling regex '" + r.Regex + "': " + err.Error())
+		}
+		rs[i].re = re
+		rs[i].replacement = regexRemapGroupRe.ReplaceAllString(r.Replacement, `$${$1}`)
+	}
+	return nil
+}
+
+// Remap returns the rewritten path and query of the first rule matching the given path and query, and whether any rule matched. If the replacement is a full URL, only its path and query are used, because the parent is chosen by the remap rule.
+func (rs RegexRemapRules) Remap(path string, query string) (string, bool) {
+	if len(rs) == 0 {
+		return "", false
+	}
+	subject := path
+	if query != "" {
+		subject += "?" + query
+	}
+	for _, r := range rs {
+		if r.re == nil {
+			continue // not compiled
+		}
+		match := r.re.FindStringSubmatchIndex(subject)
+		if match == nil {
+			continue
+		}
+		result := string(r.re.ExpandString(nil, r.replacement, subject, match))
+		if i := strings.Index(result, "://"); i != -1 {
+			result = result[i+len("://"):]
+			if i := strings.IndexAny(result, "/?"); i != -1 {
+				result = result[i:]
+			} else {
+				result = ""
+			}
+		}
+		if !strings.HasPrefix(result, "/") {
+			result = "/" + result
+		}
+		return result, true
+	}
+	return "", false
+}
+
+// uriSchemeHost returns the scheme and host of the given URI, without any path or query.
+func uriSchemeHost(uri string) string {
+	i := strings.Index(uri, "://")
+	if i == -1 {
+		return uri
+	}
+	if j := strings.IndexAny(uri[i+len("://"):], "/?"); j != -1 {
+		return uri[:i+len("://")+j]
+	}
+	return uri
+}
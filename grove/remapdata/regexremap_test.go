@@ -0,0 +1,60 @@
+package remapdata
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"testing"
+)
+
+func TestRegexRemap(t *testing.T) {
+	rules := RegexRemapRules{
+		{Regex: `^/old/([^?]*)`, Replacement: `/new/$1abc`},
+		{Regex: `^/full/(.*)`, Replacement: `http://origin.example/other/$1`},
+		{Regex: `^/host$`, Replacement: `http://origin.example`},
+	}
+	if err := rules.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		query    string
+		expected string
+		ok       bool
+	}{
+		{"/old/a/b", "", "/new/a/babc", true},
+		{"/old/a", "x=y", "/new/aabc", true},
+		{"/full/a", "x=y", "/other/a?x=y", true},
+		{"/host", "", "/", true},
+		{"/other", "", "", false},
+	}
+	for _, test := range tests {
+		actual, ok := rules.Remap(test.path, test.query)
+		if actual != test.expected || ok != test.ok {
+			t.Errorf("remap '%v' '%v': expected '%v' %v actual '%v' %v", test.path, test.query, test.expected, test.ok, actual, ok)
+		}
+	}
+
+	if err := (RegexRemapRules{{Regex: `(`}}).Compile(); err == nil {
+		t.Errorf("compiling invalid regex: expected error, actual nil")
+	}
+
+	rule := RemapRule{RemapRuleBase: RemapRuleBase{From: "http://foo.example", RegexRemap: rules, QueryString: QueryStringRule{Remap: true}}}
+	rule.To = []RemapRuleTo{{RemapRuleToBase: RemapRuleToBase{URL: "http://parent.example:8080/base"}}}
+	rule.ParentSelection = new(ParentSelectionType)
+	*rule.ParentSelection = ParentSelectionTypeFirstHealthy
+	if uri, _, _, _, _ := rule.URI("http://foo.example/old/a?q=1", "/old/a", "q=1", 0, rule.NewParentOrder()); uri != "http://parent.example:8080/new/aabc" {
+		t.Errorf("rule URI: expected 'http://parent.example:8080/new/aabc' actual '%v'", uri)
+	}
+}
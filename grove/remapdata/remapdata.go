@@ -26,10 +26,14 @@ import (
 
 	"github.com/apache/trafficcontrol/grove/chash"
 	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/thread"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
 )
 
+// MethodPurge is the HTTP method used by clients to remove an object from the cache.
+const MethodPurge = "PURGE"
+
 type Reuse int
 
 const (
@@ -46,6 +50,9 @@ type ParentSelectionType string
 const (
 	ParentSelectionTypeConsistentHash = ParentSelectionType("consistent-hash")
 	ParentSelectionTypeRoundRobin     = ParentSelectionType("round-robin")
+	ParentSelectionTypeWeightedRandom = ParentSelectionType("weighted-random")
+	ParentSelectionTypeFirstHealthy   = ParentSelectionType("first-healthy")
+	ParentSelectionTypeLatencyAware   = ParentSelectionType("latency-aware")
 	ParentSelectionTypeInvalid        = ParentSelectionType("")
 )
 
@@ -55,6 +62,12 @@ func (t ParentSelectionType) String() string {
 		return "consistent-hash"
 	case ParentSelectionTypeRoundRobin:
 		return "round-robin"
+	case ParentSelectionTypeWeightedRandom:
+		return "weighted-random"
+	case ParentSelectionTypeFirstHealthy:
+		return "first-healthy"
+	case ParentSelectionTypeLatencyAware:
+		return "latency-aware"
 	default:
 		return "invalid"
 	}
@@ -68,6 +81,15 @@ func ParentSelectionTypeFromString(s string) ParentSelectionType {
 	if s == "round-robin" {
 		return ParentSelectionTypeRoundRobin
 	}
+	if s == "weighted-random" {
+		return ParentSelectionTypeWeightedRandom
+	}
+	if s == "first-healthy" {
+		return ParentSelectionTypeFirstHealthy
+	}
+	if s == "latency-aware" {
+		return ParentSelectionTypeLatencyAware
+	}
 	return ParentSelectionTypeInvalid
 }
 
@@ -103,17 +125,40 @@ type RemapRuleBase struct {
 	CertificateKeyFile string          `json:"certificate-key-file"`
 	ConnectionClose    bool            `json:"connection-close"`
 	QueryString        QueryStringRule `json:"query-string"`
+	CacheKeyPolicy     CacheKeyRule    `json:"cache_key"`
 	// ConcurrentRuleRequests is the number of concurrent requests permitted to a remap rule, that is, to an origin. If this is 0, the global config is used.
 	ConcurrentRuleRequests int                        `json:"concurrent_rule_requests"`
 	RetryNum               *int                       `json:"retry_num"`
 	DSCP                   int                        `json:"dscp"`
 	PluginsShared          map[string]json.RawMessage `json:"plugins_shared"`
+	// Stream is whether to stream parent responses to clients as they're received, rather than receiving the entire object before responding. Streamed objects are added to the cache once they're complete.
+	Stream bool `json:"stream"`
+	// RangeChunkBytes is the size of the chunks in which to cache objects requested with a Range header. If 0, ranges are not cached in chunks. See cache.ChunkKeySeparator.
+	RangeChunkBytes int64 `json:"range_chunk_bytes"`
+	// RegexRemap rewrites the path and query of parent requests. See RegexRemapRules.
+	RegexRemap RegexRemapRules `json:"regex_remap,omitempty"`
 }
 
 type RemapRule struct {
 	RemapRuleBase
 	Timeout         *time.Duration
 	ParentSelection *ParentSelectionType
+	// StaleWhileRevalidate is the maximum time a stale object may be served while it's revalidated in the background, per the response's RFC5861 stale-while-revalidate directive. If 0, the directive is ignored.
+	StaleWhileRevalidate time.Duration
+	// StaleIfError is the maximum time a stale object may be served when revalidating it fails, per the response's RFC5861 stale-if-error directive. If 0, the directive is ignored.
+	StaleIfError time.Duration
+	// ParentMaxFailures is the number of consecutive failures after which a parent is marked down.
+	ParentMaxFailures int
+	// ParentCooldown is how long a parent marked down is skipped by parent selection. If 0, parents are never marked down.
+	ParentCooldown time.Duration
+	// ParentHTTP2 is whether to request parents over HTTP/2: negotiated with ALPN for https parents, and with prior knowledge (h2c) for http parents.
+	ParentHTTP2 bool
+	// ParentHTTP2MaxConcurrentStreams is the maximum number of concurrent HTTP/2 requests to each parent, which are multiplexed onto a single connection as far as the parent allows. Further requests wait. If 0, requests are unlimited, and new connections are opened when the parent's limit is reached.
+	ParentHTTP2MaxConcurrentStreams int
+	// RateLimiter limits the requests to the rule. If nil, requests are unlimited.
+	RateLimiter *RateLimiter
+	// RoundRobinCount is the number of round-robin parent selections made. It must be accessed atomically, and is shared by all copies of the rule.
+	RoundRobinCount *uint64
 	To              []RemapRuleTo
 	Allow           []*net.IPNet
 	Deny            []*net.IPNet
@@ -143,41 +188,46 @@ func (r *RemapRule) Allowed(ip net.IP) bool {
 	return false
 }
 
-// URI takes a request URI and maps it to the real URI to proxy-and-cache. The `failures` parameter indicates how many parents have tried and failed, indicating to skip to the nth hashed parent. Returns the URI to request, and the proxy URL (if any)
-func (r RemapRule) URI(fromURI string, path string, query string, failures int) (string, *url.URL, *http.Transport) {
+// URI takes a request URI and maps it to the real URI to proxy-and-cache. The `failures` parameter indicates how many parents have tried and failed, indicating to skip to the nth parent on the consistent hash ring. For ordered parent selection types, the next parent is taken from order, which must be the request's NewParentOrder. Returns the URI to request, the proxy URL (if any), the transport, the health of the selected parent, and its stream limit.
+func (r RemapRule) URI(fromURI string, path string, query string, failures int, order *ParentOrder) (string, *url.URL, *http.Transport, *ParentHealth, thread.Throttler) {
 	fromHash := path
 	if r.QueryString.Remap && query != "" {
 		fromHash += "?" + query
 	}
 
 	// fmt.Println("RemapRule.URI fromURI " + fromHash)
-	to, proxyURI, transport := r.uriGetTo(fromHash, failures)
+	to, proxyURI, transport, health, streams := r.uriGetTo(fromHash, failures, order)
 	uri := to + fromURI[len(r.From):]
+	if pathQuery, ok := r.RegexRemap.Remap(path, query); ok {
+		uri = uriSchemeHost(to) + pathQuery
+	}
 	if !r.QueryString.Remap {
 		if i := strings.Index(uri, "?"); i != -1 {
 			uri = uri[:i]
 		}
 	}
-	return uri, proxyURI, transport
+	return uri, proxyURI, transport, health, streams
 }
 
 // uriGetTo is a helper func for URI. It returns the To URL, based on the Parent Selection type. In the event of failure, it logs the error and returns the first parent. Also returns the URL's Proxy URI (if any).
-func (r RemapRule) uriGetTo(fromURI string, failures int) (string, *url.URL, *http.Transport) {
+func (r RemapRule) uriGetTo(fromURI string, failures int, order *ParentOrder) (string, *url.URL, *http.Transport, *ParentHealth, thread.Throttler) {
 	switch *r.ParentSelection {
 	case ParentSelectionTypeConsistentHash:
 		return r.uriGetToConsistentHash(fromURI, failures)
+	case ParentSelectionTypeRoundRobin, ParentSelectionTypeWeightedRandom, ParentSelectionTypeFirstHealthy, ParentSelectionTypeLatencyAware:
+		return r.uriGetToOrdered(order)
 	default:
 		log.Errorf("RemapRule.URI: Rule '%v': Unknown Parent Selection type %v - using first URI in rule\n", r.Name, r.ParentSelection)
-		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport
+		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport, r.To[0].Health, r.To[0].Streams
 	}
 }
 
-// uriGetToConsistentHash is a helper func for URI, uriGetTo. It returns the To URL using Consistent Hashing. In the event of failure, it logs the error and returns the first parent. Also returns the Proxy URI (if any).
-func (r RemapRule) uriGetToConsistentHash(fromURI string, failures int) (string, *url.URL, *http.Transport) {
+// uriGetToConsistentHash is a helper func for URI, uriGetTo. It returns the To URL using Consistent Hashing. Parents which are marked down are skipped, continuing around the hash ring. In the event of failure, it logs the error and returns the first parent. Also returns the Proxy URI (if any).
+func (r RemapRule) uriGetToConsistentHash(fromURI string, failures int) (string, *url.URL, *http.Transport, *ParentHealth, thread.Throttler) {
 	// fmt.Printf("DEBUGL uriGetToConsistentHash RemapRule %+v\n", r)
 	if r.ConsistentHash == nil {
 		log.Errorf("RemapRule.URI: Rule '%v': Parent Selection Type ConsistentHash, but rule.ConsistentHash is nil! Using first parent\n", r.Name)
-		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport
+		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport, r.To[0].Health, r.To[0].Streams
 	}
 
 	// fmt.Printf("DEBUGL uriGetToConsistentHash\n")
@@ -188,31 +238,39 @@ func (r RemapRule) uriGetToConsistentHash(fromURI string, failures int) (string,
 		// }
 		// fmt.Printf("DEBUGL uriGetToConsistentHash fromURI '%v' err %v returning '%v'\n", fromURI, err, r.To[0].URL)
 		log.Errorf("RemapRule.URI: Rule '%v': Error looking up Consistent Hash! Using first parent\n", r.Name)
-		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport
+		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport, r.To[0].Health, r.To[0].Streams
 	}
 
 	for i := 0; i < failures; i++ {
 		iter = iter.NextWrap()
 	}
 
-	return iter.Val().Name, iter.Val().ProxyURL, iter.Val().Transport
-}
-
-func (r RemapRule) CacheKey(method string, fromURI string) string {
-	// TODO don't cache on `to`, since it's affected by Parent Selection
-	// TODO add parent selection
-	to := r.To[0].URL
-	uri := to + fromURI[len(r.From):]
-	if !r.QueryString.Cache {
-		if i := strings.Index(uri, "?"); i != -1 {
-			uri = uri[:i]
+	// skip parents marked down, until the ring wraps back around to the selected parent. If all are down, the selected parent is tried anyway.
+	selected := iter
+	for r.healthByURL(iter.Val().Name).Down() {
+		if iter = iter.NextWrap(); iter.Key() == selected.Key() {
+			log.Warnf("RemapRule.URI: Rule '%v': all parents are down, trying them anyway\n", r.Name)
+			break
 		}
 	}
-	if method == http.MethodHead { // HEAD uses the same key as GET
+
+	return iter.Val().Name, iter.Val().ProxyURL, iter.Val().Transport, r.healthByURL(iter.Val().Name), r.streamsByURL(iter.Val().Name)
+}
+
+// CacheKey returns the cache key for the given request method, URI, and headers, per the rule's CacheKeyPolicy. The key is made from the requested `from` URI, not the parent, so it's independent of parent selection.
+func (r RemapRule) CacheKey(method string, fromURI string, reqHdr http.Header) string {
+	if method == http.MethodHead || method == MethodPurge { // HEAD and PURGE use the same key as GET
 		method = http.MethodGet
 	}
-	key := method + ":" + uri
-	return key
+	path, query := fromURI[len(r.From):], ""
+	if i := strings.Index(path, "?"); i != -1 {
+		path, query = path[:i], path[i+1:]
+	}
+	key := method + ":" + r.From + r.CacheKeyPolicy.path(path)
+	if query = r.CacheKeyPolicy.query(query, r.QueryString.Cache); query != "" {
+		key += "?" + query
+	}
+	return key + r.CacheKeyPolicy.components(reqHdr)
 }
 
 type RemapRuleToBase struct {
@@ -227,6 +285,9 @@ type RemapRuleTo struct {
 	Timeout    *time.Duration
 	RetryCodes map[int]struct{}
 	Transport  *http.Transport
+	Health     *ParentHealth
+	// Streams limits the concurrent requests to the parent. See RemapRule.ParentHTTP2MaxConcurrentStreams.
+	Streams thread.Throttler
 }
 
 type QueryStringRule struct {
@@ -20,6 +20,7 @@ package rfc
 
 import (
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -134,7 +135,7 @@ func CanCache(reqMethod string, reqHeaders http.Header, respCode int, respHeader
 func CanReuseStored(reqHeaders http.Header, respHeaders http.Header, reqCacheControl web.CacheControl, respCacheControl web.CacheControl, respReqHeaders http.Header, respReqTime time.Time, respRespTime time.Time, strictRFC bool) remapdata.Reuse {
 	// TODO: remove allowed_stale, check in cache manager after revalidate fails? (since RFC7234§4.2.4 prohibits serving stale response unless disconnected).
 
-	if !selectedHeadersMatch(reqHeaders, respReqHeaders, strictRFC) {
+	if !selectedHeadersMatch(reqHeaders, respHeaders, respReqHeaders) {
 		log.Debugf("CanReuseStored false - selected headers don't match\n") // debug
 		return remapdata.ReuseCannot
 	}
@@ -340,31 +341,113 @@ func inMaxStale(respHeaders http.Header, respCacheControl web.CacheControl, resp
 	return inMaxStale
 }
 
-// SelectedHeadersMatch checks the constraints in RFC7234§4.1
-// TODO: change caching to key on URL+headers, so multiple requests for the same URL with different vary headers can be cached?
-func selectedHeadersMatch(reqHeaders http.Header, respReqHeaders http.Header, strictRFC bool) bool {
-	varyHeaders, ok := reqHeaders["vary"]
-	if !strictRFC && !ok {
-		return true
+// StaleWhileRevalidate returns whether the given stale response may be served while it's revalidated in the background, per the `stale-while-revalidate` response directive of RFC5861§3. The response's window is limited to maxWindow, which is typically configured per remap rule; if maxWindow is not positive, stale-while-revalidate is disabled.
+func StaleWhileRevalidate(respHeaders http.Header, respCacheControl web.CacheControl, respReqTime time.Time, respRespTime time.Time, maxWindow time.Duration) bool {
+	return inStaleWindow(respHeaders, respCacheControl, respReqTime, respRespTime, "stale-while-revalidate", maxWindow)
+}
+
+// StaleIfError returns whether the given stale response may be served when revalidating it fails, per the `stale-if-error` response directive of RFC5861§4. The response's window is limited to maxWindow, which is typically configured per remap rule; if maxWindow is not positive, stale-if-error is disabled.
+func StaleIfError(respHeaders http.Header, respCacheControl web.CacheControl, respReqTime time.Time, respRespTime time.Time, maxWindow time.Duration) bool {
+	return inStaleWindow(respHeaders, respCacheControl, respReqTime, respRespTime, "stale-if-error", maxWindow)
+}
+
+// inStaleWindow returns whether the given response is stale, and has been stale for less than the delta seconds of the given Cache-Control directive, limited to maxWindow. Responses with `must-revalidate`, `proxy-revalidate`, or `no-cache` are never in the window, per RFC7234§5.2.2.1, RFC7234§5.2.2.7, and RFC7234§5.2.2.2.
+func inStaleWindow(respHeaders http.Header, respCacheControl web.CacheControl, respReqTime time.Time, respRespTime time.Time, directive string, maxWindow time.Duration) bool {
+	if maxWindow <= 0 {
+		return false
 	}
-	if len(varyHeaders) == 0 {
-		return true
+	for _, prohibits := range []string{"must-revalidate", "proxy-revalidate", "no-cache"} {
+		if _, ok := respCacheControl[prohibits]; ok {
+			return false
+		}
+	}
+	window, ok := getHTTPDeltaSecondsCacheControl(respCacheControl, directive)
+	if !ok {
+		return false
 	}
-	varyHeader := varyHeaders[0]
+	if window > maxWindow {
+		window = maxWindow
+	}
+	staleness := getCurrentAge(respHeaders, respReqTime, respRespTime) - getFreshnessLifetime(respHeaders, respCacheControl)
+	log.Debugf("inStaleWindow %v window %v staleness %v\n", directive, window, staleness)
+	return staleness >= 0 && staleness < window
+}
 
-	if varyHeader == "*" {
+// SelectedHeadersMatch checks the constraints in RFC7234§4.1. The stored response's Vary header field names must have the same values in the presented request and the stored request. A Vary of `*` never matches.
+func selectedHeadersMatch(reqHeaders http.Header, respHeaders http.Header, respReqHeaders http.Header) bool {
+	if VaryAny(respHeaders) {
 		return false
 	}
-	varyHeader = strings.ToLower(varyHeader)
-	varyHeaderHeaders := strings.Split(varyHeader, ",")
-	for _, header := range varyHeaderHeaders {
-		if _, ok := respReqHeaders[header]; !ok {
+	for _, header := range VaryHeaders(respHeaders) {
+		if normalizeVaryValue(reqHeaders[header]) != normalizeVaryValue(respReqHeaders[header]) {
 			return false
 		}
 	}
 	return true
 }
 
+// VaryAny returns whether the given response headers contain `Vary: *`, which per RFC7234§4.1 always fails to match, and thus prohibits reusing the stored response without revalidation.
+func VaryAny(respHeaders http.Header) bool {
+	for _, varyHeader := range respHeaders["Vary"] {
+		for _, name := range strings.Split(varyHeader, ",") {
+			if strings.TrimSpace(name) == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VaryHeaders returns the canonical, sorted, deduplicated request header names in the given response's Vary header, per RFC7231§7.1.4. Returns an empty slice if there is no Vary header. Note a Vary of `*` is not included; check VaryAny.
+func VaryHeaders(respHeaders http.Header) []string {
+	names := []string{}
+	seen := map[string]struct{}{}
+	for _, varyHeader := range respHeaders["Vary"] {
+		for _, name := range strings.Split(varyHeader, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || name == "*" {
+				continue
+			}
+			name = http.CanonicalHeaderKey(name)
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VaryKey returns the secondary cache key for the given primary key, Vary header names, and request headers, per RFC7234§4.1. The varyHeaders must be as returned by VaryHeaders. Requests whose selected headers normalize to the same values get the same key.
+func VaryKey(primaryKey string, varyHeaders []string, reqHeaders http.Header) string {
+	key := primaryKey + VaryKeySeparator
+	for i, name := range varyHeaders {
+		if i > 0 {
+			key += "&"
+		}
+		key += name + "=" + normalizeVaryValue(reqHeaders[name])
+	}
+	return key
+}
+
+// VaryKeySeparator separates the primary cache key from the selected request header values, in secondary keys created by VaryKey. It begins with the remapdata.CacheKeySeparator, so the URI of any cache key is everything before the first separator.
+const VaryKeySeparator = remapdata.CacheKeySeparator + "vary:"
+
+// normalizeVaryValue combines multiple header fields with the same name and normalizes whitespace, as RFC7234§4.1 permits before comparing selecting header fields.
+func normalizeVaryValue(vals []string) string {
+	parts := []string{}
+	for _, val := range vals {
+		for _, part := range strings.Split(val, ",") {
+			if part = strings.Join(strings.Fields(part), " "); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
 // HasPragmaNoCache returns whether the given headers have a `pragma: no-cache` which is to be considered per HTTP/1.1. This specifically returns false if `cache-control` exists, even if `pragma: no-cache` exists, per RFC7234§5.4
 func hasPragmaNoCache(reqHeaders http.Header) bool {
 	if _, ok := reqHeaders["Cache-Control"]; ok {
@@ -21,6 +21,7 @@ package rfc
 import (
 	"net/http"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -729,3 +730,107 @@ func TestRules(t *testing.T) {
 
 	log.Init(log.NopCloser(os.Stdout), log.NopCloser(os.Stdout), log.NopCloser(os.Stdout), log.NopCloser(os.Stdout), log.NopCloser(os.Stdout))
 }
+
+func TestVary(t *testing.T) {
+	// test Vary header names are canonicalized, sorted, and deduplicated
+	{
+		respHdr := http.Header{"Vary": {"accept-language, Accept-Encoding", "ACCEPT-ENCODING"}}
+		expected := []string{"Accept-Encoding", "Accept-Language"}
+		if actual := VaryHeaders(respHdr); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("VaryHeaders expected %+v actual %+v", expected, actual)
+		}
+		if VaryAny(respHdr) {
+			t.Errorf("VaryAny expected false for Vary without '*', actual true")
+		}
+	}
+
+	// test Vary * is never reused - tests RFC7234§4.1 compliance
+	{
+		respHdr := http.Header{"Vary": {"Accept-Encoding, *"}}
+		if !VaryAny(respHdr) {
+			t.Errorf("VaryAny expected true for Vary '*', actual false")
+		}
+		if selectedHeadersMatch(http.Header{}, respHdr, http.Header{}) {
+			t.Errorf("selectedHeadersMatch expected false for Vary '*', actual true")
+		}
+	}
+
+	// test variants get the same key iff their selected headers match - tests RFC7234§4.1 compliance
+	{
+		respHdr := http.Header{"Vary": {"Accept-Encoding"}}
+		varyHdrs := VaryHeaders(respHdr)
+		gzipReqHdr := http.Header{"Accept-Encoding": {"gzip,  deflate"}, "User-Agent": {"a"}}
+		gzipReqHdr2 := http.Header{"Accept-Encoding": {"gzip", "deflate"}, "User-Agent": {"b"}}
+		identityReqHdr := http.Header{"User-Agent": {"a"}}
+
+		if VaryKey("GET:http://a.invalid/b", varyHdrs, gzipReqHdr) != VaryKey("GET:http://a.invalid/b", varyHdrs, gzipReqHdr2) {
+			t.Errorf("VaryKey expected normalized equal headers to have the same key, actual different")
+		}
+		if VaryKey("GET:http://a.invalid/b", varyHdrs, gzipReqHdr) == VaryKey("GET:http://a.invalid/b", varyHdrs, identityReqHdr) {
+			t.Errorf("VaryKey expected different headers to have different keys, actual same")
+		}
+		if !selectedHeadersMatch(gzipReqHdr2, respHdr, gzipReqHdr) {
+			t.Errorf("selectedHeadersMatch expected true for normalized equal headers, actual false")
+		}
+		if selectedHeadersMatch(identityReqHdr, respHdr, gzipReqHdr) {
+			t.Errorf("selectedHeadersMatch expected false for different headers, actual true")
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+	now := time.Now()
+	tenMinutesAgo := now.Add(time.Minute * -10)
+	respHdr := http.Header{
+		"Date":          {tenMinutesAgo.Format(time.RFC1123)},
+		"Cache-Control": {"max-age=300, stale-while-revalidate=600, stale-if-error=60"}, // stale for 5 minutes
+	}
+	respCC := web.ParseCacheControl(respHdr)
+
+	// test stale-while-revalidate within the response window - tests RFC5861§3 compliance
+	if !StaleWhileRevalidate(respHdr, respCC, tenMinutesAgo, tenMinutesAgo, time.Hour) {
+		t.Errorf("StaleWhileRevalidate within window: expected true, actual false")
+	}
+
+	// test the rule limit restricts the response window
+	if StaleWhileRevalidate(respHdr, respCC, tenMinutesAgo, tenMinutesAgo, time.Minute) {
+		t.Errorf("StaleWhileRevalidate outside rule limit: expected false, actual true")
+	}
+
+	// test a disabled rule never serves stale
+	if StaleWhileRevalidate(respHdr, respCC, tenMinutesAgo, tenMinutesAgo, 0) {
+		t.Errorf("StaleWhileRevalidate with rule disabled: expected false, actual true")
+	}
+
+	// test stale-if-error outside the response window - tests RFC5861§4 compliance
+	if StaleIfError(respHdr, respCC, tenMinutesAgo, tenMinutesAgo, time.Hour) {
+		t.Errorf("StaleIfError outside window: expected false, actual true")
+	}
+
+	// test a fresh response is not in the stale window, so it isn't revalidated
+	{
+		respHdr := http.Header{
+			"Date":          {now.Format(time.RFC1123)},
+			"Cache-Control": {"max-age=300, stale-while-revalidate=600, stale-if-error=600"},
+		}
+		respCC := web.ParseCacheControl(respHdr)
+		if StaleWhileRevalidate(respHdr, respCC, now, now, time.Hour) {
+			t.Errorf("StaleWhileRevalidate with fresh response: expected false, actual true")
+		}
+		if StaleIfError(respHdr, respCC, now, now, time.Hour) {
+			t.Errorf("StaleIfError with fresh response: expected false, actual true")
+		}
+	}
+
+	// test must-revalidate prohibits serving stale
+	{
+		respHdr := http.Header{
+			"Date":          {tenMinutesAgo.Format(time.RFC1123)},
+			"Cache-Control": {"max-age=300, must-revalidate, stale-if-error=600"},
+		}
+		respCC := web.ParseCacheControl(respHdr)
+		if StaleIfError(respHdr, respCC, tenMinutesAgo, tenMinutesAgo, time.Hour) {
+			t.Errorf("StaleIfError with must-revalidate: expected false, actual true")
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+
+	"github.com/apache/trafficcontrol/grove/cache"
+	"github.com/apache/trafficcontrol/grove/config"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/remap"
+	"github.com/apache/trafficcontrol/grove/sibling"
+	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/trace"
+	"github.com/apache/trafficcontrol/grove/web"
+)
+
+// server is the running Grove service. Its config, remap rules, handlers, and HTTP servers are replaced by reload, and its caches are kept for the life of the process.
+type server struct {
+	cfgFileName string
+	reloadM     sync.Mutex // reloads may be triggered concurrently, by SIGHUP and the reload endpoint
+
+	cfg           config.Config
+	caches        map[string]icache.Cache
+	baseTransport *http.Transport
+	parentConns   *stat.ParentConns
+	plugins       plugin.Plugins
+	pluginContext map[string]*interface{}
+	remapper      remap.HTTPRequestRemapper
+	siblings      *sibling.Siblings
+	tracer        *trace.Tracer
+	tlsCerts      *web.Certs
+	stats         stat.Stats
+
+	httpListener           *web.SharedListener
+	httpConns              *web.ConnMap
+	httpConnStateCallback  func(net.Conn, http.ConnState)
+	httpsListener          *web.SharedListener
+	httpsConns             *web.ConnMap
+	httpsConnStateCallback func(net.Conn, http.ConnState)
+	tlsConfig              *tls.Config
+
+	httpHandler  *cache.HandlerPointer
+	httpsHandler *cache.HandlerPointer
+	httpServer   *http.Server
+	httpsServer  *http.Server
+}
+
+// newServer creates the caches, remap rules, and listeners of the given config, and starts serving. The cfgFileName is the file cfg was loaded from, which is loaded again on reload.
+func newServer(cfgFileName string, cfg config.Config) (*server, error) {
+	s := &server{cfgFileName: cfgFileName, cfg: cfg, pluginContext: map[string]*interface{}{}}
+
+	caches, err := createCaches(cfg.CacheFiles, uint64(cfg.FileMemBytes), uint64(cfg.CacheSizeBytes), time.Duration(cfg.CacheFilesExpiredGCIntervalMS)*time.Millisecond, time.Duration(cfg.CacheFilesExpiredGCGraceMS)*time.Millisecond)
+	if err != nil {
+		return nil, errors.New("creating caches: " + err.Error())
+	}
+	s.caches = caches
+
+	reqTimeout := time.Duration(cfg.ReqTimeoutMS) * time.Millisecond
+	reqKeepAlive := time.Duration(cfg.ReqKeepAliveMS) * time.Millisecond
+	reqMaxIdleConns := cfg.ReqMaxIdleConns
+	reqIdleConnTimeout := time.Duration(cfg.ReqIdleConnTimeoutMS) * time.Millisecond
+	s.baseTransport = remap.NewRemappingTransport(reqTimeout, reqKeepAlive, reqMaxIdleConns, reqIdleConnTimeout)
+	s.parentConns = stat.NewParentConns()
+	s.baseTransport.DialContext = s.parentConns.DialContext(s.baseTransport.DialContext)
+
+	s.plugins = plugin.Get(cfg.Plugins)
+	if s.remapper, err = remap.LoadRemapper(cfg.RemapRulesFile, s.plugins.LoadFuncs(), s.caches, s.baseTransport); err != nil {
+		return nil, errors.New("loading remap rules: " + err.Error())
+	}
+
+	if s.siblings, err = createSiblings(cfg); err != nil {
+		return nil, errors.New("creating siblings: " + err.Error())
+	}
+
+	certs, err := loadAllCerts(s.remapper.Rules(), cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.tracer, err = createTracer(cfg); err != nil {
+		return nil, errors.New("creating tracer: " + err.Error())
+	}
+	s.tlsCerts = web.NewCerts(certs, cfg.DisableHTTP2)
+
+	httpListener := net.Listener(nil)
+	if httpListener, s.httpConns, s.httpConnStateCallback, err = web.InterceptListen("tcp", fmt.Sprintf(":%d", cfg.Port)); err != nil {
+		s.tracer.Close()
+		return nil, fmt.Errorf("creating HTTP listener %v: %v", cfg.Port, err)
+	}
+	s.httpListener = web.NewSharedListener(httpListener)
+
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		httpsListener := net.Listener(nil)
+		if httpsListener, s.httpsConns, s.httpsConnStateCallback, s.tlsConfig, err = web.InterceptListenTLS("tcp", fmt.Sprintf(":%d", cfg.HTTPSPort), s.tlsCerts); err != nil {
+			s.httpListener.Close()
+			s.tracer.Close()
+			return nil, fmt.Errorf("creating HTTPS listener %v: %v", cfg.HTTPSPort, err)
+		}
+		s.httpsListener = web.NewSharedListener(httpsListener)
+	}
+
+	// TODO pass total size for all file groups?
+	s.stats = stat.New(s.remapper.Rules(), s.caches, uint64(cfg.CacheSizeBytes), s.httpConns, s.httpsConns, s.parentConns, Version)
+
+	s.httpHandler = cache.NewHandlerPointer(s.newHandler("http", strconv.Itoa(cfg.Port), s.httpConns))
+	s.httpsHandler = cache.NewHandlerPointer(s.newHandler("https", strconv.Itoa(cfg.HTTPSPort), s.httpsConns))
+
+	s.plugins.OnStartup(s.remapper.PluginCfg(), s.pluginContext, plugin.StartupData{Config: cfg, Shared: s.remapper.PluginSharedCfg()})
+
+	// TODO add config to not serve HTTP (only HTTPS). If port is not set?
+	s.httpServer = s.startServer("http")
+	if s.httpsListener != nil {
+		s.httpsServer = s.startServer("https")
+	}
+	return s, nil
+}
+
+func (s *server) newHandler(scheme string, port string, conns *web.ConnMap) *cache.Handler {
+	return cache.NewHandler(
+		s.remapper,
+		uint64(s.cfg.ConcurrentRuleRequests),
+		s.stats,
+		scheme,
+		port,
+		conns,
+		s.cfg.RFCCompliant,
+		s.cfg.ConnectionClose,
+		s.plugins,
+		s.pluginContext,
+		s.httpConns,
+		s.httpsConns,
+		s.cfg.InterfaceName,
+		s.reload,
+		s.siblings,
+		s.tracer,
+	)
+}
+
+// startServer starts a new server for the given protocol, "http" or "https", on its listener, with the current config.
+func (s *server) startServer(protocol string) *http.Server {
+	idleTimeout := time.Duration(s.cfg.ServerIdleTimeoutMS) * time.Millisecond
+	readTimeout := time.Duration(s.cfg.ServerReadTimeoutMS) * time.Millisecond
+	writeTimeout := time.Duration(s.cfg.ServerWriteTimeoutMS) * time.Millisecond
+	if protocol == "https" {
+		return startServer(s.httpsHandler, s.httpsListener.Listener(), s.httpsConnStateCallback, s.tlsConfig, s.cfg.HTTPSPort, idleTimeout, readTimeout, writeTimeout, s.cfg.DisableHTTP2, protocol)
+	}
+	return startServer(s.httpHandler, s.httpListener.Listener(), s.httpConnStateCallback, nil, s.cfg.Port, idleTimeout, readTimeout, writeTimeout, s.cfg.DisableHTTP2, protocol)
+}
+
+// reload loads the config file, and replaces the config, remap rules, and handlers. Servers are replaced if their port or server settings changed. Stats continue counting from before the reload.
+func (s *server) reload() error {
+	s.reloadM.Lock()
+	defer s.reloadM.Unlock()
+
+	log.Infoln("reloading config")
+	newCfg, err := config.LoadConfig(s.cfgFileName)
+	if err != nil {
+		log.Errorln("reloading config: failed to load config file, keeping existing config: " + err.Error())
+		return errors.New("loading config file: " + err.Error())
+	}
+	eventW, errW, warnW, infoW, debugW, err := log.GetLogWriters(newCfg)
+	if err != nil {
+		log.Errorln("reloading config: failed to get log writers from '" + s.cfgFileName + "', keeping existing log locations: " + err.Error())
+	} else {
+		log.Init(eventW, errW, warnW, infoW, debugW)
+	}
+
+	// TODO add cache file reloading
+	// The problem is, the disk db needs file locks, so there's no way to close and create new files without making all requests cache miss in the meantime.
+	// Thus, the file paths must be kept, diffed, only removed paths' dbs closed, only new paths opened, and dbs for existing paths passed into the new caches object.
+	if cachesChanged(s.cfg, newCfg) {
+		log.Warnln("reloading config: caches changed in new config! Dynamic cache reloading is not supported! Old cache files and sizes will be used, and new cache config will NOT be loaded! Restart service to apply cache changes!")
+	}
+
+	// Everything is loaded before anything is swapped in, so a failure at any point keeps the entire existing config.
+	newPlugins := plugin.Get(newCfg.Plugins)
+	newRemapper, err := remap.LoadRemapper(newCfg.RemapRulesFile, newPlugins.LoadFuncs(), s.caches, s.baseTransport)
+	if err != nil {
+		log.Errorln("reloading config: failed to load remap rules, keeping existing config: " + err.Error())
+		return errors.New("loading remap rules: " + err.Error())
+	}
+
+	newCerts, err := loadAllCerts(newRemapper.Rules(), newCfg.CertFile, newCfg.KeyFile)
+	if err != nil {
+		log.Errorln("reloading config: failed to load certificates, keeping existing config: " + err.Error())
+		return err
+	}
+
+	newSiblings, err := createSiblings(newCfg)
+	if err != nil {
+		log.Errorln("reloading config: failed to create siblings, keeping existing config: " + err.Error())
+		return errors.New("creating siblings: " + err.Error())
+	}
+
+	newTracer, err := createTracer(newCfg)
+	if err != nil {
+		log.Errorln("reloading config: failed to create tracer, keeping existing config: " + err.Error())
+		return errors.New("creating tracer: " + err.Error())
+	}
+
+	newHTTPListener, newHTTPConns, newHTTPConnStateCallback := s.httpListener, s.httpConns, s.httpConnStateCallback
+	httpPortChanged := newCfg.Port != s.cfg.Port
+	if httpPortChanged {
+		listener, conns, connStateCallback, err := web.InterceptListen("tcp", fmt.Sprintf(":%d", newCfg.Port))
+		if err != nil {
+			log.Errorf("reloading config: creating HTTP listener %v, keeping existing config: %v\n", newCfg.Port, err)
+			newTracer.Close()
+			return errors.New("creating HTTP listener: " + err.Error())
+		}
+		newHTTPListener, newHTTPConns, newHTTPConnStateCallback = web.NewSharedListener(listener), conns, connStateCallback
+	}
+
+	newHTTPSListener, newHTTPSConns, newHTTPSConnStateCallback, newTLSConfig := s.httpsListener, s.httpsConns, s.httpsConnStateCallback, s.tlsConfig
+	httpsPortChanged := newCfg.CertFile != "" && newCfg.KeyFile != "" && (s.httpsServer == nil || newCfg.HTTPSPort != s.cfg.HTTPSPort)
+	if httpsPortChanged {
+		listener, conns, connStateCallback, tlsConfig, err := web.InterceptListenTLS("tcp", fmt.Sprintf(":%d", newCfg.HTTPSPort), s.tlsCerts)
+		if err != nil {
+			log.Errorf("reloading config: creating HTTPS listener %v, keeping existing config: %v\n", newCfg.HTTPSPort, err)
+			if httpPortChanged {
+				newHTTPListener.Close()
+			}
+			newTracer.Close()
+			return errors.New("creating HTTPS listener: " + err.Error())
+		}
+		newHTTPSListener, newHTTPSConns, newHTTPSConnStateCallback, newTLSConfig = web.NewSharedListener(listener), conns, connStateCallback, tlsConfig
+	}
+
+	// The server settings can't be changed on a running server, so servers are replaced on their existing listeners.
+	serverChanged := newCfg.DisableHTTP2 != s.cfg.DisableHTTP2 ||
+		newCfg.ServerIdleTimeoutMS != s.cfg.ServerIdleTimeoutMS ||
+		newCfg.ServerReadTimeoutMS != s.cfg.ServerReadTimeoutMS ||
+		newCfg.ServerWriteTimeoutMS != s.cfg.ServerWriteTimeoutMS
+
+	oldTracer, oldStats, oldHTTPListener, oldHTTPSListener := s.tracer, s.stats, s.httpListener, s.httpsListener
+	s.cfg, s.plugins, s.remapper, s.siblings, s.tracer = newCfg, newPlugins, newRemapper, newSiblings, newTracer
+	s.httpListener, s.httpConns, s.httpConnStateCallback = newHTTPListener, newHTTPConns, newHTTPConnStateCallback
+	s.httpsListener, s.httpsConns, s.httpsConnStateCallback, s.tlsConfig = newHTTPSListener, newHTTPSConns, newHTTPSConnStateCallback, newTLSConfig
+	s.tlsCerts.Set(newCerts, s.cfg.DisableHTTP2)
+
+	s.stats = stat.NewFrom(oldStats, s.remapper.Rules(), s.caches, uint64(s.cfg.CacheSizeBytes), s.httpConns, s.httpsConns, s.parentConns)
+
+	s.httpHandler.Set(s.newHandler("http", strconv.Itoa(s.cfg.Port), s.httpConns))
+	s.httpsHandler.Set(s.newHandler("https", strconv.Itoa(s.cfg.HTTPSPort), s.httpsConns))
+
+	s.plugins.OnStartup(s.remapper.PluginCfg(), s.pluginContext, plugin.StartupData{Config: s.cfg, Shared: s.remapper.PluginSharedCfg()})
+
+	// Old servers are shut down in the background, because the reload may have been requested by one of their own connections.
+	if httpPortChanged || serverChanged {
+		oldServer := s.httpServer
+		s.httpServer = s.startServer("http")
+		go shutdownServerAndListener(oldServer, oldHTTPListener, httpPortChanged, "http")
+	}
+
+	if httpsPortChanged || (serverChanged && s.httpsServer != nil) {
+		oldServer := s.httpsServer
+		s.httpsServer = s.startServer("https")
+		if oldServer != nil {
+			go shutdownServerAndListener(oldServer, oldHTTPSListener, httpsPortChanged, "https")
+		}
+	}
+
+	// The old tracer is closed after the new handlers are set, and in the background, because in-flight requests may still end spans, which are dropped once it's closed, and closing waits for its last export.
+	go oldTracer.Close()
+
+	log.Infoln("reloaded config")
+	return nil
+}
+
+// shutdownServerAndListener gracefully shuts down the given server, and then closes its listener, if it's no longer used by the new server.
+func shutdownServerAndListener(server *http.Server, listener *web.SharedListener, closeListener bool, protocol string) {
+	shutdownServer(server, protocol)
+	if closeListener {
+		listener.Close()
+	}
+}
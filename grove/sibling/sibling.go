@@ -0,0 +1,93 @@
+package sibling
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/chash"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/web"
+)
+
+// Header is set on requests to siblings. A request with this header is always fetched from the parent, never another sibling, so requests can't loop between siblings.
+const Header = "X-Grove-Sibling"
+
+// Replicas is the number of replicas of each sibling on the consistent hash ring.
+const Replicas = 1024
+
+// Siblings is a group of Grove caches, typically in the same cache group, which share misses. Each cache key is owned by one sibling, selected by consistent hashing, so every sibling selects the same owner. On a miss, a sibling which doesn't own the key requests it from the owner instead of the parent, so the parent only receives one request for the object from the whole group.
+type Siblings struct {
+	self      string
+	hash      chash.ATSConsistentHash
+	health    map[string]*remapdata.ParentHealth
+	transport *http.Transport
+}
+
+// New creates a new sibling group, of the given sibling addresses of the form "host:port". The self address must be one of the siblings, and is the address other siblings use to reach this Grove. All siblings must be configured with the same addresses, in order to select the same owners.
+// Siblings which fail maxFailures consecutive requests are marked down for cooldown, and their keys are fetched from the parent until they're marked up.
+func New(self string, siblings []string, transport *http.Transport, maxFailures int, cooldown time.Duration) (*Siblings, error) {
+	s := &Siblings{
+		self:      self,
+		hash:      chash.NewSimpleATSConsistentHash(Replicas),
+		health:    map[string]*remapdata.ParentHealth{},
+		transport: transport,
+	}
+	for _, sibling := range siblings {
+		if _, ok := s.health[sibling]; ok {
+			return nil, errors.New("duplicate sibling '" + sibling + "'")
+		}
+		if err := s.hash.Insert(&chash.ATSConsistentHashNode{Name: sibling, Transport: transport}, 1.0); err != nil {
+			return nil, errors.New("inserting sibling '" + sibling + "': " + err.Error())
+		}
+		s.health[sibling] = remapdata.NewParentHealth("sibling "+sibling, maxFailures, cooldown)
+	}
+	if _, ok := s.health[self]; !ok {
+		return nil, errors.New("self '" + self + "' is not one of the siblings")
+	}
+	return s, nil
+}
+
+// Owner returns the sibling which owns the given cache key, and its health. Returns false if this Grove owns the key, or the owner is marked down, in which case the object should be requested from the parent.
+func (s *Siblings) Owner(key string) (string, *remapdata.ParentHealth, bool) {
+	iter, _, err := s.hash.Lookup(key)
+	if err != nil {
+		return "", nil, false
+	}
+	owner := iter.Val().Name
+	if owner == s.self || s.health[owner].Down() {
+		return "", nil, false
+	}
+	return owner, s.health[owner], true
+}
+
+// Transport returns the transport for requests to siblings.
+func (s *Siblings) Transport() *http.Transport {
+	return s.transport
+}
+
+// Request creates the request to the given sibling, for the given client request. The request is for the same URI and Host as the client request, so the sibling remaps it with the same rule, and the Header is set, so the sibling requests it from the parent.
+func Request(sibling string, clientReq *http.Request) (*http.Request, error) {
+	req, err := http.NewRequest(clientReq.Method, "http://"+sibling+clientReq.RequestURI, nil)
+	if err != nil {
+		return nil, errors.New("creating request: " + err.Error())
+	}
+	web.CopyHeaderTo(clientReq.Header, &req.Header)
+	req.Host = clientReq.Host
+	req.Header.Set(Header, "1")
+	return req, nil
+}
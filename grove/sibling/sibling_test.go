@@ -0,0 +1,81 @@
+package sibling
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOwner(t *testing.T) {
+	addrs := []string{"edge0:80", "edge1:80", "edge2:80"}
+	groups := map[string]*Siblings{}
+	for _, self := range addrs {
+		s, err := New(self, addrs, &http.Transport{}, 1, time.Minute)
+		if err != nil {
+			t.Fatalf("New '%v' error: %v", self, err)
+		}
+		groups[self] = s
+	}
+
+	owned := map[string]int{}
+	for i := 0; i < 300; i++ {
+		key := "GET:http://example.net/obj" + strconv.Itoa(i)
+		owners := []string{}
+		for _, self := range addrs {
+			if owner, _, ok := groups[self].Owner(key); ok {
+				owners = append(owners, owner)
+			}
+		}
+		// the owner itself requests the parent, and all other siblings request the owner.
+		if len(owners) != len(addrs)-1 {
+			t.Fatalf("Owner '%v' expected %v siblings to request another sibling, actual %v", key, len(addrs)-1, owners)
+		}
+		for _, owner := range owners {
+			if owner != owners[0] {
+				t.Fatalf("Owner '%v' expected all siblings to select the same owner, actual %v", key, owners)
+			}
+		}
+		owned[owners[0]]++
+	}
+	for _, addr := range addrs {
+		if owned[addr] == 0 {
+			t.Errorf("Owner expected keys to be distributed to every sibling, actual %v owns none: %v", addr, owned)
+		}
+	}
+
+	s := groups["edge0:80"]
+	key := "GET:http://example.net/down"
+	owner, health, ok := s.Owner(key)
+	for i := 0; !ok; i++ {
+		key = "GET:http://example.net/down" + strconv.Itoa(i)
+		owner, health, ok = s.Owner(key)
+	}
+	health.Report(false, 0)
+	if _, _, ok := s.Owner(key); ok {
+		t.Errorf("Owner expected false when owner '%v' is marked down, actual true", owner)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New("edge3:80", []string{"edge0:80", "edge1:80"}, &http.Transport{}, 1, time.Minute); err == nil {
+		t.Errorf("New with self not a sibling expected error, actual nil")
+	}
+	if _, err := New("edge0:80", []string{"edge0:80", "edge0:80"}, &http.Transport{}, 1, time.Minute); err == nil {
+		t.Errorf("New with duplicate siblings expected error, actual nil")
+	}
+}
@@ -0,0 +1,66 @@
+package stat
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of request latency histograms. These are the Prometheus client defaults, which cover typical cache hit and miss latencies.
+var LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a snapshot of a latency histogram.
+type Histogram struct {
+	// Buckets are the cumulative counts of observations less than or equal to each of LatencyBuckets.
+	Buckets []uint64
+	Count   uint64
+	// Sum is the sum of all observations, in seconds.
+	Sum float64
+}
+
+// latencyHistogram is a threadsafe histogram of request latencies, with the buckets LatencyBuckets. Observations are counted in the first bucket they fit in, or the last overflow bucket if they fit in none, and accumulated when a snapshot is taken, so observing is a single atomic add. The count is the total of all buckets, so a snapshot's count always matches its buckets.
+type latencyHistogram struct {
+	buckets  []uint64 // len(LatencyBuckets)+1, the last being +Inf
+	sumNanos uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(LatencyBuckets) && seconds > LatencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sumNanos, uint64(d))
+}
+
+func (h *latencyHistogram) Snapshot() Histogram {
+	s := Histogram{Buckets: make([]uint64, len(LatencyBuckets))}
+	cumulative := uint64(0)
+	for i := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		if i < len(s.Buckets) {
+			s.Buckets[i] = cumulative
+		}
+	}
+	s.Count = cumulative
+	s.Sum = time.Duration(atomic.LoadUint64(&h.sumNanos)).Seconds()
+	return s
+}
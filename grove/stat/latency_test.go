@@ -0,0 +1,40 @@
+package stat
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	h.Observe(time.Millisecond)
+	h.Observe(20 * time.Millisecond)
+	h.Observe(20 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	s := h.Snapshot()
+	if expected := []uint64{1, 1, 3, 3, 3, 3, 3, 3, 3, 3, 3}; !reflect.DeepEqual(s.Buckets, expected) {
+		t.Errorf("Histogram buckets expected %v, actual %v", expected, s.Buckets)
+	}
+	if s.Count != 4 {
+		t.Errorf("Histogram count expected 4, actual %v", s.Count)
+	}
+	if expected := (time.Minute + 41*time.Millisecond).Seconds(); s.Sum != expected {
+		t.Errorf("Histogram sum expected %v, actual %v", expected, s.Sum)
+	}
+}
@@ -0,0 +1,109 @@
+package stat
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialContextFunc is the signature of http.Transport.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ParentConns counts the connections made to parents, and the parent requests made over them. It's shared by every parent transport, and outlives config reloads, like the transports do.
+type ParentConns struct {
+	opened      uint64
+	closed      uint64
+	dialErrors  uint64
+	requests    uint64
+	reused      uint64
+	dialLatency *latencyHistogram
+}
+
+func NewParentConns() *ParentConns {
+	return &ParentConns{dialLatency: newLatencyHistogram()}
+}
+
+// DialContext returns dial, wrapped to count the connections it opens and closes, and the time taken to dial them.
+func (p *ParentConns) DialContext(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			atomic.AddUint64(&p.dialErrors, 1)
+			return nil, err
+		}
+		p.dialLatency.Observe(time.Since(start))
+		atomic.AddUint64(&p.opened, 1)
+		return &parentConn{Conn: conn, p: p}, nil
+	}
+}
+
+// Trace returns a shallow copy of r, which counts the request, and whether it reused an existing connection, when its connection is obtained. HTTP/2 requests multiplexed onto an open connection count as reused.
+func (p *ParentConns) Trace(r *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			atomic.AddUint64(&p.requests, 1)
+			if info.Reused {
+				atomic.AddUint64(&p.reused, 1)
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// Opened is the number of parent connections opened.
+func (p *ParentConns) Opened() uint64 { return atomic.LoadUint64(&p.opened) }
+
+// Open is the number of parent connections currently open.
+func (p *ParentConns) Open() uint64 { return p.Opened() - atomic.LoadUint64(&p.closed) }
+
+// DialErrors is the number of parent connections which failed to dial.
+func (p *ParentConns) DialErrors() uint64 { return atomic.LoadUint64(&p.dialErrors) }
+
+// Requests is the number of parent requests which obtained a connection.
+func (p *ParentConns) Requests() uint64 { return atomic.LoadUint64(&p.requests) }
+
+// Reused is the number of parent requests made on an already-open connection.
+func (p *ParentConns) Reused() uint64 { return atomic.LoadUint64(&p.reused) }
+
+// ReuseRatio is the fraction of parent requests made on an already-open connection, or 0 if there have been no requests.
+func (p *ParentConns) ReuseRatio() float64 {
+	requests := p.Requests()
+	if requests == 0 {
+		return 0
+	}
+	return float64(p.Reused()) / float64(requests)
+}
+
+// DialLatency returns the histogram of the time taken to dial parent connections, not including TLS handshakes.
+func (p *ParentConns) DialLatency() Histogram { return p.dialLatency.Snapshot() }
+
+// parentConn is a net.Conn which counts itself closed, once, in its ParentConns.
+type parentConn struct {
+	net.Conn
+	p         *ParentConns
+	closeOnce sync.Once
+}
+
+func (c *parentConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddUint64(&c.p.closed, 1) })
+	return c.Conn.Close()
+}
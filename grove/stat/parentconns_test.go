@@ -0,0 +1,91 @@
+package stat
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestParentConns(t *testing.T) {
+	for _, isH2C := range []bool{false, true} {
+		handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		if isH2C {
+			handler = h2c.NewHandler(handler, &http2.Server{})
+		}
+		srv := httptest.NewServer(handler)
+
+		p := NewParentConns()
+		dial := p.DialContext((&net.Dialer{}).DialContext)
+		transport := http.RoundTripper(&http.Transport{DialContext: dial})
+		if isH2C {
+			transport = &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+					return dial(context.Background(), network, addr)
+				},
+			}
+		}
+		expectedProto := "HTTP/1.1"
+		if isH2C {
+			expectedProto = "HTTP/2.0"
+		}
+
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.RoundTrip(p.Trace(req))
+			if err != nil {
+				t.Fatalf("h2c %v request %v: %v", isH2C, i, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != expectedProto {
+				t.Errorf("h2c %v expected proto %v, actual %v", isH2C, expectedProto, string(body))
+			}
+		}
+
+		if p.Opened() != 1 || p.Open() != 1 {
+			t.Errorf("h2c %v expected 1 connection opened and open, actual %v opened %v open", isH2C, p.Opened(), p.Open())
+		}
+		if p.Requests() != 3 || p.Reused() != 2 {
+			t.Errorf("h2c %v expected 3 requests 2 reused, actual %v requests %v reused", isH2C, p.Requests(), p.Reused())
+		}
+		if ratio := p.ReuseRatio(); ratio < 0.66 || ratio > 0.67 {
+			t.Errorf("h2c %v expected reuse ratio 2/3, actual %v", isH2C, ratio)
+		}
+		if h := p.DialLatency(); h.Count != 1 {
+			t.Errorf("h2c %v expected 1 dial latency observation, actual %v", isH2C, h.Count)
+		}
+
+		transport.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+		if p.Open() != 0 {
+			t.Errorf("h2c %v expected 0 connections open after closing idle, actual %v", isH2C, p.Open())
+		}
+		srv.Close()
+	}
+}
@@ -48,6 +48,8 @@ type Stats interface {
 	Remap() StatsRemaps
 
 	Connections() uint64
+	// ParentConns returns the counts of connections to parents, and the requests made over them.
+	ParentConns() *ParentConns
 
 	CacheHits() uint64
 	AddCacheHit()
@@ -65,9 +67,10 @@ type Stats interface {
 	CacheCapacityByName(string) (uint64, bool)
 	CacheNames() []string
 	CachePeek(string, string) (*cacheobj.CacheObj, bool)
+	CacheRemove(string, string) bool
 }
 
-func New(remapRules []remapdata.RemapRule, caches map[string]icache.Cache, cacheCapacityBytes uint64, httpConns *web.ConnMap, httpsConns *web.ConnMap, version string) Stats {
+func New(remapRules []remapdata.RemapRule, caches map[string]icache.Cache, cacheCapacityBytes uint64, httpConns *web.ConnMap, httpsConns *web.ConnMap, parentConns *ParentConns, version string) Stats {
 	cacheHits := uint64(0)
 	cacheMisses := uint64(0)
 	return &stats{
@@ -79,9 +82,23 @@ func New(remapRules []remapdata.RemapRule, caches map[string]icache.Cache, cache
 		cacheCapacityBytes: cacheCapacityBytes,
 		httpConns:          httpConns,
 		httpsConns:         httpsConns,
+		parentConns:        parentConns,
 	}
 }
 
+// NewFrom creates Stats for reloaded remap rules, caches, and connections, which continue counting from old. The system and cache hit stats are shared with old, as are the remap stats of rules whose FQDN is in old, so requests still in flight on old handlers are counted. Rules not in old start from zero.
+func NewFrom(old Stats, remapRules []remapdata.RemapRule, caches map[string]icache.Cache, cacheCapacityBytes uint64, httpConns *web.ConnMap, httpsConns *web.ConnMap, parentConns *ParentConns) Stats {
+	s := New(remapRules, caches, cacheCapacityBytes, httpConns, httpsConns, parentConns, old.System().Version()).(*stats)
+	s.system = old.System()
+	s.remap = NewStatsRemapsFrom(old.Remap(), remapRules)
+	if oldStats, ok := old.(*stats); ok {
+		s.cacheHits, s.cacheMisses = oldStats.cacheHits, oldStats.cacheMisses
+	} else {
+		*s.cacheHits, *s.cacheMisses = old.CacheHits(), old.CacheMisses()
+	}
+	return s
+}
+
 // Write writes to the remapRuleStats of s, and returns the bytes written to the connection
 func (stats *stats) Write(w http.ResponseWriter, conn *web.InterceptConn, reqFQDN string, remoteAddr string, code int, bytesWritten uint64, cacheHit bool) uint64 {
 	remapRuleStats, ok := stats.Remap().Stats(reqFQDN)
@@ -142,6 +159,7 @@ type stats struct {
 	cacheCapacityBytes uint64
 	httpConns          *web.ConnMap
 	httpsConns         *web.ConnMap
+	parentConns        *ParentConns
 }
 
 func (s stats) Connections() uint64 {
@@ -154,6 +172,8 @@ func (s stats) Connections() uint64 {
 	}
 	return l
 }
+func (s stats) ParentConns() *ParentConns { return s.parentConns }
+
 func (s stats) CacheHits() uint64    { return atomic.LoadUint64(s.cacheHits) }
 func (s stats) AddCacheHit()         { atomic.AddUint64(s.cacheHits, 1) }
 func (s stats) CacheMisses() uint64  { return atomic.LoadUint64(s.cacheMisses) }
@@ -189,7 +209,11 @@ func (s stats) CacheNames() []string {
 
 // CacheKeys returns an array of all the cache keys for the cache cacheName
 func (s stats) CacheKeys(cacheName string) []string {
-	return s.caches[cacheName].Keys()
+	c, ok := s.caches[cacheName]
+	if !ok {
+		return nil
+	}
+	return c.Keys()
 }
 
 // CachePeek returns the cached object *without* changing the recent-used-ness.
@@ -197,6 +221,15 @@ func (s stats) CachePeek(key, cacheName string) (*cacheobj.CacheObj, bool) {
 	return s.caches[cacheName].Peek(key)
 }
 
+// CacheRemove removes the key from the cache cacheName. Returns whether the key existed.
+func (s stats) CacheRemove(key, cacheName string) bool {
+	c, ok := s.caches[cacheName]
+	if !ok {
+		return false
+	}
+	return c.Remove(key)
+}
+
 func (s stats) CacheCapacityByName(cName string) (uint64, bool) {
 	if cache, ok := s.caches[cName]; ok {
 		return cache.Capacity(), true
@@ -229,6 +262,18 @@ type StatsRemap interface {
 	AddCacheHit()
 	CacheMisses() uint64
 	AddCacheMiss()
+
+	// ParentFailures is the number of parent requests which failed to connect, or returned a retry code.
+	ParentFailures() uint64
+	AddParentFailure()
+
+	// Latency returns the histogram of client request latencies, from receiving the request to finishing the response.
+	Latency() Histogram
+	AddLatency(time.Duration)
+
+	// RateLimited is the number of client requests rejected by the given rate or connection limit.
+	RateLimited(remapdata.RateLimitType) uint64
+	AddRateLimited(remapdata.RateLimitType)
 }
 
 func getFromFQDN(r remapdata.RemapRule) string {
@@ -252,6 +297,20 @@ func NewStatsRemaps(remapRules []remapdata.RemapRule) StatsRemaps {
 	return statsRemaps(m)
 }
 
+// NewStatsRemapsFrom is like NewStatsRemaps, but rules whose FQDN is in old keep their stats from old.
+func NewStatsRemapsFrom(old StatsRemaps, remapRules []remapdata.RemapRule) StatsRemaps {
+	m := make(map[string]StatsRemap, len(remapRules))
+	for _, rule := range remapRules {
+		fqdn := getFromFQDN(rule)
+		if oldStats, ok := old.Stats(fqdn); ok {
+			m[fqdn] = oldStats
+		} else {
+			m[fqdn] = NewStatsRemap()
+		}
+	}
+	return statsRemaps(m)
+}
+
 // statsRemaps fulfills the StatsRemaps interface
 type statsRemaps map[string]StatsRemap
 
@@ -261,7 +320,7 @@ func (s statsRemaps) Stats(rule string) (StatsRemap, bool) {
 }
 
 func (s statsRemaps) Rules() []string {
-	rules := make([]string, len(s))
+	rules := make([]string, 0, len(s))
 	for rule := range s {
 		rules = append(rules, rule)
 	}
@@ -269,18 +328,21 @@ func (s statsRemaps) Rules() []string {
 }
 
 func NewStatsRemap() StatsRemap {
-	return &statsRemap{}
+	return &statsRemap{latency: newLatencyHistogram()}
 }
 
 type statsRemap struct {
-	inBytes     uint64
-	outBytes    uint64
-	status2xx   uint64
-	status3xx   uint64
-	status4xx   uint64
-	status5xx   uint64
-	cacheHits   uint64
-	cacheMisses uint64
+	inBytes        uint64
+	outBytes       uint64
+	status2xx      uint64
+	status3xx      uint64
+	status4xx      uint64
+	status5xx      uint64
+	cacheHits      uint64
+	cacheMisses    uint64
+	parentFailures uint64
+	latency        *latencyHistogram
+	rateLimited    [remapdata.RateLimitConnections + 1]uint64
 }
 
 func (r *statsRemap) InBytes() uint64       { return atomic.LoadUint64(&r.inBytes) }
@@ -302,6 +364,19 @@ func (r *statsRemap) AddCacheHit()      { atomic.AddUint64(&r.cacheHits, 1) }
 func (r *statsRemap) CacheMisses() uint64 { return atomic.LoadUint64(&r.cacheMisses) }
 func (r *statsRemap) AddCacheMiss()       { atomic.AddUint64(&r.cacheMisses, 1) }
 
+func (r *statsRemap) ParentFailures() uint64 { return atomic.LoadUint64(&r.parentFailures) }
+func (r *statsRemap) AddParentFailure()      { atomic.AddUint64(&r.parentFailures, 1) }
+
+func (r *statsRemap) Latency() Histogram         { return r.latency.Snapshot() }
+func (r *statsRemap) AddLatency(d time.Duration) { r.latency.Observe(d) }
+
+func (r *statsRemap) RateLimited(t remapdata.RateLimitType) uint64 {
+	return atomic.LoadUint64(&r.rateLimited[t])
+}
+func (r *statsRemap) AddRateLimited(t remapdata.RateLimitType) {
+	atomic.AddUint64(&r.rateLimited[t], 1)
+}
+
 func NewStatsSystem(version string) StatsSystem {
 	return &statsSystem{version: version}
 }
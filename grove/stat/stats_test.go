@@ -84,7 +84,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		expected := 10
 		StatsInc(httpConns, expected, &addrs)
 		if actual := stats.Connections(); actual != uint64(expected) {
@@ -96,7 +96,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		expected := 10
 		StatsInc(httpsConns, expected, &addrs)
 		if actual := stats.Connections(); actual != uint64(expected) {
@@ -108,7 +108,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		expected := 10
 		StatsInc(httpConns, expected, &addrs)
 		StatsInc(httpsConns, expected, &addrs)
@@ -122,7 +122,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		count := 10
 		StatsInc(httpConns, count, &addrs)
 		StatsDec(httpConns, count, &addrs)
@@ -135,7 +135,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		count := 10
 		StatsInc(httpsConns, count, &addrs)
 		StatsDec(httpsConns, count, &addrs)
@@ -148,7 +148,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		count := 10
 		StatsInc(httpConns, count, &addrs)
 		StatsInc(httpsConns, count, &addrs)
@@ -163,7 +163,7 @@ func TestStatsCount(t *testing.T) {
 		httpsConns := web.NewConnMap()
 		addrs := []string{}
 		r := remapdata.RemapRule{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo"}}
-		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, "fakeversion")
+		stats := New([]remapdata.RemapRule{r}, nil, 0, httpConns, httpsConns, NewParentConns(), "fakeversion")
 		count := 10
 		StatsInc(httpConns, count, &addrs)
 		StatsDec(httpConns, 1, &addrs)
@@ -30,7 +30,7 @@ type GetterResp struct {
 }
 
 func NewGetter() Getter {
-	return &getter{waiters: map[string][]chan GetterResp{}}
+	return &getter{waiters: map[string][]chan GetterResp{}, filling: map[string]GetterResp{}}
 }
 
 // getter implements Getter, and does a fan-in so only one real request is made to the parent at any given time, and then that object is given to all concurrent requesters.
@@ -43,9 +43,14 @@ func NewGetter() Getter {
 // If the Author response can't be used, all Waiters make their own requests.
 // Note this assumes an uncacheable response for one request is likely uncacheable for all, and it's faster and less load on the origin if so.
 // If it's likely the author request is uncacheable, but a different waiter is cacheable for all other waiters, this will be more network, more origin load, and more work. If that's the case for you, consider creating another type that fulfills the Getter interface, and making the Getter configurable.
+//
+// If the Author response is streaming, it isn't in the cache until the stream is complete. So, until then, it's kept in the filling map, and new requests for the key which can use it are given the streaming object, and read the body as it arrives, rather than making their own requests.
+// Except, if the streaming response is uncacheable, its stream discards bytes once they're sent, so it isn't kept, and Waiters make their own requests.
 type getter struct {
 	// waiters is a map of cache keys to chans for getters.
-	waiters  map[string][]chan GetterResp
+	waiters map[string][]chan GetterResp
+	// filling is a map of cache keys to streaming objects which are still being received. It's mutexed by waitersM.
+	filling  map[string]GetterResp
 	waitersM sync.Mutex
 }
 
@@ -55,6 +60,13 @@ func (g *getter) Get(key string, actualGet func() *cacheobj.CacheObj, canUse fun
 	// Note this is unused if isAuthor becomes true.
 	getChan := make(chan GetterResp, 1)
 
+	g.waitersM.Lock()
+	fillingResp, isFilling := g.filling[key]
+	g.waitersM.Unlock()
+	if isFilling && canUse(fillingResp.CacheObj) {
+		return fillingResp.CacheObj, fillingResp.GetReqID
+	}
+
 	g.waitersM.Lock()
 	if _, ok := g.waiters[key]; !ok {
 		isAuthor = true
@@ -73,15 +85,35 @@ func (g *getter) Get(key string, actualGet func() *cacheobj.CacheObj, canUse fun
 			waitChan <- waitResp
 		}
 		delete(g.waiters, key)
+		if stream := obj.Stream(); stream != nil && !stream.Discarding() {
+			g.filling[key] = waitResp
+			go g.removeFilling(key, waitResp, stream)
+		}
 		g.waitersM.Unlock()
 
 		return obj, reqID
 	}
 
-	if waitResp := <-getChan; canUse(waitResp.CacheObj) {
+	if waitResp := <-getChan; canUse(waitResp.CacheObj) && !discarding(waitResp.CacheObj) {
 		return waitResp.CacheObj, waitResp.GetReqID
 	}
 
 	// if the Author response can't be used, all Waiters make their own requests
 	return actualGet(), reqID
 }
+
+// discarding returns whether the object is streaming into a discarding stream, which only the Author may read.
+func discarding(obj *cacheobj.CacheObj) bool {
+	stream := obj.Stream()
+	return stream != nil && stream.Discarding()
+}
+
+// removeFilling waits for the given stream to complete, and then removes it from the filling map, unless it's since been replaced by a newer fill.
+func (g *getter) removeFilling(key string, resp GetterResp, stream *cacheobj.Stream) {
+	stream.Wait()
+	g.waitersM.Lock()
+	if g.filling[key].CacheObj == resp.CacheObj {
+		delete(g.filling, key)
+	}
+	g.waitersM.Unlock()
+}
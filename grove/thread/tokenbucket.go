@@ -0,0 +1,129 @@
+package thread
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a threadsafe token bucket rate limiter. It holds up to burst tokens, which are refilled at rate tokens per second, and each request takes one.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	m      sync.Mutex
+}
+
+// NewTokenBucket returns a full TokenBucket. If burst is less than 1, the bucket holds one second of tokens, or at least one.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &TokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+// Take takes a token, and returns whether one was available. If not, it also returns how long until one will be.
+func (b *TokenBucket) Take(now time.Time) (bool, time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Refund returns a token taken by Take, e.g. because the request was rejected by another limit after taking it.
+func (b *TokenBucket) Refund() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// full returns whether the bucket has refilled to its burst, i.e. it's the same as a new bucket.
+func (b *TokenBucket) full(now time.Time) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// refill adds the tokens accrued since the last refill. It must be called with the mutex held.
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		if !b.last.IsZero() {
+			b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		}
+		b.last = now
+	}
+}
+
+// TokenBucketPruneInterval is how often TokenBuckets removes buckets which have refilled.
+const TokenBucketPruneInterval = time.Minute
+
+// TokenBuckets provides a threadsafe way to map string keys to TokenBuckets with the same rate and burst, such as a bucket per client. Buckets are created when a key is first used, and removed once they've refilled, so the map only holds keys which have recently made requests.
+type TokenBuckets struct {
+	rate      float64
+	burst     int
+	buckets   map[string]*TokenBucket
+	lastPrune time.Time
+	m         sync.Mutex
+}
+
+func NewTokenBuckets(rate float64, burst int) *TokenBuckets {
+	return &TokenBuckets{rate: rate, burst: burst, buckets: map[string]*TokenBucket{}}
+}
+
+// Take takes a token from the bucket of the given key, and returns whether one was available. If not, it also returns how long until one will be.
+func (b *TokenBuckets) Take(key string, now time.Time) (bool, time.Duration) {
+	b.m.Lock()
+	if now.Sub(b.lastPrune) >= TokenBucketPruneInterval {
+		for k, bucket := range b.buckets {
+			if bucket.full(now) {
+				delete(b.buckets, k)
+			}
+		}
+		b.lastPrune = now
+	}
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(b.rate, b.burst)
+		b.buckets[key] = bucket
+	}
+	b.m.Unlock()
+	return bucket.Take(now)
+}
+
+// Refund returns a token taken by Take to the bucket of the given key.
+func (b *TokenBuckets) Refund(key string) {
+	b.m.Lock()
+	bucket, ok := b.buckets[key]
+	b.m.Unlock()
+	if ok {
+		bucket.Refund()
+	}
+}
+
+// Len returns the number of keys with a bucket.
+func (b *TokenBuckets) Len() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.buckets)
+}
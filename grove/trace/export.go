@@ -0,0 +1,200 @@
+package trace
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Exporter sends batches of spans, encoded as an OTLP JSON ExportTraceServiceRequest, to a collector.
+type Exporter interface {
+	Export(otlpJSON []byte) error
+	Close() error
+}
+
+// fileExporter appends each batch to a file, as a line of JSON. This is the format of the OpenTelemetry Collector file exporter, which the Collector's otlpjsonfile receiver reads.
+type fileExporter struct {
+	file *os.File
+}
+
+// NewFileExporter returns an Exporter which appends batches of spans to the given file, one OTLP JSON object per line.
+func NewFileExporter(path string) (Exporter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.New("opening trace file: " + err.Error())
+	}
+	return &fileExporter{file: file}, nil
+}
+
+func (e *fileExporter) Export(otlpJSON []byte) error {
+	_, err := e.file.Write(append(otlpJSON, '\n'))
+	return err
+}
+
+func (e *fileExporter) Close() error { return e.file.Close() }
+
+// httpExporter posts each batch to an OTLP/HTTP endpoint.
+type httpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewHTTPExporter returns an Exporter which posts batches of spans to the given OTLP/HTTP traces endpoint with the JSON encoding, e.g. http://localhost:4318/v1/traces for a local OpenTelemetry Collector.
+func NewHTTPExporter(endpoint string, timeout time.Duration) Exporter {
+	return &httpExporter{endpoint: endpoint, client: &http.Client{Timeout: timeout}}
+}
+
+func (e *httpExporter) Export(otlpJSON []byte) error {
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(otlpJSON))
+	if err != nil {
+		return errors.New("posting to " + e.endpoint + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting to %v: code %v: %s", e.endpoint, resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (e *httpExporter) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// The OTLP JSON types. See https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto. IDs are hex, and 64-bit integers are strings, per the OTLP JSON encoding.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	TraceState        string          `json:"traceState,omitempty"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+// ScopeName is the OpenTelemetry instrumentation scope of Grove's spans.
+const ScopeName = "github.com/apache/trafficcontrol/grove"
+
+// marshalOTLP returns the given spans as an OTLP JSON ExportTraceServiceRequest.
+func marshalOTLP(resource []Attribute, spans []*Span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		otlpSp := otlpSpan{
+			TraceID:           s.ctx.TraceID.String(),
+			SpanID:            s.ctx.SpanID.String(),
+			TraceState:        s.ctx.TraceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        makeOTLPAttributes(s.attrs),
+		}
+		if s.parentID.IsValid() {
+			otlpSp.ParentSpanID = s.parentID.String()
+		}
+		if s.errMsg != "" {
+			otlpSp.Status = otlpStatus{Code: otlpStatusError, Message: s.errMsg}
+		}
+		otlpSpans = append(otlpSpans, otlpSp)
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: makeOTLPAttributes(resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: ScopeName}, Spans: otlpSpans}},
+	}}})
+}
+
+func makeOTLPAttributes(attrs []Attribute) []otlpAttribute {
+	otlpAttrs := make([]otlpAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		v := otlpValue{}
+		switch val := attr.Value.(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case uint64:
+			s := strconv.FormatUint(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprintf("%v", val)
+			v.StringValue = &s
+		}
+		otlpAttrs = append(otlpAttrs, otlpAttribute{Key: attr.Key, Value: v})
+	}
+	return otlpAttrs
+}
@@ -0,0 +1,215 @@
+package trace
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package trace implements W3C Trace Context propagation, and spans of the work done for each request, which are exported in the OpenTelemetry OTLP JSON format.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const TraceparentHeader = "traceparent"
+const TracestateHeader = "tracestate"
+
+// TraceID is the ID of a trace, shared by all its spans.
+type TraceID [16]byte
+
+// SpanID is the ID of a span.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext is the part of a span propagated to other services, in the traceparent and tracestate headers.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// Traceparent returns the W3C traceparent header value of the span context.
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + c.TraceID.String() + "-" + c.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses the W3C traceparent and tracestate header values. Returns false if the traceparent is missing or invalid, in which case the tracestate is also ignored, per the spec.
+func ParseTraceparent(traceparent string, tracestate string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return SpanContext{}, false
+	}
+	c := SpanContext{}
+	if !decodeHex(parts[1], c.TraceID[:]) || !decodeHex(parts[2], c.SpanID[:]) || !c.TraceID.IsValid() || !c.SpanID.IsValid() {
+		return SpanContext{}, false
+	}
+	flags := [1]byte{}
+	if !decodeHex(parts[3], flags[:]) {
+		return SpanContext{}, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	c.TraceState = strings.TrimSpace(tracestate)
+	return c, true
+}
+
+// decodeHex decodes the lowercase hex string s into b, which it must exactly fill.
+func decodeHex(s string, b []byte) bool {
+	if len(s) != hex.EncodedLen(len(b)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(b, []byte(s))
+	return err == nil
+}
+
+// SpanKind is the OpenTelemetry kind of a span.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Attribute is a key and value describing a span. The value must be a string, bool, int, int64, uint64, or float64.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a unit of work done for a request. Spans must only be used by the goroutine which started them. All methods may be called on a nil Span, which does nothing, so callers needn't check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	ctx      SpanContext
+	parentID SpanID
+	name     string
+	kind     SpanKind
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	errMsg   string
+	ended    bool
+}
+
+// Context returns the span's context, to propagate to other services.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttribute adds the given attribute to the span.
+func (s *Span) SetAttribute(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, Attribute{Key: key, Value: val})
+}
+
+// SetError sets the span's status to an error, with the given message.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.errMsg = msg
+}
+
+// End ends the span, and exports it if it's sampled. Spans may only be ended once, and further calls do nothing.
+func (s *Span) End() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if s.ctx.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx holding the given span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// FromContext returns the span held by ctx, or nil if it has none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Start starts a span which is a child of the span held by ctx, and returns a copy of ctx holding the new span. If ctx has no span, because the request isn't traced, it returns ctx and a nil span.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:   parent.tracer,
+		ctx:      SpanContext{TraceID: parent.ctx.TraceID, SpanID: newSpanID(), Sampled: parent.ctx.Sampled, TraceState: parent.ctx.TraceState},
+		parentID: parent.ctx.SpanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// Inject sets the traceparent and tracestate headers of r to the span held by its context, so the service r is sent to continues the trace. If the context has no span, r is unchanged.
+func Inject(r *http.Request) {
+	span := FromContext(r.Context())
+	if span == nil {
+		return
+	}
+	r.Header.Set(TraceparentHeader, span.ctx.Traceparent())
+	if span.ctx.TraceState != "" {
+		r.Header.Set(TracestateHeader, span.ctx.TraceState)
+	} else {
+		r.Header.Del(TracestateHeader)
+	}
+}
+
+func newTraceID() TraceID {
+	id := TraceID{}
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	id := SpanID{}
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,163 @@
+package trace
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, ok := ParseTraceparent(valid, " vendor=abc ")
+	if !ok {
+		t.Fatalf("expected %v valid", valid)
+	}
+	if c.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || c.SpanID.String() != "00f067aa0ba902b7" || !c.Sampled || c.TraceState != "vendor=abc" {
+		t.Errorf("expected %v parsed, actual %+v", valid, c)
+	}
+	if c.Traceparent() != valid {
+		t.Errorf("expected traceparent %v, actual %v", valid, c.Traceparent())
+	}
+
+	if c, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future", ""); !ok || c.Sampled {
+		t.Errorf("expected future version with extra fields valid and unsampled, actual %v %+v", ok, c)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g",
+	} {
+		if _, ok := ParseTraceparent(invalid, ""); ok {
+			t.Errorf("expected '%v' invalid", invalid)
+		}
+	}
+}
+
+func TestTracerFileExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(exporter, []Attribute{{Key: "service.name", Value: "grove"}}, 0, time.Hour)
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodGet, "http://example.net/foo", nil)
+	r.Header.Set(TraceparentHeader, incoming)
+	r.Header.Set(TracestateHeader, "vendor=abc")
+	ctx, server := tracer.StartRequest(r, "grove request")
+	server.SetAttribute("grove.request_id", uint64(42))
+
+	_, child := Start(ctx, "parent request", SpanKindClient)
+	parentReq := httptest.NewRequest(http.MethodGet, "http://origin.example.net/foo", nil)
+	parentReq = parentReq.WithContext(ContextWithSpan(parentReq.Context(), child))
+	Inject(parentReq)
+	if expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + child.Context().SpanID.String() + "-01"; parentReq.Header.Get(TraceparentHeader) != expected {
+		t.Errorf("expected injected traceparent %v, actual %v", expected, parentReq.Header.Get(TraceparentHeader))
+	}
+	if parentReq.Header.Get(TracestateHeader) != "vendor=abc" {
+		t.Errorf("expected injected tracestate vendor=abc, actual %v", parentReq.Header.Get(TracestateHeader))
+	}
+	child.SetError("parent failed")
+	child.End()
+	server.End()
+
+	// an untraced request with a 0 sample ratio is unsampled, and not exported
+	_, unsampled := tracer.StartRequest(httptest.NewRequest(http.MethodGet, "http://example.net/bar", nil), "grove request")
+	if unsampled.Context().Sampled || !unsampled.Context().TraceID.IsValid() {
+		t.Errorf("expected new unsampled trace, actual %+v", unsampled.Context())
+	}
+	unsampled.End()
+
+	tracer.Close()
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 batch line, actual %v: %s", len(lines), body)
+	}
+	req := otlpRequest{}
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil {
+		t.Fatalf("unmarshalling OTLP JSON: %v", err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected 1 resource and scope, actual %+v", req)
+	}
+	if attrs := req.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || *attrs[0].Value.StringValue != "grove" {
+		t.Errorf("expected resource service.name grove, actual %+v", attrs)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, actual %+v", spans)
+	}
+	childSpan, serverSpan := spans[0], spans[1]
+	if serverSpan.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || serverSpan.ParentSpanID != "00f067aa0ba902b7" || serverSpan.Kind != SpanKindServer {
+		t.Errorf("expected server span continuing the incoming trace, actual %+v", serverSpan)
+	}
+	if childSpan.TraceID != serverSpan.TraceID || childSpan.ParentSpanID != serverSpan.SpanID || childSpan.Kind != SpanKindClient {
+		t.Errorf("expected client child of server span %v, actual %+v", serverSpan.SpanID, childSpan)
+	}
+	if childSpan.Status.Code != otlpStatusError || childSpan.Status.Message != "parent failed" {
+		t.Errorf("expected child error status, actual %+v", childSpan.Status)
+	}
+	if len(serverSpan.Attributes) != 1 || serverSpan.Attributes[0].Value.IntValue == nil || *serverSpan.Attributes[0].Value.IntValue != "42" {
+		t.Errorf("expected server request_id int attribute 42, actual %+v", serverSpan.Attributes)
+	}
+	if serverSpan.StartTimeUnixNano == "" || serverSpan.EndTimeUnixNano < serverSpan.StartTimeUnixNano {
+		t.Errorf("expected server span times, actual %v %v", serverSpan.StartTimeUnixNano, serverSpan.EndTimeUnixNano)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	tracer := (*Tracer)(nil)
+	r := httptest.NewRequest(http.MethodGet, "http://example.net/foo", nil)
+	ctx, span := tracer.StartRequest(r, "grove request")
+	if span != nil || FromContext(ctx) != nil {
+		t.Errorf("expected nil tracer to start no span")
+	}
+	span.SetAttribute("foo", "bar")
+	span.End()
+	if _, child := Start(ctx, "child", SpanKindInternal); child != nil {
+		t.Errorf("expected no child span of an untraced request")
+	}
+	Inject(r)
+	if r.Header.Get(TraceparentHeader) != "" {
+		t.Errorf("expected untraced request not injected, actual %v", r.Header.Get(TraceparentHeader))
+	}
+	tracer.Close()
+}
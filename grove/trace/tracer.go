@@ -0,0 +1,157 @@
+package trace
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// DefaultQueueSpans is the number of ended spans which may wait to be exported. Spans ended while the queue is full are dropped, so a slow exporter never blocks requests.
+const DefaultQueueSpans = 8192
+
+// DefaultBatchSpans is the maximum number of spans exported at once.
+const DefaultBatchSpans = 512
+
+// Tracer starts the spans of client requests, and exports them in batches, when a batch is full or every flush interval. It is safe for concurrent use.
+type Tracer struct {
+	exporter      Exporter
+	resource      []Attribute
+	sampleRatio   float64
+	flushInterval time.Duration
+	queue         chan *Span
+	done          chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+	dropped       uint64 // atomic
+}
+
+// NewTracer creates a Tracer, and starts exporting its spans to exporter. The resource attributes describe this Grove, e.g. its service.name. Requests without a sampled traceparent are sampled with the probability sampleRatio, from 0 to 1. Close must be called to export the remaining spans and stop exporting.
+func NewTracer(exporter Exporter, resource []Attribute, sampleRatio float64, flushInterval time.Duration) *Tracer {
+	t := &Tracer{
+		exporter:      exporter,
+		resource:      resource,
+		sampleRatio:   sampleRatio,
+		flushInterval: flushInterval,
+		queue:         make(chan *Span, DefaultQueueSpans),
+		done:          make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartRequest starts the server span of the given client request, continuing the trace of its traceparent header if it has a valid one, and otherwise starting a new trace. Returns a copy of the request's context holding the span. If t is nil, it returns the request's context and a nil span.
+func (t *Tracer) StartRequest(r *http.Request, name string) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	span := &Span{tracer: t, name: name, kind: SpanKindServer, start: time.Now()}
+	if parent, ok := ParseTraceparent(r.Header.Get(TraceparentHeader), r.Header.Get(TracestateHeader)); ok {
+		span.ctx = parent
+		span.parentID = parent.SpanID
+	} else {
+		span.ctx = SpanContext{TraceID: newTraceID(), Sampled: rand.Float64() < t.sampleRatio}
+	}
+	span.ctx.SpanID = newSpanID()
+	return ContextWithSpan(r.Context(), span), span
+}
+
+// Dropped returns the number of spans dropped because the export queue was full.
+func (t *Tracer) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Close exports the queued spans, and closes the exporter. Spans ended after Close are dropped.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.closeOnce.Do(func() {
+		close(t.done)
+		<-t.closed
+	})
+}
+
+func (t *Tracer) export(span *Span) {
+	select {
+	case <-t.done:
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case t.queue <- span:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// run exports the queued spans in batches, until the Tracer is closed.
+func (t *Tracer) run() {
+	defer close(t.closed)
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, DefaultBatchSpans)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		body, err := marshalOTLP(t.resource, batch)
+		if err == nil {
+			err = t.exporter.Export(body)
+		}
+		if err != nil {
+			log.Errorf("trace exporting %v spans: %v\n", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= DefaultBatchSpans {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+		drain:
+			for {
+				select {
+				case span := <-t.queue:
+					if batch = append(batch, span); len(batch) >= DefaultBatchSpans {
+						flush()
+					}
+				default:
+					break drain
+				}
+			}
+			flush()
+			if err := t.exporter.Close(); err != nil {
+				log.Errorln("trace closing exporter: " + err.Error())
+			}
+			return
+		}
+	}
+}
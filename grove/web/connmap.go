@@ -20,13 +20,15 @@ import (
 	// "github.com/apache/trafficcontrol/traffic_monitor_golang/common/log"
 )
 
+// ConnMap holds the active connections, i.e. those currently serving a request, by their remote address. It also counts the open connections of each client IP.
 type ConnMap struct {
-	conns map[string]net.Conn
-	m     sync.Mutex
+	conns     map[string]net.Conn
+	clientLen map[string]int
+	m         sync.Mutex
 }
 
 func NewConnMap() *ConnMap {
-	return &ConnMap{conns: map[string]net.Conn{}}
+	return &ConnMap{conns: map[string]net.Conn{}, clientLen: map[string]int{}}
 }
 
 func (cm *ConnMap) Add(conn net.Conn) {
@@ -56,3 +58,40 @@ func (cm *ConnMap) Len() int {
 	defer cm.m.Unlock()
 	return len(cm.conns)
 }
+
+// Open counts the given newly opened connection as open for its client IP.
+func (cm *ConnMap) Open(conn net.Conn) {
+	ip := remoteIP(conn)
+	cm.m.Lock()
+	defer cm.m.Unlock()
+	cm.clientLen[ip]++
+}
+
+// Close counts the given connection, previously passed to Open, as closed for its client IP.
+func (cm *ConnMap) Close(conn net.Conn) {
+	ip := remoteIP(conn)
+	cm.m.Lock()
+	defer cm.m.Unlock()
+	if cm.clientLen[ip] <= 1 {
+		delete(cm.clientLen, ip)
+		return
+	}
+	cm.clientLen[ip]--
+}
+
+// ClientLen returns the number of open connections from the given client IP, which may be active or idle.
+func (cm *ConnMap) ClientLen(ip string) int {
+	cm.m.Lock()
+	defer cm.m.Unlock()
+	return cm.clientLen[ip]
+}
+
+// remoteIP returns the IP of the remote address of conn, or the entire address if it has no port.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
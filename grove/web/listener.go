@@ -19,6 +19,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/ipv4"
@@ -35,7 +36,12 @@ type InterceptListener struct {
 func getConnStateCallback(connMap *ConnMap) func(net.Conn, http.ConnState) {
 	return func(conn net.Conn, state http.ConnState) {
 		switch state {
+		case http.StateNew:
+			connMap.Open(conn)
+		case http.StateHijacked:
+			connMap.Close(conn)
 		case http.StateClosed:
+			connMap.Close(conn)
 			fallthrough
 		case http.StateIdle:
 			if iconn, ok := conn.(*InterceptConn); !ok {
@@ -67,14 +73,10 @@ func InterceptListen(network, laddr string) (net.Listener, *ConnMap, func(net.Co
 }
 
 // InterceptListenTLS is like InterceptListen but for serving HTTPS. It returns the tls.Config, which must be set on the http.Server using this listener for HTTP/2 to be set up.
-func InterceptListenTLS(network string, laddr string, certs []tls.Certificate, h2Disabled bool) (net.Listener, *ConnMap, func(net.Conn, http.ConnState), *tls.Config, error) {
-	config := &tls.Config{}
-	// HTTP2 is enabled if config.DisableHTTP2 is false
-	if !h2Disabled {
-		config.NextProtos = []string{"h2"}
-	}
-	config.Certificates = certs
-	config.BuildNameToCertificate()
+// The certificates served are those currently in certs, which may be replaced while serving.
+func InterceptListenTLS(network string, laddr string, certs *Certs) (net.Listener, *ConnMap, func(net.Conn, http.ConnState), *tls.Config, error) {
+	config := certs.get().Clone()
+	config.GetConfigForClient = certs.getConfigForClient
 	l, err := net.Listen(network, laddr)
 	if err != nil {
 		return l, nil, nil, nil, err
@@ -86,6 +88,42 @@ func InterceptListenTLS(network string, laddr string, certs []tls.Certificate, h
 	return tlsListener, connMap, getConnStateCallback(connMap), config, nil
 }
 
+// Certs is the set of TLS certificates served by listeners created with InterceptListenTLS. The certificates may be replaced while listeners are serving, in order to load new certificates without restarting. It is safe for concurrent use.
+type Certs struct {
+	config atomic.Value // *tls.Config
+}
+
+// NewCerts creates a new Certs with the given certificates. If h2Disabled is false, HTTP/2 is negotiated with clients which support it.
+func NewCerts(certs []tls.Certificate, h2Disabled bool) *Certs {
+	c := &Certs{}
+	c.Set(certs, h2Disabled)
+	return c
+}
+
+// Set replaces the certificates, and whether HTTP/2 is negotiated. Handshakes already in progress use the old certificates, and all new handshakes use the new ones.
+func (c *Certs) Set(certs []tls.Certificate, h2Disabled bool) {
+	c.config.Store(newTLSConfig(certs, h2Disabled))
+}
+
+func (c *Certs) get() *tls.Config {
+	return c.config.Load().(*tls.Config)
+}
+
+func (c *Certs) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return c.get(), nil
+}
+
+func newTLSConfig(certs []tls.Certificate, h2Disabled bool) *tls.Config {
+	config := &tls.Config{}
+	// HTTP2 is enabled if config.DisableHTTP2 is false
+	if !h2Disabled {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	config.Certificates = certs
+	config.BuildNameToCertificate()
+	return config
+}
+
 func (l *InterceptListener) Accept() (net.Conn, error) {
 	c, err := l.realListener.Accept()
 	if err != nil {
@@ -0,0 +1,118 @@
+package web
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by the Accept of a SharedListener's Listener after it's closed.
+var ErrListenerClosed = errors.New("listener closed")
+
+// SharedListener accepts connections on a listener which outlives the servers serving it, so a server can be replaced without closing its port. Each server serves its own Listener, whose Close stops that server accepting, without closing the underlying listener.
+type SharedListener struct {
+	listener  net.Listener
+	accepted  chan acceptResult
+	closing   chan struct{}
+	done      chan struct{}
+	err       error // the error which stopped accepting, set before done is closed
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewSharedListener starts accepting connections on the given listener, which are passed to the Accept of its Listeners.
+func NewSharedListener(listener net.Listener) *SharedListener {
+	l := &SharedListener{
+		listener: listener,
+		accepted: make(chan acceptResult),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go l.accept()
+	return l
+}
+
+func (l *SharedListener) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+				l.err = err
+				close(l.done)
+				return
+			}
+		}
+		select {
+		case l.accepted <- acceptResult{conn: conn, err: err}:
+		case <-l.closing:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// Listener returns a new net.Listener which accepts connections from l. Closing it doesn't close l.
+func (l *SharedListener) Listener() net.Listener {
+	return &sharedListenerView{shared: l, closed: make(chan struct{})}
+}
+
+// Addr returns the address of the underlying listener.
+func (l *SharedListener) Addr() net.Addr { return l.listener.Addr() }
+
+// Close closes the underlying listener. Connections accepted but not yet passed to a Listener are closed.
+func (l *SharedListener) Close() error {
+	err := error(nil)
+	l.closeOnce.Do(func() {
+		close(l.closing)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+type sharedListenerView struct {
+	shared    *SharedListener
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (v *sharedListenerView) Accept() (net.Conn, error) {
+	select {
+	case <-v.closed:
+		return nil, ErrListenerClosed
+	default:
+	}
+	select {
+	case r := <-v.shared.accepted:
+		return r.conn, r.err
+	case <-v.shared.done:
+		return nil, v.shared.err
+	case <-v.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (v *sharedListenerView) Close() error {
+	v.closeOnce.Do(func() { close(v.closed) })
+	return nil
+}
+
+func (v *sharedListenerView) Addr() net.Addr { return v.shared.Addr() }
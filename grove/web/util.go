@@ -16,6 +16,7 @@ package web
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -109,25 +110,34 @@ func TryFlush(w http.ResponseWriter) {
 
 // request makes the given request and returns its response code, headers, body, the request time, response time, and any error.
 func Request(transport *http.Transport, r *http.Request) (int, http.Header, []byte, time.Time, time.Time, error) {
-	log.Debugf("request requesting %v headers %v\n", r.RequestURI, r.Header)
-	rr := r
-
-	reqTime := time.Now()
-	resp, err := transport.RoundTrip(rr)
-	respTime := time.Now()
+	code, header, respBody, _, reqTime, respTime, err := RequestStream(transport, r)
 	if err != nil {
-		return 0, nil, nil, reqTime, respTime, errors.New("request error: " + err.Error())
+		return 0, nil, nil, reqTime, respTime, err
 	}
-	defer resp.Body.Close()
+	defer respBody.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(respBody)
 	// TODO determine if respTime should go here
 
 	if err != nil {
 		return 0, nil, nil, reqTime, respTime, errors.New("reading response body: " + err.Error())
 	}
 
-	return resp.StatusCode, resp.Header, body, reqTime, respTime, nil
+	return code, header, body, reqTime, respTime, nil
+}
+
+// RequestStream makes the given request and returns its response code, headers, unread body, content length, the request time, response time, and any error. The content length is -1 if unknown. The response time is the time the headers were received. If err is nil, the caller must close the body.
+func RequestStream(transport *http.Transport, r *http.Request) (int, http.Header, io.ReadCloser, int64, time.Time, time.Time, error) {
+	log.Debugf("request requesting %v headers %v\n", r.RequestURI, r.Header)
+	rr := r
+
+	reqTime := time.Now()
+	resp, err := transport.RoundTrip(rr)
+	respTime := time.Now()
+	if err != nil {
+		return 0, nil, nil, 0, reqTime, respTime, errors.New("request error: " + err.Error())
+	}
+	return resp.StatusCode, resp.Header, resp.Body, resp.ContentLength, reqTime, respTime, nil
 }
 
 // Respond writes the given code, header, and body to the ResponseWriter. If connectionClose, a Connection: Close header is also written. Returns the bytes written, and any error.
@@ -145,6 +155,44 @@ func Respond(w http.ResponseWriter, code int, header http.Header, body []byte, c
 	return uint64(bytesWritten), err
 }
 
+// RespondStream writes the given code and header to the ResponseWriter, and then copies the body from the given reader as it arrives, flushing after each read so the client receives bytes as soon as they're available. If connectionClose, a Connection: Close header is also written. Returns the body bytes written, and any error reading or writing.
+func RespondStream(w http.ResponseWriter, code int, header http.Header, body io.Reader, connectionClose bool) (uint64, error) {
+	dH := w.Header()
+	CopyHeaderTo(header, &dH)
+	if connectionClose {
+		dH.Add("Connection", "close")
+	}
+	w.WriteHeader(code)
+
+	bytesWritten := uint64(0)
+	buf := make([]byte, StreamBufferBytes)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			written, err := w.Write(buf[:n])
+			bytesWritten += uint64(written)
+			if err != nil {
+				return bytesWritten, errors.New("writing: " + err.Error())
+			}
+			TryFlush(w)
+		}
+		if readErr == io.EOF {
+			return bytesWritten, nil
+		}
+		if readErr != nil {
+			return bytesWritten, errors.New("reading: " + readErr.Error())
+		}
+	}
+}
+
+// StreamBufferBytes is the size of the buffer used to read from parents and write to clients, when streaming.
+const StreamBufferBytes = 32 * 1024
+
+// BodyAllowed returns whether a response with the given code may have a body, per RFC7230§3.3.
+func BodyAllowed(code int) bool {
+	return !(code >= 100 && code < 200) && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
 // ServeReqErr writes the appropriate response to the client, via given writer, for a generic request error. Returns the code sent, the body bytes written, and any write error.
 func ServeReqErr(w http.ResponseWriter) (int, uint64, error) {
 	code := http.StatusBadRequest
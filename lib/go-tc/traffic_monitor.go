@@ -102,6 +102,7 @@ type TMParameters struct {
 	HistoryCount            int    `json:"history.count"`
 	MinFreeKbps             int64
 	Thresholds              map[string]HealthThreshold `json:"health_threshold"`
+	Rules                   map[string]HealthRule      `json:"health_rule"`
 }
 
 const DefaultHealthThresholdComparator = "<"
@@ -111,6 +112,18 @@ type HealthThreshold struct {
 	Comparator string // TODO change to enum?
 }
 
+// HealthRule is a threshold rule built from the `health.rule.<name>.` parameters of a profile. Down and Up are boolean expressions over stats, which are evaluated by Traffic Monitor.
+type HealthRule struct {
+	// Down is the expression which marks the cache unavailable, once it has held for the Polls and Seconds.
+	Down string
+	// Up is the expression which marks the cache available again, once it has held for the Polls and Seconds. If empty, the negation of Down is used.
+	Up string
+	// Polls is the number of consecutive polls an expression must hold for. It is always at least 1.
+	Polls int
+	// Seconds is the length of time an expression must hold for. If 0, only Polls is used.
+	Seconds float64
+}
+
 // strToThreshold takes a string like ">=42" and returns a HealthThreshold with a Val of `42` and a Comparator of `">="`. If no comparator exists, `DefaultHealthThresholdComparator` is used. If the string is not of the form "(>|<|)(=|)\d+" an error is returned
 func strToThreshold(s string) (HealthThreshold, error) {
 	comparators := []string{"=", ">", "<", ">=", "<="}
@@ -189,6 +202,51 @@ func (params *TMParameters) UnmarshalJSON(bytes []byte) (err error) {
 			}
 		}
 	}
+
+	params.Rules = map[string]HealthRule{}
+	rulePrefix := "health.rule."
+	for k, v := range raw {
+		if !strings.HasPrefix(k, rulePrefix) {
+			continue
+		}
+		dot := strings.LastIndex(k, ".")
+		if dot <= len(rulePrefix) {
+			return fmt.Errorf("Unmarshalling TMParameters `health.rule.` parameter '%s' not of the form `health.rule.<name>.(down|up|polls|seconds)`", k)
+		}
+		name := k[len(rulePrefix):dot]
+		rule := params.Rules[name]
+		vStr := fmt.Sprintf("%v", v) // allows string or numeric JSON types.
+		switch field := k[dot+1:]; field {
+		case "down":
+			rule.Down = vStr
+		case "up":
+			rule.Up = vStr
+		case "polls":
+			polls, err := strconv.Atoi(vStr)
+			if err != nil || polls < 1 {
+				return fmt.Errorf("Unmarshalling TMParameters '%s' expected positive integer, got %v", k, v)
+			}
+			rule.Polls = polls
+		case "seconds":
+			seconds, err := strconv.ParseFloat(vStr, 64)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("Unmarshalling TMParameters '%s' expected non-negative number, got %v", k, v)
+			}
+			rule.Seconds = seconds
+		default:
+			return fmt.Errorf("Unmarshalling TMParameters `health.rule.` parameter '%s' has unknown field '%s'", k, field)
+		}
+		params.Rules[name] = rule
+	}
+	for name, rule := range params.Rules {
+		if rule.Down == "" {
+			return fmt.Errorf("Unmarshalling TMParameters `health.rule.%s` missing required `health.rule.%s.down` parameter", name, name)
+		}
+		if rule.Polls == 0 {
+			rule.Polls = 1
+			params.Rules[name] = rule
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,535 @@
+package cache
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// openmetrics is the Stats format of the OpenMetrics and Prometheus text
+// exposition formats, served by the Prometheus node_exporter, Grove's
+// http_metrics plugin, and nginx exporters, among others.
+//
+// Samples are of the form `name{label="value",...} value [timestamp]`, and
+// are mapped to the Statistics by a config.OpenMetricsFormat. The
+// "openmetrics" format maps node_exporter's system metrics and Grove's remap
+// metrics; other mappings are configured in traffic_monitor.cfg, and
+// registered with RegisterOpenMetricsFormats.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+const OpenMetricsFormatName = "openmetrics"
+
+func init() {
+	parse, precompute, err := newOpenMetricsDecoder(config.DefaultOpenMetricsFormat)
+	if err != nil {
+		panic("creating default openmetrics decoder: " + err.Error()) // the default format is constant, so this is a programming error
+	}
+	registerDecoder(OpenMetricsFormatName, parse, precompute)
+}
+
+// RegisterOpenMetricsFormats registers a decoder for each of the given
+// OpenMetrics formats, under its name. It returns an error if a format is
+// invalid, or its name is already registered. This must be called before
+// polling starts, because decoders aren't safe to register concurrently.
+func RegisterOpenMetricsFormats(formats map[string]config.OpenMetricsFormat) error {
+	for name, format := range formats {
+		if _, ok := statDecoders[name]; ok {
+			return errors.New("openmetrics format '" + name + "' is already a registered format")
+		}
+		parse, precompute, err := newOpenMetricsDecoder(format)
+		if err != nil {
+			return errors.New("openmetrics format '" + name + "': " + err.Error())
+		}
+		registerDecoder(name, parse, precompute)
+	}
+	return nil
+}
+
+// openMetricsSample is a single sample of an OpenMetrics series.
+type openMetricsSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// openMetricsSelector selects the series of a metric, which have all of its labels.
+type openMetricsSelector struct {
+	Name   string
+	Labels map[string]string
+}
+
+// Matches returns whether the selector is set, and the given series has its name and labels.
+func (s openMetricsSelector) Matches(name string, labels map[string]string) bool {
+	if s.Name == "" || s.Name != name {
+		return false
+	}
+	for label, val := range s.Labels {
+		if labels[label] != val {
+			return false
+		}
+	}
+	return true
+}
+
+func parseOpenMetricsSelector(selector string) (openMetricsSelector, error) {
+	if selector == "" {
+		return openMetricsSelector{}, nil
+	}
+	name, labels, rest, err := parseOpenMetricsSeries(selector)
+	if err != nil {
+		return openMetricsSelector{}, fmt.Errorf("parsing selector '%s': %v", selector, err)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return openMetricsSelector{}, fmt.Errorf("parsing selector '%s': unexpected '%s' after labels", selector, rest)
+	}
+	return openMetricsSelector{Name: name, Labels: labels}, nil
+}
+
+// openMetricsDecoder is the parsed config.OpenMetricsFormat of an openmetrics decoder.
+type openMetricsDecoder struct {
+	LoadavgOne     openMetricsSelector
+	LoadavgFive    openMetricsSelector
+	LoadavgFifteen openMetricsSelector
+	Processes      openMetricsSelector
+	NotAvailable   openMetricsSelector
+
+	InterfaceLabel           string
+	InterfaceBytesIn         openMetricsSelector
+	InterfaceBytesOut        openMetricsSelector
+	InterfaceSpeed           openMetricsSelector
+	InterfaceSpeedMultiplier float64
+	IgnoreInterfaces         map[string]struct{}
+
+	DeliveryServiceLabel       string
+	DeliveryServiceLabelType   string
+	DeliveryServiceInBytes     openMetricsSelector
+	DeliveryServiceOutBytes    openMetricsSelector
+	DeliveryServiceResponses   openMetricsSelector
+	DeliveryServiceStatusLabel string
+
+	Stats []openMetricsSelector
+}
+
+func newOpenMetricsDecoder(format config.OpenMetricsFormat) (StatisticsParser, StatisticsPrecomputer, error) {
+	d := openMetricsDecoder{
+		InterfaceLabel:             format.InterfaceLabel,
+		InterfaceSpeedMultiplier:   format.InterfaceSpeedMultiplier,
+		IgnoreInterfaces:           map[string]struct{}{},
+		DeliveryServiceLabel:       format.DeliveryServiceLabel,
+		DeliveryServiceLabelType:   format.DeliveryServiceLabelType,
+		DeliveryServiceStatusLabel: format.DeliveryServiceStatusLabel,
+	}
+	selectors := []struct {
+		selector *openMetricsSelector
+		str      string
+	}{
+		{&d.LoadavgOne, format.LoadavgOne},
+		{&d.LoadavgFive, format.LoadavgFive},
+		{&d.LoadavgFifteen, format.LoadavgFifteen},
+		{&d.Processes, format.Processes},
+		{&d.NotAvailable, format.NotAvailable},
+		{&d.InterfaceBytesIn, format.InterfaceBytesIn},
+		{&d.InterfaceBytesOut, format.InterfaceBytesOut},
+		{&d.InterfaceSpeed, format.InterfaceSpeed},
+		{&d.DeliveryServiceInBytes, format.DeliveryServiceInBytes},
+		{&d.DeliveryServiceOutBytes, format.DeliveryServiceOutBytes},
+		{&d.DeliveryServiceResponses, format.DeliveryServiceResponses},
+	}
+	for _, s := range selectors {
+		selector, err := parseOpenMetricsSelector(s.str)
+		if err != nil {
+			return nil, nil, err
+		}
+		*s.selector = selector
+	}
+	for _, str := range format.Stats {
+		selector, err := parseOpenMetricsSelector(str)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.Stats = append(d.Stats, selector)
+	}
+	for _, iface := range format.IgnoreInterfaces {
+		d.IgnoreInterfaces[iface] = struct{}{}
+	}
+
+	if d.LoadavgOne.Name == "" {
+		return nil, nil, errors.New("loadavg_one is required")
+	}
+	if d.InterfaceLabel == "" || d.InterfaceBytesIn.Name == "" || d.InterfaceBytesOut.Name == "" {
+		return nil, nil, errors.New("interface_label, interface_bytes_in and interface_bytes_out are required")
+	}
+	hasDSMetrics := d.DeliveryServiceInBytes.Name != "" || d.DeliveryServiceOutBytes.Name != "" || d.DeliveryServiceResponses.Name != ""
+	if hasDSMetrics && d.DeliveryServiceLabel == "" {
+		return nil, nil, errors.New("delivery_service_label is required with delivery service metrics")
+	}
+	if d.DeliveryServiceResponses.Name != "" && d.DeliveryServiceStatusLabel == "" {
+		return nil, nil, errors.New("delivery_service_status_label is required with delivery_service_responses")
+	}
+	if d.DeliveryServiceLabelType != config.OpenMetricsLabelTypeFQDN && d.DeliveryServiceLabelType != config.OpenMetricsLabelTypeXMLID {
+		return nil, nil, fmt.Errorf("delivery_service_label_type must be '%s' or '%s', was '%s'", config.OpenMetricsLabelTypeFQDN, config.OpenMetricsLabelTypeXMLID, d.DeliveryServiceLabelType)
+	}
+	return d.Parse, d.Precompute, nil
+}
+
+// isDSStat returns whether the series is one of the Delivery Service metrics, which are passed to Precompute in the miscellaneous stats.
+func (d openMetricsDecoder) isDSStat(name string, labels map[string]string) bool {
+	return d.DeliveryServiceInBytes.Matches(name, labels) || d.DeliveryServiceOutBytes.Matches(name, labels) || d.DeliveryServiceResponses.Matches(name, labels)
+}
+
+// Parse parses the OpenMetrics text, returning the system stats, and the miscellaneous stats of the Delivery Service metrics and configured Stats, named by their series.
+func (d openMetricsDecoder) Parse(cacheName string, data io.Reader) (Statistics, map[string]interface{}, error) {
+	stats := Statistics{Interfaces: map[string]Interface{}}
+	if data == nil {
+		log.Warnf("Cannot read stats data for cache '%s' - nil data reader", cacheName)
+		return stats, nil, errors.New("handler got nil reader")
+	}
+
+	samples, err := parseOpenMetrics(data)
+	if err != nil {
+		return stats, nil, fmt.Errorf("parsing openmetrics for cache '%s': %v", cacheName, err)
+	}
+
+	misc := map[string]interface{}{}
+	foundLoadavg := false
+	for _, sample := range samples {
+		switch {
+		case d.LoadavgOne.Matches(sample.Name, sample.Labels):
+			stats.Loadavg.One = sample.Value
+			foundLoadavg = true
+		case d.LoadavgFive.Matches(sample.Name, sample.Labels):
+			stats.Loadavg.Five = sample.Value
+		case d.LoadavgFifteen.Matches(sample.Name, sample.Labels):
+			stats.Loadavg.Fifteen = sample.Value
+		case d.Processes.Matches(sample.Name, sample.Labels):
+			stats.Loadavg.CurrentProcesses = openMetricsUint(sample.Value)
+		case d.NotAvailable.Matches(sample.Name, sample.Labels):
+			stats.NotAvailable = sample.Value != 0
+		case d.InterfaceBytesIn.Matches(sample.Name, sample.Labels):
+			if name, ok := d.interfaceName(sample); ok {
+				iface := stats.Interfaces[name]
+				iface.BytesIn = openMetricsUint(sample.Value)
+				stats.Interfaces[name] = iface
+			}
+		case d.InterfaceBytesOut.Matches(sample.Name, sample.Labels):
+			if name, ok := d.interfaceName(sample); ok {
+				iface := stats.Interfaces[name]
+				iface.BytesOut = openMetricsUint(sample.Value)
+				stats.Interfaces[name] = iface
+			}
+		case d.InterfaceSpeed.Matches(sample.Name, sample.Labels):
+			if name, ok := d.interfaceName(sample); ok {
+				iface := stats.Interfaces[name]
+				iface.Speed = int64(openMetricsUint(sample.Value * d.InterfaceSpeedMultiplier))
+				stats.Interfaces[name] = iface
+			}
+		case d.isDSStat(sample.Name, sample.Labels):
+			misc[openMetricsSeriesName(sample.Name, sample.Labels)] = sample.Value
+		default:
+			for _, selector := range d.Stats {
+				if selector.Matches(sample.Name, sample.Labels) {
+					misc[openMetricsSeriesName(sample.Name, sample.Labels)] = sample.Value
+					break
+				}
+			}
+		}
+	}
+
+	if !foundLoadavg {
+		return stats, nil, fmt.Errorf("cache '%s' had no loadavg metric '%s'", cacheName, d.LoadavgOne.Name)
+	}
+	if len(stats.Interfaces) < 1 {
+		return stats, nil, fmt.Errorf("cache '%s' had no interfaces", cacheName)
+	}
+	return stats, misc, nil
+}
+
+// interfaceName returns the interface of the given interface metric sample, and false if it has none, or is ignored.
+func (d openMetricsDecoder) interfaceName(sample openMetricsSample) (string, bool) {
+	name := sample.Labels[d.InterfaceLabel]
+	if name == "" {
+		log.Warnf("openmetrics interface metric '%s' has no '%s' label", openMetricsSeriesName(sample.Name, sample.Labels), d.InterfaceLabel)
+		return "", false
+	}
+	_, ignored := d.IgnoreInterfaces[name]
+	return name, !ignored
+}
+
+// openMetricsUint returns the sample value as a uint64. Negative and NaN values, which counters and gauges of bytes and speeds can't have, are 0.
+func openMetricsUint(val float64) uint64 {
+	if math.IsNaN(val) || val < 0 {
+		return 0
+	}
+	if val >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(val)
+}
+
+// Precompute sums the Delivery Service metrics in the miscellaneous stats into the stats of each Delivery Service.
+func (d openMetricsDecoder) Precompute(cacheName string, data todata.TOData, stats Statistics, miscStats map[string]interface{}) PrecomputedData {
+	precomputed := PrecomputedData{DeliveryServiceStats: map[string]*DSStat{}}
+	for _, iface := range stats.Interfaces {
+		precomputed.OutBytes += iface.BytesOut
+		if kbps := iface.Speed * 1000; kbps > precomputed.MaxKbps {
+			precomputed.MaxKbps = kbps
+		}
+	}
+
+	for stat, value := range miscStats {
+		name, labels, _, err := parseOpenMetricsSeries(stat)
+		if err != nil || !d.isDSStat(name, labels) {
+			continue // not a DS stat, but one of the configured Stats
+		}
+		val, ok := value.(float64)
+		if !ok {
+			continue // should never happen, the parser only creates float64 values
+		}
+
+		ds, err := d.deliveryService(data, labels[d.DeliveryServiceLabel])
+		if err != nil {
+			log.Infof("precomputing cache %s stat %s value %v error %v", cacheName, stat, value, err)
+			precomputed.Errors = append(precomputed.Errors, err)
+			continue
+		}
+
+		dsStat := precomputed.DeliveryServiceStats[ds]
+		if dsStat == nil {
+			dsStat = &DSStat{}
+			precomputed.DeliveryServiceStats[ds] = dsStat
+		}
+
+		switch {
+		case d.DeliveryServiceInBytes.Matches(name, labels):
+			dsStat.InBytes += openMetricsUint(val)
+		case d.DeliveryServiceOutBytes.Matches(name, labels):
+			dsStat.OutBytes += openMetricsUint(val)
+		case d.DeliveryServiceResponses.Matches(name, labels):
+			code := labels[d.DeliveryServiceStatusLabel]
+			if code == "" {
+				err := fmt.Errorf("responses stat has no '%s' label", d.DeliveryServiceStatusLabel)
+				log.Infof("precomputing cache %s stat %s value %v error %v", cacheName, stat, value, err)
+				precomputed.Errors = append(precomputed.Errors, err)
+				continue
+			}
+			switch code[0] {
+			case '2':
+				dsStat.Status2xx += openMetricsUint(val)
+			case '3':
+				dsStat.Status3xx += openMetricsUint(val)
+			case '4':
+				dsStat.Status4xx += openMetricsUint(val)
+			case '5':
+				dsStat.Status5xx += openMetricsUint(val)
+			}
+		}
+	}
+	return precomputed
+}
+
+// deliveryService returns the Delivery Service of the given DeliveryServiceLabel value.
+func (d openMetricsDecoder) deliveryService(data todata.TOData, labelVal string) (string, error) {
+	if labelVal == "" {
+		return "", fmt.Errorf("stat has no '%s' label", d.DeliveryServiceLabel)
+	}
+	if d.DeliveryServiceLabelType == config.OpenMetricsLabelTypeXMLID {
+		if _, ok := data.DeliveryServiceTypes[tc.DeliveryServiceName(labelVal)]; !ok {
+			return "", fmt.Errorf("No Delivery Service '%s'", labelVal)
+		}
+		return labelVal, nil
+	}
+
+	fqdn := labelVal
+	if i := strings.LastIndex(fqdn, ":"); i >= 0 && !strings.Contains(fqdn[i:], "]") {
+		fqdn = fqdn[:i] // remove any port
+	}
+	fqdnParts := strings.SplitN(fqdn, ".", 3)
+	if len(fqdnParts) < 3 {
+		return "", fmt.Errorf("stat '%s' label '%s' is not a Delivery Service FQDN", d.DeliveryServiceLabel, labelVal)
+	}
+	ds, ok := data.DeliveryServiceRegexes.DeliveryService(fqdnParts[2], fqdnParts[1], fqdnParts[0])
+	if !ok {
+		return "", errors.New("No Delivery Service match for stat")
+	}
+	if ds == "" {
+		return "", errors.New("Empty Delivery Service FQDN")
+	}
+	return string(ds), nil
+}
+
+// parseOpenMetrics parses the samples of the OpenMetrics or Prometheus text format. Comments, including HELP and TYPE metadata, are skipped, as are timestamps and exemplars.
+func parseOpenMetrics(r io.Reader) ([]openMetricsSample, error) {
+	samples := []openMetricsSample{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, rest, err := parseOpenMetricsSeries(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if i := strings.Index(rest, "#"); i >= 0 {
+			rest = rest[:i] // remove any exemplar
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 1 || len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a value and optional timestamp after the series, got '%s'", lineNum, rest)
+		}
+		val, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parsing value: %v", lineNum, err)
+		}
+		samples = append(samples, openMetricsSample{Name: name, Labels: labels, Value: val})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// parseOpenMetricsSeries parses the metric name and labels at the start of s, returning them and the rest of s.
+func parseOpenMetricsSeries(s string) (string, map[string]string, string, error) {
+	nameEnd := strings.IndexAny(s, "{ \t")
+	if nameEnd < 0 {
+		nameEnd = len(s)
+	}
+	name := s[:nameEnd]
+	if !isOpenMetricsName(name, true) {
+		return "", nil, "", fmt.Errorf("invalid metric name '%s'", name)
+	}
+	s = s[nameEnd:]
+	labels := map[string]string{}
+	if !strings.HasPrefix(s, "{") {
+		return name, labels, s, nil
+	}
+	s = s[1:]
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return name, labels, s[1:], nil
+		}
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			return "", nil, "", fmt.Errorf("metric '%s' label has no '='", name)
+		}
+		label := strings.TrimSpace(s[:eq])
+		if !isOpenMetricsName(label, false) {
+			return "", nil, "", fmt.Errorf("metric '%s' has invalid label name '%s'", name, label)
+		}
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return "", nil, "", fmt.Errorf("metric '%s' label '%s' value is not quoted", name, label)
+		}
+		val, n, err := parseOpenMetricsLabelValue(s[1:])
+		if err != nil {
+			return "", nil, "", fmt.Errorf("metric '%s' label '%s': %v", name, label, err)
+		}
+		labels[label] = val
+		s = strings.TrimLeft(s[1+n:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return "", nil, "", fmt.Errorf("metric '%s' labels are not terminated", name)
+		}
+	}
+}
+
+// parseOpenMetricsLabelValue parses the escaped label value at the start of s, which must follow its opening quote. It returns the value, and the length of s it took, including the closing quote.
+func parseOpenMetricsLabelValue(s string) (string, int, error) {
+	val := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return val.String(), i + 1, nil
+		case '\\':
+			if i++; i >= len(s) {
+				return "", 0, errors.New("value ends in an escape")
+			}
+			switch s[i] {
+			case 'n':
+				val.WriteByte('\n')
+			case '\\', '"':
+				val.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("value has invalid escape '\\%c'", s[i])
+			}
+		default:
+			val.WriteByte(s[i])
+		}
+	}
+	return "", 0, errors.New("value has no closing quote")
+}
+
+// isOpenMetricsName returns whether s is a valid metric name, or label name if metric is false, which can't have colons.
+func isOpenMetricsName(s string, metric bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case c == ':' && metric:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// openMetricsSeriesName returns the name of the series with the given metric name and labels, with the labels sorted, e.g. `foo_total{a="1",b="2"}`.
+func openMetricsSeriesName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	labelNames := make([]string, 0, len(labels))
+	for label := range labels {
+		labelNames = append(labelNames, label)
+	}
+	sort.Strings(labelNames)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	series := strings.Builder{}
+	series.WriteString(name)
+	series.WriteString("{")
+	for i, label := range labelNames {
+		if i > 0 {
+			series.WriteString(",")
+		}
+		series.WriteString(label + `="` + escaper.Replace(labels[label]) + `"`)
+	}
+	series.WriteString("}")
+	return series.String()
+}
@@ -0,0 +1,185 @@
+package cache
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+
+	"github.com/json-iterator/go"
+)
+
+const testOpenMetrics = `# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.25
+node_load5 0.5
+node_load15 0.75
+node_procs_running 3
+# TYPE node_network_receive_bytes_total counter
+node_network_receive_bytes_total{device="eth0"} 1.2345e+06
+node_network_receive_bytes_total{device="lo"} 999
+node_network_transmit_bytes_total{device="eth0"} 7654321 1700000000000
+node_network_transmit_bytes_total{device="lo"} 999
+node_network_speed_bytes{device="eth0"} 1.25e+09
+node_memory_MemAvailable_bytes 4096
+grove_remap_in_bytes_total{remap="edge.ds1.example.net"} 100
+grove_remap_out_bytes_total{remap="edge.ds1.example.net:8080"} 2000
+grove_remap_out_bytes_total{remap="edge.nods.example.net"} 5
+grove_remap_responses_total{remap="edge.ds1.example.net",code="2xx"} 10 # {trace_id="abc"} 1
+grove_remap_responses_total{remap="edge.ds1.example.net",code="5xx"} 2
+grove_remap_responses_total{code="4xx", remap="edge.ds1.example.net" } 3
+# EOF
+`
+
+func TestOpenMetricsParse(t *testing.T) {
+	decoder, err := GetDecoder(OpenMetricsFormatName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, misc, err := decoder.Parse("test", strings.NewReader(testOpenMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Loadavg.One != 0.25 || stats.Loadavg.Five != 0.5 || stats.Loadavg.Fifteen != 0.75 || stats.Loadavg.CurrentProcesses != 3 {
+		t.Errorf("Incorrect loadavg, expected 0.25 0.5 0.75 3, got %+v", stats.Loadavg)
+	}
+	if len(stats.Interfaces) != 1 {
+		t.Fatalf("Expected exactly one interface, lo ignored, got %+v", stats.Interfaces)
+	}
+	if iface := stats.Interfaces["eth0"]; iface.BytesIn != 1234500 || iface.BytesOut != 7654321 || iface.Speed != 10000 {
+		t.Errorf("Incorrect eth0, expected in 1234500 out 7654321 speed 10000, got %+v", iface)
+	}
+	if _, ok := misc["node_memory_MemAvailable_bytes"]; ok {
+		t.Errorf("Expected unconfigured stat not in miscellaneous stats")
+	}
+	if val := misc[`grove_remap_responses_total{code="4xx",remap="edge.ds1.example.net"}`]; val != float64(3) {
+		t.Errorf("Expected responses stat with sorted labels 3, got %v in %+v", val, misc)
+	}
+
+	toData := *todata.New()
+	toData.DeliveryServiceRegexes.DirectMatches["edge.ds1.example.net"] = "ds1"
+	precomputed := decoder.Precompute("test", toData, stats, misc)
+	if precomputed.OutBytes != 7654321 || precomputed.MaxKbps != 10000000 {
+		t.Errorf("Incorrect precomputed interface data, expected out 7654321 max kbps 10000000, got %v %v", precomputed.OutBytes, precomputed.MaxKbps)
+	}
+	ds1, ok := precomputed.DeliveryServiceStats["ds1"]
+	if !ok || len(precomputed.DeliveryServiceStats) != 1 {
+		t.Fatalf("Expected only ds1 stats, got %+v", precomputed.DeliveryServiceStats)
+	}
+	if *ds1 != (DSStat{InBytes: 100, OutBytes: 2000, Status2xx: 10, Status4xx: 3, Status5xx: 2}) {
+		t.Errorf("Incorrect ds1 stats, got %+v", *ds1)
+	}
+	if len(precomputed.Errors) != 1 {
+		t.Errorf("Expected 1 error for the unmatched Delivery Service, got %v", precomputed.Errors)
+	}
+}
+
+func TestOpenMetricsFormats(t *testing.T) {
+	cfg := config.Config{}
+	json := jsoniter.ConfigFastest
+	err := json.Unmarshal([]byte(`{"openmetrics_formats": {"test-nginx-vts": {
+		"loadavg_one": "nginx_load{period=\"1m\"}",
+		"processes": "",
+		"interface_label": "if",
+		"interface_bytes_in": "nginx_if_bytes_total{direction=\"in\"}",
+		"interface_bytes_out": "nginx_if_bytes_total{direction=\"out\"}",
+		"interface_speed": "nginx_if_speed_mbps",
+		"interface_speed_multiplier": 1,
+		"delivery_service_label": "ds",
+		"delivery_service_label_type": "xml_id",
+		"delivery_service_out_bytes": "nginx_vts_server_bytes_total{direction=\"out\"}",
+		"delivery_service_responses": "nginx_vts_server_requests_total",
+		"stats": ["nginx_connections{state=\"active\"}"]
+	}}}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := cfg.OpenMetricsFormats["test-nginx-vts"]; format.LoadavgFive != config.DefaultOpenMetricsFormat.LoadavgFive || format.Processes != "" || format.DeliveryServiceStatusLabel != "code" {
+		t.Errorf("Expected omitted settings default and empty settings disabled, got %+v", format)
+	}
+	if err := RegisterOpenMetricsFormats(cfg.OpenMetricsFormats); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterOpenMetricsFormats(cfg.OpenMetricsFormats); err == nil {
+		t.Errorf("Expected registering an existing format name to fail")
+	}
+
+	decoder, err := GetDecoder("test-nginx-vts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, misc, err := decoder.Parse("test", strings.NewReader(`
+nginx_load{period="1m"} 1.5
+nginx_if_bytes_total{if="bond0",direction="in"} 10
+nginx_if_bytes_total{if="bond0",direction="out"} 20
+nginx_if_speed_mbps{if="bond0"} 40000
+nginx_connections{state="active"} 7
+nginx_connections{state="reading"} 1
+nginx_vts_server_bytes_total{ds="ds1",direction="in"} 1
+nginx_vts_server_bytes_total{ds="ds1",direction="out"} 30
+nginx_vts_server_requests_total{ds="ds1",code="200"} 4
+nginx_vts_server_requests_total{ds="ds1",code="total"} 4
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Loadavg.One != 1.5 || stats.Interfaces["bond0"] != (Interface{Speed: 40000, BytesIn: 10, BytesOut: 20}) {
+		t.Errorf("Incorrect stats, got %+v", stats)
+	}
+	if len(misc) != 4 || misc[`nginx_connections{state="active"}`] != float64(7) {
+		t.Errorf("Expected 3 DS stats and 1 configured stat, got %+v", misc)
+	}
+
+	toData := *todata.New()
+	toData.DeliveryServiceTypes["ds1"] = tc.DSTypeCategoryHTTP
+	precomputed := decoder.Precompute("test", toData, stats, misc)
+	if ds1 := precomputed.DeliveryServiceStats["ds1"]; ds1 == nil || *ds1 != (DSStat{OutBytes: 30, Status2xx: 4}) {
+		t.Errorf("Incorrect ds1 stats, got %+v", precomputed.DeliveryServiceStats)
+	}
+}
+
+func TestOpenMetricsParseInvalid(t *testing.T) {
+	decoder, err := GetDecoder(OpenMetricsFormatName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{
+		"node_load1 notanumber\n",
+		"node_load1{a=\"b} 1\n",
+		"node_load1{a=b} 1\n",
+		"1node_load 1\n",
+		"node_load1 1 2 3\n",
+		"node_load5 1\nnode_network_receive_bytes_total{device=\"eth0\"} 1\n",
+		"node_load1 1\nnode_network_receive_bytes_total{device=\"lo\"} 1\n",
+	} {
+		if _, _, err := decoder.Parse("test", strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected error parsing '%s'", invalid)
+		}
+	}
+
+	if _, _, err := newOpenMetricsDecoder(config.OpenMetricsFormat{}); err == nil {
+		t.Errorf("Expected error creating a decoder with no loadavg")
+	}
+}
@@ -93,6 +93,57 @@ func (t *PollingProtocol) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// PeerConsensus is how the health states of this Traffic Monitor and its peers are combined.
+type PeerConsensus string
+
+const (
+	// PeerConsensusOptimistic marks a cache available if this Traffic Monitor or any peer says it's available.
+	PeerConsensusOptimistic = PeerConsensus("optimistic")
+	// PeerConsensusMajority marks a cache available if more Traffic Monitors say it's available than unavailable.
+	PeerConsensusMajority = PeerConsensus("majority")
+	// PeerConsensusCacheGroup is like PeerConsensusMajority, but the votes of Traffic Monitors in the cache's own cache group are weighted by PeerConsensusCGWeight, and other votes have a weight of 1.
+	PeerConsensusCacheGroup = PeerConsensus("cachegroup")
+	// PeerConsensusDistance is like PeerConsensusMajority, but the votes of Traffic Monitors are weighted by the distance of their cache group from the cache's, halving at PeerConsensusDistanceKm.
+	PeerConsensusDistance = PeerConsensus("distance")
+	InvalidPeerConsensus  = PeerConsensus("invalid_peer_consensus")
+)
+
+// String returns a string representation of this PeerConsensus.
+func (t PeerConsensus) String() string {
+	return string(t)
+}
+
+// PeerConsensusFromString returns a PeerConsensus based on the string input.
+func PeerConsensusFromString(s string) PeerConsensus {
+	s = strings.ToLower(s)
+	switch s {
+	case PeerConsensusOptimistic.String():
+		return PeerConsensusOptimistic
+	case PeerConsensusMajority.String():
+		return PeerConsensusMajority
+	case PeerConsensusCacheGroup.String():
+		return PeerConsensusCacheGroup
+	case PeerConsensusDistance.String():
+		return PeerConsensusDistance
+	default:
+		return InvalidPeerConsensus
+	}
+}
+
+// UnmarshalJSON implements the json.Unmarshaller interface
+func (t *PeerConsensus) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	*t = PeerConsensusFromString(s)
+	if *t == InvalidPeerConsensus {
+		return errors.New("parsed invalid PeerConsensus: " + s)
+	}
+	return nil
+}
+
 // Config is the configuration for the application. It includes myriad data, such as polling intervals and log locations.
 type Config struct {
 	CacheHealthPollingInterval   time.Duration   `json:"-"`
@@ -125,6 +176,20 @@ type Config struct {
 	TrafficOpsDiskRetryMax       uint64          `json:"-"`
 	CachePollingProtocol         PollingProtocol `json:"cache_polling_protocol"`
 	PeerPollingProtocol          PollingProtocol `json:"peer_polling_protocol"`
+	CRStatesStreamHistory        uint64          `json:"crstates_stream_history"`
+	PeerConsensus                PeerConsensus   `json:"peer_consensus"`
+	PeerConsensusCGWeight        float64         `json:"peer_consensus_cachegroup_weight"`
+	PeerConsensusDistanceKm      float64         `json:"peer_consensus_distance_km"`
+	PeerMaxPollAge               time.Duration   `json:"-"`
+	HistoryDBPath                string          `json:"history_db_path"`
+	HistoryDBStatRetention       time.Duration   `json:"-"`
+	HistoryDBEventRetention      time.Duration   `json:"-"`
+	// OpenMetricsFormats are stats formats for cache servers with OpenMetrics or Prometheus text stats, in addition to the default "openmetrics" format. The map key is the format name, which is used as a Profile's health.polling.format Parameter.
+	OpenMetricsFormats map[string]OpenMetricsFormat `json:"openmetrics_formats"`
+	// DSProbes are synthetic health checks of Delivery Services, requested through each of their cache servers. The map key is the Delivery Service's name.
+	DSProbes map[string]DSProbe `json:"ds_probes"`
+	// Notifications configures pushing events, such as cache availability changes, to webhooks.
+	Notifications Notifications `json:"notifications"`
 }
 
 func (c Config) ErrorLog() log.LogLocation   { return log.LogLocation(c.LogLocationError) }
@@ -165,6 +230,15 @@ var DefaultConfig = Config{
 	TrafficOpsDiskRetryMax:       2,
 	CachePollingProtocol:         Both,
 	PeerPollingProtocol:          Both,
+	CRStatesStreamHistory:        1000,
+	PeerConsensus:                PeerConsensusOptimistic,
+	PeerConsensusCGWeight:        2,
+	PeerConsensusDistanceKm:      1000,
+	PeerMaxPollAge:               30 * time.Second,
+	HistoryDBPath:                "",
+	HistoryDBStatRetention:       24 * time.Hour,
+	HistoryDBEventRetention:      30 * 24 * time.Hour,
+	Notifications:                DefaultNotifications,
 }
 
 // MarshalJSON marshals custom millisecond durations. Aliasing inspired by http://choly.ca/post/go-json-marshalling/
@@ -184,6 +258,9 @@ func (c *Config) MarshalJSON() ([]byte, error) {
 		StatBufferIntervalMs           uint64 `json:"stat_buffer_interval_ms"`
 		ServeReadTimeoutMs             uint64 `json:"serve_read_timeout_ms"`
 		ServeWriteTimeoutMs            uint64 `json:"serve_write_timeout_ms"`
+		PeerMaxPollAgeMs               uint64 `json:"peer_max_poll_age_ms"`
+		HistoryDBStatRetentionMs       uint64 `json:"history_db_stat_retention_ms"`
+		HistoryDBEventRetentionMs      uint64 `json:"history_db_event_retention_ms"`
 		*Alias
 	}{
 		CacheHealthPollingIntervalMs:   uint64(c.CacheHealthPollingInterval / time.Millisecond),
@@ -196,6 +273,9 @@ func (c *Config) MarshalJSON() ([]byte, error) {
 		HealthFlushIntervalMs:          uint64(c.HealthFlushInterval / time.Millisecond),
 		StatFlushIntervalMs:            uint64(c.StatFlushInterval / time.Millisecond),
 		StatBufferIntervalMs:           uint64(c.StatBufferInterval / time.Millisecond),
+		PeerMaxPollAgeMs:               uint64(c.PeerMaxPollAge / time.Millisecond),
+		HistoryDBStatRetentionMs:       uint64(c.HistoryDBStatRetention / time.Millisecond),
+		HistoryDBEventRetentionMs:      uint64(c.HistoryDBEventRetention / time.Millisecond),
 		Alias:                          (*Alias)(c),
 	})
 }
@@ -221,6 +301,9 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		TrafficOpsDiskRetryMax         *uint64 `json:"traffic_ops_disk_retry_max"`
 		CRConfigBackupFile             *string `json:"crconfig_backup_file"`
 		TMConfigBackupFile             *string `json:"tmconfig_backup_file"`
+		PeerMaxPollAgeMs               *uint64 `json:"peer_max_poll_age_ms"`
+		HistoryDBStatRetentionMs       *uint64 `json:"history_db_stat_retention_ms"`
+		HistoryDBEventRetentionMs      *uint64 `json:"history_db_event_retention_ms"`
 		*Alias
 	}{
 		Alias: (*Alias)(c),
@@ -281,6 +364,15 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 	if aux.TMConfigBackupFile != nil {
 		c.TMConfigBackupFile = *aux.TMConfigBackupFile
 	}
+	if aux.PeerMaxPollAgeMs != nil {
+		c.PeerMaxPollAge = time.Duration(*aux.PeerMaxPollAgeMs) * time.Millisecond
+	}
+	if aux.HistoryDBStatRetentionMs != nil {
+		c.HistoryDBStatRetention = time.Duration(*aux.HistoryDBStatRetentionMs) * time.Millisecond
+	}
+	if aux.HistoryDBEventRetentionMs != nil {
+		c.HistoryDBEventRetention = time.Duration(*aux.HistoryDBEventRetentionMs) * time.Millisecond
+	}
 	return nil
 }
 
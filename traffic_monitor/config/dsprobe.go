@@ -0,0 +1,92 @@
+package config
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/json-iterator/go"
+)
+
+// DSProbe is a synthetic health check of a Delivery Service, which is requested through each of the Delivery Service's cache servers. A cache server which fails the check is treated as unavailable for that Delivery Service only.
+type DSProbe struct {
+	// URL is requested from each cache server's address, rather than the address of the URL's host. It is required, and must be http or https.
+	URL string `json:"url"`
+	// ExpectedStatus is the response status code of a healthy Delivery Service. Redirects are not followed.
+	ExpectedStatus int `json:"expected_status"`
+	// MaxLatency is the longest a healthy Delivery Service may take to send the full response. Zero is no limit, besides the Timeout.
+	MaxLatency time.Duration `json:"-"`
+	// Interval is how often the Delivery Service is probed through each cache server.
+	Interval time.Duration `json:"-"`
+	// Timeout is how long a probe may take before it fails.
+	Timeout time.Duration `json:"-"`
+}
+
+// DefaultDSProbe is the default of any setting omitted from a configured DSProbe.
+var DefaultDSProbe = DSProbe{
+	ExpectedStatus: 200,
+	MaxLatency:     0,
+	Interval:       10 * time.Second,
+	Timeout:        2 * time.Second,
+}
+
+// UnmarshalJSON populates the probe from the given JSON bytes, with the DefaultDSProbe of any setting they omit.
+func (p *DSProbe) UnmarshalJSON(data []byte) error {
+	type Alias DSProbe
+	*p = DefaultDSProbe
+	aux := &struct {
+		MaxLatencyMs *uint64 `json:"max_latency_ms"`
+		IntervalMs   *uint64 `json:"interval_ms"`
+		TimeoutMs    *uint64 `json:"timeout_ms"`
+		*Alias
+	}{
+		Alias: (*Alias)(p),
+	}
+	json := jsoniter.ConfigFastest
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.MaxLatencyMs != nil {
+		p.MaxLatency = time.Duration(*aux.MaxLatencyMs) * time.Millisecond
+	}
+	if aux.IntervalMs != nil {
+		p.Interval = time.Duration(*aux.IntervalMs) * time.Millisecond
+	}
+	if aux.TimeoutMs != nil {
+		p.Timeout = time.Duration(*aux.TimeoutMs) * time.Millisecond
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return errors.New("parsing url: " + err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL, got '" + p.URL + "'")
+	}
+	if p.Interval <= 0 {
+		return errors.New("interval_ms must be greater than 0")
+	}
+	if p.Timeout <= 0 {
+		return errors.New("timeout_ms must be greater than 0")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package config
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/json-iterator/go"
+)
+
+// WebhookFormat is the body format of a notification webhook.
+type WebhookFormat string
+
+const (
+	// WebhookFormatJSON is a generic JSON object per event.
+	WebhookFormatJSON = WebhookFormat("json")
+	// WebhookFormatAlertmanager is a Prometheus Alertmanager alert array, for posting to the Alertmanager alerts API.
+	WebhookFormatAlertmanager = WebhookFormat("alertmanager")
+)
+
+// Webhook is a URL which events are posted to.
+type Webhook struct {
+	// URL is posted each notification. It is required, and must be http or https.
+	URL string `json:"url"`
+	// Format is the body format, either "json" or "alertmanager". The default is "json".
+	Format WebhookFormat `json:"format"`
+	// Kinds are the event kinds to post, such as "cache" or "crconfig". If empty, all kinds are posted.
+	Kinds []string `json:"kinds"`
+	// Headers are added to each request, for example for authorization.
+	Headers map[string]string `json:"headers"`
+	// Timeout is how long a single request may take before it fails and is retried.
+	Timeout time.Duration `json:"-"`
+}
+
+// DefaultWebhook is the default of any setting omitted from a configured Webhook.
+var DefaultWebhook = Webhook{
+	Format:  WebhookFormatJSON,
+	Timeout: 5 * time.Second,
+}
+
+// UnmarshalJSON populates the webhook from the given JSON bytes, with the DefaultWebhook of any setting they omit.
+func (w *Webhook) UnmarshalJSON(data []byte) error {
+	type Alias Webhook
+	*w = DefaultWebhook
+	aux := &struct {
+		TimeoutMs *uint64 `json:"timeout_ms"`
+		*Alias
+	}{
+		Alias: (*Alias)(w),
+	}
+	json := jsoniter.ConfigFastest
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.TimeoutMs != nil {
+		w.Timeout = time.Duration(*aux.TimeoutMs) * time.Millisecond
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return errors.New("parsing url: " + err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL, got '" + w.URL + "'")
+	}
+	if w.Format != WebhookFormatJSON && w.Format != WebhookFormatAlertmanager {
+		return errors.New("format must be '" + string(WebhookFormatJSON) + "' or '" + string(WebhookFormatAlertmanager) + "', got '" + string(w.Format) + "'")
+	}
+	if w.Timeout <= 0 {
+		return errors.New("timeout_ms must be greater than 0")
+	}
+	return nil
+}
+
+// Notifications configures pushing events to webhooks.
+type Notifications struct {
+	// Webhooks are posted each event notification. If there are none, notifications are disabled.
+	Webhooks []Webhook `json:"webhooks"`
+	// DedupWindow is how long a repeated event, with the same availability as the last one notified for the same thing, is dropped.
+	DedupWindow time.Duration `json:"-"`
+	// FlapWindow and FlapMax rate-limit flapping: once FlapMax notifications have been sent for the same thing within FlapWindow, further ones are held, and only the latest is sent when the window allows. Zero FlapMax disables the limit.
+	FlapWindow time.Duration `json:"-"`
+	FlapMax    int           `json:"flap_max"`
+	// RetryMax is how many times a failed webhook request is retried, with exponential backoff from RetryInitial to RetryMaxInterval.
+	RetryMax         int           `json:"retry_max"`
+	RetryInitial     time.Duration `json:"-"`
+	RetryMaxInterval time.Duration `json:"-"`
+	// AlertmanagerResend is how often firing alerts are re-sent to alertmanager webhooks, so Alertmanager doesn't resolve them itself. It should be less than Alertmanager's resolve_timeout.
+	AlertmanagerResend time.Duration `json:"-"`
+}
+
+// DefaultNotifications is the default of any setting omitted from the configured Notifications.
+var DefaultNotifications = Notifications{
+	DedupWindow:        5 * time.Minute,
+	FlapWindow:         10 * time.Minute,
+	FlapMax:            4,
+	RetryMax:           5,
+	RetryInitial:       1 * time.Second,
+	RetryMaxInterval:   60 * time.Second,
+	AlertmanagerResend: 1 * time.Minute,
+}
+
+// UnmarshalJSON populates the notifications from the given JSON bytes, with the DefaultNotifications of any setting they omit.
+func (n *Notifications) UnmarshalJSON(data []byte) error {
+	type Alias Notifications
+	*n = DefaultNotifications
+	aux := &struct {
+		DedupWindowMs        *uint64 `json:"dedup_window_ms"`
+		FlapWindowMs         *uint64 `json:"flap_window_ms"`
+		RetryInitialMs       *uint64 `json:"retry_initial_ms"`
+		RetryMaxIntervalMs   *uint64 `json:"retry_max_interval_ms"`
+		AlertmanagerResendMs *uint64 `json:"alertmanager_resend_interval_ms"`
+		*Alias
+	}{
+		Alias: (*Alias)(n),
+	}
+	json := jsoniter.ConfigFastest
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.DedupWindowMs != nil {
+		n.DedupWindow = time.Duration(*aux.DedupWindowMs) * time.Millisecond
+	}
+	if aux.FlapWindowMs != nil {
+		n.FlapWindow = time.Duration(*aux.FlapWindowMs) * time.Millisecond
+	}
+	if aux.RetryInitialMs != nil {
+		n.RetryInitial = time.Duration(*aux.RetryInitialMs) * time.Millisecond
+	}
+	if aux.RetryMaxIntervalMs != nil {
+		n.RetryMaxInterval = time.Duration(*aux.RetryMaxIntervalMs) * time.Millisecond
+	}
+	if aux.AlertmanagerResendMs != nil {
+		n.AlertmanagerResend = time.Duration(*aux.AlertmanagerResendMs) * time.Millisecond
+	}
+
+	if n.FlapMax < 0 {
+		return errors.New("flap_max must not be negative")
+	}
+	if n.RetryMax < 0 {
+		return errors.New("retry_max must not be negative")
+	}
+	if n.RetryInitial <= 0 {
+		return errors.New("retry_initial_ms must be greater than 0")
+	}
+	if n.RetryMaxInterval < n.RetryInitial {
+		return errors.New("retry_max_interval_ms must not be less than retry_initial_ms")
+	}
+	if n.AlertmanagerResend <= 0 {
+		return errors.New("alertmanager_resend_interval_ms must be greater than 0")
+	}
+	return nil
+}
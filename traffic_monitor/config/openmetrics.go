@@ -0,0 +1,101 @@
+package config
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"github.com/json-iterator/go"
+)
+
+// OpenMetricsFormat maps the metrics of a cache server's OpenMetrics or Prometheus text format statistics to Traffic Monitor's statistics.
+//
+// Metrics are given as selectors, which are a metric name, optionally followed by label matchers which a series must have, e.g. `node_load1` or `nginx_vts_server_bytes_total{direction="out"}`. Optional metrics may be disabled with an empty string.
+type OpenMetricsFormat struct {
+	// LoadavgOne is the one-minute loadavg metric. It is required.
+	LoadavgOne string `json:"loadavg_one"`
+	// LoadavgFive is the five-minute loadavg metric.
+	LoadavgFive string `json:"loadavg_five"`
+	// LoadavgFifteen is the fifteen-minute loadavg metric.
+	LoadavgFifteen string `json:"loadavg_fifteen"`
+	// Processes is the metric of the number of currently executing processes.
+	Processes string `json:"processes"`
+	// NotAvailable is a metric which, if it is nonzero, marks the cache server unavailable.
+	NotAvailable string `json:"not_available"`
+
+	// InterfaceLabel is the label of the interface metrics whose value is the network interface name.
+	InterfaceLabel string `json:"interface_label"`
+	// InterfaceBytesIn is the metric of the bytes received by each interface.
+	InterfaceBytesIn string `json:"interface_bytes_in"`
+	// InterfaceBytesOut is the metric of the bytes transmitted by each interface.
+	InterfaceBytesOut string `json:"interface_bytes_out"`
+	// InterfaceSpeed is the metric of the speed of each interface.
+	InterfaceSpeed string `json:"interface_speed"`
+	// InterfaceSpeedMultiplier converts InterfaceSpeed values to megabits per second. The default converts node_exporter's bytes per second.
+	InterfaceSpeedMultiplier float64 `json:"interface_speed_multiplier"`
+	// IgnoreInterfaces are interfaces which are not added to the cache server's statistics, such as the loopback.
+	IgnoreInterfaces []string `json:"ignore_interfaces"`
+
+	// DeliveryServiceLabel is the label of the Delivery Service metrics which identifies the Delivery Service.
+	DeliveryServiceLabel string `json:"delivery_service_label"`
+	// DeliveryServiceLabelType is what the DeliveryServiceLabel value is: "fqdn", a host name which is matched against the Delivery Services' regexes, as stats_over_http's remap_stats are, or "xml_id", the Delivery Service's name.
+	DeliveryServiceLabelType string `json:"delivery_service_label_type"`
+	// DeliveryServiceInBytes is the metric of the bytes received for each Delivery Service.
+	DeliveryServiceInBytes string `json:"delivery_service_in_bytes"`
+	// DeliveryServiceOutBytes is the metric of the bytes transmitted for each Delivery Service.
+	DeliveryServiceOutBytes string `json:"delivery_service_out_bytes"`
+	// DeliveryServiceResponses is the metric of the responses for each Delivery Service, by status code or class.
+	DeliveryServiceResponses string `json:"delivery_service_responses"`
+	// DeliveryServiceStatusLabel is the label of the DeliveryServiceResponses metric whose value is the status code, such as "200", or class, such as "2xx".
+	DeliveryServiceStatusLabel string `json:"delivery_service_status_label"`
+
+	// Stats are additional metrics to keep as miscellaneous stats, for thresholds and the stat history. Each matching series is a stat named by its metric name and labels, e.g. `node_memory_MemAvailable_bytes`.
+	Stats []string `json:"stats"`
+}
+
+// DefaultOpenMetricsFormat maps the Prometheus node_exporter system metrics and Grove's remap metrics. It is the format named "openmetrics", and the default of any setting omitted from a configured format.
+var DefaultOpenMetricsFormat = OpenMetricsFormat{
+	LoadavgOne:                 "node_load1",
+	LoadavgFive:                "node_load5",
+	LoadavgFifteen:             "node_load15",
+	Processes:                  "node_procs_running",
+	InterfaceLabel:             "device",
+	InterfaceBytesIn:           "node_network_receive_bytes_total",
+	InterfaceBytesOut:          "node_network_transmit_bytes_total",
+	InterfaceSpeed:             "node_network_speed_bytes",
+	InterfaceSpeedMultiplier:   8.0 / 1000 / 1000,
+	IgnoreInterfaces:           []string{"lo"},
+	DeliveryServiceLabel:       "remap",
+	DeliveryServiceLabelType:   OpenMetricsLabelTypeFQDN,
+	DeliveryServiceInBytes:     "grove_remap_in_bytes_total",
+	DeliveryServiceOutBytes:    "grove_remap_out_bytes_total",
+	DeliveryServiceResponses:   "grove_remap_responses_total",
+	DeliveryServiceStatusLabel: "code",
+}
+
+const OpenMetricsLabelTypeFQDN = "fqdn"
+const OpenMetricsLabelTypeXMLID = "xml_id"
+
+// UnmarshalJSON populates the format from the given JSON bytes, with the DefaultOpenMetricsFormat of any setting they omit.
+func (f *OpenMetricsFormat) UnmarshalJSON(data []byte) error {
+	type Alias OpenMetricsFormat
+	*f = DefaultOpenMetricsFormat
+	f.IgnoreInterfaces = append([]string(nil), DefaultOpenMetricsFormat.IgnoreInterfaces...) // copy, so decoding into it can't modify the default
+	json := jsoniter.ConfigFastest
+	return json.Unmarshal(data, (*Alias)(f))
+}
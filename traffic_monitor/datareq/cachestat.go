@@ -20,20 +20,50 @@
 package datareq
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/historydb"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/srvhttp"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
 )
 
-func srvCacheStats(params url.Values, errorCount threadsafe.Uint, path string, toData todata.TODataThreadsafe, statResultHistory threadsafe.ResultStatHistory, statInfoHistory threadsafe.ResultInfoHistory, monitorConfig threadsafe.TrafficMonitorConfigMap, combinedStates peer.CRStatesThreadsafe, statMaxKbpses threadsafe.CacheKbpses) ([]byte, int) {
+func srvCacheStats(params url.Values, errorCount threadsafe.Uint, path string, toData todata.TODataThreadsafe, statResultHistory threadsafe.ResultStatHistory, statInfoHistory threadsafe.ResultInfoHistory, monitorConfig threadsafe.TrafficMonitorConfigMap, combinedStates peer.CRStatesThreadsafe, statMaxKbpses threadsafe.CacheKbpses, historyDB *historydb.DB) ([]byte, int) {
 	filter, err := NewCacheStatFilter(path, params, toData.Get().ServerTypes)
 	if err != nil {
 		HandleErr(errorCount, path, err)
 		return []byte(err.Error()), http.StatusBadRequest
 	}
+	start, end, isRange, err := parseTimeRange(params)
+	if err == nil && isRange && historyDB == nil {
+		err = errors.New("start and end require the history database, which is not enabled")
+	}
+	if err != nil {
+		HandleErr(errorCount, path, err)
+		return []byte(err.Error()), http.StatusBadRequest
+	}
+	if isRange {
+		bytes, err := historyCacheStats(params, historyDB, start, end, filter)
+		return WrapErrCode(errorCount, path, bytes, err)
+	}
 	bytes, err := threadsafe.StatsMarshall(statResultHistory, statInfoHistory.Get(), combinedStates.Get(), monitorConfig.Get(), statMaxKbpses.Get(), filter, params)
 	return WrapErrCode(errorCount, path, bytes, err)
 }
+
+// historyCacheStats returns the stats between start and end from the history database, in the same form as the in-memory stats.
+func historyCacheStats(params url.Values, historyDB *historydb.DB, start time.Time, end time.Time, filter cache.Filter) ([]byte, error) {
+	caches, err := historyDB.Stats(start, end, filter)
+	if err != nil {
+		return nil, errors.New("getting stats from history database: " + err.Error())
+	}
+	return json.Marshal(cache.Stats{
+		CommonAPIData: srvhttp.GetCommonAPIData(params, time.Now()),
+		Caches:        caches,
+	})
+}
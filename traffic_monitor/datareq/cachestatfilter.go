@@ -79,8 +79,8 @@ func (f *CacheStatFilter) WithinStatHistoryMax(n int) bool {
 }
 
 // NewCacheStatFilter takes the HTTP query parameters and creates a CacheStatFilter which fulfills the `cache.Filter` interface, filtering according to the query parameters passed.
-// Query parameters used are `hc`, `stats`, `wildcard`, `type`, and `hosts`.
-// If `hc` is 0, all history is returned. If `hc` is empty, 1 history is returned.
+// Query parameters used are `hc`, `stats`, `wildcard`, `type`, and `hosts`. The `start` and `end` parameters are allowed, but the time range is not part of the filter.
+// If `hc` is 0, all history is returned. If `hc` is empty, 1 history is returned, unless `start` or `end` is given, in which case all history in the range is returned.
 // If `stats` is empty, all stats are returned.
 // If `wildcard` is empty, `stats` is considered exact.
 // If `type` is empty, all cache types are returned.
@@ -92,6 +92,8 @@ func NewCacheStatFilter(path string, params url.Values, cacheTypes map[tc.CacheN
 		"type":     struct{}{},
 		"hosts":    struct{}{},
 		"cache":    struct{}{},
+		"start":    struct{}{},
+		"end":      struct{}{},
 	}
 	if len(params) > len(validParams) {
 		return nil, fmt.Errorf("invalid query parameters")
@@ -103,6 +105,11 @@ func NewCacheStatFilter(path string, params url.Values, cacheTypes map[tc.CacheN
 	}
 
 	historyCount := 1
+	if _, isRange := params["start"]; isRange {
+		historyCount = 0
+	} else if _, isRange := params["end"]; isRange {
+		historyCount = 0
+	}
 	if paramHc, exists := params["hc"]; exists && len(paramHc) > 0 {
 		v, err := strconv.Atoi(paramHc[0])
 		if err == nil {
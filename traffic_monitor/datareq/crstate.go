@@ -20,9 +20,11 @@
 package datareq
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
 	"github.com/apache/trafficcontrol/lib/go-tc"
@@ -42,13 +44,8 @@ func srvTRState(params url.Values, localStates peer.CRStatesThreadsafe, combined
 	// to use the last good state fetched from a Traffic Monitor within the CDN. If the peers are simply unreachable from
 	// this Traffic Monitor, serving 503s until connectivity is restored will cause Traffic Router to ignore this instance
 	// until the health protocol can be relied upon once again.
-	if peerStates.OptimisticQuorumEnabled() {
-		optimisticQuorum, peersAvailable, peerCount, minimum := peerStates.HasOptimisticQuorum()
-		log.Debugf("optimisticQuorum=%v, peerCount=%v, peersAvailable=%v, minimum=%v", optimisticQuorum, peerCount, peersAvailable, minimum)
-
-		if !optimisticQuorum {
-			return nil, http.StatusServiceUnavailable, fmt.Errorf("number of peers available (%d/%d) is less than the minimum number of %d required for optimistic peer quorum", peersAvailable, peerCount, minimum)
-		}
+	if err := checkOptimisticQuorum(peerStates); err != nil {
+		return nil, http.StatusServiceUnavailable, err
 	}
 
 	data, err := srvTRStateDerived(combinedStates, peerStates)
@@ -56,10 +53,29 @@ func srvTRState(params url.Values, localStates peer.CRStatesThreadsafe, combined
 	return data, http.StatusOK, err
 }
 
+// checkOptimisticQuorum returns an error if optimistic peer quorum is enabled and not met, in which case the combined states must not be served.
+func checkOptimisticQuorum(peerStates peer.CRStatesPeersThreadsafe) error {
+	if !peerStates.OptimisticQuorumEnabled() {
+		return nil
+	}
+	optimisticQuorum, peersAvailable, peerCount, minimum := peerStates.HasOptimisticQuorum()
+	log.Debugf("optimisticQuorum=%v, peerCount=%v, peersAvailable=%v, minimum=%v", optimisticQuorum, peerCount, peersAvailable, minimum)
+
+	if !optimisticQuorum {
+		return fmt.Errorf("number of peers available (%d/%d) is less than the minimum number of %d required for optimistic peer quorum", peersAvailable, peerCount, minimum)
+	}
+	return nil
+}
+
 func srvTRStateDerived(combinedStates peer.CRStatesThreadsafe, peerStates peer.CRStatesPeersThreadsafe) ([]byte, error) {
 	return tc.CRStatesMarshall(combinedStates.Get())
 }
 
 func srvTRStateSelf(localStates peer.CRStatesThreadsafe) ([]byte, error) {
-	return tc.CRStatesMarshall(localStates.Get())
+	self := peer.SelfCRStates{CRStates: localStates.Get()}
+	if pollTime := localStates.GetPollTime(); !pollTime.IsZero() {
+		pollAgeMS := int64(time.Since(pollTime) / time.Millisecond)
+		self.PollAgeMS = &pollAgeMS
+	}
+	return json.Marshal(self)
 }
@@ -0,0 +1,178 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+)
+
+// ContentTypeEventStream is the Content-Type of Server-Sent Events.
+const ContentTypeEventStream = "text/event-stream"
+
+// crStatesStreamKeepalive is how often a comment is sent on an idle CRStates stream, to keep proxies from closing it and to detect dead clients.
+const crStatesStreamKeepalive = 30 * time.Second
+
+// crStatesStreamWriteTimeout is the longest a single write to a CRStates stream may take before the client is considered dead.
+const crStatesStreamWriteTimeout = 10 * time.Second
+
+// crStatesStreamRetryMS is the reconnection time, in milliseconds, sent to clients.
+const crStatesStreamRetryMS = "1000"
+
+// srvTRStateStream serves the combined CRStates as Server-Sent Events. The first event is the full states, and each following event is a peer.CRStatesDelta of the caches and delivery services which changed, sent as soon as the state combiner changes them.
+// Each event ID is the stream epoch and sequence number. Clients resuming after a disconnect may send the last ID they received in the standard Last-Event-ID header, or the lastEventId query parameter, to receive only the changes they missed; if those changes are no longer kept, the full states are sent instead.
+// If optimistic peer quorum is lost, the stream is closed, the same as CrStates requests fail.
+func srvTRStateStream(w http.ResponseWriter, r *http.Request, stream *peer.CRStatesStream, peerStates peer.CRStatesPeersThreadsafe, errorCount threadsafe.Uint) {
+	if err := checkOptimisticQuorum(peerStates); err != nil {
+		HandleErr(errorCount, r.URL.EscapedPath(), err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Write(w, []byte(http.StatusText(http.StatusServiceUnavailable)), r.URL.EscapedPath())
+		return
+	}
+
+	epoch, seq := int64(0), uint64(0) // an epoch of 0 never matches, so sends the full states
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		epoch, seq = parseLastEventID(lastID)
+	} else if lastID := r.URL.Query().Get("lastEventId"); lastID != "" {
+		epoch, seq = parseLastEventID(lastID)
+	}
+
+	write, done, closeStream, err := startEventStream(w, r)
+	if err != nil {
+		HandleErr(errorCount, r.URL.EscapedPath(), err)
+		return
+	}
+	defer closeStream()
+
+	if err := write([]byte("retry: " + crStatesStreamRetryMS + "\n\n")); err != nil {
+		log.Infof("CRStates stream to %s closed: %v", r.RemoteAddr, err)
+		return
+	}
+
+	keepalive := time.NewTicker(crStatesStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		deltas, changed := stream.Since(epoch, seq)
+		for _, delta := range deltas {
+			bts, err := json.Marshal(delta)
+			if err != nil {
+				HandleErr(errorCount, r.URL.EscapedPath(), errors.New("marshalling CRStates delta: "+err.Error()))
+				return
+			}
+			msg := make([]byte, 0, len(bts)+64)
+			msg = append(msg, "id: "+peer.CRStatesStreamID(stream.Epoch(), delta.Seq)+"\nevent: crstates\ndata: "...)
+			msg = append(msg, bts...)
+			msg = append(msg, "\n\n"...)
+			if err := write(msg); err != nil {
+				log.Infof("CRStates stream to %s closed: %v", r.RemoteAddr, err)
+				return
+			}
+			epoch, seq = stream.Epoch(), delta.Seq
+		}
+
+		select {
+		case <-changed:
+			if err := checkOptimisticQuorum(peerStates); err != nil {
+				HandleErr(errorCount, r.URL.EscapedPath(), err)
+				return
+			}
+		case <-keepalive.C:
+			if err := write([]byte(": keepalive\n\n")); err != nil {
+				log.Infof("CRStates stream to %s closed: %v", r.RemoteAddr, err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func parseLastEventID(id string) (int64, uint64) {
+	epoch, seq, err := peer.ParseCRStatesStreamID(id)
+	if err != nil {
+		log.Warnf("CRStates stream: %v, sending full states", err)
+		return 0, 0
+	}
+	return epoch, seq
+}
+
+// startEventStream writes the response headers of an event stream, and returns a func to write and flush events, a chan closed when the client disconnects, and a func to close the stream.
+// If possible, the connection is hijacked, because the server's read and write timeouts apply to the whole request, and would otherwise end the stream; each write instead has its own timeout. Otherwise, for example over HTTP/2, the stream lasts until the server's write timeout, and clients are expected to resume.
+func startEventStream(w http.ResponseWriter, r *http.Request) (func([]byte) error, <-chan struct{}, func(), error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, nil, nil, errors.New("response writer doesn't support streaming")
+		}
+		w.Header().Set("Content-Type", ContentTypeEventStream)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		write := func(b []byte) error {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+		return write, r.Context().Done(), func() {}, nil
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, nil, errors.New("hijacking connection: " + err.Error())
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, nil, errors.New("clearing connection deadline: " + err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// clients send nothing after the request, so this only returns when the connection is closed.
+		io.Copy(ioutil.Discard, rw.Reader)
+		close(done)
+	}()
+
+	write := func(b []byte) error {
+		if err := conn.SetWriteDeadline(time.Now().Add(crStatesStreamWriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := rw.Write(b); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+	header := "HTTP/1.1 200 OK\r\nContent-Type: " + ContentTypeEventStream + "\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n"
+	if err := write([]byte(header)); err != nil {
+		conn.Close()
+		return nil, nil, nil, errors.New("writing event stream header: " + err.Error())
+	}
+	return write, done, func() { conn.Close() }, nil
+}
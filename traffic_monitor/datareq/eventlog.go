@@ -20,7 +20,13 @@
 package datareq
 
 import (
+	"errors"
+	"net/http"
+	"net/url"
+
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/historydb"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
 
 	"github.com/json-iterator/go"
 )
@@ -30,7 +36,25 @@ type JSONEvents struct {
 	Events []health.Event `json:"events"`
 }
 
-func srvEventLog(events health.ThreadsafeEvents) ([]byte, error) {
+// srvEventLog returns the in-memory events, or if the `start` or `end` query parameter is given, the events in that range from the history database.
+func srvEventLog(params url.Values, errorCount threadsafe.Uint, path string, events health.ThreadsafeEvents, historyDB *historydb.DB) ([]byte, int) {
+	start, end, isRange, err := parseTimeRange(params)
+	if err == nil && isRange && historyDB == nil {
+		err = errors.New("start and end require the history database, which is not enabled")
+	}
+	if err != nil {
+		HandleErr(errorCount, path, err)
+		return []byte(err.Error()), http.StatusBadRequest
+	}
+
+	eventList := events.Get()
+	if isRange {
+		if eventList, err = historyDB.Events(start, end); err != nil {
+			return WrapErrCode(errorCount, path, nil, errors.New("getting events from history database: "+err.Error()))
+		}
+	}
+
 	json := jsoniter.ConfigFastest
-	return json.Marshal(JSONEvents{Events: events.Get()})
+	bytes, err := json.Marshal(JSONEvents{Events: eventList})
+	return WrapErrCode(errorCount, path, bytes, err)
 }
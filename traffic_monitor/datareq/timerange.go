@@ -0,0 +1,64 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package datareq
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// parseTimeRange returns the time range of the `start` and `end` query parameters, which may be milliseconds since the epoch or RFC3339 times. If neither is given, ok is false. If only start is given, the range ends now; if only end is given, the range starts at the epoch.
+func parseTimeRange(params url.Values) (start time.Time, end time.Time, ok bool, err error) {
+	startStr := params.Get("start")
+	endStr := params.Get("end")
+	if startStr == "" && endStr == "" {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	start = time.Unix(0, 0)
+	end = time.Now()
+	if startStr != "" {
+		if start, err = parseTime(startStr); err != nil {
+			return time.Time{}, time.Time{}, false, errors.New("invalid query parameter start: " + err.Error())
+		}
+	}
+	if endStr != "" {
+		if end, err = parseTime(endStr); err != nil {
+			return time.Time{}, time.Time{}, false, errors.New("invalid query parameter end: " + err.Error())
+		}
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, false, errors.New("invalid query parameters: end is before start")
+	}
+	return start, end, true, nil
+}
+
+// parseTime parses milliseconds since the epoch, as returned in stat times, or an RFC3339 time.
+func parseTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("must be milliseconds since the epoch or an RFC3339 time")
+	}
+	return t, nil
+}
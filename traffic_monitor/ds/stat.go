@@ -119,6 +119,7 @@ func addAvailableData(dsStats *dsdata.Stats, crStates tc.CRStates, serverCachegr
 				Name:        dsName.String(),
 				Hostname:    dsName.String(),
 				Type:        "Delivery Service",
+				Kind:        health.EventKindDeliveryService,
 				Available:   stat.CommonStats.IsAvailable.Value,
 			}
 		}
@@ -330,6 +331,7 @@ func addDSPerSecStats(lastStats *dsdata.LastStats, dsStats *dsdata.Stats, dsName
 			Name:        dsName.String(),
 			Hostname:    dsName.String(),
 			Type:        "DELIVERYSERVICE",
+			Kind:        health.EventKindDeliveryService,
 			Available:   stat.CommonStats.IsAvailable.Value,
 		}
 	}
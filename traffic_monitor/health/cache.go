@@ -21,6 +21,7 @@ package health
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
@@ -90,7 +91,8 @@ const UnavailableStr = "unavailable"
 
 // EvalCache returns whether the given cache should be marked available, a boolean of whether the result was over ipv4 (false means it was ipv6), a string describing why, and which stat exceeded a threshold. The `stats` may be nil, for pollers which don't poll stats.
 // The availability of EvalCache MAY NOT be used to directly set the cache's local availability, because the threshold stats may not be part of the poller which produced the result. Rather, if the cache was previously unavailable from a threshold, it must be verified that threshold stat is in the results before setting the cache to available.
-// The resultStats may be nil, and if so, won't be checked for thresholds. For example, the Health poller doesn't have Stats.
+// The resultStats may be nil, and if so, won't be checked for thresholds or rules. For example, the Health poller doesn't have Stats.
+// Threshold rules record their state in resultStats, so EvalCache must only be called with non-nil resultStats by the single writer of the history.
 // TODO change to return a `cache.AvailableStatus`
 func EvalCache(result cache.ResultInfo, resultStats *threadsafe.ResultStatValHistory, mc *tc.TrafficMonitorConfigMap) (bool, bool, string, string) {
 	serverInfo, ok := mc.TrafficServer[string(result.ID)]
@@ -115,6 +117,12 @@ func EvalCache(result cache.ResultInfo, resultStats *threadsafe.ResultStatValHis
 		return avail, result.UsingIPv4, eventDescVal, eventMsg
 	}
 
+	// rules are evaluated before thresholds, so their state is recorded on every poll, even if a threshold is exceeded.
+	unavailableRule := ""
+	if resultStats != nil {
+		unavailableRule = evalRules(result, resultStats, serverInfo, serverProfile)
+	}
+
 	computedStats := cache.ComputedStats()
 
 	for stat, threshold := range serverProfile.Parameters.Thresholds {
@@ -144,12 +152,16 @@ func EvalCache(result cache.ResultInfo, resultStats *threadsafe.ResultStatValHis
 		}
 	}
 
+	if unavailableRule != "" {
+		return false, result.UsingIPv4, eventDesc(status, fmt.Sprintf("rule %s held (%s)", unavailableRule, serverProfile.Parameters.Rules[unavailableRule].Down)), RuleStatPrefix + unavailableRule
+	}
+
 	return avail, result.UsingIPv4, eventDescVal, eventMsg
 }
 
 // CalcAvailabilityWithStats calculates the availability of each cache in results.
 // statResultHistory may be nil, in which case stats won't be used to calculate availability.
-func CalcAvailability(results []cache.Result, pollerName string, statResultHistory *threadsafe.ResultStatHistory, mc tc.TrafficMonitorConfigMap, toData todata.TOData, localCacheStatusThreadsafe threadsafe.CacheAvailableStatus, localStates peer.CRStatesThreadsafe, events ThreadsafeEvents, protocol config.PollingProtocol) {
+func CalcAvailability(results []cache.Result, pollerName string, statResultHistory *threadsafe.ResultStatHistory, mc tc.TrafficMonitorConfigMap, toData todata.TOData, localCacheStatusThreadsafe threadsafe.CacheAvailableStatus, localStates peer.CRStatesThreadsafe, events ThreadsafeEvents, dsProbes DSProbeResults, protocol config.PollingProtocol) {
 	localCacheStatuses := localCacheStatusThreadsafe.Get().Copy()
 	statResults := (*threadsafe.ResultStatValHistory)(nil)
 	processAvailableTuple := func(tuple cache.AvailableTuple, serverInfo tc.TrafficServer) bool {
@@ -195,7 +207,9 @@ func CalcAvailability(results []cache.Result, pollerName string, statResultHisto
 
 			if processAvailableTuple(availableTuple, serverInfo) {
 				if !processAvailableTuple(previousStatus.Available, serverInfo) && previousStatus.UnavailableStat != "" {
-					if !result.HasStat(previousStatus.UnavailableStat) {
+					// rules are only evaluated by pollers with stat history, so only those may bring the cache back.
+					isRuleStat := strings.HasPrefix(previousStatus.UnavailableStat, RuleStatPrefix)
+					if (isRuleStat && statResults == nil) || (!isRuleStat && !result.HasStat(previousStatus.UnavailableStat)) {
 						return
 					}
 				}
@@ -230,12 +244,13 @@ func CalcAvailability(results []cache.Result, pollerName string, statResultHisto
 				protocol = "IPv6"
 			}
 			log.Infof("Changing state for %s was: %t now: %t because %s poller: %v on protocol %v error: %v", result.ID, available.IsAvailable, newAvailableState, whyAvailable, pollerName, protocol, result.Error)
-			events.Add(Event{Time: Time(time.Now()), Description: "Protocol: (" + protocol + ") " + whyAvailable + " (" + pollerName + ")", Name: string(result.ID), Hostname: string(result.ID), Type: toData.ServerTypes[tc.CacheName(result.ID)].String(), Available: newAvailableState, IPv4Available: availableTuple.IPv4, IPv6Available: availableTuple.IPv6})
+			events.Add(Event{Time: Time(time.Now()), Description: "Protocol: (" + protocol + ") " + whyAvailable + " (" + pollerName + ")", Name: string(result.ID), Hostname: string(result.ID), Type: toData.ServerTypes[tc.CacheName(result.ID)].String(), Kind: EventKindCache, Available: newAvailableState, IPv4Available: availableTuple.IPv4, IPv6Available: availableTuple.IPv6})
 		}
 
 		localStates.SetCache(tc.CacheName(result.ID), tc.IsAvailable{IsAvailable: newAvailableState, Ipv4Available: availableTuple.IPv4, Ipv6Available: availableTuple.IPv6})
 	}
-	calculateDeliveryServiceState(toData.DeliveryServiceServers, localStates, toData)
+	calculateDeliveryServiceState(toData.DeliveryServiceServers, localStates, toData, dsProbes)
+	localStates.SetPollTime(time.Now())
 	localCacheStatusThreadsafe.Set(localCacheStatuses)
 }
 
@@ -284,8 +299,8 @@ func eventDesc(status tc.CacheStatus, message string) string {
 	return fmt.Sprintf("%s - %s", status, message)
 }
 
-//calculateDeliveryServiceState calculates the state of delivery services from the new cache state data `cacheState` and the CRConfig data `deliveryServiceServers` and puts the calculated state in the outparam `deliveryServiceStates`
-func calculateDeliveryServiceState(deliveryServiceServers map[tc.DeliveryServiceName][]tc.CacheName, states peer.CRStatesThreadsafe, toData todata.TOData) {
+//calculateDeliveryServiceState calculates the state of delivery services from the new cache state data `cacheState` and the CRConfig data `deliveryServiceServers` and the synthetic health check results `dsProbes`, and puts the calculated state in the outparam `deliveryServiceStates`
+func calculateDeliveryServiceState(deliveryServiceServers map[tc.DeliveryServiceName][]tc.CacheName, states peer.CRStatesThreadsafe, toData todata.TOData, dsProbes DSProbeResults) {
 	cacheStates := states.GetCaches()
 
 	deliveryServices := states.GetDeliveryServices()
@@ -294,14 +309,14 @@ func calculateDeliveryServiceState(deliveryServiceServers map[tc.DeliveryService
 			log.Infof("CRConfig does not have delivery service %s, but traffic monitor poller does; skipping\n", deliveryServiceName)
 			continue
 		}
-		deliveryServiceState.DisabledLocations = getDisabledLocations(deliveryServiceName, toData.DeliveryServiceServers[deliveryServiceName], cacheStates, toData.ServerCachegroups)
+		deliveryServiceState.DisabledLocations = getDisabledLocations(deliveryServiceName, toData.DeliveryServiceServers[deliveryServiceName], cacheStates, toData.ServerCachegroups, dsProbes[deliveryServiceName])
 		states.SetDeliveryService(deliveryServiceName, deliveryServiceState)
 	}
 }
 
-func getDisabledLocations(deliveryService tc.DeliveryServiceName, deliveryServiceServers []tc.CacheName, cacheStates map[tc.CacheName]tc.IsAvailable, serverCacheGroups map[tc.CacheName]tc.CacheGroupName) []tc.CacheGroupName {
+func getDisabledLocations(deliveryService tc.DeliveryServiceName, deliveryServiceServers []tc.CacheName, cacheStates map[tc.CacheName]tc.IsAvailable, serverCacheGroups map[tc.CacheName]tc.CacheGroupName, probes map[tc.CacheName]DSProbeResult) []tc.CacheGroupName {
 	disabledLocations := []tc.CacheGroupName{} // it's important this isn't nil, so it serialises to the JSON `[]` instead of `null`
-	dsCacheStates := getDeliveryServiceCacheAvailability(cacheStates, deliveryServiceServers)
+	dsCacheStates := getDeliveryServiceCacheAvailability(cacheStates, deliveryServiceServers, probes)
 	dsCachegroupsAvailable := getDeliveryServiceCachegroupAvailability(dsCacheStates, serverCacheGroups)
 	for cg, avail := range dsCachegroupsAvailable {
 		if avail {
@@ -312,10 +327,15 @@ func getDisabledLocations(deliveryService tc.DeliveryServiceName, deliveryServic
 	return disabledLocations
 }
 
-func getDeliveryServiceCacheAvailability(cacheStates map[tc.CacheName]tc.IsAvailable, deliveryServiceServers []tc.CacheName) map[tc.CacheName]tc.IsAvailable {
+// getDeliveryServiceCacheAvailability returns the availability of the Delivery Service's caches. Caches which failed the Delivery Service's synthetic health check are unavailable for it, even if they're available for others.
+func getDeliveryServiceCacheAvailability(cacheStates map[tc.CacheName]tc.IsAvailable, deliveryServiceServers []tc.CacheName, probes map[tc.CacheName]DSProbeResult) map[tc.CacheName]tc.IsAvailable {
 	dsCacheStates := map[tc.CacheName]tc.IsAvailable{}
 	for _, server := range deliveryServiceServers {
-		dsCacheStates[server] = cacheStates[tc.CacheName(server)]
+		state := cacheStates[tc.CacheName(server)]
+		if probe, ok := probes[server]; ok && !probe.Available {
+			state = tc.IsAvailable{}
+		}
+		dsCacheStates[server] = state
 	}
 	return dsCacheStates
 }
@@ -110,7 +110,7 @@ func TestCalcAvailabilityThresholds(t *testing.T) {
 
 	pollerName := "stat"
 	results := []cache.Result{result}
-	CalcAvailability(results, pollerName, statResultHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	CalcAvailability(results, pollerName, statResultHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, nil, config.Both)
 
 	localCacheStatuses := localCacheStatusThreadsafe.Get()
 	if localCacheStatus, ok := localCacheStatuses[tc.CacheName(result.ID)]; !ok {
@@ -140,7 +140,7 @@ func TestCalcAvailabilityThresholds(t *testing.T) {
 	GetVitals(&healthResult, &result, nil)
 	healthPollerName := "health"
 	healthResults := []cache.Result{healthResult}
-	CalcAvailability(healthResults, healthPollerName, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	CalcAvailability(healthResults, healthPollerName, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, nil, config.Both)
 
 	localCacheStatuses = localCacheStatusThreadsafe.Get()
 	if localCacheStatus, ok := localCacheStatuses[tc.CacheName(result.ID)]; !ok {
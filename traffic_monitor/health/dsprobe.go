@@ -0,0 +1,70 @@
+package health
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+// DSProbeResult is the result of a synthetic health check of a Delivery Service through a cache server.
+type DSProbeResult struct {
+	Available  bool
+	Why        string
+	StatusCode int
+	Latency    time.Duration
+	Time       time.Time
+}
+
+// DSProbeResults are the latest synthetic health check results of each probed Delivery Service, through each of its cache servers.
+type DSProbeResults map[tc.DeliveryServiceName]map[tc.CacheName]DSProbeResult
+
+// ThreadsafeDSProbeResults provides safe access for multiple goroutines to the latest DSProbeResults. Each Delivery Service MUST only be set by one goroutine.
+type ThreadsafeDSProbeResults struct {
+	results *DSProbeResults
+	m       *sync.RWMutex
+}
+
+// NewThreadsafeDSProbeResults returns a new, empty ThreadsafeDSProbeResults.
+func NewThreadsafeDSProbeResults() ThreadsafeDSProbeResults {
+	results := DSProbeResults{}
+	return ThreadsafeDSProbeResults{results: &results, m: &sync.RWMutex{}}
+}
+
+// Get returns the results. Callers MUST NOT modify.
+func (o ThreadsafeDSProbeResults) Get() DSProbeResults {
+	o.m.RLock()
+	defer o.m.RUnlock()
+	return *o.results
+}
+
+// SetDeliveryService replaces the results of the given Delivery Service. The given map MUST NOT be modified after it's set.
+func (o ThreadsafeDSProbeResults) SetDeliveryService(ds tc.DeliveryServiceName, results map[tc.CacheName]DSProbeResult) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	newResults := make(DSProbeResults, len(*o.results)+1)
+	for name, dsResults := range *o.results {
+		newResults[name] = dsResults
+	}
+	newResults[ds] = results
+	*o.results = newResults
+}
@@ -0,0 +1,61 @@
+package health
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+func TestCalculateDeliveryServiceStateProbes(t *testing.T) {
+	toData := todata.New()
+	toData.DeliveryServiceServers["ds0"] = []tc.CacheName{"cache0", "cache1", "cache2"}
+	toData.DeliveryServiceServers["ds1"] = []tc.CacheName{"cache0", "cache1", "cache2"}
+	toData.ServerCachegroups["cache0"] = "cg0"
+	toData.ServerCachegroups["cache1"] = "cg0"
+	toData.ServerCachegroups["cache2"] = "cg1"
+
+	states := peer.NewCRStatesThreadsafe()
+	for _, cache := range []tc.CacheName{"cache0", "cache1", "cache2"} {
+		states.AddCache(cache, tc.IsAvailable{IsAvailable: true, Ipv4Available: true})
+	}
+	states.SetDeliveryService("ds0", tc.CRStatesDeliveryService{IsAvailable: true})
+	states.SetDeliveryService("ds1", tc.CRStatesDeliveryService{IsAvailable: true})
+
+	// ds0 fails through both caches of cg0, and ds1 only through one, so only ds0 has cg0 disabled
+	probes := DSProbeResults{
+		"ds0": {"cache0": {Available: false}, "cache1": {Available: false}, "cache2": {Available: true}},
+		"ds1": {"cache0": {Available: false}},
+	}
+	calculateDeliveryServiceState(toData.DeliveryServiceServers, states, *toData, probes)
+
+	if ds, _ := states.GetDeliveryService("ds0"); len(ds.DisabledLocations) != 1 || ds.DisabledLocations[0] != "cg0" {
+		t.Errorf("ds0 disabled locations expected [cg0], actual %v", ds.DisabledLocations)
+	}
+	if ds, _ := states.GetDeliveryService("ds1"); len(ds.DisabledLocations) != 0 {
+		t.Errorf("ds1 disabled locations expected [], actual %v", ds.DisabledLocations)
+	}
+	if cache, _ := states.GetCache("cache0"); !cache.IsAvailable {
+		t.Errorf("cache failing probes expected to stay available for other delivery services, actual unavailable")
+	}
+}
@@ -41,17 +41,40 @@ type Event struct {
 	Name          string `json:"name"`
 	Hostname      string `json:"hostname"`
 	Type          string `json:"type"`
+	Kind          string `json:"kind"`
 	Available     bool   `json:"isAvailable"`
 	IPv4Available bool   `json:"isAvailable"`
 	IPv6Available bool   `json:"isAvailable"`
 }
 
+// Event kinds are what events are about, for grouping notifications.
+const (
+	// EventKindCache is a change in a cache's availability.
+	EventKindCache = "cache"
+	// EventKindDeliveryService is a change in a Delivery Service's availability.
+	EventKindDeliveryService = "deliveryservice"
+	// EventKindDSProbe is a change in a Delivery Service's synthetic health check through a cache.
+	EventKindDSProbe = "dsprobe"
+	// EventKindPeer is a change in a peer Traffic Monitor's availability.
+	EventKindPeer = "peer"
+	// EventKindPeerDisagreement is a cache's combined availability differing from this Traffic Monitor's own.
+	EventKindPeerDisagreement = "peer_disagreement"
+	// EventKindCRConfig is a CRConfig request failing, or succeeding after failing.
+	EventKindCRConfig = "crconfig"
+)
+
+// EventRecorder records events somewhere other than the in-memory list, such as an on-disk database, so they may be kept after they're pruned from the list. RecordEvent MUST NOT block.
+type EventRecorder interface {
+	RecordEvent(e Event)
+}
+
 // Events provides safe access for multiple goroutines readers and a single writer to a stored Events slice.
 type ThreadsafeEvents struct {
 	events    *[]Event
 	m         *sync.RWMutex
 	nextIndex *uint64
 	max       uint64
+	recorders *[]EventRecorder
 }
 
 func copyEvents(a []Event) []Event {
@@ -63,7 +86,14 @@ func copyEvents(a []Event) []Event {
 // NewEvents creates a new single-writer-multiple-reader Threadsafe object
 func NewThreadsafeEvents(maxEvents uint64) ThreadsafeEvents {
 	i := uint64(0)
-	return ThreadsafeEvents{m: &sync.RWMutex{}, events: &[]Event{}, nextIndex: &i, max: maxEvents}
+	return ThreadsafeEvents{m: &sync.RWMutex{}, events: &[]Event{}, nextIndex: &i, max: maxEvents, recorders: &[]EventRecorder{}}
+}
+
+// AddRecorder adds an EventRecorder, which every subsequently added event is also given to.
+func (o *ThreadsafeEvents) AddRecorder(r EventRecorder) {
+	o.m.Lock()
+	*o.recorders = append(append([]EventRecorder(nil), *o.recorders...), r)
+	o.m.Unlock()
 }
 
 // Get returns the internal slice of Events for reading. This MUST NOT be modified. If modification is necessary, copy the slice.
@@ -87,5 +117,9 @@ func (o *ThreadsafeEvents) Add(e Event) {
 	// o.m.Lock()
 	*o.events = events
 	*o.nextIndex++
+	recorders := *o.recorders
 	o.m.Unlock()
+	for _, recorder := range recorders {
+		recorder.RecordEvent(e)
+	}
 }
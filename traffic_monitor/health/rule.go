@@ -0,0 +1,504 @@
+package health
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/lib/go-util"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+)
+
+// RuleStatPrefix is the prefix of the stats each threshold rule records in the cache's stat history.
+// The stat `health.rule.<name>` holds whether the rule has marked the cache available or unavailable, and `health.rule.<name>.since` holds the time the expression which would change that state started holding, or the empty string if it doesn't currently hold.
+const RuleStatPrefix = "health.rule."
+
+const (
+	RuleStateAvailable   = "available"
+	RuleStateUnavailable = "unavailable"
+)
+
+const ruleSinceSuffix = ".since"
+
+var errRuleStatMissing = errors.New("stat missing")
+
+// ruleExpr is a compiled rule expression. Booleans are represented as 1 and 0, and any non-zero value is true.
+type ruleExpr func(lookup func(stat string) (float64, error)) (float64, error)
+
+type compiledRuleExpr struct {
+	expr ruleExpr
+	err  error
+}
+
+// ruleExprs caches compiled expressions, since the monitor config is unmarshalled anew on every fetch. It is a map[string]compiledRuleExpr.
+var ruleExprs = sync.Map{}
+
+func compileRuleExpr(s string) (ruleExpr, error) {
+	if v, ok := ruleExprs.Load(s); ok {
+		c := v.(compiledRuleExpr)
+		return c.expr, c.err
+	}
+	expr, err := parseRuleExpr(s)
+	ruleExprs.Store(s, compiledRuleExpr{expr: expr, err: err})
+	return expr, err
+}
+
+// evalRules evaluates the profile's threshold rules against the cache's stat history, and records the new state of each rule in the history. It returns the name of the first rule, in name order, which has the cache marked unavailable, or the empty string if none do.
+// Because it stores to resultStats, evalRules must only be called by the single writer of the history.
+func evalRules(result cache.ResultInfo, resultStats *threadsafe.ResultStatValHistory, serverInfo tc.TrafficServer, serverProfile tc.TMProfile) string {
+	if len(serverProfile.Parameters.Rules) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(serverProfile.Parameters.Rules))
+	for name := range serverProfile.Parameters.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	limit := serverProfile.Parameters.HistoryCount
+	if limit < 1 {
+		limit = 1
+	}
+
+	computedStats := cache.ComputedStats()
+	lookup := func(stat string) (float64, error) {
+		val := interface{}(nil)
+		if computedStatF, ok := computedStats[stat]; ok {
+			val = computedStatF(result, serverInfo, serverProfile, tc.IsAvailable{})
+		} else {
+			history := resultStats.Load(stat)
+			if len(history) == 0 {
+				return 0, errRuleStatMissing
+			}
+			val = history[0].Val
+		}
+		if num, ok := ruleStatNumeric(val); ok {
+			return num, nil
+		}
+		return 0, fmt.Errorf("stat %s was not a number: %v", stat, val)
+	}
+
+	unavailableRule := ""
+	for _, name := range names {
+		rule := serverProfile.Parameters.Rules[name]
+		stateStat := RuleStatPrefix + name
+		sinceStat := stateStat + ruleSinceSuffix
+
+		unavailable := false
+		if history := resultStats.Load(stateStat); len(history) > 0 {
+			unavailable = history[0].Val == RuleStateUnavailable
+		}
+
+		exprStr, negate := rule.Down, false
+		if unavailable {
+			if rule.Up != "" {
+				exprStr = rule.Up
+			} else {
+				negate = true
+			}
+		}
+
+		held, err := evalRuleExpr(exprStr, lookup)
+		if err == errRuleStatMissing {
+			// like thresholds, a stat not in this poll neither marks the cache down nor brings it back
+		} else if err != nil {
+			log.Errorf("health.EvalCache cache %s rule %s expression '%s': %v", result.ID, name, exprStr, err)
+		} else {
+			unavailable = evalRuleHold(result.Time, resultStats, rule, sinceStat, held != negate, limit) != unavailable
+			state := RuleStateAvailable
+			if unavailable {
+				state = RuleStateUnavailable
+			}
+			storeRuleStat(resultStats, stateStat, state, result.Time, limit)
+		}
+
+		if unavailable && unavailableRule == "" {
+			unavailableRule = name
+		}
+	}
+	return unavailableRule
+}
+
+// evalRuleHold records whether the rule's current expression held in the given poll, and returns whether it has now held for long enough to change the rule's state.
+func evalRuleHold(pollTime time.Time, resultStats *threadsafe.ResultStatValHistory, rule tc.HealthRule, sinceStat string, held bool, limit int) bool {
+	if !held {
+		storeRuleStat(resultStats, sinceStat, "", pollTime, limit)
+		return false
+	}
+
+	since := pollTime
+	polls := uint64(1)
+	if history := resultStats.Load(sinceStat); len(history) > 0 {
+		if s, ok := history[0].Val.(string); ok && s != "" {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				since = t
+				polls = history[0].Span + 1
+			}
+		}
+	}
+
+	if polls >= uint64(rule.Polls) && pollTime.Sub(since).Seconds() >= rule.Seconds {
+		storeRuleStat(resultStats, sinceStat, "", pollTime, limit) // the state changes, so the expression for the new state hasn't held yet
+		return true
+	}
+	storeRuleStat(resultStats, sinceStat, since.Format(time.RFC3339Nano), pollTime, limit)
+	return false
+}
+
+// storeRuleStat adds the value to the history of the given stat, in the same manner as ResultStatHistory.Add.
+func storeRuleStat(resultStats *threadsafe.ResultStatValHistory, stat string, val string, t time.Time, limit int) {
+	history := resultStats.Load(stat)
+	if len(history) > 0 && history[0].Val == val {
+		history[0].Time = t
+		history[0].Span++
+		resultStats.Store(stat, history)
+		return
+	}
+	newHistory := make([]cache.ResultStatVal, 0, limit)
+	newHistory = append(newHistory, cache.ResultStatVal{Val: val, Time: t, Span: 1})
+	for i := 0; i < len(history) && len(newHistory) < limit; i++ {
+		newHistory = append(newHistory, history[i])
+	}
+	resultStats.Store(stat, newHistory)
+}
+
+func evalRuleExpr(s string, lookup func(stat string) (float64, error)) (bool, error) {
+	expr, err := compileRuleExpr(s)
+	if err != nil {
+		return false, err
+	}
+	val, err := expr(lookup)
+	if err != nil {
+		return false, err
+	}
+	return val != 0, nil
+}
+
+// ruleStatNumeric returns the numeric value of a stat. In addition to numbers, booleans and numeric strings are accepted, since stats are decoded from many formats.
+func ruleStatNumeric(v interface{}) (float64, bool) {
+	switch i := v.(type) {
+	case bool:
+		return boolToFloat(i), true
+	case string:
+		f, err := strconv.ParseFloat(i, 64)
+		return f, err == nil
+	default:
+		return util.ToNumeric(v)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseRuleExpr parses a rule expression. Expressions are made of numbers, `true`, `false`, stat names, the operators `|| && ! == != < <= > >= + - * /` with their usual C precedence, and parentheses.
+// Stat names may contain letters, digits, underscores, and dots; a stat with any other character in its name may be written in double quotes, for example `"error-string"`.
+func parseRuleExpr(s string) (ruleExpr, error) {
+	tokens, err := lexRuleExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos].val)
+	}
+	return expr, nil
+}
+
+type ruleTokenType int
+
+const (
+	ruleTokenOp ruleTokenType = iota
+	ruleTokenNum
+	ruleTokenStat
+)
+
+type ruleToken struct {
+	typ ruleTokenType
+	val string
+	num float64
+}
+
+func lexRuleExpr(s string) ([]ruleToken, error) {
+	tokens := []ruleToken{}
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			start := i
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.' || rs[i] == 'e' || rs[i] == 'E' || ((rs[i] == '-' || rs[i] == '+') && (rs[i-1] == 'e' || rs[i-1] == 'E'))) {
+				i++
+			}
+			num, err := strconv.ParseFloat(string(rs[start:i]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s'", string(rs[start:i]))
+			}
+			tokens = append(tokens, ruleToken{typ: ruleTokenNum, val: string(rs[start:i]), num: num})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i]) || rs[i] == '_' || rs[i] == '.') {
+				i++
+			}
+			name := string(rs[start:i])
+			switch name {
+			case "true":
+				tokens = append(tokens, ruleToken{typ: ruleTokenNum, val: name, num: 1})
+			case "false":
+				tokens = append(tokens, ruleToken{typ: ruleTokenNum, val: name, num: 0})
+			default:
+				tokens = append(tokens, ruleToken{typ: ruleTokenStat, val: name})
+			}
+		case r == '"':
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end == len(rs) {
+				return nil, errors.New("unterminated quoted stat name")
+			}
+			tokens = append(tokens, ruleToken{typ: ruleTokenStat, val: string(rs[i+1 : end])})
+			i = end + 1
+		default:
+			op := string(r)
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			switch op {
+			case "&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")":
+			default:
+				return nil, fmt.Errorf("unexpected character '%s'", op)
+			}
+			tokens = append(tokens, ruleToken{typ: ruleTokenOp, val: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+// acceptOp consumes and returns the next token if it's one of the given operators.
+func (p *ruleParser) acceptOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].typ != ruleTokenOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].val == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOp("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a != 0 || b != 0) })
+	}
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOp("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a != 0 && b != 0) })
+	}
+}
+
+func (p *ruleParser) parseComparison() (ruleExpr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.acceptOp("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "==":
+		return ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a == b) }), nil
+	case "!=":
+		return ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a != b) }), nil
+	case "<=":
+		return ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a <= b) }), nil
+	case ">=":
+		return ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a >= b) }), nil
+	case "<":
+		return ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a < b) }), nil
+	default:
+		return ruleBinary(left, right, func(a, b float64) float64 { return boolToFloat(a > b) }), nil
+	}
+}
+
+func (p *ruleParser) parseSum() (ruleExpr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.acceptOp("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			left = ruleBinary(left, right, func(a, b float64) float64 { return a + b })
+		} else {
+			left = ruleBinary(left, right, func(a, b float64) float64 { return a - b })
+		}
+	}
+}
+
+func (p *ruleParser) parseProduct() (ruleExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.acceptOp("*", "/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "*" {
+			left = ruleBinary(left, right, func(a, b float64) float64 { return a * b })
+		} else {
+			left = ruleBinary(left, right, func(a, b float64) float64 { return a / b })
+		}
+	}
+}
+
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	op, ok := p.acceptOp("!", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(lookup func(stat string) (float64, error)) (float64, error) {
+		v, err := operand(lookup)
+		if err != nil {
+			return 0, err
+		}
+		if op == "!" {
+			return boolToFloat(v == 0), nil
+		}
+		return -v, nil
+	}, nil
+}
+
+func (p *ruleParser) parsePrimary() (ruleExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	if _, ok := p.acceptOp("("); ok {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.acceptOp(")"); !ok {
+			return nil, errors.New("missing ')'")
+		}
+		return expr, nil
+	}
+	tok := p.tokens[p.pos]
+	switch tok.typ {
+	case ruleTokenNum:
+		p.pos++
+		return func(lookup func(stat string) (float64, error)) (float64, error) { return tok.num, nil }, nil
+	case ruleTokenStat:
+		p.pos++
+		return func(lookup func(stat string) (float64, error)) (float64, error) { return lookup(tok.val) }, nil
+	default:
+		return nil, fmt.Errorf("unexpected '%s'", tok.val)
+	}
+}
+
+func ruleBinary(left, right ruleExpr, f func(a, b float64) float64) ruleExpr {
+	return func(lookup func(stat string) (float64, error)) (float64, error) {
+		a, err := left(lookup)
+		if err != nil {
+			return 0, err
+		}
+		b, err := right(lookup)
+		if err != nil {
+			return 0, err
+		}
+		return f(a, b), nil
+	}
+}
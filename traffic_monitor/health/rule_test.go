@@ -0,0 +1,193 @@
+package health
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+func TestParseRuleExpr(t *testing.T) {
+	stats := map[string]float64{"loadavg": 25, "kbps": 950, "maxKbps": 1000, "error-string": 0}
+	lookup := func(stat string) (float64, error) {
+		if v, ok := stats[stat]; ok {
+			return v, nil
+		}
+		return 0, errRuleStatMissing
+	}
+
+	exprs := map[string]bool{
+		"loadavg > 20 && kbps > 0.9*maxKbps":   true,
+		"loadavg > 20 && kbps > 0.96*maxKbps":  false,
+		"loadavg > 30 || kbps >= maxKbps - 50": true,
+		"!(loadavg > 20)":                      false,
+		"-loadavg + 2 * 10 < 0":                true,
+		`"error-string" == 0`:                  true,
+		"true && !false":                       true,
+		"(1 + 2) * 3 == 9":                     true,
+	}
+	for s, expected := range exprs {
+		actual, err := evalRuleExpr(s, lookup)
+		if err != nil {
+			t.Errorf("evalRuleExpr('%s') expected no error, actual: %v", s, err)
+		} else if actual != expected {
+			t.Errorf("evalRuleExpr('%s') expected %v, actual %v", s, expected, actual)
+		}
+	}
+
+	if _, err := evalRuleExpr("nonexistent > 1", lookup); err != errRuleStatMissing {
+		t.Errorf("evalRuleExpr with missing stat expected errRuleStatMissing, actual: %v", err)
+	}
+
+	for _, s := range []string{"", "loadavg >", "(loadavg > 1", "loadavg > 1)", "loadavg # 1", `"loadavg`, "loadavg 1"} {
+		if _, err := parseRuleExpr(s); err == nil {
+			t.Errorf("parseRuleExpr('%s') expected error, actual: nil", s)
+		}
+	}
+}
+
+func TestEvalRules(t *testing.T) {
+	serverInfo := tc.TrafficServer{ServerStatus: string(tc.CacheStatusReported), Profile: "myProfileName"}
+	serverProfile := tc.TMProfile{
+		Name: serverInfo.Profile,
+		Parameters: tc.TMParameters{
+			HistoryCount: 5,
+			Rules: map[string]tc.HealthRule{
+				"overload": tc.HealthRule{
+					Down:    "loadavg > 20",
+					Up:      "loadavg < 10",
+					Polls:   3,
+					Seconds: 0,
+				},
+			},
+		},
+	}
+	resultStats := threadsafe.NewResultStatValHistory()
+
+	start := time.Now()
+	poll := func(i int, loadavg float64) string {
+		result := cache.ResultInfo{ID: "myCacheName", Time: start.Add(time.Duration(i) * 10 * time.Second), Vitals: cache.Vitals{LoadAvg: loadavg}}
+		return evalRules(result, &resultStats, serverInfo, serverProfile)
+	}
+
+	// loads over the mark-down level must hold for 3 polls
+	loads := []float64{25, 25, 5, 25, 25}
+	for i, load := range loads {
+		if rule := poll(i, load); rule != "" {
+			t.Fatalf("evalRules poll %d expected available, actual unavailable from rule '%s'", i, rule)
+		}
+	}
+	if rule := poll(len(loads), 25); rule != "overload" {
+		t.Fatalf("evalRules after 3 polls over the mark-down level expected unavailable from 'overload', actual '%s'", rule)
+	}
+
+	// loads between the mark-down and mark-up levels keep the cache unavailable
+	loads = []float64{15, 5, 5, 15, 5, 5}
+	for i, load := range loads {
+		if rule := poll(i+10, load); rule != "overload" {
+			t.Fatalf("evalRules poll %d expected unavailable, actual '%s'", i+10, rule)
+		}
+	}
+	if rule := poll(20, 5); rule != "" {
+		t.Fatalf("evalRules after 3 polls under the mark-up level expected available, actual unavailable from rule '%s'", rule)
+	}
+
+	if history := resultStats.Load(RuleStatPrefix + "overload"); len(history) == 0 || history[0].Val != RuleStateAvailable {
+		t.Errorf("evalRules expected rule state stat %s, actual %+v", RuleStateAvailable, history)
+	}
+
+	// a duration window requires the expression to hold for that long, regardless of the number of polls
+	serverProfile.Parameters.Rules["overload"] = tc.HealthRule{Down: "loadavg > 20", Polls: 1, Seconds: 30}
+	for i := 30; i < 33; i++ {
+		if rule := poll(i, 25); rule != "" {
+			t.Fatalf("evalRules poll %d before 30 seconds expected available, actual unavailable from rule '%s'", i, rule)
+		}
+	}
+	if rule := poll(33, 25); rule != "overload" {
+		t.Fatalf("evalRules after 30 seconds expected unavailable from 'overload', actual '%s'", rule)
+	}
+	// with no Up expression, the negation of Down must hold for the window
+	if rule := poll(34, 5); rule != "overload" {
+		t.Fatalf("evalRules before 30 seconds under the mark-down level expected unavailable, actual '%s'", rule)
+	}
+}
+
+func TestCalcAvailabilityRules(t *testing.T) {
+	result := cache.Result{
+		ID:            "myCacheName",
+		Miscellaneous: map[string]interface{}{},
+		Time:          time.Now(),
+		Vitals:        cache.Vitals{LoadAvg: 25},
+		Available:     true,
+		UsingIPv4:     true,
+	}
+	mc := tc.TrafficMonitorConfigMap{
+		TrafficServer: map[string]tc.TrafficServer{
+			string(result.ID): {ServerStatus: string(tc.CacheStatusReported), Profile: "myProfileName", IP: "192.0.2.1"},
+		},
+		Profile: map[string]tc.TMProfile{
+			"myProfileName": {
+				Name: "myProfileName",
+				Parameters: tc.TMParameters{
+					Rules: map[string]tc.HealthRule{"overload": {Down: "loadavg > 20", Polls: 1}},
+				},
+			},
+		},
+	}
+	toData := todata.TOData{
+		ServerTypes:            map[tc.CacheName]tc.CacheType{tc.CacheName(result.ID): tc.CacheTypeEdge},
+		DeliveryServiceServers: map[tc.DeliveryServiceName][]tc.CacheName{},
+		ServerCachegroups:      map[tc.CacheName]tc.CacheGroupName{},
+	}
+	statResultHistory := threadsafe.NewResultStatHistory()
+	localCacheStatusThreadsafe := threadsafe.NewCacheAvailableStatus()
+	localStates := peer.NewCRStatesThreadsafe()
+	events := NewThreadsafeEvents(200)
+
+	available := func() bool {
+		return localCacheStatusThreadsafe.Get()[tc.CacheName(result.ID)].ProcessedAvailable
+	}
+
+	CalcAvailability([]cache.Result{result}, "stat", &statResultHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, nil, config.IPv4Only)
+	if available() {
+		t.Fatalf("expected rule over the mark-down level to mark unavailable, actual available")
+	} else if stat := localCacheStatusThreadsafe.Get()[tc.CacheName(result.ID)].UnavailableStat; stat != RuleStatPrefix+"overload" {
+		t.Fatalf("UnavailableStat expected %s, actual %s", RuleStatPrefix+"overload", stat)
+	}
+
+	// the health poller can't evaluate rules, so mustn't bring the cache back
+	result.Vitals.LoadAvg = 5
+	CalcAvailability([]cache.Result{result}, "health", nil, mc, toData, localCacheStatusThreadsafe, localStates, events, nil, config.IPv4Only)
+	if available() {
+		t.Fatalf("expected health poll not to mark available from a rule, actual available")
+	}
+
+	CalcAvailability([]cache.Result{result}, "stat", &statResultHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, nil, config.IPv4Only)
+	if !available() {
+		t.Fatalf("expected stat poll under the mark-down level to mark available, actual unavailable")
+	}
+}
@@ -0,0 +1,448 @@
+// Package historydb is an optional on-disk store of cache stats and events, so they are kept across restarts, and for longer than the in-memory stat history and event log.
+package historydb
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const StatBucketName = "stats"
+const EventBucketName = "events"
+
+// writeQueueSize is the number of writes which may be waiting to be written. Writes beyond this are dropped, rather than blocking polling.
+const writeQueueSize = 1024
+
+// PruneInterval is how often samples and events older than the retention are deleted.
+const PruneInterval = time.Minute
+
+// DB stores cache stats and events in a bbolt database.
+//
+// Stats are stored in a bucket per cache, containing a bucket per stat, keyed by the time the value was first seen. Like ResultStatHistory, if a stat has the same value as its last sample, the last sample's time and span are updated, rather than storing a new sample.
+//
+// Writes are queued and done by a single goroutine, batching all queued writes into one transaction, so adding stats and events never blocks on the disk.
+type DB struct {
+	db             *bolt.DB
+	writes         chan func(tx *bolt.Tx) error
+	done           chan struct{}
+	closeM         sync.RWMutex // guards closed and sending on writes
+	closed         bool
+	statRetention  time.Duration
+	eventRetention time.Duration
+}
+
+// Open opens or creates the database at the given path, and starts writing and pruning. Stat samples older than statRetention and events older than eventRetention are deleted; a retention of 0 keeps them forever.
+func Open(path string, statRetention time.Duration, eventRetention time.Duration) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.New("opening database '" + path + "': " + err.Error())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{StatBucketName, EventBucketName} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return errors.New("creating bucket '" + name + "': " + err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.New("creating buckets for database '" + path + "': " + err.Error())
+	}
+
+	d := &DB{
+		db:             db,
+		writes:         make(chan func(tx *bolt.Tx) error, writeQueueSize),
+		done:           make(chan struct{}),
+		statRetention:  statRetention,
+		eventRetention: eventRetention,
+	}
+	go d.write()
+	return d, nil
+}
+
+// Close waits for all queued writes to finish, and closes the database. Stats and events added after Close is called are dropped.
+func (d *DB) Close() error {
+	d.closeM.Lock()
+	if d.closed {
+		d.closeM.Unlock()
+		return nil
+	}
+	d.closed = true
+	close(d.writes)
+	d.closeM.Unlock()
+	<-d.done
+	return d.db.Close()
+}
+
+// write does all queued writes, and prunes every PruneInterval, until Close is called.
+func (d *DB) write() {
+	defer close(d.done)
+	pruneTicker := time.NewTicker(PruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case w, ok := <-d.writes:
+			if !ok {
+				return
+			}
+			writes := []func(tx *bolt.Tx) error{w}
+		queued:
+			for {
+				select {
+				case w, ok := <-d.writes:
+					if !ok {
+						break queued
+					}
+					writes = append(writes, w)
+				default:
+					break queued
+				}
+			}
+			err := d.db.Update(func(tx *bolt.Tx) error {
+				for _, w := range writes {
+					if err := w(tx); err != nil {
+						log.Errorln("history db writing: " + err.Error())
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Errorln("history db writing: " + err.Error())
+			}
+		case <-pruneTicker.C:
+			if err := d.Prune(time.Now()); err != nil {
+				log.Errorln("history db pruning: " + err.Error())
+			}
+		}
+	}
+}
+
+// enqueue queues the given write, dropping it if the queue is full or the database is closed.
+func (d *DB) enqueue(w func(tx *bolt.Tx) error) {
+	d.closeM.RLock()
+	defer d.closeM.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.writes <- w:
+	default:
+		log.Errorln("history db write queue full, dropping write")
+	}
+}
+
+// statSample is the stats of one cache from one poll, with each value formatted as it's served by the CacheStats API.
+type statSample struct {
+	cache tc.CacheName
+	time  time.Time
+	stats map[string]string
+}
+
+// AddResults queues the stats of the given results to be written, including the stats computed by Traffic Monitor, as served by the CacheStats API.
+func (d *DB) AddResults(results []cache.Result, mc tc.TrafficMonitorConfigMap, combinedStates tc.CRStates) {
+	computedStats := cache.ComputedStats()
+	samples := make([]statSample, 0, len(results))
+	for _, result := range results {
+		id := tc.CacheName(result.ID)
+		stats := make(map[string]string, len(result.Miscellaneous)+len(computedStats))
+		for stat, val := range result.Miscellaneous {
+			stats["ats."+stat] = fmt.Sprintf("%v", val) // TM1 prefixes ATS stats with 'ats.'
+		}
+		serverInfo := mc.TrafficServer[string(id)]
+		serverProfile := mc.Profile[serverInfo.Profile]
+		info := cache.ToInfo(result)
+		for stat, statValF := range computedStats {
+			stats[stat] = fmt.Sprintf("%v", statValF(info, serverInfo, serverProfile, combinedStates.Caches[id]))
+		}
+		samples = append(samples, statSample{cache: id, time: result.Time, stats: stats})
+	}
+	d.enqueue(func(tx *bolt.Tx) error { return putStats(tx, samples) })
+}
+
+func putStats(tx *bolt.Tx, samples []statSample) error {
+	statsBucket := tx.Bucket([]byte(StatBucketName))
+	for _, sample := range samples {
+		cacheBucket, err := statsBucket.CreateBucketIfNotExists([]byte(sample.cache))
+		if err != nil {
+			return errors.New("creating bucket for cache '" + string(sample.cache) + "': " + err.Error())
+		}
+		for stat, val := range sample.stats {
+			statBucket, err := cacheBucket.CreateBucketIfNotExists([]byte(stat))
+			if err != nil {
+				return errors.New("creating bucket for cache '" + string(sample.cache) + "' stat '" + stat + "': " + err.Error())
+			}
+			if k, v := statBucket.Cursor().Last(); k != nil {
+				if last, err := decodeStatVal(v); err == nil && last.Val == val {
+					last.Time = sample.time
+					last.Span++
+					k = append([]byte(nil), k...) // cursor keys are only valid until the next modification
+					if err := statBucket.Put(k, encodeStatVal(last)); err != nil {
+						return errors.New("putting cache '" + string(sample.cache) + "' stat '" + stat + "': " + err.Error())
+					}
+					continue
+				}
+			}
+			statVal := cache.ResultStatVal{Val: val, Time: sample.time, Span: 1}
+			if err := statBucket.Put(timeKey(sample.time), encodeStatVal(statVal)); err != nil {
+				return errors.New("putting cache '" + string(sample.cache) + "' stat '" + stat + "': " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Stats returns the stat samples of each cache which were polled between start and end inclusive, newest first, in the same form as the in-memory stat history. A sample is returned if any poll it spans is in the range. The filter's history max is applied to each stat in the range.
+func (d *DB) Stats(start time.Time, end time.Time, filter cache.Filter) (map[tc.CacheName]map[string][]cache.ResultStatVal, error) {
+	caches := map[tc.CacheName]map[string][]cache.ResultStatVal{}
+	endKey := timeKey(end)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(StatBucketName)).ForEach(func(cacheName []byte, v []byte) error {
+			id := tc.CacheName(cacheName)
+			if v != nil || !filter.UseCache(id) {
+				return nil
+			}
+			cacheBucket := tx.Bucket([]byte(StatBucketName)).Bucket(cacheName)
+			return cacheBucket.ForEach(func(statName []byte, v []byte) error {
+				stat := string(statName)
+				if v != nil || !filter.UseStat(stat) {
+					return nil
+				}
+				c := cacheBucket.Bucket(statName).Cursor()
+				k, v := c.Seek(endKey)
+				if k == nil {
+					k, v = c.Last()
+				} else if bytes.Compare(k, endKey) > 0 {
+					k, v = c.Prev()
+				}
+				historyCount := 1
+				for ; k != nil; k, v = c.Prev() {
+					val, err := decodeStatVal(v)
+					if err != nil {
+						return errors.New("decoding cache '" + string(id) + "' stat '" + stat + "': " + err.Error())
+					}
+					if val.Time.Before(start) || !filter.WithinStatHistoryMax(historyCount) {
+						break
+					}
+					if _, ok := caches[id]; !ok {
+						caches[id] = map[string][]cache.ResultStatVal{}
+					}
+					caches[id][stat] = append(caches[id][stat], val)
+					historyCount += int(val.Span)
+				}
+				return nil
+			})
+		})
+	})
+	return caches, err
+}
+
+// storedEvent is the stored form of a health.Event, which doesn't round-trip through JSON itself.
+type storedEvent struct {
+	Time          int64  `json:"time"`
+	Index         uint64 `json:"index"`
+	Description   string `json:"description"`
+	Name          string `json:"name"`
+	Hostname      string `json:"hostname"`
+	Type          string `json:"type"`
+	Kind          string `json:"kind"`
+	Available     bool   `json:"isAvailable"`
+	IPv4Available bool   `json:"ipv4Available"`
+	IPv6Available bool   `json:"ipv6Available"`
+}
+
+// RecordEvent queues the given event to be written. This fulfills the health.EventRecorder interface.
+func (d *DB) RecordEvent(e health.Event) {
+	d.enqueue(func(tx *bolt.Tx) error {
+		t := time.Time(e.Time)
+		v, err := json.Marshal(storedEvent{
+			Time:          t.UnixNano(),
+			Index:         e.Index,
+			Description:   e.Description,
+			Name:          e.Name,
+			Hostname:      e.Hostname,
+			Type:          e.Type,
+			Kind:          e.Kind,
+			Available:     e.Available,
+			IPv4Available: e.IPv4Available,
+			IPv6Available: e.IPv6Available,
+		})
+		if err != nil {
+			return errors.New("encoding event: " + err.Error())
+		}
+		// the index is added to the key, so events at the same time don't overwrite each other
+		k := make([]byte, 16)
+		copy(k, timeKey(t))
+		binary.BigEndian.PutUint64(k[8:], e.Index)
+		return tx.Bucket([]byte(EventBucketName)).Put(k, v)
+	})
+}
+
+// Events returns the events between start and end inclusive, newest first.
+func (d *DB) Events(start time.Time, end time.Time) ([]health.Event, error) {
+	events := []health.Event{}
+	endKey := timeKey(end)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(EventBucketName)).Cursor()
+		for k, v := c.Seek(timeKey(start)); k != nil && bytes.Compare(k[:8], endKey) <= 0; k, v = c.Next() {
+			e := storedEvent{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return errors.New("decoding event: " + err.Error())
+			}
+			events = append(events, health.Event{
+				Time:          health.Time(time.Unix(0, e.Time)),
+				Index:         e.Index,
+				Description:   e.Description,
+				Name:          e.Name,
+				Hostname:      e.Hostname,
+				Type:          e.Type,
+				Kind:          e.Kind,
+				Available:     e.Available,
+				IPv4Available: e.IPv4Available,
+				IPv6Available: e.IPv6Available,
+			})
+		}
+		return nil
+	})
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, err
+}
+
+// Prune deletes stat samples and events older than their retention, relative to the given time. Stat and cache buckets left empty are deleted, so removed caches and stats don't accumulate.
+func (d *DB) Prune(now time.Time) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if d.statRetention > 0 {
+			if err := pruneStats(tx.Bucket([]byte(StatBucketName)), now.Add(-d.statRetention)); err != nil {
+				return err
+			}
+		}
+		if d.eventRetention > 0 {
+			if err := pruneEvents(tx.Bucket([]byte(EventBucketName)), now.Add(-d.eventRetention)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func pruneStats(statsBucket *bolt.Bucket, cutoff time.Time) error {
+	// buckets can't be deleted while iterating, so names are collected first
+	for _, cacheName := range bucketNames(statsBucket) {
+		cacheBucket := statsBucket.Bucket(cacheName)
+		for _, statName := range bucketNames(cacheBucket) {
+			statBucket := cacheBucket.Bucket(statName)
+			oldKeys := [][]byte{}
+			c := statBucket.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if val, err := decodeStatVal(v); err == nil && !val.Time.Before(cutoff) {
+					break // samples are in time order, so all following samples are newer
+				}
+				oldKeys = append(oldKeys, append([]byte(nil), k...))
+			}
+			for _, k := range oldKeys {
+				if err := statBucket.Delete(k); err != nil {
+					return errors.New("deleting cache '" + string(cacheName) + "' stat '" + string(statName) + "': " + err.Error())
+				}
+			}
+			if k, _ := statBucket.Cursor().First(); k == nil {
+				if err := cacheBucket.DeleteBucket(statName); err != nil {
+					return errors.New("deleting cache '" + string(cacheName) + "' stat '" + string(statName) + "' bucket: " + err.Error())
+				}
+			}
+		}
+		if k, _ := cacheBucket.Cursor().First(); k == nil {
+			if err := statsBucket.DeleteBucket(cacheName); err != nil {
+				return errors.New("deleting cache '" + string(cacheName) + "' bucket: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func pruneEvents(eventBucket *bolt.Bucket, cutoff time.Time) error {
+	cutoffKey := timeKey(cutoff)
+	oldKeys := [][]byte{}
+	c := eventBucket.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], cutoffKey) < 0; k, _ = c.Next() {
+		oldKeys = append(oldKeys, append([]byte(nil), k...))
+	}
+	for _, k := range oldKeys {
+		if err := eventBucket.Delete(k); err != nil {
+			return errors.New("deleting event: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// bucketNames returns the names of the nested buckets in the given bucket.
+func bucketNames(b *bolt.Bucket) [][]byte {
+	names := [][]byte{}
+	b.ForEach(func(k []byte, v []byte) error {
+		if v == nil {
+			names = append(names, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	return names
+}
+
+// timeKey returns the big-endian nanoseconds since the epoch of the given time, which sorts in time order.
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+// encodeStatVal encodes the time and span of the given stat value as big-endian integers, followed by the value, which must be a string.
+func encodeStatVal(val cache.ResultStatVal) []byte {
+	s, _ := val.Val.(string)
+	v := make([]byte, 16+len(s))
+	binary.BigEndian.PutUint64(v, uint64(val.Time.UnixNano()))
+	binary.BigEndian.PutUint64(v[8:], val.Span)
+	copy(v[16:], s)
+	return v
+}
+
+func decodeStatVal(v []byte) (cache.ResultStatVal, error) {
+	if len(v) < 16 {
+		return cache.ResultStatVal{}, fmt.Errorf("malformed stat value of %d bytes", len(v))
+	}
+	return cache.ResultStatVal{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+		Span: binary.BigEndian.Uint64(v[8:]),
+		Val:  string(v[16:]),
+	}, nil
+}
@@ -0,0 +1,155 @@
+package historydb
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+)
+
+type fooFilter struct{ historyCount int }
+
+func (f fooFilter) UseStat(name string) bool        { return name == "ats.foo" }
+func (f fooFilter) UseCache(name tc.CacheName) bool { return true }
+func (f fooFilter) WithinStatHistoryMax(n int) bool {
+	return f.historyCount == 0 || n <= f.historyCount
+}
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "historydb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	db, err := Open(path, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+
+	start := time.Unix(1500000000, 0)
+	poll := func(i int, val float64) []cache.Result {
+		return []cache.Result{{ID: "cache0", Time: start.Add(time.Duration(i) * time.Second), Miscellaneous: map[string]interface{}{"foo": val}}}
+	}
+	// polls 0-2 are 1, 3-4 are 2, 5 is 1
+	for i, val := range []float64{1, 1, 1, 2, 2, 1} {
+		db.AddResults(poll(i, val), tc.TrafficMonitorConfigMap{}, tc.NewCRStates())
+	}
+	for i := 0; i < 3; i++ {
+		db.RecordEvent(health.Event{Time: health.Time(start.Add(time.Duration(i) * time.Second)), Index: uint64(i), Hostname: "cache0", Description: "event", Available: i%2 == 0})
+	}
+
+	// reopening checks that writes are flushed on close, and kept across restarts
+	if err := db.Close(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	db.RecordEvent(health.Event{Time: health.Time(start), Hostname: "cache0", Description: "dropped after close"}) // must not panic
+	if err := db.Close(); err != nil {
+		t.Fatalf("closing twice: %v", err)
+	}
+	if db, err = Open(path, time.Hour, 24*time.Hour); err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer db.Close()
+
+	caches, err := db.Stats(start, start.Add(time.Hour), fooFilter{})
+	if err != nil {
+		t.Fatalf("getting stats: %v", err)
+	}
+	vals := caches["cache0"]["ats.foo"]
+	if len(vals) != 3 {
+		t.Fatalf("stats expected 3 samples, actual %+v", caches)
+	}
+	expected := []struct {
+		val  string
+		time time.Time
+		span uint64
+	}{
+		{"1", start.Add(5 * time.Second), 1},
+		{"2", start.Add(4 * time.Second), 2},
+		{"1", start.Add(2 * time.Second), 3},
+	}
+	for i, e := range expected {
+		if vals[i].Val != e.val || !vals[i].Time.Equal(e.time) || vals[i].Span != e.span {
+			t.Errorf("stats sample %d expected %+v, actual %+v", i, e, vals[i])
+		}
+	}
+	if _, ok := caches["cache0"]["error-string"]; ok {
+		t.Errorf("stats expected filtered stats to be omitted, actual %+v", caches["cache0"])
+	}
+
+	// the range overlaps the middle of the first sample, and ends in the middle of the second
+	caches, err = db.Stats(start.Add(time.Second), start.Add(3*time.Second), fooFilter{})
+	if err != nil {
+		t.Fatalf("getting stats: %v", err)
+	}
+	if vals := caches["cache0"]["ats.foo"]; len(vals) != 2 || vals[0].Val != "2" || vals[1].Val != "1" {
+		t.Errorf("stats in range expected samples 2 and 1, actual %+v", vals)
+	}
+
+	caches, err = db.Stats(start, start.Add(time.Hour), fooFilter{historyCount: 1})
+	if err != nil {
+		t.Fatalf("getting stats: %v", err)
+	}
+	if vals := caches["cache0"]["ats.foo"]; len(vals) != 1 || vals[0].Val != "1" {
+		t.Errorf("stats with history count 1 expected 1 sample, actual %+v", vals)
+	}
+
+	events, err := db.Events(start.Add(time.Second), start.Add(2*time.Second))
+	if err != nil {
+		t.Fatalf("getting events: %v", err)
+	}
+	if len(events) != 2 || events[0].Index != 2 || events[1].Index != 1 || !events[0].Available || events[1].Available {
+		t.Errorf("events expected indexes 2 and 1 newest first, actual %+v", events)
+	}
+
+	if err := db.Prune(start.Add(time.Hour + 3*time.Second)); err != nil {
+		t.Fatalf("pruning: %v", err)
+	}
+	caches, err = db.Stats(time.Unix(0, 0), start.Add(time.Hour), fooFilter{})
+	if err != nil {
+		t.Fatalf("getting stats: %v", err)
+	}
+	if vals := caches["cache0"]["ats.foo"]; len(vals) != 2 {
+		t.Errorf("stats after pruning expected 2 samples, actual %+v", vals)
+	}
+	if events, err := db.Events(time.Unix(0, 0), start.Add(time.Hour)); err != nil || len(events) != 3 {
+		t.Errorf("events after pruning stats expected 3 events, actual %+v %v", events, err)
+	}
+
+	if err := db.Prune(start.Add(48 * time.Hour)); err != nil {
+		t.Fatalf("pruning: %v", err)
+	}
+	caches, err = db.Stats(time.Unix(0, 0), start.Add(48*time.Hour), fooFilter{})
+	if err != nil || len(caches) != 0 {
+		t.Errorf("stats after pruning all expected none, actual %+v %v", caches, err)
+	}
+	if events, err := db.Events(time.Unix(0, 0), start.Add(48*time.Hour)); err != nil || len(events) != 0 {
+		t.Errorf("events after pruning all expected none, actual %+v %v", events, err)
+	}
+}
@@ -0,0 +1,61 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
+)
+
+// crConfigEventName is the name of CRConfig events. There is a single CRConfig per Traffic Monitor, so it's always the same.
+const crConfigEventName = "CRConfig"
+
+// StartCRConfigEventManager adds an event each time a CRConfig request fails, including failing validation, and each time one succeeds after failing, by checking the Traffic Ops session's CRConfig history every interval. The hostname is this Traffic Monitor's.
+func StartCRConfigEventManager(toSession towrap.ITrafficOpsSession, interval time.Duration, hostname string, events health.ThreadsafeEvents) {
+	go func() {
+		lastReq := time.Time{}
+		failing := false
+		for range time.Tick(interval) {
+			lastReq, failing = addCRConfigEvents(toSession.CRConfigHistory(), lastReq, failing, hostname, events)
+		}
+	}()
+}
+
+// addCRConfigEvents adds events for the given CRConfig history requested after lastReq, where failing is whether the request at lastReq failed. Returns the time of the last request, and whether it failed.
+func addCRConfigEvents(hist []towrap.CRConfigStat, lastReq time.Time, failing bool, hostname string, events health.ThreadsafeEvents) (time.Time, bool) {
+	for _, stat := range hist {
+		if !stat.ReqTime.After(lastReq) {
+			continue
+		}
+		lastReq = stat.ReqTime
+		if stat.Err != nil {
+			failing = true
+			events.Add(health.Event{Time: health.Time(stat.ReqTime), Description: "CRConfig request to '" + stat.ReqAddr + "' failed: " + stat.Err.Error(), Name: crConfigEventName, Hostname: hostname, Type: "CRCONFIG", Kind: health.EventKindCRConfig, Available: false})
+			continue
+		}
+		if failing {
+			failing = false
+			events.Add(health.Event{Time: health.Time(stat.ReqTime), Description: "CRConfig request to '" + stat.ReqAddr + "' succeeded", Name: crConfigEventName, Hostname: hostname, Type: "CRCONFIG", Kind: health.EventKindCRConfig, Available: true})
+		}
+	}
+	return lastReq, failing
+}
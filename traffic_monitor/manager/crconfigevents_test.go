@@ -0,0 +1,57 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
+)
+
+func TestAddCRConfigEvents(t *testing.T) {
+	events := health.NewThreadsafeEvents(100)
+	start := time.Unix(1500000000, 0)
+	stat := func(i int, err error) towrap.CRConfigStat {
+		return towrap.CRConfigStat{ReqTime: start.Add(time.Duration(i) * time.Second), ReqAddr: "to", Err: err}
+	}
+
+	hist := []towrap.CRConfigStat{stat(0, nil), stat(1, errors.New("invalid CRConfig")), stat(2, errors.New("invalid CRConfig"))}
+	lastReq, failing := addCRConfigEvents(hist, time.Time{}, false, "tm0", events)
+	if !failing || !lastReq.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("expected failing at the last request, actual failing %t at %v", failing, lastReq)
+	}
+	if len(events.Get()) != 2 {
+		t.Fatalf("expected an event per failed request, actual %d", len(events.Get()))
+	}
+
+	// already seen requests must not add events again
+	hist = append(hist, stat(3, nil), stat(4, nil))
+	lastReq, failing = addCRConfigEvents(hist, lastReq, failing, "tm0", events)
+	evs := events.Get()
+	if failing || len(evs) != 3 {
+		t.Fatalf("expected one success event after failing, actual failing %t with %d events", failing, len(evs))
+	}
+	if e := evs[0]; !e.Available || e.Kind != health.EventKindCRConfig || e.Hostname != "tm0" {
+		t.Errorf("expected available crconfig event for tm0, actual %+v", e)
+	}
+}
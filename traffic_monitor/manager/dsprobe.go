@@ -0,0 +1,201 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR nCONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+// dsProbeMaxConcurrency is the most probes of a single Delivery Service which may be in flight at once.
+const dsProbeMaxConcurrency = 32
+
+// dsProbeMaxBodyBytes is the most of a probe's response body which is read. The rest is ignored, and not included in the latency.
+const dsProbeMaxBodyBytes = 1024 * 1024
+
+// StartDSProbeManager starts probing each Delivery Service with a configured synthetic health check, through each of its cache servers, every probe interval. Returns the latest results, which are used when calculating availability.
+func StartDSProbeManager(
+	cfg config.Config,
+	appData config.StaticAppData,
+	toData todata.TODataThreadsafe,
+	monitorConfig threadsafe.TrafficMonitorConfigMap,
+	events health.ThreadsafeEvents,
+) health.ThreadsafeDSProbeResults {
+	results := health.NewThreadsafeDSProbeResults()
+	for name, probe := range cfg.DSProbes {
+		go dsProbeManagerListen(tc.DeliveryServiceName(name), probe, appData.UserAgent, toData, monitorConfig, events, results)
+	}
+	return results
+}
+
+func dsProbeManagerListen(
+	ds tc.DeliveryServiceName,
+	probe config.DSProbe,
+	userAgent string,
+	toData todata.TODataThreadsafe,
+	monitorConfig threadsafe.TrafficMonitorConfigMap,
+	events health.ThreadsafeEvents,
+	results health.ThreadsafeDSProbeResults,
+) {
+	ticker := time.NewTicker(probe.Interval)
+	defer ticker.Stop()
+	for {
+		probeDeliveryService(ds, probe, userAgent, toData.Get(), monitorConfig.Get(), events, results)
+		<-ticker.C
+	}
+}
+
+// probeDeliveryService probes the given Delivery Service through each of its cache servers which isn't ADMIN_DOWN or OFFLINE, and sets the results. An event is added for each cache server whose result changed from the last probe, or which failed its first probe.
+func probeDeliveryService(
+	ds tc.DeliveryServiceName,
+	probe config.DSProbe,
+	userAgent string,
+	toData todata.TOData,
+	mc tc.TrafficMonitorConfigMap,
+	events health.ThreadsafeEvents,
+	results health.ThreadsafeDSProbeResults,
+) {
+	type cacheResult struct {
+		cache  tc.CacheName
+		result health.DSProbeResult
+	}
+	resultChan := make(chan cacheResult)
+	sem := make(chan struct{}, dsProbeMaxConcurrency)
+	probes := 0
+	for _, cacheName := range toData.DeliveryServiceServers[ds] {
+		server, ok := mc.TrafficServer[string(cacheName)]
+		if !ok {
+			continue
+		}
+		if status := tc.CacheStatusFromString(server.ServerStatus); status == tc.CacheStatusAdminDown || status == tc.CacheStatusOffline {
+			continue
+		}
+		probes++
+		go func(cacheName tc.CacheName, server tc.TrafficServer) {
+			sem <- struct{}{}
+			result := probeCache(probe, userAgent, server)
+			<-sem
+			resultChan <- cacheResult{cache: cacheName, result: result}
+		}(cacheName, server)
+	}
+
+	if probes == 0 {
+		log.Warnf("delivery service probe %s has no cache servers to probe\n", ds)
+	}
+
+	lastResults := results.Get()[ds]
+	newResults := make(map[tc.CacheName]health.DSProbeResult, probes)
+	for i := 0; i < probes; i++ {
+		r := <-resultChan
+		newResults[r.cache] = r.result
+		if lastResult, ok := lastResults[r.cache]; (ok && lastResult.Available == r.result.Available) || (!ok && r.result.Available) {
+			continue
+		}
+		log.Infof("Changing delivery service %s probe state for %s now: %t because %s", ds, r.cache, r.result.Available, r.result.Why)
+		events.Add(health.Event{Time: health.Time(time.Now()), Description: "Delivery Service " + string(ds) + " probe: " + r.result.Why, Name: string(ds), Hostname: string(r.cache), Type: toData.ServerTypes[r.cache].String(), Kind: health.EventKindDSProbe, Available: r.result.Available})
+	}
+	results.SetDeliveryService(ds, newResults)
+}
+
+// probeCache requests the probe's URL from the given cache server's address, and returns whether the response had the expected status within the max latency.
+func probeCache(probe config.DSProbe, userAgent string, server tc.TrafficServer) health.DSProbeResult {
+	result := health.DSProbeResult{Time: time.Now()}
+
+	u, err := url.Parse(probe.URL)
+	if err != nil {
+		result.Why = "invalid url: " + err.Error()
+		return result
+	}
+	ip := server.IP
+	if ip == "" {
+		ip = server.IP6
+	}
+	if ip == "" {
+		result.Why = "cache server has no IP address"
+		return result
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(ip, port)
+
+	// connect to the cache server, rather than the URL's host, while keeping the host for the Host header and TLS server name
+	dialer := &net.Dialer{Timeout: probe.Timeout}
+	client := &http.Client{
+		Timeout: probe.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	req, err := http.NewRequest(http.MethodGet, probe.URL, nil)
+	if err != nil {
+		result.Why = "creating request: " + err.Error()
+		return result
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Why = "request failed: " + err.Error()
+		return result
+	}
+	_, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, dsProbeMaxBodyBytes))
+	resp.Body.Close()
+	result.Latency = time.Since(result.Time)
+	result.StatusCode = resp.StatusCode
+	if err != nil {
+		result.Why = "reading response: " + err.Error()
+		return result
+	}
+
+	latencyMs := float64(result.Latency) / float64(time.Millisecond)
+	switch {
+	case resp.StatusCode != probe.ExpectedStatus:
+		result.Why = fmt.Sprintf("status %d, expected %d", resp.StatusCode, probe.ExpectedStatus)
+	case probe.MaxLatency > 0 && result.Latency > probe.MaxLatency:
+		result.Why = fmt.Sprintf("latency too high (%.2fms > %dms)", latencyMs, probe.MaxLatency/time.Millisecond)
+	default:
+		result.Available = true
+		result.Why = fmt.Sprintf("status %d in %.2fms", resp.StatusCode, latencyMs)
+	}
+	return result
+}
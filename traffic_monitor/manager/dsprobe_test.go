@@ -0,0 +1,95 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR nCONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+func TestProbeDeliveryService(t *testing.T) {
+	status := http.StatusOK
+	delay := time.Duration(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "ds0.example.net:"+r.URL.Query().Get("port") || r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		time.Sleep(delay)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	_, port, _ := net.SplitHostPort(srvURL.Host)
+
+	probe := config.DefaultDSProbe
+	probe.URL = "http://ds0.example.net:" + port + "/health?port=" + port
+	probe.MaxLatency = 100 * time.Millisecond
+
+	toData := todata.New()
+	toData.DeliveryServiceServers["ds0"] = []tc.CacheName{"cache0", "cache1", "cache2"}
+	toData.ServerTypes["cache0"] = tc.CacheTypeEdge
+	mc := tc.TrafficMonitorConfigMap{TrafficServer: map[string]tc.TrafficServer{
+		"cache0": {HostName: "cache0", IP: "127.0.0.1", ServerStatus: string(tc.CacheStatusReported)},
+		"cache1": {HostName: "cache1", IP: "127.0.0.1", ServerStatus: string(tc.CacheStatusAdminDown)},
+	}}
+	events := health.NewThreadsafeEvents(10)
+	results := health.NewThreadsafeDSProbeResults()
+
+	probeDeliveryService("ds0", probe, "traffic_monitor/test", *toData, mc, events, results)
+	if r, ok := results.Get()["ds0"]["cache0"]; !ok || !r.Available || r.StatusCode != http.StatusOK {
+		t.Errorf("probe expected available with status 200, actual %+v", r)
+	}
+	if len(results.Get()["ds0"]) != 1 {
+		t.Errorf("probe expected only REPORTED caches in the monitoring config to be probed, actual %+v", results.Get()["ds0"])
+	}
+	if len(events.Get()) != 0 {
+		t.Errorf("probe succeeding the first time expected no events, actual %+v", events.Get())
+	}
+
+	status = http.StatusBadGateway
+	probeDeliveryService("ds0", probe, "traffic_monitor/test", *toData, mc, events, results)
+	if r := results.Get()["ds0"]["cache0"]; r.Available || r.Why != "status 502, expected 200" {
+		t.Errorf("probe with wrong status expected unavailable, actual %+v", r)
+	}
+	if e := events.Get(); len(e) != 1 || e[0].Available || !strings.Contains(e[0].Description, "ds0") {
+		t.Errorf("probe changing availability expected 1 event, actual %+v", e)
+	}
+
+	status = http.StatusOK
+	delay = 200 * time.Millisecond
+	probeDeliveryService("ds0", probe, "traffic_monitor/test", *toData, mc, events, results)
+	if r := results.Get()["ds0"]["cache0"]; r.Available || !strings.HasPrefix(r.Why, "latency too high") {
+		t.Errorf("probe slower than max latency expected unavailable, actual %+v", r)
+	}
+	if len(events.Get()) != 1 {
+		t.Errorf("probe staying unavailable expected no new events, actual %+v", events.Get())
+	}
+}
@@ -48,6 +48,7 @@ func StartHealthResultManager(
 	cfg config.Config,
 	events health.ThreadsafeEvents,
 	localCacheStatus threadsafe.CacheAvailableStatus,
+	dsProbes health.ThreadsafeDSProbeResults,
 ) (threadsafe.DurationMap, threadsafe.ResultHistory) {
 	lastHealthDurations := threadsafe.NewDurationMap()
 	healthHistory := threadsafe.NewResultHistory()
@@ -63,6 +64,7 @@ func StartHealthResultManager(
 		errorCount,
 		events,
 		localCacheStatus,
+		dsProbes,
 		cfg,
 	)
 	return lastHealthDurations, healthHistory
@@ -80,6 +82,7 @@ func healthResultManagerListen(
 	errorCount threadsafe.Uint,
 	events health.ThreadsafeEvents,
 	localCacheStatus threadsafe.CacheAvailableStatus,
+	dsProbes health.ThreadsafeDSProbeResults,
 	cfg config.Config,
 ) {
 	lastHealthEndTimes := map[tc.CacheName]time.Time{}
@@ -101,6 +104,7 @@ func healthResultManagerListen(
 			lastHealthEndTimes,
 			healthHistory,
 			results,
+			dsProbes,
 			cfg,
 		)
 	}
@@ -147,6 +151,7 @@ func processHealthResult(
 	lastHealthEndTimes map[tc.CacheName]time.Time,
 	healthHistory threadsafe.ResultHistory,
 	results []cache.Result,
+	dsProbes health.ThreadsafeDSProbeResults,
 	cfg config.Config,
 ) {
 	if len(results) == 0 {
@@ -186,7 +191,7 @@ func processHealthResult(
 
 	pollerName := "health"
 	statResultHistoryNil := (*threadsafe.ResultStatHistory)(nil) // health poller doesn't have stats
-	health.CalcAvailability(results, pollerName, statResultHistoryNil, monitorConfigCopy, toDataCopy, localCacheStatusThreadsafe, localStates, events, cfg.CachePollingProtocol)
+	health.CalcAvailability(results, pollerName, statResultHistoryNil, monitorConfigCopy, toDataCopy, localCacheStatusThreadsafe, localStates, events, dsProbes.Get(), cfg.CachePollingProtocol)
 
 	healthHistory.Set(healthHistoryCopy)
 	// TODO determine if we should combineCrStates() here
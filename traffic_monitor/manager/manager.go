@@ -33,6 +33,8 @@ import (
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/handler"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/historydb"
+	"github.com/apache/trafficcontrol/traffic_monitor/notify"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/poller"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
@@ -68,6 +70,23 @@ func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData
 
 	events := health.NewThreadsafeEvents(cfg.MaxEvents)
 
+	var historyDB *historydb.DB
+	if cfg.HistoryDBPath != "" {
+		db, err := historydb.Open(cfg.HistoryDBPath, cfg.HistoryDBStatRetention, cfg.HistoryDBEventRetention)
+		if err != nil {
+			return fmt.Errorf("opening history database: %v", err)
+		}
+		historyDB = db
+		defer historyDB.Close()
+		closeOnTerminate(historyDB)
+		events.AddRecorder(historyDB)
+	}
+
+	if len(cfg.Notifications.Webhooks) > 0 {
+		events.AddRecorder(notify.New(cfg.Notifications, appData.Hostname, appData.UserAgent))
+	}
+	StartCRConfigEventManager(toSession, cfg.MonitorConfigPollingInterval, appData.Hostname, events)
+
 	cachesChanged := make(chan struct{})
 	peerStates := peer.NewCRStatesPeersThreadsafe(cfg.PeerOptimisticQuorumMin) // each peer's last state is saved in this map
 
@@ -86,7 +105,10 @@ func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData
 		toData,
 	)
 
-	combinedStates, combineStateFunc := StartStateCombiner(events, peerStates, localStates, toData)
+	dsProbes := StartDSProbeManager(cfg, appData, toData, monitorConfig, events)
+
+	crStatesStream := peer.NewCRStatesStream(cfg.CRStatesStreamHistory)
+	combinedStates, combineStateFunc := StartStateCombiner(events, peerStates, localStates, toData, crStatesStream, monitorConfig, cfg, appData)
 
 	StartPeerManager(
 		peerHandler.ResultChannel,
@@ -105,6 +127,8 @@ func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData
 		cfg,
 		monitorConfig,
 		events,
+		historyDB,
+		dsProbes,
 		combineStateFunc,
 	)
 
@@ -119,6 +143,7 @@ func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData
 		cfg,
 		events,
 		localCacheStatus,
+		dsProbes,
 	)
 
 	StartOpsConfigManager(
@@ -130,6 +155,7 @@ func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData
 		localStates,
 		peerStates,
 		combinedStates,
+		crStatesStream,
 		statInfoHistory,
 		statResultHistory,
 		statMaxKbpses,
@@ -137,6 +163,7 @@ func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData
 		lastKbpsStats,
 		dsStats,
 		events,
+		historyDB,
 		appData,
 		cacheHealthPoller.Config.Interval,
 		lastHealthDurations,
@@ -202,6 +229,20 @@ func startSignalFileReloader(filename string, sig os.Signal, f func([]byte, erro
 	}()
 }
 
+// closeOnTerminate starts a goroutine which, when the process is interrupted or terminated, closes the given history database, so queued writes aren't lost, and exits.
+func closeOnTerminate(historyDB *historydb.DB) {
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, unix.SIGINT, unix.SIGTERM)
+		sig := <-c
+		log.Infof("received %v, closing history database\n", sig)
+		if err := historyDB.Close(); err != nil {
+			log.Errorf("closing history database: %v\n", err)
+		}
+		os.Exit(0)
+	}()
+}
+
 // ipv6CIDRStrToAddr takes an IPv6 CIDR string, e.g. `2001:DB8::1/32` returns `2001:DB8::1`.
 // It does not verify cidr is a valid CIDR or IPv6. It only removes the first slash and everything after it, for performance.
 func ipv6CIDRStrToAddr(cidr string) string {
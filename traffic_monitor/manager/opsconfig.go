@@ -36,6 +36,7 @@ import (
 	"github.com/apache/trafficcontrol/traffic_monitor/datareq"
 	"github.com/apache/trafficcontrol/traffic_monitor/handler"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/historydb"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/srvhttp"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
@@ -57,6 +58,7 @@ func StartOpsConfigManager(
 	localStates peer.CRStatesThreadsafe,
 	peerStates peer.CRStatesPeersThreadsafe,
 	combinedStates peer.CRStatesThreadsafe,
+	crStatesStream *peer.CRStatesStream,
 	statInfoHistory threadsafe.ResultInfoHistory,
 	statResultHistory threadsafe.ResultStatHistory,
 	statMaxKbpses threadsafe.CacheKbpses,
@@ -64,6 +66,7 @@ func StartOpsConfigManager(
 	lastStats threadsafe.LastStats,
 	dsStats threadsafe.DSStatsReader,
 	events health.ThreadsafeEvents,
+	historyDB *historydb.DB,
 	staticAppData config.StaticAppData,
 	healthPollInterval time.Duration,
 	lastHealthDurations threadsafe.DurationMap,
@@ -113,12 +116,14 @@ func StartOpsConfigManager(
 			localStates,
 			peerStates,
 			combinedStates,
+			crStatesStream,
 			statInfoHistory,
 			statResultHistory,
 			statMaxKbpses,
 			healthHistory,
 			dsStats,
 			events,
+			historyDB,
 			staticAppData,
 			healthPollInterval,
 			lastHealthDurations,
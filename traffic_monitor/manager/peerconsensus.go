@@ -0,0 +1,195 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+// peerConsensus is how the states of this Traffic Monitor and its peers are combined.
+type peerConsensus struct {
+	Mode          config.PeerConsensus
+	CGWeight      float64
+	DistanceKm    float64
+	MaxPollAge    time.Duration
+	Self          tc.TrafficMonitorName
+	MonitorConfig tc.TrafficMonitorConfigMap
+}
+
+func newPeerConsensus(cfg config.Config, self string, monitorConfig tc.TrafficMonitorConfigMap) peerConsensus {
+	return peerConsensus{
+		Mode:          cfg.PeerConsensus,
+		CGWeight:      cfg.PeerConsensusCGWeight,
+		DistanceKm:    cfg.PeerConsensusDistanceKm,
+		MaxPollAge:    cfg.PeerMaxPollAge,
+		Self:          tc.TrafficMonitorName(self),
+		MonitorConfig: monitorConfig,
+	}
+}
+
+// trustPeer returns whether the given peer's states may be used, and if not, why. A peer must be available, and its latest calculation of its states from polling caches must not be older than MaxPollAge. Peers which don't report their poll time are trusted, since older Traffic Monitors don't.
+func (c peerConsensus) trustPeer(peerStates peer.CRStatesPeersThreadsafe, peerName tc.TrafficMonitorName) (bool, string) {
+	if !peerStates.GetPeerAvailability(peerName) {
+		return false, "unavailable"
+	}
+	if c.MaxPollAge <= 0 {
+		return true, ""
+	}
+	pollTime := peerStates.GetPeerPollTime(peerName)
+	if pollTime.IsZero() {
+		return true, ""
+	}
+	if age := time.Since(pollTime); age > c.MaxPollAge {
+		return false, fmt.Sprintf("stale poll data, %v old", age.Round(time.Second))
+	}
+	return true, ""
+}
+
+// weight returns the weight of the given Traffic Monitor's vote for a cache in the given cache group.
+func (c peerConsensus) weight(monitor tc.TrafficMonitorName, cacheGroup tc.CacheGroupName) float64 {
+	switch c.Mode {
+	case config.PeerConsensusCacheGroup:
+		if tc.CacheGroupName(c.MonitorConfig.TrafficMonitor[string(monitor)].Location) == cacheGroup {
+			return c.CGWeight
+		}
+		return 1
+	case config.PeerConsensusDistance:
+		monitorCG, monitorOK := c.MonitorConfig.CacheGroup[c.MonitorConfig.TrafficMonitor[string(monitor)].Location]
+		cacheCG, cacheOK := c.MonitorConfig.CacheGroup[string(cacheGroup)]
+		if !monitorOK || !cacheOK || c.DistanceKm <= 0 {
+			return 0.5 // as if the monitor were DistanceKm away
+		}
+		return c.DistanceKm / (c.DistanceKm + distanceKm(monitorCG.Coordinates, cacheCG.Coordinates))
+	default:
+		return 1
+	}
+}
+
+// earthRadiusKm is the mean radius of the Earth.
+const earthRadiusKm = 6371.0
+
+// distanceKm returns the great-circle distance between the given coordinates, by the haversine formula.
+func distanceKm(a tc.MonitoringCoordinates, b tc.MonitoringCoordinates) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLon := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// consensusTally is the weighted votes of Traffic Monitors for the availability of a single cache.
+type consensusTally struct {
+	Available       float64
+	Unavailable     float64
+	IPv4Available   float64
+	IPv4Unavailable float64
+	IPv6Available   float64
+	IPv6Unavailable float64
+	AvailableOn     []string
+	UnavailableOn   []string
+}
+
+func (t *consensusTally) add(name string, state tc.IsAvailable, weight float64) {
+	vote := fmt.Sprintf("%s=%.2f", name, weight)
+	if state.IsAvailable {
+		t.Available += weight
+		t.AvailableOn = append(t.AvailableOn, vote)
+	} else {
+		t.Unavailable += weight
+		t.UnavailableOn = append(t.UnavailableOn, vote)
+	}
+	if state.Ipv4Available {
+		t.IPv4Available += weight
+	} else {
+		t.IPv4Unavailable += weight
+	}
+	if state.Ipv6Available {
+		t.IPv6Available += weight
+	} else {
+		t.IPv6Unavailable += weight
+	}
+}
+
+// result returns the availability with the greater weight of votes. Ties are broken by the local state.
+func (t consensusTally) result(local tc.IsAvailable) tc.IsAvailable {
+	majority := func(available float64, unavailable float64, tie bool) bool {
+		if available == unavailable {
+			return tie
+		}
+		return available > unavailable
+	}
+	state := tc.IsAvailable{IsAvailable: majority(t.Available, t.Unavailable, local.IsAvailable)}
+	if state.IsAvailable {
+		state.Ipv4Available = majority(t.IPv4Available, t.IPv4Unavailable, local.Ipv4Available)
+		state.Ipv6Available = majority(t.IPv6Available, t.IPv6Unavailable, local.Ipv6Available)
+	}
+	return state
+}
+
+func (t consensusTally) String() string {
+	sort.Strings(t.AvailableOn)
+	sort.Strings(t.UnavailableOn)
+	return fmt.Sprintf("available %.2f (%s), unavailable %.2f (%s)", t.Available, strings.Join(t.AvailableOn, ", "), t.Unavailable, strings.Join(t.UnavailableOn, ", "))
+}
+
+// combineCacheStateConsensus combines the states of a cache by the weighted votes of this Traffic Monitor and its trusted peers. Whenever the combined availability changes, or differs from the local availability when first combined, the votes are recorded in the event log.
+func combineCacheStateConsensus(cacheName tc.CacheName, localCacheState tc.IsAvailable, events health.ThreadsafeEvents, consensus peerConsensus, peerStates peer.CRStatesPeersThreadsafe, combinedStates peer.CRStatesThreadsafe, toData todata.TOData) {
+	cacheGroup := toData.ServerCachegroups[cacheName]
+
+	tally := consensusTally{}
+	tally.add(consensus.Self.String()+" (local)", localCacheState, consensus.weight(consensus.Self, cacheGroup))
+
+	distrusted := []string{}
+	for peerName, peerCrStates := range peerStates.GetCrstates() {
+		if trusted, why := consensus.trustPeer(peerStates, peerName); !trusted {
+			distrusted = append(distrusted, peerName.String()+" "+why)
+			continue
+		}
+		peerCacheState, ok := peerCrStates.Caches[cacheName]
+		if !ok {
+			continue // the peer doesn't monitor this cache, or hasn't gotten it from Traffic Ops yet
+		}
+		tally.add(peerName.String(), peerCacheState, consensus.weight(peerName, cacheGroup))
+	}
+
+	combined := tally.result(localCacheState)
+
+	previous, hasPrevious := combinedStates.GetCache(cacheName)
+	if (hasPrevious && previous.IsAvailable != combined.IsAvailable) || (!hasPrevious && combined.IsAvailable != localCacheState.IsAvailable) {
+		description := fmt.Sprintf("Health protocol %s consensus: %s", consensus.Mode, tally)
+		if len(distrusted) > 0 {
+			sort.Strings(distrusted)
+			description += "; distrusted " + strings.Join(distrusted, ", ")
+		}
+		events.Add(health.Event{Time: health.Time(time.Now()), Description: description, Name: cacheName.String(), Hostname: cacheName.String(), Type: toData.ServerTypes[cacheName].String(), Kind: health.EventKindPeerDisagreement, Available: combined.IsAvailable, IPv4Available: combined.Ipv4Available, IPv6Available: combined.Ipv6Available})
+	}
+
+	combinedStates.AddCache(cacheName, combined)
+}
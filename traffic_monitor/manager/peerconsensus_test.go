@@ -0,0 +1,146 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+func TestCombineCacheStateConsensus(t *testing.T) {
+	const cacheName = tc.CacheName("cache0")
+	available := tc.IsAvailable{IsAvailable: true, Ipv4Available: true, Ipv6Available: true}
+	unavailable := tc.IsAvailable{}
+
+	mc := tc.TrafficMonitorConfigMap{
+		TrafficMonitor: map[string]tc.TrafficMonitor{
+			"self":  {HostName: "self", Location: "cgFar"},
+			"near":  {HostName: "near", Location: "cgNear"},
+			"far":   {HostName: "far", Location: "cgFar"},
+			"stale": {HostName: "stale", Location: "cgNear"},
+		},
+		CacheGroup: map[string]tc.TMCacheGroup{
+			"cgNear": {Name: "cgNear", Coordinates: tc.MonitoringCoordinates{Latitude: 40, Longitude: -105}},
+			"cgFar":  {Name: "cgFar", Coordinates: tc.MonitoringCoordinates{Latitude: 51, Longitude: 0}},
+		},
+	}
+	toData := todata.New()
+	toData.ServerCachegroups[cacheName] = "cgNear"
+	toData.ServerTypes[cacheName] = tc.CacheTypeEdge
+
+	now := time.Now()
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	addPeer := func(name tc.TrafficMonitorName, state tc.IsAvailable, pollTime time.Time) {
+		crStates := tc.NewCRStates()
+		crStates.Caches[cacheName] = state
+		peerStates.Set(peer.Result{ID: name, Available: true, PeerStates: crStates, Time: now, PollTime: pollTime})
+	}
+	addPeer("near", available, now)
+	addPeer("far", unavailable, now)
+	addPeer("stale", available, now.Add(-time.Hour))
+	peerStates.SetPeers(map[tc.TrafficMonitorName]struct{}{"near": {}, "far": {}, "stale": {}})
+
+	cfg := config.DefaultConfig
+	combine := func(mode config.PeerConsensus, local tc.IsAvailable) (tc.IsAvailable, []health.Event) {
+		cfg.PeerConsensus = mode
+		events := health.NewThreadsafeEvents(10)
+		combinedStates := peer.NewCRStatesThreadsafe()
+		combineCacheStateConsensus(cacheName, local, events, newPeerConsensus(cfg, "self", mc), peerStates, combinedStates, *toData)
+		state, _ := combinedStates.GetCache(cacheName)
+		return state, events.Get()
+	}
+
+	// majority: self and far against near, with the stale peer distrusted
+	if state, events := combine(config.PeerConsensusMajority, unavailable); state.IsAvailable {
+		t.Errorf("majority consensus expected unavailable, actual available")
+	} else if len(events) != 0 {
+		t.Errorf("majority consensus agreeing with local state expected no events, actual %+v", events)
+	}
+
+	// cachegroup: near is in the cache's cache group, so its vote of 2 ties self and far, and the tie goes to the local state
+	if state, _ := combine(config.PeerConsensusCacheGroup, unavailable); state.IsAvailable {
+		t.Errorf("cachegroup consensus tied expected local unavailable, actual available")
+	}
+	if state, events := combine(config.PeerConsensusCacheGroup, available); !state.IsAvailable || !state.Ipv4Available {
+		t.Errorf("cachegroup consensus tied expected local available, actual %+v", state)
+	} else if len(events) != 0 {
+		t.Errorf("cachegroup consensus agreeing with local state expected no events, actual %+v", events)
+	}
+
+	// distance: near is close to the cache, and self and far are across the Atlantic
+	state, events := combine(config.PeerConsensusDistance, unavailable)
+	if !state.IsAvailable {
+		t.Errorf("distance consensus expected available, actual unavailable")
+	}
+	if len(events) != 1 {
+		t.Fatalf("distance consensus overriding local state expected 1 event, actual %+v", events)
+	} else if desc := events[0].Description; !strings.Contains(desc, "distance consensus") || !strings.Contains(desc, "near=1.00") || !strings.Contains(desc, "distrusted stale stale poll data") {
+		t.Errorf("distance consensus event expected votes and distrusted peers, actual '%s'", desc)
+	}
+}
+
+func TestCombineDSStateTrustsPeers(t *testing.T) {
+	const dsName = tc.DeliveryServiceName("ds0")
+	now := time.Now()
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	addPeer := func(name tc.TrafficMonitorName, available bool, disabled []tc.CacheGroupName, pollTime time.Time) {
+		crStates := tc.NewCRStates()
+		crStates.DeliveryService[dsName] = tc.CRStatesDeliveryService{IsAvailable: available, DisabledLocations: disabled}
+		peerStates.Set(peer.Result{ID: name, Available: true, PeerStates: crStates, Time: now, PollTime: pollTime})
+	}
+	addPeer("fresh", false, []tc.CacheGroupName{"cg0", "cg1"}, now)
+	addPeer("stale", true, nil, now.Add(-time.Hour))
+	peerStates.SetPeers(map[tc.TrafficMonitorName]struct{}{"fresh": {}, "stale": {}})
+
+	combinedStates := peer.NewCRStatesThreadsafe()
+	local := tc.CRStatesDeliveryService{IsAvailable: false, DisabledLocations: []tc.CacheGroupName{"cg0"}}
+	consensus := newPeerConsensus(config.DefaultConfig, "self", tc.TrafficMonitorConfigMap{})
+	combineDSState(dsName, local, health.NewThreadsafeEvents(10), true, consensus, peerStates, tc.NewCRStates(), combinedStates, map[tc.CacheName]bool{}, *todata.New())
+
+	ds, ok := combinedStates.GetDeliveryService(dsName)
+	if !ok {
+		t.Fatalf("expected combined delivery service %v, actual none", dsName)
+	}
+	if ds.IsAvailable {
+		t.Errorf("delivery service unavailable locally and on trusted peers expected unavailable, ignoring the stale peer, actual available")
+	}
+	if len(ds.DisabledLocations) != 1 || ds.DisabledLocations[0] != "cg0" {
+		t.Errorf("expected disabled locations [cg0], ignoring the stale peer, actual %v", ds.DisabledLocations)
+	}
+}
+
+func TestDistanceKm(t *testing.T) {
+	denver := tc.MonitoringCoordinates{Latitude: 39.7392, Longitude: -104.9903}
+	london := tc.MonitoringCoordinates{Latitude: 51.5074, Longitude: -0.1278}
+	if d := distanceKm(denver, london); math.Abs(d-7540) > 25 {
+		t.Errorf("distanceKm Denver to London expected about 7540, actual %v", d)
+	}
+	if d := distanceKm(denver, denver); d != 0 {
+		t.Errorf("distanceKm to itself expected 0, actual %v", d)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/ds"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/historydb"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
@@ -68,6 +69,8 @@ func StartStatHistoryManager(
 	cfg config.Config,
 	monitorConfig threadsafe.TrafficMonitorConfigMap,
 	events health.ThreadsafeEvents,
+	historyDB *historydb.DB,
+	dsProbes health.ThreadsafeDSProbeResults,
 	combineState func(),
 ) (threadsafe.ResultInfoHistory, threadsafe.ResultStatHistory, threadsafe.CacheKbpses, threadsafe.DurationMap, threadsafe.LastStats, threadsafe.DSStatsReader, threadsafe.UnpolledCaches, threadsafe.CacheAvailableStatus) {
 	statInfoHistory := threadsafe.NewResultInfoHistory()
@@ -98,7 +101,7 @@ func StartStatHistoryManager(
 		if haveCachesChanged() {
 			unpolledCaches.SetNewCaches(getNewCaches(localStates, monitorConfig))
 		}
-		processStatResults(results, statInfoHistory, statResultHistory, statMaxKbpses, combinedStates, lastStats, toData.Get(), errorCount, dsStats, lastStatEndTimes, lastStatDurations, unpolledCaches, monitorConfig.Get(), precomputedData, lastResults, localStates, events, localCacheStatus, overrideMap, combineState, cfg.CachePollingProtocol)
+		processStatResults(results, statInfoHistory, statResultHistory, statMaxKbpses, combinedStates, lastStats, toData.Get(), errorCount, dsStats, lastStatEndTimes, lastStatDurations, unpolledCaches, monitorConfig.Get(), precomputedData, lastResults, localStates, events, localCacheStatus, overrideMap, combineState, cfg.CachePollingProtocol, historyDB, dsProbes)
 	}
 
 	go func() {
@@ -255,6 +258,8 @@ func processStatResults(
 	overrideMap map[tc.CacheName]bool,
 	combineState func(),
 	pollingProtocol config.PollingProtocol,
+	historyDB *historydb.DB,
+	dsProbes health.ThreadsafeDSProbeResults,
 ) {
 	if len(results) == 0 {
 		return
@@ -320,9 +325,13 @@ func processStatResults(
 	}
 
 	pollerName := "stat"
-	health.CalcAvailability(results, pollerName, &statResultHistoryThreadsafe, mc, toData, localCacheStatusThreadsafe, localStates, events, pollingProtocol)
+	health.CalcAvailability(results, pollerName, &statResultHistoryThreadsafe, mc, toData, localCacheStatusThreadsafe, localStates, events, dsProbes.Get(), pollingProtocol)
 	combineState()
 
+	if historyDB != nil {
+		historyDB.AddResults(results, mc, combinedStatesThreadsafe.Get())
+	}
+
 	endTime := time.Now()
 	lastStatDurations := threadsafe.CopyDurationMap(lastStatDurationsThreadsafe.Get())
 	for _, result := range results {
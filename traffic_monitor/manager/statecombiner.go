@@ -27,13 +27,15 @@ import (
 
 	"github.com/apache/trafficcontrol/lib/go-log"
 	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
 )
 
-// StartStateCombiner starts the State Combiner goroutine, and returns the threadsafe CombinedStates, and a func to signal to combine states.
-func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStatesPeersThreadsafe, localStates peer.CRStatesThreadsafe, toData todata.TODataThreadsafe) (peer.CRStatesThreadsafe, func()) {
+// StartStateCombiner starts the State Combiner goroutine, and returns the threadsafe CombinedStates, and a func to signal to combine states. Each change to the combined states is published to crStatesStream. States are combined per cfg.PeerConsensus.
+func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStatesPeersThreadsafe, localStates peer.CRStatesThreadsafe, toData todata.TODataThreadsafe, crStatesStream *peer.CRStatesStream, monitorConfig threadsafe.TrafficMonitorConfigMap, cfg config.Config, appData config.StaticAppData) (peer.CRStatesThreadsafe, func()) {
 	combinedStates := peer.NewCRStatesThreadsafe()
 
 	// the chan buffer just reduces the number of goroutines on our infinite buffer hack in combineState(), no real writer will block, since combineState() writes in a goroutine.
@@ -58,14 +60,16 @@ func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStates
 		overrideMap := map[tc.CacheName]bool{}
 		for range combineStateChan {
 			drain(combineStateChan)
-			combineCrStates(events, true, peerStates, localStates.Get(), combinedStates, overrideMap, toData.Get())
+			consensus := newPeerConsensus(cfg, appData.Hostname, monitorConfig.Get())
+			combineCrStates(events, true, consensus, peerStates, localStates.Get(), combinedStates, overrideMap, toData.Get())
+			crStatesStream.Publish(combinedStates.Get())
 		}
 	}()
 
 	return combinedStates, combineState
 }
 
-func combineCacheState(cacheName tc.CacheName, localCacheState tc.IsAvailable, events health.ThreadsafeEvents, peerOptimistic bool, peerStates peer.CRStatesPeersThreadsafe, localStates tc.CRStates, combinedStates peer.CRStatesThreadsafe, overrideMap map[tc.CacheName]bool, toData todata.TOData) {
+func combineCacheState(cacheName tc.CacheName, localCacheState tc.IsAvailable, events health.ThreadsafeEvents, peerOptimistic bool, consensus peerConsensus, peerStates peer.CRStatesPeersThreadsafe, localStates tc.CRStates, combinedStates peer.CRStatesThreadsafe, overrideMap map[tc.CacheName]bool, toData todata.TOData) {
 	overrideCondition := ""
 	available := false
 	ipv4Available := false
@@ -93,7 +97,7 @@ func combineCacheState(cacheName tc.CacheName, localCacheState tc.IsAvailable, e
 			ipv6OnlineOnPeers := make([]string, 0)
 
 			for peer, peerCrStates := range peerStates.GetCrstates() {
-				if peerStates.GetPeerAvailability(peer) {
+				if trusted, _ := consensus.trustPeer(peerStates, peer); trusted {
 					if peerCrStates.Caches[cacheName].IsAvailable {
 						onlineOnPeers = append(onlineOnPeers, peer.String())
 					}
@@ -125,7 +129,7 @@ func combineCacheState(cacheName tc.CacheName, localCacheState tc.IsAvailable, e
 	}
 
 	if overrideCondition != "" {
-		events.Add(health.Event{Time: health.Time(time.Now()), Description: fmt.Sprintf("Health protocol override condition %s", overrideCondition), Name: cacheName.String(), Hostname: cacheName.String(), Type: toData.ServerTypes[cacheName].String(), Available: available, IPv4Available: ipv4Available, IPv6Available: ipv6Available})
+		events.Add(health.Event{Time: health.Time(time.Now()), Description: fmt.Sprintf("Health protocol override condition %s", overrideCondition), Name: cacheName.String(), Hostname: cacheName.String(), Type: toData.ServerTypes[cacheName].String(), Kind: health.EventKindPeerDisagreement, Available: available, IPv4Available: ipv4Available, IPv6Available: ipv6Available})
 	}
 
 	combinedStates.AddCache(cacheName, tc.IsAvailable{IsAvailable: available, Ipv4Available: ipv4Available, Ipv6Available: ipv6Available})
@@ -136,6 +140,7 @@ func combineDSState(
 	localDeliveryService tc.CRStatesDeliveryService,
 	events health.ThreadsafeEvents,
 	peerOptimistic bool,
+	consensus peerConsensus,
 	peerStates peer.CRStatesPeersThreadsafe,
 	localStates tc.CRStates,
 	combinedStates peer.CRStatesThreadsafe,
@@ -149,6 +154,9 @@ func combineDSState(
 	deliveryService.DisabledLocations = localDeliveryService.DisabledLocations
 
 	for peerName, iPeerStates := range peerStates.GetCrstates() {
+		if trusted, _ := consensus.trustPeer(peerStates, peerName); !trusted {
+			continue
+		}
 		peerDeliveryService, ok := iPeerStates.DeliveryService[deliveryServiceName]
 		if !ok {
 			log.Infof("local delivery service %s not found in peer %s\n", deliveryServiceName, peerName)
@@ -197,13 +205,17 @@ func pruneCombinedCaches(combinedStates peer.CRStatesThreadsafe, localStates tc.
 	}
 }
 
-func combineCrStates(events health.ThreadsafeEvents, peerOptimistic bool, peerStates peer.CRStatesPeersThreadsafe, localStates tc.CRStates, combinedStates peer.CRStatesThreadsafe, overrideMap map[tc.CacheName]bool, toData todata.TOData) {
+func combineCrStates(events health.ThreadsafeEvents, peerOptimistic bool, consensus peerConsensus, peerStates peer.CRStatesPeersThreadsafe, localStates tc.CRStates, combinedStates peer.CRStatesThreadsafe, overrideMap map[tc.CacheName]bool, toData todata.TOData) {
 	for cacheName, localCacheState := range localStates.Caches { // localStates gets pruned when servers are disabled, it's the source of truth
-		combineCacheState(cacheName, localCacheState, events, peerOptimistic, peerStates, localStates, combinedStates, overrideMap, toData)
+		if consensus.Mode != config.PeerConsensusOptimistic {
+			combineCacheStateConsensus(cacheName, localCacheState, events, consensus, peerStates, combinedStates, toData)
+			continue
+		}
+		combineCacheState(cacheName, localCacheState, events, peerOptimistic, consensus, peerStates, localStates, combinedStates, overrideMap, toData)
 	}
 
 	for deliveryServiceName, localDeliveryService := range localStates.DeliveryService {
-		combineDSState(deliveryServiceName, localDeliveryService, events, peerOptimistic, peerStates, localStates, combinedStates, overrideMap, toData)
+		combineDSState(deliveryServiceName, localDeliveryService, events, peerOptimistic, consensus, peerStates, localStates, combinedStates, overrideMap, toData)
 	}
 
 	pruneCombinedDSState(combinedStates, localStates, peerStates)
@@ -0,0 +1,410 @@
+// Package notify pushes events, such as cache servers becoming unavailable, to webhooks, in a generic JSON format or the Prometheus Alertmanager alerts format.
+package notify
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+)
+
+// eventQueueSize is the number of events which may be waiting to be filtered. Events beyond this are dropped, rather than blocking the event log.
+const eventQueueSize = 1024
+
+// webhookQueueSize is the number of notifications which may be waiting to be sent to a single webhook, for example while it's being retried. Notifications beyond this are dropped.
+const webhookQueueSize = 1024
+
+// tickInterval is how often held flapping notifications are checked, and whether firing alerts need re-sent.
+const tickInterval = time.Second
+
+// maxResponseBytes is the most of a webhook's response body which is read, so the connection may be reused.
+const maxResponseBytes = 64 * 1024
+
+// Notifier sends events to the configured webhooks. This fulfills the health.EventRecorder interface.
+//
+// Events are filtered by a single goroutine, per thing an event is about, identified by its kind, name, and hostname. An event with the same availability as the last one for the same thing within the dedup window is dropped. Once the flap limit of notifications has been sent for the same thing within the flap window, the last is marked as flapping, and later events are held, and only the latest of them is sent, when the window allows. The first event for a thing is only sent if it's unavailable, so startup doesn't send an event for every available cache.
+//
+// Each webhook has its own queue and goroutine, so a slow or failing webhook doesn't delay the others.
+type Notifier struct {
+	cfg      config.Notifications
+	monitor  string
+	events   chan health.Event
+	stop     chan struct{}
+	wg       *sync.WaitGroup
+	webhooks []*webhook
+	states   map[stateKey]*state
+}
+
+type stateKey struct {
+	kind     string
+	name     string
+	hostname string
+}
+
+// state is the notification state of a single thing events are about. It is only accessed by the Notifier's filtering goroutine.
+type state struct {
+	// last is the last event sent, or the first event seen if none have been sent.
+	last health.Event
+	// lastTime is when last was sent or seen.
+	lastTime time.Time
+	// sent are the times of notifications sent within the flap window.
+	sent []time.Time
+	// held is the latest event held while flapping, or nil.
+	held *health.Event
+}
+
+type notification struct {
+	event    health.Event
+	flapping bool
+	// resend is whether this is a firing alert being re-sent. Resends are only sent to alertmanager webhooks.
+	resend bool
+}
+
+type webhook struct {
+	cfg       config.Webhook
+	kinds     map[string]struct{}
+	queue     chan notification
+	client    *http.Client
+	userAgent string
+}
+
+// New creates a Notifier for the given config, and starts filtering and sending events. The monitor is the name of this Traffic Monitor, which is included in each notification.
+func New(cfg config.Notifications, monitor string, userAgent string) *Notifier {
+	n := &Notifier{
+		cfg:     cfg,
+		monitor: monitor,
+		events:  make(chan health.Event, eventQueueSize),
+		stop:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+		states:  map[stateKey]*state{},
+	}
+	for _, whCfg := range cfg.Webhooks {
+		wh := &webhook{
+			cfg:       whCfg,
+			kinds:     map[string]struct{}{},
+			queue:     make(chan notification, webhookQueueSize),
+			client:    &http.Client{Timeout: whCfg.Timeout},
+			userAgent: userAgent,
+		}
+		for _, kind := range whCfg.Kinds {
+			wh.kinds[kind] = struct{}{}
+		}
+		n.webhooks = append(n.webhooks, wh)
+		n.wg.Add(1)
+		go n.send(wh)
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n
+}
+
+// Close stops filtering and sending, and waits for the goroutines to exit. Queued notifications, and notifications being retried, are dropped.
+func (n *Notifier) Close() {
+	close(n.stop)
+	n.wg.Wait()
+}
+
+// RecordEvent queues the given event to be notified. This fulfills the health.EventRecorder interface.
+func (n *Notifier) RecordEvent(e health.Event) {
+	select {
+	case n.events <- e:
+	default:
+		log.Errorln("notifications: event queue full, dropping " + e.Kind + " event for '" + e.Name + "'")
+	}
+}
+
+// run filters queued events, and releases held events and re-sends firing alerts every tickInterval, until Close is called.
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	lastResend := time.Now()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case e := <-n.events:
+			n.handle(e, time.Now())
+		case now := <-ticker.C:
+			n.release(now)
+			if now.Sub(lastResend) >= n.cfg.AlertmanagerResend {
+				n.resend()
+				lastResend = now
+			}
+		}
+	}
+}
+
+// handle dedupes, rate-limits, and sends the given event.
+func (n *Notifier) handle(e health.Event, now time.Time) {
+	key := stateKey{kind: e.Kind, name: e.Name, hostname: e.Hostname}
+	st, ok := n.states[key]
+	if !ok {
+		n.states[key] = &state{last: e, lastTime: now}
+		if e.Available {
+			return
+		}
+		n.notify(n.states[key], e, now)
+		return
+	}
+
+	st.sent = pruneTimes(st.sent, now.Add(-n.cfg.FlapWindow))
+	if n.limited(st) {
+		if e.Available == st.last.Available {
+			st.held = nil // flapped back to what was last sent, so there's nothing to send
+		} else {
+			held := e
+			st.held = &held
+		}
+		return
+	}
+	if e.Available == st.last.Available && now.Sub(st.lastTime) < n.cfg.DedupWindow {
+		return
+	}
+	n.notify(st, e, now)
+}
+
+// release sends held events whose flap window allows, and forgets things which no longer need their state.
+func (n *Notifier) release(now time.Time) {
+	forget := n.cfg.DedupWindow
+	if n.cfg.FlapWindow > forget {
+		forget = n.cfg.FlapWindow
+	}
+	for key, st := range n.states {
+		st.sent = pruneTimes(st.sent, now.Add(-n.cfg.FlapWindow))
+		if st.held != nil && !n.limited(st) {
+			n.notify(st, *st.held, now)
+		}
+		// unavailable things are kept, so their alerts are re-sent
+		if st.held == nil && st.last.Available && now.Sub(st.lastTime) > forget {
+			delete(n.states, key)
+		}
+	}
+}
+
+// resend re-sends the last alert of each unavailable thing to alertmanager webhooks, because Alertmanager resolves alerts which aren't re-sent within its resolve_timeout.
+func (n *Notifier) resend() {
+	for _, st := range n.states {
+		if st.last.Available {
+			continue
+		}
+		n.enqueue(notification{event: st.last, resend: true})
+	}
+}
+
+// limited returns whether the flap limit has been reached for the given state. The state's sent times must already be pruned.
+func (n *Notifier) limited(st *state) bool {
+	return n.cfg.FlapMax > 0 && len(st.sent) >= n.cfg.FlapMax
+}
+
+// notify sends the given event to all webhooks for its kind, and updates the given state.
+func (n *Notifier) notify(st *state, e health.Event, now time.Time) {
+	st.last = e
+	st.lastTime = now
+	st.sent = append(st.sent, now)
+	st.held = nil
+	n.enqueue(notification{event: e, flapping: n.limited(st)})
+}
+
+func (n *Notifier) enqueue(no notification) {
+	for _, wh := range n.webhooks {
+		if no.resend && wh.cfg.Format != config.WebhookFormatAlertmanager {
+			continue
+		}
+		if len(wh.kinds) > 0 {
+			if _, ok := wh.kinds[no.event.Kind]; !ok {
+				continue
+			}
+		}
+		select {
+		case wh.queue <- no:
+		default:
+			log.Errorln("notifications: webhook " + wh.cfg.URL + " queue full, dropping " + no.event.Kind + " event for '" + no.event.Name + "'")
+		}
+	}
+}
+
+// pruneTimes returns the given times after the given time. The times must be in ascending order.
+func pruneTimes(times []time.Time, after time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(after) {
+		i++
+	}
+	return times[i:]
+}
+
+// send posts the webhook's queued notifications, until Close is called.
+func (n *Notifier) send(wh *webhook) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case no := <-wh.queue:
+			n.post(wh, no)
+		}
+	}
+}
+
+// post posts the given notification to the given webhook, retrying with exponential backoff if the request fails, or the webhook returns a server error or asks to be retried.
+func (n *Notifier) post(wh *webhook, no notification) {
+	body, err := n.body(wh.cfg.Format, no)
+	if err != nil {
+		log.Errorln("notifications: encoding " + no.event.Kind + " event for '" + no.event.Name + "': " + err.Error())
+		return
+	}
+	backoff := n.cfg.RetryInitial
+	for attempt := 0; ; attempt++ {
+		retry, err := wh.request(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= n.cfg.RetryMax {
+			log.Errorln("notifications: posting " + no.event.Kind + " event for '" + no.event.Name + "' to webhook " + wh.cfg.URL + " failed after " + strconv.Itoa(attempt+1) + " attempts, dropping: " + err.Error())
+			return
+		}
+		log.Warnln("notifications: posting " + no.event.Kind + " event for '" + no.event.Name + "' to webhook " + wh.cfg.URL + " failed, retrying in " + backoff.String() + ": " + err.Error())
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > n.cfg.RetryMaxInterval {
+			backoff = n.cfg.RetryMaxInterval
+		}
+	}
+}
+
+// request posts the given body to the webhook. Returns whether the request should be retried, if it failed.
+func (wh *webhook) request(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, wh.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.New("creating request: " + err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", wh.userAgent)
+	for name, val := range wh.cfg.Headers {
+		req.Header.Set(name, val)
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseBytes))
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, errors.New("response status " + strconv.Itoa(resp.StatusCode))
+}
+
+// JSONEvent is the body of a json format webhook notification.
+type JSONEvent struct {
+	Monitor       string    `json:"monitor"`
+	Kind          string    `json:"kind"`
+	Name          string    `json:"name"`
+	Hostname      string    `json:"hostname"`
+	Type          string    `json:"type"`
+	Description   string    `json:"description"`
+	Available     bool      `json:"isAvailable"`
+	IPv4Available bool      `json:"ipv4Available"`
+	IPv6Available bool      `json:"ipv6Available"`
+	Time          time.Time `json:"time"`
+	Flapping      bool      `json:"flapping"`
+}
+
+// Alert is an alert in the Prometheus Alertmanager alerts API. An alertmanager format webhook notification is an array of one Alert.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// alertNames are the Alertmanager alert names of each event kind. Kinds not in this map use DefaultAlertName.
+var alertNames = map[string]string{
+	health.EventKindCache:            "TrafficMonitorCacheUnavailable",
+	health.EventKindDeliveryService:  "TrafficMonitorDeliveryServiceUnavailable",
+	health.EventKindDSProbe:          "TrafficMonitorDeliveryServiceProbeFailed",
+	health.EventKindPeer:             "TrafficMonitorPeerUnavailable",
+	health.EventKindPeerDisagreement: "TrafficMonitorPeerDisagreement",
+	health.EventKindCRConfig:         "TrafficMonitorCRConfigInvalid",
+}
+
+const DefaultAlertName = "TrafficMonitorUnavailable"
+
+func (n *Notifier) body(format config.WebhookFormat, no notification) ([]byte, error) {
+	e := no.event
+	if format != config.WebhookFormatAlertmanager {
+		return json.Marshal(JSONEvent{
+			Monitor:       n.monitor,
+			Kind:          e.Kind,
+			Name:          e.Name,
+			Hostname:      e.Hostname,
+			Type:          e.Type,
+			Description:   e.Description,
+			Available:     e.Available,
+			IPv4Available: e.IPv4Available,
+			IPv6Available: e.IPv6Available,
+			Time:          time.Time(e.Time),
+			Flapping:      no.flapping,
+		})
+	}
+
+	alertName, ok := alertNames[e.Kind]
+	if !ok {
+		alertName = DefaultAlertName
+	}
+	// labels must be the same for an alert and its resolution, so they only identify the thing the event is about
+	labels := map[string]string{
+		"alertname": alertName,
+		"monitor":   n.monitor,
+		"kind":      e.Kind,
+		"name":      e.Name,
+	}
+	if e.Hostname != e.Name {
+		labels["hostname"] = e.Hostname
+	}
+	if e.Type != "" {
+		labels["type"] = e.Type
+	}
+	annotations := map[string]string{"description": e.Description}
+	if no.flapping {
+		annotations["flapping"] = "true"
+	}
+	alert := Alert{Labels: labels, Annotations: annotations, StartsAt: time.Time(e.Time)}
+	if e.Available {
+		endsAt := time.Time(e.Time)
+		alert.EndsAt = &endsAt
+	}
+	return json.Marshal([]Alert{alert})
+}
@@ -0,0 +1,139 @@
+package notify
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+)
+
+func cacheEvent(available bool) health.Event {
+	return health.Event{Time: health.Time(time.Unix(1500000000, 0)), Name: "cache0", Hostname: "cache0", Type: "EDGE", Kind: health.EventKindCache, Available: available}
+}
+
+// TestFilter tests dedup and flap limiting, without starting the Notifier's goroutines.
+func TestFilter(t *testing.T) {
+	cfg := config.DefaultNotifications
+	cfg.DedupWindow = time.Minute
+	cfg.FlapWindow = 10 * time.Minute
+	cfg.FlapMax = 3
+	wh := &webhook{cfg: config.Webhook{Format: config.WebhookFormatJSON}, queue: make(chan notification, 100)}
+	n := &Notifier{cfg: cfg, webhooks: []*webhook{wh}, states: map[stateKey]*state{}}
+
+	start := time.Unix(1500000000, 0)
+	sent := func() []notification {
+		nos := []notification{}
+		for len(wh.queue) > 0 {
+			nos = append(nos, <-wh.queue)
+		}
+		return nos
+	}
+
+	n.handle(cacheEvent(true), start)
+	if nos := sent(); len(nos) != 0 {
+		t.Fatalf("first available event expected not sent, actual %d sent", len(nos))
+	}
+	n.handle(cacheEvent(false), start.Add(time.Second))
+	n.handle(cacheEvent(false), start.Add(2*time.Second))
+	if nos := sent(); len(nos) != 1 || nos[0].event.Available || nos[0].flapping {
+		t.Fatalf("unavailable event expected sent once and not flapping, actual %+v", nos)
+	}
+
+	n.handle(cacheEvent(true), start.Add(3*time.Second))
+	n.handle(cacheEvent(false), start.Add(4*time.Second))
+	if nos := sent(); len(nos) != 2 || !nos[0].event.Available || nos[0].flapping || nos[1].event.Available || !nos[1].flapping {
+		t.Fatalf("flap max expected to mark the third notification flapping, actual %+v", nos)
+	}
+
+	n.handle(cacheEvent(true), start.Add(5*time.Second))
+	n.handle(cacheEvent(false), start.Add(6*time.Second))
+	n.handle(cacheEvent(true), start.Add(7*time.Second))
+	if nos := sent(); len(nos) != 0 {
+		t.Fatalf("flapping events expected held, actual %d sent", len(nos))
+	}
+
+	n.release(start.Add(5 * time.Minute))
+	if nos := sent(); len(nos) != 0 {
+		t.Fatalf("held event expected held within the flap window, actual %d sent", len(nos))
+	}
+	n.release(start.Add(10*time.Minute + 2*time.Second))
+	if nos := sent(); len(nos) != 1 || !nos[0].event.Available {
+		t.Fatalf("latest held event expected sent after the flap window, actual %+v", nos)
+	}
+}
+
+func TestNotifierRetryAlertmanager(t *testing.T) {
+	requests := 0
+	alerts := make(chan []Alert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer foo" {
+			t.Errorf("expected configured header, actual '%s'", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		a := []Alert{}
+		if err := json.Unmarshal(body, &a); err != nil {
+			t.Errorf("decoding alerts '%s': %v", string(body), err)
+		}
+		alerts <- a
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultNotifications
+	cfg.RetryInitial = time.Millisecond
+	cfg.Webhooks = []config.Webhook{{URL: srv.URL, Format: config.WebhookFormatAlertmanager, Kinds: []string{health.EventKindCache}, Headers: map[string]string{"Authorization": "Bearer foo"}, Timeout: time.Second}}
+	n := New(cfg, "tm0", "traffic_monitor/test")
+	defer n.Close()
+
+	n.RecordEvent(health.Event{Kind: health.EventKindPeer, Name: "tm1", Hostname: "tm1", Available: false})
+	n.RecordEvent(cacheEvent(false))
+
+	select {
+	case a := <-alerts:
+		if len(a) != 1 {
+			t.Fatalf("expected 1 alert, actual %d", len(a))
+		}
+		if a[0].Labels["alertname"] != "TrafficMonitorCacheUnavailable" || a[0].Labels["name"] != "cache0" || a[0].Labels["monitor"] != "tm0" {
+			t.Errorf("unexpected alert labels %+v", a[0].Labels)
+		}
+		if a[0].EndsAt != nil {
+			t.Errorf("unavailable alert expected no endsAt, actual %v", *a[0].EndsAt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for retried alert")
+	}
+
+	select {
+	case a := <-alerts:
+		t.Errorf("expected peer event to be filtered by kind, actual %+v", a)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -31,13 +31,29 @@ import (
 // TODO add separate locks for Caches and DeliveryService maps?
 type CRStatesThreadsafe struct {
 	crStates *tc.CRStates
+	pollTime *time.Time
 	m        *sync.RWMutex
 }
 
 // NewCRStatesThreadsafe creates a new CRStatesThreadsafe object safe for multiple goroutine readers and a single writer.
 func NewCRStatesThreadsafe() CRStatesThreadsafe {
 	crs := tc.NewCRStates()
-	return CRStatesThreadsafe{m: &sync.RWMutex{}, crStates: &crs}
+	pollTime := time.Time{}
+	return CRStatesThreadsafe{m: &sync.RWMutex{}, crStates: &crs, pollTime: &pollTime}
+}
+
+// GetPollTime returns the time the states were last calculated from polling caches, or the zero time if they never have been.
+func (t *CRStatesThreadsafe) GetPollTime() time.Time {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return *t.pollTime
+}
+
+// SetPollTime sets the time the states were last calculated from polling caches. Peers distrust states whose poll time is too old.
+func (t *CRStatesThreadsafe) SetPollTime(pollTime time.Time) {
+	t.m.Lock()
+	*t.pollTime = pollTime
+	t.m.Unlock()
 }
 
 // Get returns the internal Crstates object for reading.
@@ -117,14 +133,15 @@ func (t *CRStatesThreadsafe) DeleteDeliveryService(name tc.DeliveryServiceName)
 // CRStatesPeersThreadsafe provides safe access for multiple goroutines to read a map of Traffic Monitor peers to their returned Crstates, with a single goroutine writer.
 // This could be made lock-free, if the performance was necessary
 type CRStatesPeersThreadsafe struct {
-	crStates   map[tc.TrafficMonitorName]tc.CRStates
-	peerStates map[tc.TrafficMonitorName]bool
-	peerTimes  map[tc.TrafficMonitorName]time.Time
-	peerOnline map[tc.TrafficMonitorName]bool
-	peerCount  *int
-	quorumMin  *int
-	timeout    *time.Duration
-	m          *sync.RWMutex
+	crStates      map[tc.TrafficMonitorName]tc.CRStates
+	peerStates    map[tc.TrafficMonitorName]bool
+	peerTimes     map[tc.TrafficMonitorName]time.Time
+	peerPollTimes map[tc.TrafficMonitorName]time.Time
+	peerOnline    map[tc.TrafficMonitorName]bool
+	peerCount     *int
+	quorumMin     *int
+	timeout       *time.Duration
+	m             *sync.RWMutex
 }
 
 // NewCRStatesPeersThreadsafe creates a new CRStatesPeers object safe for multiple goroutine readers and a single writer.
@@ -132,14 +149,15 @@ func NewCRStatesPeersThreadsafe(quorumMin int) CRStatesPeersThreadsafe {
 	count := 0
 	timeout := time.Hour // default to a large timeout
 	return CRStatesPeersThreadsafe{
-		m:          &sync.RWMutex{},
-		timeout:    &timeout,
-		peerOnline: map[tc.TrafficMonitorName]bool{},
-		crStates:   map[tc.TrafficMonitorName]tc.CRStates{},
-		peerStates: map[tc.TrafficMonitorName]bool{},
-		peerTimes:  map[tc.TrafficMonitorName]time.Time{},
-		peerCount:  &count,
-		quorumMin:  &quorumMin,
+		m:             &sync.RWMutex{},
+		timeout:       &timeout,
+		peerOnline:    map[tc.TrafficMonitorName]bool{},
+		crStates:      map[tc.TrafficMonitorName]tc.CRStates{},
+		peerStates:    map[tc.TrafficMonitorName]bool{},
+		peerTimes:     map[tc.TrafficMonitorName]time.Time{},
+		peerPollTimes: map[tc.TrafficMonitorName]time.Time{},
+		peerCount:     &count,
+		quorumMin:     &quorumMin,
 	}
 }
 
@@ -202,6 +220,13 @@ func (t *CRStatesPeersThreadsafe) GetPeerAvailability(peer tc.TrafficMonitorName
 	return availability
 }
 
+// GetPeerPollTime returns the time the given peer last calculated its states from polling caches, or the zero time if the peer didn't say.
+func (t *CRStatesPeersThreadsafe) GetPeerPollTime(peer tc.TrafficMonitorName) time.Time {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.peerPollTimes[peer]
+}
+
 // GetPeersOnline return a map of peers which are marked ONLINE in the latest CRConfig from Traffic Ops. This is NOT guaranteed to actually _contain_ all OFFLINE monitors returned by other functions, such as `GetPeerAvailability` and `GetQueryTimes`, but bool defaults to false, so the value of any key is guaranteed to be correct.
 func (t *CRStatesPeersThreadsafe) GetPeersOnline() map[tc.TrafficMonitorName]bool {
 	t.m.RLock()
@@ -254,6 +279,7 @@ func (t *CRStatesPeersThreadsafe) Set(result Result) {
 	t.crStates[result.ID] = result.PeerStates
 	t.peerStates[result.ID] = result.Available
 	t.peerTimes[result.ID] = result.Time
+	t.peerPollTimes[result.ID] = result.PollTime
 	t.m.Unlock()
 }
 
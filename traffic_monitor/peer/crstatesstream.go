@@ -0,0 +1,182 @@
+package peer
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+// CRStatesDelta is a change to the combined CRStates, as pushed to subscribers of the CRStates stream.
+// If Full is true, Caches and DeliveryService are the complete states, which replace any states the client has. Otherwise, they contain only the caches and delivery services which changed, and the Removed lists contain those which no longer exist.
+type CRStatesDelta struct {
+	Seq                     uint64                                                `json:"seq"`
+	Full                    bool                                                  `json:"full"`
+	Caches                  map[tc.CacheName]tc.IsAvailable                       `json:"caches"`
+	DeliveryService         map[tc.DeliveryServiceName]tc.CRStatesDeliveryService `json:"deliveryServices"`
+	RemovedCaches           []tc.CacheName                                        `json:"removedCaches,omitempty"`
+	RemovedDeliveryServices []tc.DeliveryServiceName                              `json:"removedDeliveryServices,omitempty"`
+}
+
+// CRStatesStream holds the recent changes to the combined CRStates, for pushing to long-lived subscribers. It is safe for multiple goroutine readers and a single writer.
+// Each change has a sequence number, which subscribers may give back to resume after a disconnect. Sequence numbers are only meaningful within one Traffic Monitor process, so each stream also has an epoch, the time it was created, which is part of its IDs.
+type CRStatesStream struct {
+	m         *sync.RWMutex
+	epoch     int64
+	seq       uint64
+	states    tc.CRStates
+	deltas    []CRStatesDelta // oldest first
+	maxDeltas int
+	changed   chan struct{}
+}
+
+// NewCRStatesStream creates a new CRStatesStream, which keeps up to maxDeltas changes for resuming subscribers. Subscribers which are further behind are sent the full states.
+func NewCRStatesStream(maxDeltas uint64) *CRStatesStream {
+	if maxDeltas == 0 {
+		maxDeltas = 1
+	}
+	return &CRStatesStream{
+		m:         &sync.RWMutex{},
+		epoch:     time.Now().UnixNano(),
+		states:    tc.NewCRStates(),
+		maxDeltas: int(maxDeltas),
+		changed:   make(chan struct{}),
+	}
+}
+
+// Publish sets the current combined states, and notifies subscribers if they changed. The given states MUST NOT be modified afterwards. Publish MUST NOT be called by multiple goroutines.
+func (s *CRStatesStream) Publish(states tc.CRStates) {
+	s.m.RLock()
+	delta := diffCRStates(s.states, states)
+	s.m.RUnlock()
+	if delta == nil {
+		return
+	}
+
+	s.m.Lock()
+	s.seq++
+	delta.Seq = s.seq
+	s.states = states
+	if len(s.deltas) >= s.maxDeltas {
+		s.deltas = append(s.deltas[:0], s.deltas[len(s.deltas)-s.maxDeltas+1:]...)
+	}
+	s.deltas = append(s.deltas, *delta)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.m.Unlock()
+}
+
+// Since returns the changes after the given sequence number, and a chan which is closed on the next change. If the changes since seq are no longer kept, or seq isn't from this stream's epoch, a single delta with the full states is returned.
+func (s *CRStatesStream) Since(epoch int64, seq uint64) ([]CRStatesDelta, <-chan struct{}) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if epoch == s.epoch && seq == s.seq {
+		return nil, s.changed
+	}
+	if epoch != s.epoch || seq > s.seq || len(s.deltas) == 0 || seq+1 < s.deltas[0].Seq {
+		full := CRStatesDelta{Seq: s.seq, Full: true, Caches: s.states.Caches, DeliveryService: s.states.DeliveryService}
+		return []CRStatesDelta{full}, s.changed
+	}
+	first := int(seq + 1 - s.deltas[0].Seq)
+	deltas := make([]CRStatesDelta, len(s.deltas)-first)
+	copy(deltas, s.deltas[first:])
+	return deltas, s.changed
+}
+
+// Epoch returns the epoch of the stream, which distinguishes its sequence numbers from those of other Traffic Monitor processes.
+func (s *CRStatesStream) Epoch() int64 {
+	return s.epoch
+}
+
+// CRStatesStreamID returns the ID of the given sequence number in the stream with the given epoch, of the form `epoch-seq`.
+func CRStatesStreamID(epoch int64, seq uint64) string {
+	return strconv.FormatInt(epoch, 10) + "-" + strconv.FormatUint(seq, 10)
+}
+
+// ParseCRStatesStreamID parses an ID created by CRStatesStreamID.
+func ParseCRStatesStreamID(id string) (int64, uint64, error) {
+	i := strings.Index(id, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("malformed stream ID '%s', expected 'epoch-seq'", id)
+	}
+	epoch, err := strconv.ParseInt(id[:i], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed stream ID '%s' epoch: %v", id, err)
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed stream ID '%s' sequence: %v", id, err)
+	}
+	return epoch, seq, nil
+}
+
+// diffCRStates returns the changes from old to new, or nil if there are none. The returned delta has no sequence number.
+func diffCRStates(old tc.CRStates, new tc.CRStates) *CRStatesDelta {
+	delta := CRStatesDelta{
+		Caches:          map[tc.CacheName]tc.IsAvailable{},
+		DeliveryService: map[tc.DeliveryServiceName]tc.CRStatesDeliveryService{},
+	}
+	changed := false
+	for name, avail := range new.Caches {
+		if oldAvail, ok := old.Caches[name]; !ok || oldAvail != avail {
+			delta.Caches[name] = avail
+			changed = true
+		}
+	}
+	for name := range old.Caches {
+		if _, ok := new.Caches[name]; !ok {
+			delta.RemovedCaches = append(delta.RemovedCaches, name)
+			changed = true
+		}
+	}
+	for name, ds := range new.DeliveryService {
+		if oldDS, ok := old.DeliveryService[name]; !ok || !crStatesDSEqual(oldDS, ds) {
+			delta.DeliveryService[name] = ds
+			changed = true
+		}
+	}
+	for name := range old.DeliveryService {
+		if _, ok := new.DeliveryService[name]; !ok {
+			delta.RemovedDeliveryServices = append(delta.RemovedDeliveryServices, name)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return &delta
+}
+
+func crStatesDSEqual(a tc.CRStatesDeliveryService, b tc.CRStatesDeliveryService) bool {
+	if a.IsAvailable != b.IsAvailable || len(a.DisabledLocations) != len(b.DisabledLocations) {
+		return false
+	}
+	for i, loc := range a.DisabledLocations {
+		if b.DisabledLocations[i] != loc {
+			return false
+		}
+	}
+	return true
+}
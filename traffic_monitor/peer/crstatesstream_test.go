@@ -0,0 +1,92 @@
+package peer
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+func TestCRStatesStream(t *testing.T) {
+	stream := NewCRStatesStream(2)
+
+	states := tc.NewCRStates()
+	states.Caches["cache0"] = tc.IsAvailable{IsAvailable: true, Ipv4Available: true}
+	states.Caches["cache1"] = tc.IsAvailable{IsAvailable: true, Ipv4Available: true}
+	states.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}}
+	stream.Publish(states.Copy())
+
+	deltas, changed := stream.Since(0, 0)
+	if len(deltas) != 1 || !deltas[0].Full || deltas[0].Seq != 1 || len(deltas[0].Caches) != 2 {
+		t.Fatalf("Since unknown epoch expected full states at seq 1, actual %+v", deltas)
+	}
+
+	stream.Publish(states.Copy())
+	select {
+	case <-changed:
+		t.Fatalf("Publish with unchanged states expected no change notification")
+	default:
+	}
+
+	states = states.Copy()
+	states.Caches["cache0"] = tc.IsAvailable{IsAvailable: false}
+	delete(states.Caches, "cache1")
+	stream.Publish(states)
+
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("Publish with changed states expected change notification")
+	}
+
+	deltas, _ = stream.Since(stream.Epoch(), 1)
+	if len(deltas) != 1 {
+		t.Fatalf("Since seq 1 expected 1 delta, actual %+v", deltas)
+	} else if delta := deltas[0]; delta.Full || delta.Seq != 2 {
+		t.Errorf("Since seq 1 expected partial delta with seq 2, actual %+v", delta)
+	} else if avail, ok := delta.Caches["cache0"]; !ok || avail.IsAvailable || len(delta.Caches) != 1 {
+		t.Errorf("Since seq 1 expected only cache0 unavailable, actual %+v", delta.Caches)
+	} else if len(delta.RemovedCaches) != 1 || delta.RemovedCaches[0] != "cache1" {
+		t.Errorf("Since seq 1 expected cache1 removed, actual %+v", delta.RemovedCaches)
+	} else if len(delta.DeliveryService) != 0 {
+		t.Errorf("Since seq 1 expected no delivery service changes, actual %+v", delta.DeliveryService)
+	}
+
+	if deltas, _ := stream.Since(stream.Epoch(), 2); len(deltas) != 0 {
+		t.Errorf("Since latest seq expected no deltas, actual %+v", deltas)
+	}
+
+	states = states.Copy()
+	states.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{"cg0"}}
+	stream.Publish(states)
+
+	// only 2 deltas are kept, so resuming from seq 0 must resync
+	if deltas, _ := stream.Since(stream.Epoch(), 0); len(deltas) != 1 || !deltas[0].Full || deltas[0].Seq != 3 {
+		t.Errorf("Since expired seq expected full states at seq 3, actual %+v", deltas)
+	}
+	if deltas, _ := stream.Since(stream.Epoch(), 1); len(deltas) != 2 || deltas[0].Seq != 2 || deltas[1].Seq != 3 {
+		t.Errorf("Since seq 1 expected deltas 2 and 3, actual %+v", deltas)
+	}
+
+	if epoch, seq, err := ParseCRStatesStreamID(CRStatesStreamID(stream.Epoch(), 3)); err != nil || epoch != stream.Epoch() || seq != 3 {
+		t.Errorf("ParseCRStatesStreamID expected %v 3, actual %v %v %v", stream.Epoch(), epoch, seq, err)
+	}
+}
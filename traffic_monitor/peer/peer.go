@@ -47,6 +47,14 @@ type Result struct {
 	PollID       uint64
 	PollFinished chan<- uint64
 	Time         time.Time
+	// PollTime is the time the peer last calculated its states from polling caches, in this Traffic Monitor's clock, or the zero time if the peer didn't say.
+	PollTime time.Time
+}
+
+// SelfCRStates is the local CRStates served to peers. PollAgeMS is the age in milliseconds of the states' last calculation from polling caches, as an age rather than a time so peers need not have synchronized clocks. It is nil if the states have never been calculated.
+type SelfCRStates struct {
+	tc.CRStates
+	PollAgeMS *int64 `json:"pollAgeMs,omitempty"`
 }
 
 // Handle handles a response from a polled Traffic Monitor peer, parsing the data and forwarding it to the ResultChannel.
@@ -66,9 +74,14 @@ func (handler Handler) Handle(id string, r io.Reader, format string, reqTime tim
 
 	if r != nil {
 		json := jsoniter.ConfigFastest // TODo make configurable?
-		err = json.NewDecoder(r).Decode(&result.PeerStates)
+		selfStates := SelfCRStates{}
+		err = json.NewDecoder(r).Decode(&selfStates)
 		if err == nil {
 			result.Available = true
+			result.PeerStates = selfStates.CRStates
+			if selfStates.PollAgeMS != nil {
+				result.PollTime = reqEnd.Add(-time.Duration(*selfStates.PollAgeMS) * time.Millisecond)
+			}
 		} else {
 			result.Errors = append(result.Errors, err)
 		}
@@ -26,6 +26,7 @@ import (
 	"runtime"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/manager"
 )
@@ -66,6 +67,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := cache.RegisterOpenMetricsFormats(cfg.OpenMetricsFormats); err != nil {
+		fmt.Printf("Error starting service: failed to register openmetrics formats: %v\n", err)
+		os.Exit(1)
+	}
+
 	log.Infof("Starting with config %+v\n", cfg)
 
 	err = manager.Start(*opsConfigFile, cfg, staticData, *configFileName)